@@ -14,6 +14,12 @@ import (
 
 var ConfigGlobal *Config
 
+// UserQuota storage quota bytes of one user, 0 use global quota
+type UserQuota struct {
+	Images int64 `yaml:"images"`
+	Inputs int64 `yaml:"inputs"`
+}
+
 type ConfigYaml struct {
 	// ots
 	OtsEndpoint     string `yaml:"otsEndpoint"`
@@ -25,6 +31,26 @@ type ConfigYaml struct {
 	Bucket      string `yaml:"bucket"`
 	OssPath     string `yaml:"ossPath""`
 	OssMode     string `yaml:"ossMode"`
+	// ossMode=local file url: {fileUrlPrefix}/files/{ossKey}?expires=&signature=, hmac sign by fileSignSecret
+	FileUrlPrefix  string `yaml:"fileUrlPrefix"`
+	FileSignSecret string `yaml:"fileSignSecret"`
+	// ossMode=s3, s3 compatible storage, accessKey empty use ak/sk of env
+	S3Endpoint     string `yaml:"s3Endpoint"`
+	S3Bucket       string `yaml:"s3Bucket"`
+	S3Region       string `yaml:"s3Region"`
+	S3PathStyle    string `yaml:"s3PathStyle"`
+	S3AccessKey    string `yaml:"s3AccessKey"`
+	S3SecretKey    string `yaml:"s3SecretKey"`
+	S3SessionToken string `yaml:"s3SessionToken"`
+	// ossMode=remote|s3 resilient policy, timeout/cooldown/retryInterval seconds,
+	// failed output upload saved in ossRetryDir and retry in background
+	OssRetry            string `yaml:"ossRetry"`
+	OssMaxRetries       int    `yaml:"ossMaxRetries"`
+	OssTimeout          int    `yaml:"ossTimeout"`
+	OssBreakerThreshold int    `yaml:"ossBreakerThreshold"`
+	OssBreakerCooldown  int    `yaml:"ossBreakerCooldown"`
+	OssRetryDir         string `yaml:"ossRetryDir"`
+	OssRetryInterval    int    `yaml:"ossRetryInterval"`
 
 	// db
 	DbSqlite string `yaml:"dbSqlite"`
@@ -54,8 +80,67 @@ type ConfigYaml struct {
 	SdPath      string `yaml:"sdPath"`
 	SdShell     string `yaml:"sdShell"`
 
-	// model
-	UseLocalModels string `yaml:"useLocalModel"`
+	// model, hybrid: register in db and reconcile with files of sdPath every reconcileInterval seconds
+	UseLocalModels    string `yaml:"useLocalModel"`
+	ReconcileInterval int    `yaml:"reconcileInterval"`
+	// model download from oss, chunk size bytes and parallel range requests
+	DownloadChunkSize   int64 `yaml:"downloadChunkSize"`
+	DownloadConcurrency int   `yaml:"downloadConcurrency"`
+	// model register from http(s) url or hub reference {org}/{repo}/{file}@{revision},
+	// hub token only send to modelHubEndpoint, maxSize bytes 0 unlimited,
+	// contentTypes empty reject text/* and application/json
+	ModelHubEndpoint  string   `yaml:"modelHubEndpoint"`
+	ModelHubToken     string   `yaml:"modelHubToken"`
+	ModelMaxSize      int64    `yaml:"modelMaxSize"`
+	ModelContentTypes []string `yaml:"modelContentTypes"`
+	// model url and redirects allowed schemes (default https) and hosts ("*.example.com" match subdomain,
+	// empty any host), private/loopback/link-local address rejected unless modelUrlPrivate
+	ModelUrlSchemes []string `yaml:"modelUrlSchemes"`
+	ModelUrlHosts   []string `yaml:"modelUrlHosts"`
+	ModelUrlPrivate bool     `yaml:"modelUrlPrivate"`
+	// model type => webui dir and refresh api, add new type or override builtin
+	ModelTypes map[string]*ModelType `yaml:"modelTypes"`
+	// model gc, delete models unused modelGcDays days of modelGcTypes (empty types whose use recorded),
+	// modelGcExclude name glob never deleted, run every modelGcInterval seconds, 0 only by api
+	ModelGcDays     int      `yaml:"modelGcDays"`
+	ModelGcTypes    []string `yaml:"modelGcTypes"`
+	ModelGcExclude  []string `yaml:"modelGcExclude"`
+	ModelGcInterval int      `yaml:"modelGcInterval"`
+	// visibility of registered model without visibility set: private|shared|public
+	ModelVisibility string `yaml:"modelVisibility"`
+
+	// predict params validate
+	MaxWidth          int64    `yaml:"maxWidth"`
+	MaxHeight         int64    `yaml:"maxHeight"`
+	MaxSteps          int64    `yaml:"maxSteps"`
+	Samplers          []string `yaml:"samplers"`
+	ControlNetModules []string `yaml:"controlNetModules"`
+
+	// upload input image, size limit bytes and max side pixels
+	MaxUploadSize int64 `yaml:"maxUploadSize"`
+	MaxUploadSide int64 `yaml:"maxUploadSide"`
+	// MaxUploadRequestSize body bytes of multipart predict request, payload and all images
+	MaxUploadRequestSize int64 `yaml:"maxUploadRequestSize"`
+
+	// storage quota bytes of images/{user}/ and inputs/{user}/, 0 unlimited, userQuotas override by user
+	ImageQuota int64                `yaml:"imageQuota"`
+	InputQuota int64                `yaml:"inputQuota"`
+	UserQuotas map[string]UserQuota `yaml:"userQuotas"`
+
+	// output image, user/request output options first
+	OutputFormat  string `yaml:"outputFormat"`
+	OutputQuality int64  `yaml:"outputQuality"`
+	// thumbnail longest side size, eg: [256, 512], empty not generate
+	ThumbnailSizes []int `yaml:"thumbnailSizes"`
+
+	// watermark, image: local file path or oss key, position: top-left|top-right|bottom-left|bottom-right|center
+	WatermarkText              string  `yaml:"watermarkText"`
+	WatermarkImage             string  `yaml:"watermarkImage"`
+	WatermarkPosition          string  `yaml:"watermarkPosition"`
+	WatermarkOpacity           float64 `yaml:"watermarkOpacity"`
+	WatermarkScale             float64 `yaml:"watermarkScale"`
+	InvisibleWatermark         string  `yaml:"invisibleWatermark"`
+	InvisibleWatermarkStrength float64 `yaml:"invisibleWatermarkStrength"`
 
 	// flex mode
 	FlexMode string `yaml:"flexMode"`
@@ -116,6 +201,11 @@ func (c *Config) GetFlexMode() FlexMode {
 func (c *Config) UseLocalModel() bool {
 	return c.UseLocalModels == "yes"
 }
+
+func (c *Config) HybridModel() bool {
+	return c.UseLocalModels == "hybrid"
+}
+
 func (c *Config) EnableLogin() bool {
 	return c.LoginSwitch == "on"
 }
@@ -139,6 +229,24 @@ func (c *Config) EnableProgressImg() bool {
 	return c.ProgressImageOutputSwitch == "on"
 }
 
+// S3UsePathStyle s3 url {endpoint}/{bucket}/{key}, minio/ceph usually need
+func (c *Config) S3UsePathStyle() bool {
+	return c.S3PathStyle == "on"
+}
+
+func (c *Config) EnableOssRetry() bool {
+	return c.OssRetry == "on"
+}
+
+// EnableVisibleWatermark text or image watermark set
+func (c *Config) EnableVisibleWatermark() bool {
+	return c.WatermarkText != "" || c.WatermarkImage != ""
+}
+
+func (c *Config) EnableInvisibleWatermark() bool {
+	return c.InvisibleWatermark == "on"
+}
+
 func (c *Config) GetDisableHealthCheck() bool {
 	return c.DisableHealthCheck == "true" || c.DisableHealthCheck == "1"
 }
@@ -285,6 +393,15 @@ func (c *Config) setDefaults() {
 	if c.UseLocalModels == "" {
 		c.UseLocalModels = DefaultUseLocalModel
 	}
+	if c.ReconcileInterval == 0 {
+		c.ReconcileInterval = DefaultReconcileInterval
+	}
+	if c.ModelGcDays == 0 {
+		c.ModelGcDays = DefaultModelGcDays
+	}
+	if c.ModelVisibility == "" {
+		c.ModelVisibility = DefaultModelVisibility
+	}
 	if c.FlexMode == "" {
 		c.FlexMode = DefaultFlexMode
 	}
@@ -294,6 +411,27 @@ func (c *Config) setDefaults() {
 	if c.OssPath == "" {
 		c.OssPath = DefaultOssPath
 	}
+	if c.OssRetry == "" {
+		c.OssRetry = DefaultOssRetry
+	}
+	if c.OssMaxRetries == 0 {
+		c.OssMaxRetries = DefaultOssMaxRetries
+	}
+	if c.OssTimeout == 0 {
+		c.OssTimeout = DefaultOssTimeout
+	}
+	if c.OssBreakerThreshold == 0 {
+		c.OssBreakerThreshold = DefaultOssBreakerThreshold
+	}
+	if c.OssBreakerCooldown == 0 {
+		c.OssBreakerCooldown = DefaultOssBreakerCooldown
+	}
+	if c.OssRetryDir == "" {
+		c.OssRetryDir = DefaultOssRetryDir
+	}
+	if c.OssRetryInterval == 0 {
+		c.OssRetryInterval = DefaultOssRetryInterval
+	}
 	if c.LogRemoteService == "" {
 		c.LogRemoteService = DefaultLogService
 	}
@@ -328,6 +466,48 @@ func (c *Config) setDefaults() {
 	if c.Timeout == 0 {
 		c.Timeout = DefaultTimeout
 	}
+	if c.MaxWidth == 0 {
+		c.MaxWidth = DefaultMaxWidth
+	}
+	if c.MaxHeight == 0 {
+		c.MaxHeight = DefaultMaxHeight
+	}
+	if c.MaxSteps == 0 {
+		c.MaxSteps = DefaultMaxSteps
+	}
+	if len(c.Samplers) == 0 {
+		c.Samplers = DefaultSamplers
+	}
+	if len(c.ControlNetModules) == 0 {
+		c.ControlNetModules = DefaultControlNetModules
+	}
+	if c.DownloadChunkSize == 0 {
+		c.DownloadChunkSize = DefaultDownloadChunkSize
+	}
+	if c.DownloadConcurrency == 0 {
+		c.DownloadConcurrency = DefaultDownloadConcurrency
+	}
+	if c.ModelHubEndpoint == "" {
+		c.ModelHubEndpoint = DefaultModelHubEndpoint
+	}
+	if len(c.ModelUrlSchemes) == 0 {
+		c.ModelUrlSchemes = []string{DefaultModelUrlScheme}
+	}
+	if c.MaxUploadSize == 0 {
+		c.MaxUploadSize = DefaultMaxUploadSize
+	}
+	if c.MaxUploadSide == 0 {
+		c.MaxUploadSide = DefaultMaxUploadSide
+	}
+	if c.MaxUploadRequestSize == 0 {
+		c.MaxUploadRequestSize = DefaultMaxMultipartSize
+	}
+	if c.OutputFormat == "" {
+		c.OutputFormat = DefaultOutputFormat
+	}
+	if c.OutputQuality == 0 {
+		c.OutputQuality = DefaultOutputQuality
+	}
 	if c.SdUrlPrefix == "" {
 		c.SdUrlPrefix = fmt.Sprintf("http://localhost:%s", DefaultSdPort)
 	}
@@ -9,6 +9,13 @@ const (
 	MODEL_LOADED      = "loaded"
 	MODEL_UNLOADED    = "unloaded"
 	MODEL_DELETE      = "deleted"
+	MODEL_FAILED      = "failed"
+	MODEL_MISSING     = "missing"
+
+	// model visibility, shared: owner and users of shared list
+	MODEL_PRIVATE = "private"
+	MODEL_SHARED  = "shared"
+	MODEL_PUBLIC  = "public"
 
 	// task status
 	TASK_INPROGRESS = "running"
@@ -38,16 +45,23 @@ const (
 
 // model type
 const (
-	SD_MODEL         = "stableDiffusion"
-	SD_VAE           = "sdVae"
-	LORA_MODEL       = "lora"
-	CONTORLNET_MODEL = "controlNet"
+	SD_MODEL           = "stableDiffusion"
+	SD_VAE             = "sdVae"
+	LORA_MODEL         = "lora"
+	CONTORLNET_MODEL   = "controlNet"
+	EMBEDDING_MODEL    = "embedding"
+	HYPERNETWORK_MODEL = "hypernetwork"
+	LYCORIS_MODEL      = "lycoris"
+	ESRGAN_MODEL       = "esrgan"
+	CLIP_MODEL         = "clip"
+	IPADAPTER_MODEL    = "ipAdapter"
 )
 
 // sd api path
 const (
-	//REFRESH_LORAS      = "/sdapi/v1/refresh-loras"
 	//GET_LORAS          = "/sdapi/v1/loras"
+	REFRESH_LORAS      = "/sdapi/v1/refresh-loras"
+	REFRESH_EMBEDDINGS = "/sdapi/v1/refresh-embeddings"
 	GET_SD_MODEL       = "/sdapi/v1/sd-models"
 	REFRESH_SD_MODEL   = "/sdapi/v1/refresh-checkpoints"
 	GET_SD_VAE         = "/sdapi/v1/sd-vae"
@@ -106,7 +120,7 @@ const (
 	DefaultExtraArgs           = "--api"
 	DefaultSessionExpire       = 3600
 	DefaultLoginSwitch         = "off"       // value: off|on
-	DefaultUseLocalModel       = "yes"       // value: yes|no
+	DefaultUseLocalModel       = "yes"       // value: yes|no|hybrid
 	DefaultFlexMode            = "multiFunc" // value: singleFunc|multiFunc
 	DefaultOssPath             = "/mnt/oss"
 	DefaultLogService          = "http://server-ai-backend-agwwspzdwb.cn-hangzhou.devsapp.net"
@@ -119,6 +133,51 @@ const (
 	DefaultGpuMemorySize       = 16384
 	DefaultTimeout             = 600
 	DefaultOssMode             = REMOTE
+	DefaultOssRetry            = "on" // value: on|off
+	DefaultOssMaxRetries       = 3
+	DefaultOssTimeout          = 60 // seconds
+	DefaultOssBreakerThreshold = 5
+	DefaultOssBreakerCooldown  = 30 // seconds
+	DefaultOssRetryDir         = "/tmp/oss-retry"
+	DefaultOssRetryInterval    = 30 // seconds
+	DefaultMaxWidth            = 2048
+	DefaultMaxHeight           = 2048
+	DefaultMaxSteps            = 150
+	DefaultMaxUploadSize       = 20 << 20 // 20MB
+	DefaultMaxUploadSide       = 8192
+	DefaultMaxMultipartSize    = 64 << 20 // 64MB
+	DefaultDownloadChunkSize   = 64 << 20 // 64MB
+	DefaultDownloadConcurrency = 4
+	DefaultModelHubEndpoint    = "https://huggingface.co"
+	DefaultModelUrlScheme      = "https"
+	DefaultReconcileInterval   = 300 // seconds
+	DefaultModelGcDays         = 30
+	DefaultModelVisibility     = "public" // value: private|shared|public
+	DefaultOutputFormat        = "png"    // value: png|jpeg|webp
+	DefaultOutputQuality       = 90
+)
+
+// default sampler and controlnet preprocessor list, used by predict params validate
+var (
+	DefaultSamplers = []string{"Euler a", "Euler", "LMS", "Heun", "DPM2", "DPM2 a", "DPM++ 2S a",
+		"DPM++ 2M", "DPM++ SDE", "DPM++ 2M SDE", "DPM++ 2M SDE Heun", "DPM++ 3M SDE", "DPM fast",
+		"DPM adaptive", "LMS Karras", "DPM2 Karras", "DPM2 a Karras", "DPM++ 2S a Karras",
+		"DPM++ 2M Karras", "DPM++ SDE Karras", "DPM++ 2M SDE Karras", "DPM++ 2M SDE Exponential",
+		"DPM++ 2M SDE Heun Karras", "DPM++ 2M SDE Heun Exponential", "DPM++ 3M SDE Karras",
+		"DPM++ 3M SDE Exponential", "Restart", "DDIM", "PLMS", "UniPC", "LCM"}
+	DefaultControlNetModules = []string{"none", "canny", "depth", "depth_leres", "depth_leres++",
+		"depth_midas", "depth_zoe", "depth_anything", "hed", "hed_safe", "mediapipe_face", "mlsd",
+		"normal_bae", "normal_map", "normal_midas", "openpose", "openpose_face", "openpose_faceonly",
+		"openpose_full", "openpose_hand", "dw_openpose_full", "animal_openpose", "densepose",
+		"clip_vision", "color", "pidinet", "pidinet_safe", "pidinet_sketch", "pidinet_scribble",
+		"scribble_xdog", "scribble_hed", "segmentation", "seg_ofade20k", "seg_ofcoco", "seg_ufade20k",
+		"threshold", "oneformer_coco", "oneformer_ade20k", "lineart", "lineart_coarse", "lineart_anime",
+		"lineart_standard", "lineart_anime_denoise", "shuffle", "tile_resample", "tile_colorfix",
+		"tile_colorfix+sharp", "invert", "reference_only", "reference_adain", "reference_adain+attn",
+		"inpaint", "inpaint_only", "inpaint_only+lama", "softedge_hed", "softedge_hedsafe",
+		"softedge_pidinet", "softedge_pidisafe", "recolor_luminance", "recolor_intensity",
+		"blur_gaussian", "ip-adapter_clip_sd15", "ip-adapter_clip_sdxl", "t2ia_style_clipvision",
+		"t2ia_color_grid", "t2ia_sketch_pidi", "instant_id_face_embedding", "instant_id_face_keypoints"}
 )
 
 // function http trigger
@@ -139,6 +198,7 @@ const (
 const (
 	LOCAL  = "local"
 	REMOTE = "remote"
+	S3     = "s3"
 )
 
 type FlexMode int32
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ModelType webui directory of model type and sd api reload model list after files change
+type ModelType struct {
+	// Dir relative to sdPath
+	Dir string `yaml:"dir"`
+	// RefreshPath empty means webui load file on use or no reload api
+	RefreshPath   string `yaml:"refreshPath"`
+	RefreshMethod string `yaml:"refreshMethod"`
+	// Extensions model file suffix, empty use defaultModelExtensions
+	Extensions []string `yaml:"extensions"`
+}
+
+var defaultModelExtensions = []string{".safetensors", ".ckpt", ".pt", ".pth"}
+
+// builtinModelTypes modelTypes of config add new type or override
+var builtinModelTypes = map[string]*ModelType{
+	SD_MODEL:         {Dir: "models/Stable-diffusion", RefreshPath: REFRESH_SD_MODEL, RefreshMethod: "POST"},
+	SD_VAE:           {Dir: "models/VAE", RefreshPath: REFRESH_VAE, RefreshMethod: "POST"},
+	LORA_MODEL:       {Dir: "models/Lora", RefreshPath: REFRESH_LORAS, RefreshMethod: "POST"},
+	CONTORLNET_MODEL: {Dir: "models/ControlNet", RefreshPath: REFRESH_CONTROLNET, RefreshMethod: "GET"},
+	EMBEDDING_MODEL: {Dir: "embeddings", RefreshPath: REFRESH_EMBEDDINGS, RefreshMethod: "POST",
+		Extensions: []string{".safetensors", ".pt", ".bin"}},
+	HYPERNETWORK_MODEL: {Dir: "models/hypernetworks"},
+	LYCORIS_MODEL:      {Dir: "models/LyCORIS", RefreshPath: REFRESH_LORAS, RefreshMethod: "POST"},
+	ESRGAN_MODEL:       {Dir: "models/ESRGAN"},
+	CLIP_MODEL:         {Dir: "models/clip", Extensions: []string{".safetensors", ".pt", ".pth", ".bin"}},
+	IPADAPTER_MODEL: {Dir: "models/ControlNet", RefreshPath: REFRESH_CONTROLNET, RefreshMethod: "GET",
+		Extensions: []string{".safetensors", ".bin", ".pth"}},
+}
+
+// builtinModelTypeOrder list order of builtin types
+var builtinModelTypeOrder = []string{SD_MODEL, SD_VAE, LORA_MODEL, CONTORLNET_MODEL, EMBEDDING_MODEL,
+	HYPERNETWORK_MODEL, LYCORIS_MODEL, ESRGAN_MODEL, CLIP_MODEL, IPADAPTER_MODEL}
+
+// GetModelType config modelTypes first, nil if not support
+func (c *Config) GetModelType(name string) *ModelType {
+	modelType, ok := c.ModelTypes[name]
+	if !ok {
+		modelType, ok = builtinModelTypes[name]
+	}
+	if !ok || modelType == nil || modelType.Dir == "" {
+		return nil
+	}
+	return modelType
+}
+
+// ModelTypeNames builtin types then config types sorted
+func (c *Config) ModelTypeNames() []string {
+	names := append([]string{}, builtinModelTypeOrder...)
+	extra := make([]string, 0, len(c.ModelTypes))
+	for name := range c.ModelTypes {
+		if _, ok := builtinModelTypes[name]; !ok {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	ret := make([]string, 0, len(names)+len(extra))
+	for _, name := range append(names, extra...) {
+		if c.GetModelType(name) != nil {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// ModelTypeDir {sdPath}/{dir} of model type, "" if not support
+func (c *Config) ModelTypeDir(name string) string {
+	modelType := c.GetModelType(name)
+	if modelType == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", c.SdPath, strings.Trim(modelType.Dir, "/"))
+}
+
+// FileExtensions model file suffix of type, default if not configured
+func (m *ModelType) FileExtensions() []string {
+	if len(m.Extensions) == 0 {
+		return defaultModelExtensions
+	}
+	return m.Extensions
+}
+
+// IsModelFile file suffix match type extensions
+func (m *ModelType) IsModelFile(name string) bool {
+	for _, ext := range m.FileExtensions() {
+		if strings.HasSuffix(strings.ToLower(name), strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestModelType(t *testing.T) {
+	c := &Config{ConfigYaml: ConfigYaml{
+		SdPath: "/sd",
+		ModelTypes: map[string]*ModelType{
+			"swinir":      {Dir: "models/SwinIR", Extensions: []string{".pth"}},
+			LYCORIS_MODEL: {Dir: "models/lyco/"},
+		},
+	}}
+	assert.Equal(t, "/sd/models/Stable-diffusion", c.ModelTypeDir(SD_MODEL))
+	assert.Equal(t, "/sd/embeddings", c.ModelTypeDir(EMBEDDING_MODEL))
+	assert.Equal(t, "/sd/models/lyco", c.ModelTypeDir(LYCORIS_MODEL))
+	assert.Equal(t, "", c.ModelTypeDir("unknown"))
+	names := c.ModelTypeNames()
+	assert.Equal(t, SD_MODEL, names[0])
+	assert.Equal(t, "swinir", names[len(names)-1])
+	assert.True(t, c.GetModelType("swinir").IsModelFile("4x.PTH"))
+	assert.False(t, c.GetModelType("swinir").IsModelFile("4x.safetensors"))
+	assert.True(t, c.GetModelType(SD_MODEL).IsModelFile("sd.safetensors"))
+}
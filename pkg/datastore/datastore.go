@@ -8,6 +8,9 @@ const (
 	TableStore DatastoreType = "tableStore"
 )
 
+// batchGetLimit keys of one BatchGet request, ots BatchGetRow at most 100 rows
+const batchGetLimit = 100
+
 type Config struct {
 	Type                 DatastoreType // the datastore type
 	DBName               string        // the database name
@@ -46,6 +49,25 @@ type Datastore interface {
 	// Note: since it reads all data and store them in memory, so do not call this function on a large datastore.
 	ListAll(columns []string) (map[string]map[string]interface{}, error)
 
+	// ListRange read at most limit rows whose primary key >= start, in primary key order.
+	// It takes a start key, a row limit and a list of column name, and returns the ordered primary keys
+	// along with the nested map the same as ListAll.
+	ListRange(start string, limit int, columns []string) ([]string, map[string]map[string]interface{}, error)
+
+	// BatchGet retrieves the column values of many keys.
+	// It takes a list of keys and a list of column name, and returns the nested map the same as ListAll,
+	// keys not exist are absent from the map.
+	BatchGet(keys []string, columns []string) (map[string]map[string]interface{}, error)
+
+	// Increment atomically add deltas to the INT columns, create the row if not exist.
+	// It takes a key and a map of column names to deltas, and returns the column values after increment.
+	Increment(key string, deltas map[string]int64) (map[string]int64, error)
+
+	// UpdateIf update the column values only when the current values equal expect, missing column equals zero value.
+	// expect nil means insert only when the key does not exist.
+	// It returns false if the condition not matched.
+	UpdateIf(key string, values map[string]interface{}, expect map[string]interface{}) (bool, error)
+
 	// Close close the datastore.
 	Close() error
 }
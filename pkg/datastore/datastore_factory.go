@@ -46,6 +46,8 @@ func NewSQLiteConfig(tableName string) *Config {
 			KTaskStatus:             "TEXT",
 			KTaskCreateTime:         "TEXT",
 			KTaskModifyTime:         "TEXT",
+			KTaskThumbnails:         "TEXT",
+			KTaskContactSheet:       "TEXT",
 		}
 		config.PrimaryKeyColumnName = KTaskIdColumnName
 	case KModelTableName:
@@ -53,10 +55,27 @@ func NewSQLiteConfig(tableName string) *Config {
 			KModelName:       "TEXT PRIMARY KEY NOT NULL",
 			KModelType:       "TEXT",
 			KModelOssPath:    "TEXT",
+			KModelUrl:        "TEXT",
 			KModelEtag:       "TEXT",
 			KModelStatus:     "TEXT",
+			KModelLocalPath:  "TEXT",
 			KModelCreateTime: "TEXT",
 			KModelModifyTime: "TEXT",
+			KModelSha256:     "TEXT",
+			KModelProgress:   "TEXT",
+			KModelMessage:    "TEXT",
+			KModelShortHash:  "TEXT",
+			KModelInfo:       "TEXT",
+			KModelVersions:   "TEXT",
+			KModelAliases:    "TEXT",
+			KModelLastUsed:   "TEXT",
+			KModelUseCount:   "TEXT",
+			KModelOwner:      "TEXT",
+			KModelVisibility: "TEXT",
+			KModelSharedWith: "TEXT",
+			KModelJobOwner:   "TEXT",
+			KModelJobLease:   "TEXT",
+			KModelJob:        "TEXT",
 		}
 		config.PrimaryKeyColumnName = KModelName
 	case KModelServiceTableName:
@@ -83,6 +102,13 @@ func NewSQLiteConfig(tableName string) *Config {
 			KUserPassword:         "TEXT",
 		}
 		config.PrimaryKeyColumnName = KUserName
+	case KQuotaTableName:
+		config.ColumnConfig = map[string]string{
+			KQuotaUser:       "TEXT PRIMARY KEY NOT NULL",
+			KQuotaImageBytes: "INT",
+			KQuotaInputBytes: "INT",
+		}
+		config.PrimaryKeyColumnName = KQuotaUser
 	case KConfigTableName:
 		config.ColumnConfig = map[string]string{
 			KConfigKey:        "TEXT PRIMARY KEY NOT NULL",
@@ -91,6 +117,8 @@ func NewSQLiteConfig(tableName string) *Config {
 			KConfigMd5:        "TEXT",
 			KConfigCreateTime: "TEXT",
 			KConfigModifyTime: "TEXT",
+			KConfigOwner:      "TEXT",
+			KConfigLease:      "TEXT",
 		}
 		config.PrimaryKeyColumnName = KConfigKey
 	}
@@ -118,6 +146,8 @@ func NewOtsConfig(tableName string) *Config {
 			KTaskStatus:             "TEXT",
 			KTaskCreateTime:         "TEXT",
 			KTaskModifyTime:         "TEXT",
+			KTaskThumbnails:         "TEXT",
+			KTaskContactSheet:       "TEXT",
 		}
 		config.PrimaryKeyColumnName = KTaskIdColumnName
 	case KModelTableName:
@@ -125,10 +155,27 @@ func NewOtsConfig(tableName string) *Config {
 			KModelName:       "TEXT",
 			KModelType:       "TEXT",
 			KModelOssPath:    "TEXT",
+			KModelUrl:        "TEXT",
 			KModelEtag:       "TEXT",
 			KModelStatus:     "TEXT",
+			KModelLocalPath:  "TEXT",
 			KModelCreateTime: "TEXT",
 			KModelModifyTime: "TEXT",
+			KModelSha256:     "TEXT",
+			KModelProgress:   "TEXT",
+			KModelMessage:    "TEXT",
+			KModelShortHash:  "TEXT",
+			KModelInfo:       "TEXT",
+			KModelVersions:   "TEXT",
+			KModelAliases:    "TEXT",
+			KModelLastUsed:   "TEXT",
+			KModelUseCount:   "TEXT",
+			KModelOwner:      "TEXT",
+			KModelVisibility: "TEXT",
+			KModelSharedWith: "TEXT",
+			KModelJobOwner:   "TEXT",
+			KModelJobLease:   "TEXT",
+			KModelJob:        "TEXT",
 		}
 		config.PrimaryKeyColumnName = KModelName
 	case KModelServiceTableName:
@@ -155,6 +202,13 @@ func NewOtsConfig(tableName string) *Config {
 			KUserPassword:         "TEXT",
 		}
 		config.PrimaryKeyColumnName = KUserName
+	case KQuotaTableName:
+		config.ColumnConfig = map[string]string{
+			KQuotaUser:       "TEXT",
+			KQuotaImageBytes: "INT",
+			KQuotaInputBytes: "INT",
+		}
+		config.PrimaryKeyColumnName = KQuotaUser
 	case KConfigTableName:
 		config.ColumnConfig = map[string]string{
 			KConfigKey:        "TEXT",
@@ -163,6 +217,8 @@ func NewOtsConfig(tableName string) *Config {
 			KConfigMd5:        "TEXT",
 			KConfigCreateTime: "TEXT",
 			KConfigModifyTime: "TEXT",
+			KConfigOwner:      "TEXT",
+			KConfigLease:      "TEXT",
 		}
 		config.PrimaryKeyColumnName = KConfigKey
 	}
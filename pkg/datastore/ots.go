@@ -1,11 +1,15 @@
 package datastore
 
 import (
+	"fmt"
 	"github.com/aliyun/aliyun-tablestore-go-sdk/tablestore"
 	conf "github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
 	"sync"
 )
 
+// otsConditionCheckFail error code of row existence or column condition not matched
+const otsConditionCheckFail = "OTSConditionCheckFail"
+
 var (
 	otsClient    *tablestore.TableStoreClient
 	once         sync.Once
@@ -128,6 +132,73 @@ func (o *OtsStore) Update(key string, datas map[string]interface{}) error {
 	return nil
 }
 
+func (o *OtsStore) Increment(key string, deltas map[string]int64) (map[string]int64, error) {
+	updateRowRequest := new(tablestore.UpdateRowRequest)
+	updateRowChange := new(tablestore.UpdateRowChange)
+	updateRowChange.TableName = o.config.TableName
+	updatePk := new(tablestore.PrimaryKey)
+	updatePk.AddPrimaryKeyColumn(conf.COLPK, key)
+	updateRowChange.PrimaryKey = updatePk
+	for col, delta := range deltas {
+		updateRowChange.IncrementColumn(col, delta)
+		updateRowChange.AppendIncrementColumnToReturn(col)
+	}
+	updateRowChange.SetReturnIncrementValue()
+	updateRowChange.SetCondition(tablestore.RowExistenceExpectation_IGNORE)
+	updateRowRequest.UpdateRowChange = updateRowChange
+	resp, err := otsClient.UpdateRow(updateRowRequest)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]int64, len(deltas))
+	for _, col := range resp.Columns {
+		if val, ok := col.Value.(int64); ok {
+			ret[col.ColumnName] = val
+		}
+	}
+	return ret, nil
+}
+
+func (o *OtsStore) UpdateIf(key string, values map[string]interface{},
+	expect map[string]interface{}) (bool, error) {
+	pk := new(tablestore.PrimaryKey)
+	pk.AddPrimaryKeyColumn(conf.COLPK, key)
+	var err error
+	if expect == nil {
+		putRowChange := new(tablestore.PutRowChange)
+		putRowChange.TableName = o.config.TableName
+		putRowChange.PrimaryKey = pk
+		for col, data := range values {
+			putRowChange.AddColumn(col, data)
+		}
+		putRowChange.SetCondition(tablestore.RowExistenceExpectation_EXPECT_NOT_EXIST)
+		_, err = otsClient.PutRow(&tablestore.PutRowRequest{PutRowChange: putRowChange})
+	} else {
+		updateRowChange := new(tablestore.UpdateRowChange)
+		updateRowChange.TableName = o.config.TableName
+		updateRowChange.PrimaryKey = pk
+		for col, data := range values {
+			updateRowChange.PutColumn(col, data)
+		}
+		updateRowChange.SetCondition(tablestore.RowExistenceExpectation_EXPECT_EXIST)
+		// missing column pass the condition, the same as zero value
+		condition := tablestore.NewCompositeColumnCondition(tablestore.LO_AND)
+		for col, data := range expect {
+			condition.AddFilter(tablestore.NewSingleColumnCondition(col, tablestore.CT_EQUAL, data))
+		}
+		if len(expect) == 1 {
+			updateRowChange.SetColumnCondition(condition.Filters[0])
+		} else if len(expect) > 1 {
+			updateRowChange.SetColumnCondition(condition)
+		}
+		_, err = otsClient.UpdateRow(&tablestore.UpdateRowRequest{UpdateRowChange: updateRowChange})
+	}
+	if otsErr, ok := err.(*tablestore.OtsError); ok && otsErr.Code == otsConditionCheckFail {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func (o *OtsStore) Delete(key string) error {
 	deletePk := new(tablestore.PrimaryKey)
 	deletePk.AddPrimaryKeyColumn(conf.COLPK, key)
@@ -148,35 +219,117 @@ func (o *OtsStore) ListAll(columns []string) (map[string]map[string]interface{},
 	endPK := new(tablestore.PrimaryKey)
 	endPK.AddPrimaryKeyColumnWithMaxValue(conf.COLPK)
 
-	rangeRowQueryCriteria := &tablestore.RangeRowQueryCriteria{
-		TableName:       o.config.TableName,
-		StartPrimaryKey: startPK,
-		EndPrimaryKey:   endPK,
-		Direction:       tablestore.FORWARD,
-		MaxVersion:      1,
-		Limit:           1000,
-		ColumnsToGet:    columns,
-	}
-	getRangeRequest := &tablestore.GetRangeRequest{
-		RangeRowQueryCriteria: rangeRowQueryCriteria,
-	}
+	resp := make(map[string]map[string]interface{})
+	// one GetRange return at most 1000 rows, continue from next start until end
+	for startPK != nil {
+		rangeRowQueryCriteria := &tablestore.RangeRowQueryCriteria{
+			TableName:       o.config.TableName,
+			StartPrimaryKey: startPK,
+			EndPrimaryKey:   endPK,
+			Direction:       tablestore.FORWARD,
+			MaxVersion:      1,
+			Limit:           1000,
+			ColumnsToGet:    columns,
+		}
+		getRangeRequest := &tablestore.GetRangeRequest{
+			RangeRowQueryCriteria: rangeRowQueryCriteria,
+		}
 
-	getRangeResp, err := otsClient.GetRange(getRangeRequest)
-	if err != nil {
-		return nil, err
+		getRangeResp, err := otsClient.GetRange(getRangeRequest)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range getRangeResp.Rows {
+			result := make(map[string]interface{})
+			key := row.PrimaryKey.PrimaryKeys[0].Value.(string)
+			for _, col := range row.Columns {
+				result[col.ColumnName] = col.Value
+			}
+			resp[key] = result
+		}
+		startPK = getRangeResp.NextStartPrimaryKey
 	}
+	return resp, nil
+}
+
+func (o *OtsStore) BatchGet(keys []string, columns []string) (map[string]map[string]interface{}, error) {
 	resp := make(map[string]map[string]interface{})
-	for _, row := range getRangeResp.Rows {
-		result := make(map[string]interface{})
-		key := row.PrimaryKey.PrimaryKeys[0].Value.(string)
-		for _, col := range row.Columns {
-			result[col.ColumnName] = col.Value
+	for start := 0; start < len(keys); start += batchGetLimit {
+		chunk := keys[start:min(start+batchGetLimit, len(keys))]
+		criteria := &tablestore.MultiRowQueryCriteria{
+			TableName:    o.config.TableName,
+			ColumnsToGet: columns,
+			MaxVersion:   1,
+		}
+		for _, key := range chunk {
+			pk := new(tablestore.PrimaryKey)
+			pk.AddPrimaryKeyColumn(conf.COLPK, key)
+			criteria.AddRow(pk)
+		}
+		batchGetResp, err := otsClient.BatchGetRow(&tablestore.BatchGetRowRequest{
+			MultiRowQueryCriteria: []*tablestore.MultiRowQueryCriteria{criteria},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range batchGetResp.TableToRowsResult[o.config.TableName] {
+			if !row.IsSucceed {
+				return nil, fmt.Errorf("batch get row %s err=%s %s", chunk[row.Index], row.Error.Code,
+					row.Error.Message)
+			}
+			// row not exist without columns, the same as Get
+			if len(row.Columns) == 0 {
+				continue
+			}
+			result := make(map[string]interface{})
+			for _, col := range row.Columns {
+				result[col.ColumnName] = col.Value
+			}
+			resp[chunk[row.Index]] = result
 		}
-		resp[key] = result
 	}
 	return resp, nil
 }
 
+func (o *OtsStore) ListRange(start string, limit int,
+	columns []string) ([]string, map[string]map[string]interface{}, error) {
+	startPK := new(tablestore.PrimaryKey)
+	startPK.AddPrimaryKeyColumn(conf.COLPK, start)
+	endPK := new(tablestore.PrimaryKey)
+	endPK.AddPrimaryKeyColumnWithMaxValue(conf.COLPK)
+
+	var keys []string
+	resp := make(map[string]map[string]interface{})
+	for startPK != nil && len(keys) < limit {
+		getRangeResp, err := otsClient.GetRange(&tablestore.GetRangeRequest{
+			RangeRowQueryCriteria: &tablestore.RangeRowQueryCriteria{
+				TableName:       o.config.TableName,
+				StartPrimaryKey: startPK,
+				EndPrimaryKey:   endPK,
+				Direction:       tablestore.FORWARD,
+				MaxVersion:      1,
+				Limit:           int32(limit - len(keys)),
+				ColumnsToGet:    columns,
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, row := range getRangeResp.Rows {
+			result := make(map[string]interface{})
+			key := row.PrimaryKey.PrimaryKeys[0].Value.(string)
+			for _, col := range row.Columns {
+				result[col.ColumnName] = col.Value
+			}
+			keys = append(keys, key)
+			resp[key] = result
+		}
+		// server may return less rows than limit, continue from next start
+		startPK = getRangeResp.NextStartPrimaryKey
+	}
+	return keys, resp, nil
+}
+
 func (o *OtsStore) Close() error {
 	// do nothing
 	return nil
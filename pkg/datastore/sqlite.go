@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -34,12 +35,47 @@ func NewSQLiteDatastore(config *Config) *SQLiteDatastore {
 	if err != nil {
 		panic(fmt.Errorf("failed to create table %s: %v", config.TableName, err))
 	}
+	// Add columns introduced after the table was created.
+	if err := addMissingColumns(db, config); err != nil {
+		panic(fmt.Errorf("failed to add columns to table %s: %v", config.TableName, err))
+	}
 	return &SQLiteDatastore{
 		db:     db,
 		config: config,
 	}
 }
 
+func addMissingColumns(db *sql.DB, config *Config) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", config.TableName))
+	if err != nil {
+		return err
+	}
+	existed := make(map[string]struct{})
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			defaultVal       sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existed[strings.ToUpper(name)] = struct{}{}
+	}
+	rows.Close()
+	for name, typ := range config.ColumnConfig {
+		if _, ok := existed[strings.ToUpper(name)]; ok || name == config.PrimaryKeyColumnName {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s",
+			config.TableName, name, typ)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ds *SQLiteDatastore) Close() error {
 	return ds.db.Close()
 }
@@ -56,14 +92,20 @@ func (ds *SQLiteDatastore) Get(key string, columns []string) (map[string]interfa
 	for i, column := range columns {
 		// We use the type information stored in the Config to create a variable of the correct type.
 		var value interface{}
-		switch ds.config.ColumnConfig[column] {
+		// Use sql.Null* so that columns never written (NULL) can be scanned.
+		// primary key column type eg: "TEXT PRIMARY KEY NOT NULL"
+		columnType := ds.config.ColumnConfig[column]
+		if idx := strings.Index(columnType, " "); idx > 0 {
+			columnType = columnType[:idx]
+		}
+		switch columnType {
 		case "TEXT":
-			value = new(string)
+			value = new(sql.NullString)
 		case "INT":
 			// For simplicity, we use int64 for all integers.
-			value = new(int64)
+			value = new(sql.NullInt64)
 		case "FLOAT":
-			value = new(float64)
+			value = new(sql.NullFloat64)
 		default:
 			// If the column type is not supported, we return an error.
 			return nil, fmt.Errorf("unsupported column type: %s", ds.config.ColumnConfig[column])
@@ -84,9 +126,24 @@ func (ds *SQLiteDatastore) Get(key string, columns []string) (map[string]interfa
 	// Prepare the result map and fill it with values.
 	result := make(map[string]interface{})
 	for i, column := range columns {
-		// We use the reflect package to dereference the pointer.
-		value := reflect.ValueOf(values[i]).Elem().Interface()
-		result[column] = value
+		// NULL columns are skipped, the same as ots missing columns.
+		switch value := values[i].(type) {
+		case *sql.NullString:
+			if value.Valid {
+				result[column] = value.String
+			}
+		case *sql.NullInt64:
+			if value.Valid {
+				result[column] = value.Int64
+			}
+		case *sql.NullFloat64:
+			if value.Valid {
+				result[column] = value.Float64
+			}
+		default:
+			// We use the reflect package to dereference the pointer.
+			result[column] = reflect.ValueOf(values[i]).Elem().Interface()
+		}
 	}
 
 	return result, nil
@@ -129,6 +186,106 @@ func (ds *SQLiteDatastore) Update(key string, values map[string]interface{}) err
 	return err
 }
 
+func (ds *SQLiteDatastore) Increment(key string, deltas map[string]int64) (map[string]int64, error) {
+	columns := make([]string, 0, len(deltas))
+	for column := range deltas {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	placeholders := []string{"?"}
+	updates := make([]string, 0, len(columns))
+	args := []interface{}{key}
+	for _, column := range columns {
+		placeholders = append(placeholders, "?")
+		updates = append(updates, fmt.Sprintf("%s=COALESCE(%s, 0)+excluded.%s", column, column, column))
+		args = append(args, deltas[column])
+	}
+	// upsert is a single statement, concurrent increments never lost
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s) VALUES (%s) ON CONFLICT(%s) DO UPDATE SET %s RETURNING %s",
+		ds.config.TableName,
+		ds.config.PrimaryKeyColumnName,
+		strings.Join(columns, ", "),
+		strings.Join(placeholders, ", "),
+		ds.config.PrimaryKeyColumnName,
+		strings.Join(updates, ", "),
+		strings.Join(columns, ", "),
+	)
+	values := make([]interface{}, len(columns))
+	results := make([]int64, len(columns))
+	for i := range results {
+		values[i] = &results[i]
+	}
+	if err := ds.db.QueryRow(query, args...).Scan(values...); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]int64, len(columns))
+	for i, column := range columns {
+		ret[column] = results[i]
+	}
+	return ret, nil
+}
+
+func (ds *SQLiteDatastore) UpdateIf(key string, values map[string]interface{},
+	expect map[string]interface{}) (bool, error) {
+	var (
+		query string
+		args  []interface{}
+	)
+	if expect == nil {
+		columns := []string{ds.config.PrimaryKeyColumnName}
+		placeholders := []string{"?"}
+		args = []interface{}{key}
+		for column, value := range values {
+			columns = append(columns, column)
+			placeholders = append(placeholders, "?")
+			args = append(args, value)
+		}
+		query = fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES (%s) ON CONFLICT(%s) DO NOTHING",
+			ds.config.TableName,
+			strings.Join(columns, ", "),
+			strings.Join(placeholders, ", "),
+			ds.config.PrimaryKeyColumnName,
+		)
+	} else {
+		columns := make([]string, 0, len(values))
+		for column, value := range values {
+			columns = append(columns, fmt.Sprintf("%s=?", column))
+			args = append(args, value)
+		}
+		conditions := []string{fmt.Sprintf("%s = ?", ds.config.PrimaryKeyColumnName)}
+		args = append(args, key)
+		for column, value := range expect {
+			// NULL column equals zero value, the same as ots missing column
+			var zero interface{} = ""
+			switch value.(type) {
+			case int, int64:
+				zero = 0
+			case float64:
+				zero = 0.0
+			}
+			conditions = append(conditions, fmt.Sprintf("COALESCE(%s, ?) = ?", column))
+			args = append(args, zero, value)
+		}
+		query = fmt.Sprintf(
+			"UPDATE %s SET %s WHERE %s",
+			ds.config.TableName,
+			strings.Join(columns, ", "),
+			strings.Join(conditions, " AND "),
+		)
+	}
+	result, err := ds.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
 func (ds *SQLiteDatastore) Delete(key string) error {
 	_, err := ds.db.Exec(
 		fmt.Sprintf(
@@ -138,17 +295,65 @@ func (ds *SQLiteDatastore) Delete(key string) error {
 }
 
 func (ds *SQLiteDatastore) ListAll(columns []string) (map[string]map[string]interface{}, error) {
-	rows, err := ds.db.Query(fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ","), ds.config.TableName))
+	// primary key selected for scanRows, columns may not include it
+	rows, err := ds.db.Query(fmt.Sprintf("SELECT %s FROM %s",
+		strings.Join(append([]string{ds.config.PrimaryKeyColumnName}, columns...), ","), ds.config.TableName))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	_, results, err := ds.scanRows(rows)
+	return results, err
+}
+
+func (ds *SQLiteDatastore) ListRange(start string, limit int,
+	columns []string) ([]string, map[string]map[string]interface{}, error) {
+	rows, err := ds.db.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s >= ? ORDER BY %s LIMIT ?",
+		strings.Join(append([]string{ds.config.PrimaryKeyColumnName}, columns...), ","), ds.config.TableName,
+		ds.config.PrimaryKeyColumnName, ds.config.PrimaryKeyColumnName), start, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	return ds.scanRows(rows)
+}
+
+func (ds *SQLiteDatastore) BatchGet(keys []string,
+	columns []string) (map[string]map[string]interface{}, error) {
+	results := make(map[string]map[string]interface{})
+	for start := 0; start < len(keys); start += batchGetLimit {
+		chunk := keys[start:min(start+batchGetLimit, len(keys))]
+		args := make([]interface{}, 0, len(chunk))
+		for _, key := range chunk {
+			args = append(args, key)
+		}
+		rows, err := ds.db.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s IN (%s)",
+			strings.Join(append([]string{ds.config.PrimaryKeyColumnName}, columns...), ","), ds.config.TableName,
+			ds.config.PrimaryKeyColumnName, strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")), args...)
+		if err != nil {
+			return nil, err
+		}
+		_, datas, err := ds.scanRows(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		for key, data := range datas {
+			results[key] = data
+		}
+	}
+	return results, nil
+}
+
+// scanRows read rows into map of primary key, primary key column must be selected
+func (ds *SQLiteDatastore) scanRows(rows *sql.Rows) ([]string, map[string]map[string]interface{}, error) {
 	cols, err := rows.Columns()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	var keys []string
 	results := make(map[string]map[string]interface{})
 	for rows.Next() {
 		columns := make([]interface{}, len(cols))
@@ -159,7 +364,7 @@ func (ds *SQLiteDatastore) ListAll(columns []string) (map[string]map[string]inte
 
 		err := rows.Scan(columnPointers...)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		m := make(map[string]interface{})
@@ -169,12 +374,13 @@ func (ds *SQLiteDatastore) ListAll(columns []string) (map[string]map[string]inte
 		}
 
 		key := m[ds.config.PrimaryKeyColumnName].(string)
+		keys = append(keys, key)
 		results[key] = m
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return results, nil
+	return keys, results, nil
 }
@@ -1,6 +1,9 @@
 package datastore
 
 import (
+	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -83,6 +86,17 @@ func TestSQLiteDatastore(t *testing.T) {
 	// Test Get with non-existent key.
 	_, err = ds.Get("non-existent key", []string{"value", "intCol", "floatCol"})
 	assert.NoError(t, err)
+
+	// Test Get with NULL columns, NULL columns not in result.
+	err = ds.Put("nullKey", map[string]interface{}{"value": value})
+	assert.NoError(t, err)
+	ret, err = ds.Get("nullKey", []string{"value", "intCol", "floatCol"})
+	assert.NoError(t, err)
+	assert.Equal(t, value, ret["value"].(string))
+	_, ok := ret["intCol"]
+	assert.False(t, ok)
+	_, ok = ret["floatCol"]
+	assert.False(t, ok)
 }
 
 func TestListAll(t *testing.T) {
@@ -122,6 +136,10 @@ func TestListAll(t *testing.T) {
 		assert.Equal(t, int64(v["intCol"].(int)), r["intCol"].(int64))
 		assert.Equal(t, v["floatCol"].(float64), r["floatCol"].(float64))
 	}
+	// primary key column not listed
+	result, err = ds.ListAll([]string{"value"})
+	assert.NoError(t, err)
+	assert.Equal(t, "value2", result["key2"]["value"])
 
 	// Delete all data.
 	for k := range testData {
@@ -135,3 +153,174 @@ func TestListAll(t *testing.T) {
 	assert.Equal(t, 0, len(result))
 
 }
+
+func TestListRange(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    ":memory:",
+		TableName: "TestListRange",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "TEXT primary key not null",
+			"value":              "TEXT",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+	for _, k := range []string{"c", "a", "b", "B"} {
+		assert.NoError(t, ds.Put(k, map[string]interface{}{"value": "v" + k}))
+	}
+
+	// primary key order, start included
+	keys, result, err := ds.ListRange("", 2, []string{"value"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"B", "a"}, keys)
+	assert.Equal(t, "va", result["a"]["value"])
+	keys, result, err = ds.ListRange("a\x00", 10, []string{"value"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, keys)
+	assert.Equal(t, 2, len(result))
+	keys, _, err = ds.ListRange("d", 10, []string{"value"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(keys))
+}
+
+func TestBatchGet(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    ":memory:",
+		TableName: "TestBatchGet",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "TEXT primary key not null",
+			"value":              "TEXT",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+	var keys []string
+	for i := 0; i < batchGetLimit+10; i++ {
+		k := fmt.Sprintf("k%03d", i)
+		assert.NoError(t, ds.Put(k, map[string]interface{}{"value": "v" + k}))
+		keys = append(keys, k)
+	}
+
+	// more keys than one batch, not exist keys absent
+	result, err := ds.BatchGet(append(keys, "missing"), []string{"value"})
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys), len(result))
+	assert.Equal(t, "vk105", result["k105"]["value"])
+	_, ok := result["missing"]
+	assert.False(t, ok)
+	result, err = ds.BatchGet(nil, []string{"value"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(result))
+}
+
+func TestAddMissingColumns(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    "file:TestAddMissingColumns?mode=memory&cache=shared",
+		TableName: "TestAddMissingColumns",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "TEXT primary key not null",
+			"value":              "TEXT",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+	err := ds.Put("key", map[string]interface{}{"value": "value"})
+	assert.NoError(t, err)
+
+	// reopen with new column
+	config.ColumnConfig["newCol"] = "TEXT"
+	newDs := NewSQLiteDatastore(config)
+	defer newDs.Close()
+	err = newDs.Update("key", map[string]interface{}{"newCol": "newValue"})
+	assert.NoError(t, err)
+	ret, err := newDs.Get("key", []string{"value", "newCol"})
+	assert.NoError(t, err)
+	assert.Equal(t, "value", ret["value"].(string))
+	assert.Equal(t, "newValue", ret["newCol"].(string))
+}
+
+func TestIncrement(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    filepath.Join(t.TempDir(), "sqlite3"),
+		TableName: "TestIncrement",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "TEXT primary key not null",
+			"a":                  "INT",
+			"b":                  "INT",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+
+	// row created on first increment
+	ret, err := ds.Increment("key", map[string]int64{"a": 3})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"a": 3}, ret)
+	ret, err = ds.Increment("key", map[string]int64{"a": -5, "b": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"a": -2, "b": 2}, ret)
+
+	// concurrent increments not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ds.Increment("key", map[string]int64{"b": 1})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	data, err := ds.Get("key", []string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-2), data["a"])
+	assert.Equal(t, int64(22), data["b"])
+}
+
+func TestUpdateIf(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    ":memory:",
+		TableName: "TestUpdateIf",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "TEXT primary key not null",
+			"owner":              "TEXT",
+			"value":              "TEXT",
+			"intCol":             "INT",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+
+	// nil expect insert only when not exist
+	ok, err := ds.UpdateIf("key", map[string]interface{}{"value": "a"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = ds.UpdateIf("key", map[string]interface{}{"value": "b"}, nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// missing column equals zero value
+	ok, err = ds.UpdateIf("key", map[string]interface{}{"owner": "x"},
+		map[string]interface{}{"owner": "", "intCol": int64(0)})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = ds.UpdateIf("key", map[string]interface{}{"owner": "y"}, map[string]interface{}{"owner": ""})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = ds.UpdateIf("missing", map[string]interface{}{"owner": "y"}, map[string]interface{}{"owner": ""})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	data, err := ds.Get("key", []string{"owner", "value"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"owner": "x", "value": "a"}, data)
+}
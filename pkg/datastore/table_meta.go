@@ -19,11 +19,28 @@ const (
 	KModelType       = "MODEL_TYPE"
 	KModelName       = "MODEL_NAME"
 	KModelOssPath    = "MODEL_OSS_PATH"
+	KModelUrl        = "MODEL_URL"
 	KModelEtag       = "MODEL_ETAG"
 	KModelStatus     = "MODEL_STATUS"
 	KModelLocalPath  = "MODEL_LOCAL_PATH"
 	KModelCreateTime = "MODEL_REGISTERED"
 	KModelModifyTime = "MODEL_MODIFY"
+	KModelSha256     = "MODEL_SHA256"
+	KModelProgress   = "MODEL_PROGRESS"
+	KModelMessage    = "MODEL_MESSAGE"
+	KModelShortHash  = "MODEL_SHORT_HASH"
+	KModelInfo       = "MODEL_INFO"
+	KModelVersions   = "MODEL_VERSIONS"
+	KModelAliases    = "MODEL_ALIASES"
+	KModelLastUsed   = "MODEL_LAST_USED"
+	KModelUseCount   = "MODEL_USE_COUNT"
+	KModelOwner      = "MODEL_OWNER"
+	KModelVisibility = "MODEL_VISIBILITY"
+	KModelSharedWith = "MODEL_SHARED_WITH"
+	KModelJobOwner   = "MODEL_JOB_OWNER"
+	KModelJobLease   = "MODEL_JOB_LEASE"
+	// KModelJob source of running update job, json
+	KModelJob = "MODEL_JOB"
 )
 
 // tasks table
@@ -40,6 +57,8 @@ const (
 	KTaskStatus             = "TASK_STATUS"
 	KTaskCreateTime         = "TASK_CREATE_TIME"
 	KTaskModifyTime         = "TASK_MODIFY_TIME"
+	KTaskThumbnails         = "TASK_THUMBNAILS"
+	KTaskContactSheet       = "TASK_CONTACT_SHEET"
 )
 
 // user table
@@ -55,6 +74,14 @@ const (
 	KUserModifyTime       = "USER_MODIFY_TIME"
 )
 
+// quota table, storage usage bytes of user
+const (
+	KQuotaTableName  = "quota"
+	KQuotaUser       = "QUOTA_USER"
+	KQuotaImageBytes = "QUOTA_IMAGE_BYTES"
+	KQuotaInputBytes = "QUOTA_INPUT_BYTES"
+)
+
 // config
 const (
 	KConfigTableName  = "config"
@@ -64,4 +91,7 @@ const (
 	KConfigVer        = "CONFIG_VERSION"
 	KConfigCreateTime = "CONFIG_CREATE_TIME"
 	KConfigModifyTime = "CONFIG_MODIFY_TIME"
+	// owner and lease expire time of row used as lock between instances
+	KConfigOwner = "CONFIG_OWNER"
+	KConfigLease = "CONFIG_LEASE"
 )
@@ -65,7 +65,7 @@ func (a *AgentHandler) ExtraImages(c *gin.Context) {
 		return
 	}
 	// preprocess request ossPath image to base64
-	if err := preprocessRequest(request); err != nil {
+	if err := a.preprocessRequest(username, request); err != nil {
 		// update task status
 		a.taskStore.Update(taskId, map[string]interface{}{
 			datastore.KTaskStatus:     config.TASK_FAILED,
@@ -76,6 +76,9 @@ func (a *AgentHandler) ExtraImages(c *gin.Context) {
 		handleError(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	// output options handle by agent, not send to sd
+	output := newImageOutputOption(request.OutputFormat, request.OutputQuality, request.StripMetadata)
+	request.OutputFormat, request.OutputQuality, request.StripMetadata = nil, nil, nil
 	// update task status
 	a.taskStore.Update(taskId, map[string]interface{}{
 		datastore.KTaskStatus: config.TASK_INPROGRESS,
@@ -86,7 +89,7 @@ func (a *AgentHandler) ExtraImages(c *gin.Context) {
 		handleError(c, http.StatusBadRequest, config.BADREQUEST)
 		return
 	}
-	if images, err := a.extraImages(username, taskId, config.EXTRAIMAGES, body); err != nil {
+	if images, err := a.extraImages(username, taskId, config.EXTRAIMAGES, body, output); err != nil {
 		logrus.WithFields(logrus.Fields{"taskId": taskId}).Error(err.Error())
 		handleError(c, http.StatusInternalServerError, err.Error())
 	} else {
@@ -134,7 +137,7 @@ func (a *AgentHandler) Img2Img(c *gin.Context) {
 		return
 	}
 	// preprocess request ossPath image to base64
-	if err := preprocessRequest(request); err != nil {
+	if err := a.preprocessRequest(username, request); err != nil {
 		// update task status
 		a.taskStore.Update(taskId, map[string]interface{}{
 			datastore.KTaskStatus:     config.TASK_FAILED,
@@ -162,6 +165,11 @@ func (a *AgentHandler) Img2Img(c *gin.Context) {
 	}
 	// default OverrideSettingsRestoreAfterwards = true
 	request.OverrideSettingsRestoreAfterwards = utils.Bool(false)
+	// output options handle by agent, not send to sd
+	output := newImageOutputOption(request.OutputFormat, request.OutputQuality, request.StripMetadata)
+	contactSheet := request.ContactSheet != nil && *request.ContactSheet
+	request.OutputFormat, request.OutputQuality, request.StripMetadata = nil, nil, nil
+	request.ContactSheet = nil
 	// update task status
 	a.taskStore.Update(taskId, map[string]interface{}{
 		datastore.KTaskStatus: config.TASK_INPROGRESS,
@@ -183,7 +191,7 @@ func (a *AgentHandler) Img2Img(c *gin.Context) {
 		return
 	}
 	// predict task
-	images, err := a.predictTask(username, taskId, config.IMG2IMG, body)
+	images, err := a.predictTask(username, taskId, config.IMG2IMG, body, output, contactSheet)
 	if err != nil {
 		// update task status
 		a.taskStore.Update(taskId, map[string]interface{}{
@@ -247,7 +255,7 @@ func (a *AgentHandler) Txt2Img(c *gin.Context) {
 		return
 	}
 	// preprocess request ossPath image to base64
-	if err := preprocessRequest(request); err != nil {
+	if err := a.preprocessRequest(username, request); err != nil {
 		// update task status
 		a.taskStore.Update(taskId, map[string]interface{}{
 			datastore.KTaskStatus:     config.TASK_FAILED,
@@ -276,6 +284,11 @@ func (a *AgentHandler) Txt2Img(c *gin.Context) {
 	}
 	// default OverrideSettingsRestoreAfterwards = true
 	request.OverrideSettingsRestoreAfterwards = utils.Bool(false)
+	// output options handle by agent, not send to sd
+	output := newImageOutputOption(request.OutputFormat, request.OutputQuality, request.StripMetadata)
+	contactSheet := request.ContactSheet != nil && *request.ContactSheet
+	request.OutputFormat, request.OutputQuality, request.StripMetadata = nil, nil, nil
+	request.ContactSheet = nil
 	// update task status
 	if err := a.taskStore.Update(taskId, map[string]interface{}{
 		datastore.KTaskStatus: config.TASK_INPROGRESS,
@@ -301,7 +314,7 @@ func (a *AgentHandler) Txt2Img(c *gin.Context) {
 		return
 	}
 	// predict task
-	images, err := a.predictTask(username, taskId, config.TXT2IMG, body)
+	images, err := a.predictTask(username, taskId, config.TXT2IMG, body, output, contactSheet)
 	if err != nil {
 		// update task status
 		a.taskStore.Update(taskId, map[string]interface{}{
@@ -337,7 +350,8 @@ func (a *AgentHandler) Txt2Img(c *gin.Context) {
 	}
 }
 
-func (a *AgentHandler) predictTask(user, taskId, path string, body []byte) ([]string, error) {
+func (a *AgentHandler) predictTask(user, taskId, path string, body []byte,
+	output *utils.ImageOutputOption, contactSheet bool) ([]string, error) {
 	url := fmt.Sprintf("%s%s", config.ConfigGlobal.SdUrlPrefix, path)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
@@ -382,29 +396,59 @@ func (a *AgentHandler) predictTask(user, taskId, path string, body []byte) ([]st
 	var images []string
 	var status string
 	var errMeg error
+	var sheetOssKey string
+	thumbnails := make(map[string][]string)
 	if resp.StatusCode == requestOk {
 		count := len(result.Images)
+		infotexts := parseInfotexts(result.Info)
+		info := new(sdPredictInfo)
+		sheetItems := make([]*utils.ContactSheetItem, 0, count)
+		if contactSheet {
+			if err := json.Unmarshal([]byte(result.Info), info); err != nil {
+				logrus.WithFields(logrus.Fields{"taskId": taskId}).Warnf("parse info err=%s", err.Error())
+			}
+		}
 		for i := 1; i <= count; i++ {
+			infotext := ""
+			if i <= len(infotexts) {
+				infotext = infotexts[i-1]
+			}
+			body, err := decodeOutputImage(user, taskId, &result.Images[i-1])
+			if err != nil {
+				return nil, fmt.Errorf("output image err=%s", err.Error())
+			}
 			// upload image to oss
-			ossPath := fmt.Sprintf("images/%s/%s_%d.png", user, taskId, i)
-			if err := uploadImages(&ossPath, &result.Images[i-1]); err != nil {
+			ossKeyPrefix := fmt.Sprintf("images/%s/%s_%d", user, taskId, i)
+			ossPath, err := uploadOutputImage(ossKeyPrefix, body, infotext, output)
+			if err != nil {
 				return nil, fmt.Errorf("output image err=%s", err.Error())
 			}
+			appendThumbnails(thumbnails, uploadThumbnails(ossKeyPrefix, body, output))
+			if contactSheet {
+				if item := contactSheetItem(info, infotexts, i-1, body); item != nil {
+					sheetItems = append(sheetItems, item)
+				}
+			}
 
 			images = append(images, ossPath)
 		}
+		if contactSheet {
+			sheetOssKey = uploadContactSheet(fmt.Sprintf("images/%s/%s_grid", user, taskId), sheetItems, output)
+		}
 		status = config.TASK_FINISH
 	} else {
 		status = config.TASK_FAILED
 		errMeg = errors.New("predict error")
 	}
 	if err := a.taskStore.Update(taskId, map[string]interface{}{
-		datastore.KTaskCode:       int64(resp.StatusCode),
-		datastore.KTaskStatus:     status,
-		datastore.KTaskImage:      strings.Join(images, ","),
-		datastore.KTaskParams:     string(params),
-		datastore.KTaskInfo:       result.Info,
-		datastore.KTaskModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+		datastore.KTaskCode:         int64(resp.StatusCode),
+		datastore.KTaskStatus:       status,
+		datastore.KTaskImage:        strings.Join(images, ","),
+		datastore.KTaskThumbnails:   thumbnailsToString(thumbnails),
+		datastore.KTaskContactSheet: sheetOssKey,
+		datastore.KTaskParams:       string(params),
+		datastore.KTaskInfo:         result.Info,
+		datastore.KTaskModifyTime:   fmt.Sprintf("%d", utils.TimestampS()),
 	}); err != nil {
 		logrus.WithFields(logrus.Fields{"taskId": taskId}).Errorln(err.Error())
 		return nil, err
@@ -486,7 +530,8 @@ func (a *AgentHandler) taskProgress(ctx context.Context, user, taskId string) er
 	}
 }
 
-func (a *AgentHandler) extraImages(user, taskId, path string, body []byte) ([]string, error) {
+func (a *AgentHandler) extraImages(user, taskId, path string, body []byte,
+	output *utils.ImageOutputOption) ([]string, error) {
 	url := fmt.Sprintf("%s%s", config.ConfigGlobal.SdUrlPrefix, path)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
@@ -522,12 +567,19 @@ func (a *AgentHandler) extraImages(user, taskId, path string, body []byte) ([]st
 		return nil, errors.New("predict fail")
 	}
 	var images []string
+	thumbnails := make(map[string][]string)
 	if resp.StatusCode == requestOk {
+		body, err := decodeOutputImage(user, taskId, &result.Image)
+		if err != nil {
+			return nil, fmt.Errorf("output image err=%s", err.Error())
+		}
 		// upload image to oss
-		ossPath := fmt.Sprintf("images/%s/%s_%d.png", user, taskId, 1)
-		if err := uploadImages(&ossPath, &result.Image); err != nil {
+		ossKeyPrefix := fmt.Sprintf("images/%s/%s_%d", user, taskId, 1)
+		ossPath, err := uploadOutputImage(ossKeyPrefix, body, "", output)
+		if err != nil {
 			return nil, fmt.Errorf("output image err=%s", err.Error())
 		}
+		appendThumbnails(thumbnails, uploadThumbnails(ossKeyPrefix, body, output))
 
 		images = append(images, ossPath)
 	}
@@ -535,6 +587,7 @@ func (a *AgentHandler) extraImages(user, taskId, path string, body []byte) ([]st
 		datastore.KTaskCode:       int64(resp.StatusCode),
 		datastore.KTaskStatus:     config.TASK_FINISH,
 		datastore.KTaskImage:      strings.Join(images, ","),
+		datastore.KTaskThumbnails: thumbnailsToString(thumbnails),
 		datastore.KTaskParams:     "{}",
 		datastore.KTaskInfo:       fmt.Sprintf("{\"html_info\":\"%s\"}", result.HTMLInfo),
 		datastore.KTaskModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
@@ -587,11 +640,18 @@ func (a *AgentHandler) updateOverrideSettingsRequest(overrideSettings *map[strin
 	return nil
 }
 
-// deal ossImg to base64
-func preprocessRequest(req any) error {
+// deal ossImg and task://{taskId}/{index} to base64
+func (a *AgentHandler) preprocessRequest(user string, req any) error {
 	switch req.(type) {
 	case *models.ExtraImagesJSONRequestBody:
 		request := req.(*models.ExtraImagesJSONRequestBody)
+		if isTaskRef(request.Image) {
+			ossKey, err := resolveTaskRef(a.taskStore, user, request.Image)
+			if err != nil {
+				return err
+			}
+			request.Image = ossKey
+		}
 		if request.Image != "" {
 			if isImgPath(request.Image) {
 
@@ -605,23 +665,42 @@ func preprocessRequest(req any) error {
 	case *models.Txt2ImgJSONRequestBody:
 		request := req.(*models.Txt2ImgJSONRequestBody)
 		if request.AlwaysonScripts != nil {
+			if err := resolveTaskRefMap(a.taskStore, user, *request.AlwaysonScripts); err != nil {
+				return err
+			}
 			return updateControlNet(request.AlwaysonScripts)
 		}
 	case *models.Img2ImgJSONRequestBody:
 		request := req.(*models.Img2ImgJSONRequestBody)
-		// init images: ossPath to base64Str
-		for i, str := range *request.InitImages {
-			if !isImgPath(str) {
-				continue
+		// init images: task ref/ossPath to base64Str
+		if request.InitImages != nil {
+			for i, str := range *request.InitImages {
+				if isTaskRef(str) {
+					ossKey, err := resolveTaskRef(a.taskStore, user, str)
+					if err != nil {
+						return err
+					}
+					str = ossKey
+				}
+				if !isImgPath(str) {
+					continue
+				}
+				base64, err := module.OssGlobal.DownloadFileToBase64(str)
+				if err != nil {
+					return err
+				}
+				(*request.InitImages)[i] = *base64
 			}
-			base64, err := module.OssGlobal.DownloadFileToBase64(str)
+		}
+
+		// mask images: task ref/ossPath to base64St
+		if request.Mask != nil && isTaskRef(*request.Mask) {
+			ossKey, err := resolveTaskRef(a.taskStore, user, *request.Mask)
 			if err != nil {
 				return err
 			}
-			(*request.InitImages)[i] = *base64
+			*request.Mask = ossKey
 		}
-
-		// mask images: ossPath to base64St
 		if request.Mask != nil && isImgPath(*request.Mask) {
 			base64, err := module.OssGlobal.DownloadFileToBase64(*request.Mask)
 			if err != nil {
@@ -630,8 +709,11 @@ func preprocessRequest(req any) error {
 			*request.Mask = *base64
 		}
 
-		// controlNet images: ossPath to base64Str
+		// controlNet images: task ref/ossPath to base64Str
 		if request.AlwaysonScripts != nil {
+			if err := resolveTaskRefMap(a.taskStore, user, *request.AlwaysonScripts); err != nil {
+				return err
+			}
 			return updateControlNet(request.AlwaysonScripts)
 		}
 	}
@@ -679,7 +761,109 @@ func updateControlNet(alwaysonScripts *map[string]interface{}) error {
 
 // ListModels list model, not support
 // (GET /models)
-func (a *AgentHandler) ListModels(c *gin.Context) {
+func (a *AgentHandler) ListModels(c *gin.Context, params models.ListModelsParams) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// Txt2ImgValidate validate txt to img predict params, not support
+// (POST /txt2img:validate)
+func (a *AgentHandler) Txt2ImgValidate(c *gin.Context) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// Img2ImgValidate validate img to img predict params, not support
+// (POST /img2img:validate)
+func (a *AgentHandler) Img2ImgValidate(c *gin.Context) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// GetUserOutputOptions get user output options, not support
+// (GET /users/{user_name}/output_options)
+func (a *AgentHandler) GetUserOutputOptions(c *gin.Context, userName string) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// UpdateUserOutputOptions update user output options, not support
+// (PUT /users/{user_name}/output_options)
+func (a *AgentHandler) UpdateUserOutputOptions(c *gin.Context, userName string) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// PngInfo read image generation params, not support
+// (POST /png-info)
+func (a *AgentHandler) PngInfo(c *gin.Context) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// WatermarkVerify decode image watermark, not support
+// (POST /watermark/verify)
+func (a *AgentHandler) WatermarkVerify(c *gin.Context) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// GetTaskArchive download task archive, not support
+// (GET /tasks/{taskId}/archive)
+func (a *AgentHandler) GetTaskArchive(c *gin.Context, taskId string) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// ArchiveTasks download multi tasks archive, not support
+// (POST /tasks/archive)
+func (a *AgentHandler) ArchiveTasks(c *gin.Context) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// GetUserUsage get user storage usage, not support
+// (GET /users/{user_name}/usage)
+func (a *AgentHandler) GetUserUsage(c *gin.Context, userName string) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// UploadImage upload input image, not support
+// (POST /images)
+func (a *AgentHandler) UploadImage(c *gin.Context) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// GetOssMetrics oss retry/circuit breaker metrics, output upload of agent
+// (GET /metrics/oss)
+func (a *AgentHandler) GetOssMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, module.GetOssMetrics())
+}
+
+// GetModelDrift get model drift, not support
+// (GET /models/drift)
+func (a *AgentHandler) GetModelDrift(c *gin.Context) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// UpdateModelAcl update model acl, not support
+// (PUT /models/{model_name}/acl)
+func (a *AgentHandler) UpdateModelAcl(c *gin.Context, modelName string) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// GcModels gc models, not support
+// (POST /models/gc)
+func (a *AgentHandler) GcModels(c *gin.Context) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// ListModelVersions list model versions, not support
+// (GET /models/{model_name}/versions)
+func (a *AgentHandler) ListModelVersions(c *gin.Context, modelName string) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// SetModelAlias set model alias, not support
+// (PUT /models/{model_name}/aliases/{alias})
+func (a *AgentHandler) SetModelAlias(c *gin.Context, modelName string, alias string) {
+	c.String(http.StatusNotFound, "api not support")
+}
+
+// DeleteModelAlias delete model alias, not support
+// (DELETE /models/{model_name}/aliases/{alias})
+func (a *AgentHandler) DeleteModelAlias(c *gin.Context, modelName string, alias string) {
 	c.String(http.StatusNotFound, "api not support")
 }
 
@@ -691,7 +875,7 @@ func (a *AgentHandler) RegisterModel(c *gin.Context) {
 
 // DeleteModel delete model, not support
 // (DELETE /models/{model_name})
-func (a *AgentHandler) DeleteModel(c *gin.Context, modelName string) {
+func (a *AgentHandler) DeleteModel(c *gin.Context, modelName string, params models.DeleteModelParams) {
 	c.String(http.StatusNotFound, "api not support")
 }
 
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/sirupsen/logrus"
+	"io"
+	"path"
+	"strings"
+)
+
+// maxArchiveTasks max task num of one archive
+const maxArchiveTasks = 100
+
+// archiveTask one finished task in archive
+type archiveTask struct {
+	TaskId     string                 `json:"taskId"`
+	Images     []string               `json:"images"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Info       map[string]interface{} `json:"info,omitempty"`
+	CreateTime string                 `json:"createTime,omitempty"`
+
+	ossKeys []string
+}
+
+// getArchiveTask read task outputs, task must belong to user and finish success
+func getArchiveTask(taskStore datastore.Datastore, user, taskId string) (*archiveTask, error) {
+	data, err := taskStore.Get(taskId, []string{datastore.KTaskUser, datastore.KTaskStatus, datastore.KTaskCode,
+		datastore.KTaskImage, datastore.KTaskParams, datastore.KTaskInfo, datastore.KTaskCreateTime})
+	if err != nil {
+		return nil, fmt.Errorf("task %s read db error", taskId)
+	}
+	if data == nil || len(data) == 0 {
+		return nil, fmt.Errorf("task %s not found", taskId)
+	}
+	if owner, ok := data[datastore.KTaskUser].(string); !ok || owner != user {
+		return nil, fmt.Errorf("task %s not found", taskId)
+	}
+	if status, ok := data[datastore.KTaskStatus].(string); !ok || status != config.TASK_FINISH {
+		return nil, fmt.Errorf("task %s not finished", taskId)
+	}
+	if code, ok := data[datastore.KTaskCode].(int64); !ok || code != requestOk {
+		return nil, fmt.Errorf("task %s not succeeded", taskId)
+	}
+	task := &archiveTask{
+		TaskId:  taskId,
+		Images:  make([]string, 0),
+		ossKeys: make([]string, 0),
+	}
+	if val, ok := data[datastore.KTaskImage].(string); ok {
+		for _, ossKey := range strings.Split(val, ",") {
+			if ossKey != "" {
+				task.ossKeys = append(task.ossKeys, ossKey)
+				task.Images = append(task.Images, path.Base(ossKey))
+			}
+		}
+	}
+	if val, ok := data[datastore.KTaskParams].(string); ok && val != "" {
+		if err := json.Unmarshal([]byte(val), &task.Parameters); err != nil {
+			logrus.WithFields(logrus.Fields{"taskId": taskId}).Warnf("Unmarshal params error=%s", err.Error())
+		}
+	}
+	if val, ok := data[datastore.KTaskInfo].(string); ok && val != "" {
+		if err := json.Unmarshal([]byte(val), &task.Info); err != nil {
+			logrus.WithFields(logrus.Fields{"taskId": taskId}).Warnf("Unmarshal info error=%s", err.Error())
+		}
+	}
+	if val, ok := data[datastore.KTaskCreateTime].(string); ok {
+		task.CreateTime = val
+	}
+	return task, nil
+}
+
+// parseArchiveTaskIds remove empty and duplicate taskIds
+func parseArchiveTaskIds(taskIds []string) ([]string, error) {
+	ret := make([]string, 0)
+	exist := make(map[string]struct{})
+	for _, taskId := range taskIds {
+		taskId = strings.TrimSpace(taskId)
+		if taskId == "" {
+			continue
+		}
+		if _, ok := exist[taskId]; ok {
+			continue
+		}
+		exist[taskId] = struct{}{}
+		ret = append(ret, taskId)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("taskIds empty")
+	}
+	if len(ret) > maxArchiveTasks {
+		return nil, fmt.Errorf("taskIds num %d exceed limit %d", len(ret), maxArchiveTasks)
+	}
+	return ret, nil
+}
+
+// writeArchive write task images and {taskId}.json sidecar of params/info to zip stream
+func writeArchive(w io.Writer, tasks []*archiveTask) error {
+	zw := zip.NewWriter(w)
+	for _, task := range tasks {
+		for i, ossKey := range task.ossKeys {
+			if err := writeArchiveImage(zw, task.Images[i], ossKey); err != nil {
+				return err
+			}
+		}
+		body, err := json.MarshalIndent(task, "", "  ")
+		if err != nil {
+			return err
+		}
+		fw, err := zw.Create(fmt.Sprintf("%s.json", task.TaskId))
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(body); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeArchiveImage(zw *zip.Writer, name, ossKey string) error {
+	reader, err := module.OssGlobal.GetObject(ossKey)
+	if err != nil {
+		return fmt.Errorf("read %s err=%s", ossKey, err.Error())
+	}
+	defer reader.Close()
+	// image already compressed, store only
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, reader)
+	return err
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseArchiveTaskIds(t *testing.T) {
+	taskIds, err := parseArchiveTaskIds([]string{" a ", "b", "", "a", "c"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, taskIds)
+
+	_, err = parseArchiveTaskIds([]string{"", " "})
+	assert.NotNil(t, err)
+
+	many := make([]string, 0, maxArchiveTasks+1)
+	for i := 0; i <= maxArchiveTasks; i++ {
+		many = append(many, fmt.Sprintf("task%d", i))
+	}
+	_, err = parseArchiveTaskIds(many)
+	assert.NotNil(t, err)
+	_, err = parseArchiveTaskIds(append(many[:maxArchiveTasks], many[0]))
+	assert.Nil(t, err)
+}
+
+func TestArchive(t *testing.T) {
+	taskStore := newTestTaskStore(t)
+	config.ConfigGlobal.OssPath = filepath.Join(t.TempDir(), "oss")
+	module.OssGlobal = new(module.OssManagerLocal)
+	assert.Nil(t, taskStore.Update("done", map[string]interface{}{
+		datastore.KTaskCode:       int64(requestOk),
+		datastore.KTaskParams:     `{"prompt":"a cat","steps":20}`,
+		datastore.KTaskInfo:       `{"seed":123}`,
+		datastore.KTaskCreateTime: "1700000000",
+	}))
+	assert.Nil(t, taskStore.Put("fail", map[string]interface{}{
+		datastore.KTaskIdColumnName: "fail",
+		datastore.KTaskUser:         "admin",
+		datastore.KTaskStatus:       config.TASK_FINISH,
+		datastore.KTaskCode:         int64(requestFail),
+	}))
+
+	// not owner, not finished, failed, not exist
+	for _, taskId := range []string{"running", "fail", "missing"} {
+		_, err := getArchiveTask(taskStore, "admin", taskId)
+		assert.NotNil(t, err, taskId)
+	}
+	_, err := getArchiveTask(taskStore, "other", "done")
+	assert.NotNil(t, err)
+
+	task, err := getArchiveTask(taskStore, "admin", "done")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"done_0.png", "done_1.png"}, task.Images)
+	assert.Equal(t, "a cat", task.Parameters["prompt"])
+	assert.Equal(t, "1700000000", task.CreateTime)
+
+	// image missing in oss
+	var buf bytes.Buffer
+	assert.NotNil(t, writeArchive(&buf, []*archiveTask{task}))
+
+	assert.Nil(t, module.OssGlobal.UploadFileByByte("images/admin/done_0.png", []byte("image0")))
+	assert.Nil(t, module.OssGlobal.UploadFileByByte("images/admin/done_1.png", []byte("image1")))
+	buf.Reset()
+	assert.Nil(t, writeArchive(&buf, []*archiveTask{task}))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	files := make(map[string][]byte)
+	for _, file := range zr.File {
+		reader, err := file.Open()
+		assert.Nil(t, err)
+		body, err := io.ReadAll(reader)
+		reader.Close()
+		assert.Nil(t, err)
+		files[file.Name] = body
+	}
+	assert.Equal(t, 3, len(files))
+	assert.Equal(t, []byte("image0"), files["done_0.png"])
+	assert.Equal(t, []byte("image1"), files["done_1.png"])
+	sidecar := new(archiveTask)
+	assert.Nil(t, json.Unmarshal(files["done.json"], sidecar))
+	assert.Equal(t, "done", sidecar.TaskId)
+	assert.Equal(t, task.Images, sidecar.Images)
+	assert.Equal(t, float64(123), sidecar.Info["seed"])
+}
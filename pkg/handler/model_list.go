@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/models"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+const (
+	maxModelListLimit = 1000
+	// modelListBatch rows read from db each time
+	modelListBatch = 200
+	// nextCursorHeader cursor of next page
+	nextCursorHeader = "Next-Cursor"
+)
+
+var (
+	errModelCursor = errors.New("cursor not valid")
+	errModelRead   = errors.New("read model from db error")
+)
+
+// modelCursor sort key, name and type of last model in page, name not unique across types in disk mode
+type modelCursor struct {
+	Key  string `json:"k"`
+	Name string `json:"n"`
+	Type string `json:"t"`
+}
+
+// modelSortKey comparable string of sort field, time field left pad to compare as number
+func modelSortKey(model *models.ModelAttributes, field string) (string, error) {
+	switch field {
+	case "name":
+		return model.Name, nil
+	case "type":
+		return model.Type, nil
+	case "status":
+		return model.Status, nil
+	case "registeredTime":
+		return padTime(model.RegisteredTime), nil
+	case "lastModificationTime":
+		return padTime(model.LastModificationTime), nil
+	default:
+		return "", fmt.Errorf("sort field %s not support", field)
+	}
+}
+
+func padTime(t *string) string {
+	if t == nil {
+		return fmt.Sprintf("%020s", "")
+	}
+	return fmt.Sprintf("%020s", *t)
+}
+
+// listModelPage filter, sort by field then name, keyset paginate after cursor,
+// return page and cursor of next page, "" if last page
+func listModelPage(list []*models.ModelAttributes, params *models.ListModelsParams) ([]*models.ModelAttributes,
+	string, error) {
+	field, desc := "name", false
+	if params.Sort != nil && *params.Sort != "" {
+		field, desc = strings.TrimPrefix(*params.Sort, "-"), strings.HasPrefix(*params.Sort, "-")
+	}
+	type item struct {
+		key   string
+		model *models.ModelAttributes
+	}
+	items := make([]item, 0, len(list))
+	for _, model := range list {
+		if !matchModel(model, params) {
+			continue
+		}
+		key, err := modelSortKey(model, field)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, item{key: key, model: model})
+	}
+	// less in sort order of (key, name, type)
+	less := func(cursor *modelCursor, model *models.ModelAttributes, key string) bool {
+		a, b := cursor.Key, key
+		if a == b {
+			a, b = cursor.Name, model.Name
+		}
+		if a == b {
+			a, b = cursor.Type, model.Type
+		}
+		if desc {
+			return a > b
+		}
+		return a < b
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return less(&modelCursor{Key: items[i].key, Name: items[i].model.Name, Type: items[i].model.Type},
+			items[j].model, items[j].key)
+	})
+	if params.Cursor != nil && *params.Cursor != "" {
+		cursor, err := decodeModelCursor(*params.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		idx := sort.Search(len(items), func(i int) bool {
+			return less(cursor, items[i].model, items[i].key)
+		})
+		items = items[idx:]
+	}
+	limit := modelPageLimit(params)
+	next := ""
+	if limit > 0 && limit < len(items) {
+		last := items[limit-1]
+		next = encodeModelCursor(&modelCursor{Key: last.key, Name: last.model.Name, Type: last.model.Type})
+		items = items[:limit]
+	}
+	ret := make([]*models.ModelAttributes, 0, len(items))
+	for _, one := range items {
+		ret = append(ret, one.model)
+	}
+	return ret, next, nil
+}
+
+// listModelDb list models visible to user from db, sort by name read by primary key range
+// from cursor until page is full instead of reading the whole table
+func listModelDb(store datastore.Datastore, user string, params *models.ListModelsParams) ([]*models.ModelAttributes,
+	string, error) {
+	visible := func(data map[string]interface{}) bool {
+		return module.ParseModelAcl(data).CanUse(user)
+	}
+	if params.Sort != nil && *params.Sort != "" && *params.Sort != "name" {
+		// other sort field need all rows
+		var list []*models.ModelAttributes
+		if err := scanModels(store, "", func(data map[string]interface{}) bool {
+			if visible(data) {
+				list = append(list, convertToModelResponse(map[string]map[string]interface{}{"": data})...)
+			}
+			return true
+		}); err != nil {
+			return nil, "", err
+		}
+		return listModelPage(list, params)
+	}
+	start, prefix := "", ""
+	if params.Prefix != nil {
+		start, prefix = *params.Prefix, *params.Prefix
+	}
+	if params.Cursor != nil && *params.Cursor != "" {
+		cursor, err := decodeModelCursor(*params.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		// smallest name after cursor
+		if after := cursor.Name + "\x00"; after > start {
+			start = after
+		}
+	}
+	limit := modelPageLimit(params)
+	ret := make([]*models.ModelAttributes, 0)
+	if err := scanModels(store, start, func(data map[string]interface{}) bool {
+		model := convertToModelResponse(map[string]map[string]interface{}{"": data})[0]
+		if !strings.HasPrefix(model.Name, prefix) {
+			return false
+		}
+		if visible(data) && matchModel(model, params) {
+			ret = append(ret, model)
+		}
+		// read one more to know whether next page exist
+		return limit <= 0 || len(ret) <= limit
+	}); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if limit > 0 && limit < len(ret) {
+		ret = ret[:limit]
+		last := ret[limit-1]
+		next = encodeModelCursor(&modelCursor{Key: last.Name, Name: last.Name, Type: last.Type})
+	}
+	return ret, next, nil
+}
+
+// scanModels read models in name order from start batch by batch, stop when fn return false
+func scanModels(store datastore.Datastore, start string, fn func(data map[string]interface{}) bool) error {
+	for {
+		keys, rows, err := store.ListRange(start, modelListBatch, modelColumns)
+		if err != nil {
+			logrus.Errorf("list model from %s err=%s", start, err.Error())
+			return errModelRead
+		}
+		for _, key := range keys {
+			if !fn(rows[key]) {
+				return nil
+			}
+		}
+		if len(keys) < modelListBatch {
+			return nil
+		}
+		start = keys[len(keys)-1] + "\x00"
+	}
+}
+
+// modelPageLimit page size of request, 0 means no limit
+func modelPageLimit(params *models.ListModelsParams) int {
+	if params.Limit == nil || *params.Limit <= 0 {
+		return 0
+	}
+	if *params.Limit > maxModelListLimit {
+		return maxModelListLimit
+	}
+	return *params.Limit
+}
+
+func matchModel(model *models.ModelAttributes, params *models.ListModelsParams) bool {
+	if params.Type != nil && *params.Type != "" && model.Type != *params.Type {
+		return false
+	}
+	if params.Status != nil && *params.Status != "" && model.Status != *params.Status {
+		return false
+	}
+	if params.Prefix != nil && !strings.HasPrefix(model.Name, *params.Prefix) {
+		return false
+	}
+	if params.Search != nil && !strings.Contains(strings.ToLower(model.Name), strings.ToLower(*params.Search)) {
+		return false
+	}
+	return true
+}
+
+func encodeModelCursor(cursor *modelCursor) string {
+	body, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(body)
+}
+
+func decodeModelCursor(s string) (*modelCursor, error) {
+	body, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errModelCursor
+	}
+	cursor := new(modelCursor)
+	if err := json.Unmarshal(body, cursor); err != nil {
+		return nil, errModelCursor
+	}
+	return cursor, nil
+}
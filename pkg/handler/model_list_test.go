@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func newTestModel(name, modelType, status, registeredTime string) *models.ModelAttributes {
+	return &models.ModelAttributes{Name: name, Type: modelType, Status: status,
+		RegisteredTime: &registeredTime, LastModificationTime: &registeredTime}
+}
+
+func modelKeys(list []*models.ModelAttributes) []string {
+	ret := make([]string, 0, len(list))
+	for _, model := range list {
+		ret = append(ret, model.Type+"/"+model.Name)
+	}
+	return ret
+}
+
+// listAllPages follow cursor until last page
+func listAllPages(t *testing.T, params models.ListModelsParams,
+	list func(params *models.ListModelsParams) ([]*models.ModelAttributes, string, error)) []string {
+	var ret []string
+	for i := 0; i < 100; i++ {
+		page, next, err := list(&params)
+		assert.Nil(t, err)
+		ret = append(ret, modelKeys(page)...)
+		if next == "" {
+			return ret
+		}
+		params.Cursor = &next
+	}
+	t.Fatal("cursor not end")
+	return nil
+}
+
+func TestListModelPage(t *testing.T) {
+	list := []*models.ModelAttributes{
+		newTestModel("b.safetensors", "sdModel", "loaded", "1700000003"),
+		newTestModel("a.safetensors", "sdModel", "loaded", "1700000002"),
+		newTestModel("a.safetensors", "lora", "failed", "1700000001"),
+		newTestModel("Anime.pt", "sdVae", "loaded", "999999999"),
+		newTestModel("c.safetensors", "lora", "loaded", "1700000004"),
+	}
+	str := func(s string) *string { return &s }
+	cases := []struct {
+		name   string
+		params models.ListModelsParams
+		expect []string
+	}{
+		{"default sort by name then type", models.ListModelsParams{},
+			[]string{"sdVae/Anime.pt", "lora/a.safetensors", "sdModel/a.safetensors", "sdModel/b.safetensors",
+				"lora/c.safetensors"}},
+		{"desc", models.ListModelsParams{Sort: str("-name")},
+			[]string{"lora/c.safetensors", "sdModel/b.safetensors", "sdModel/a.safetensors", "lora/a.safetensors",
+				"sdVae/Anime.pt"}},
+		{"time compare as number", models.ListModelsParams{Sort: str("registeredTime")},
+			[]string{"sdVae/Anime.pt", "lora/a.safetensors", "sdModel/a.safetensors", "sdModel/b.safetensors",
+				"lora/c.safetensors"}},
+		{"type", models.ListModelsParams{Type: str("lora")},
+			[]string{"lora/a.safetensors", "lora/c.safetensors"}},
+		{"status", models.ListModelsParams{Status: str("failed")}, []string{"lora/a.safetensors"}},
+		{"prefix", models.ListModelsParams{Prefix: str("a")},
+			[]string{"lora/a.safetensors", "sdModel/a.safetensors"}},
+		{"search ignore case", models.ListModelsParams{Search: str("ANI")}, []string{"sdVae/Anime.pt"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			page, next, err := listModelPage(list, &tc.params)
+			assert.Nil(t, err)
+			assert.Equal(t, "", next)
+			assert.Equal(t, tc.expect, modelKeys(page))
+			// same name of different types not skipped across pages
+			for _, limit := range []int{1, 2, 3} {
+				params := tc.params
+				params.Limit = &limit
+				assert.Equal(t, tc.expect, listAllPages(t, params,
+					func(params *models.ListModelsParams) ([]*models.ModelAttributes, string, error) {
+						return listModelPage(list, params)
+					}), "limit %d", limit)
+			}
+		})
+	}
+
+	_, _, err := listModelPage(list, &models.ListModelsParams{Sort: str("etag")})
+	assert.NotNil(t, err)
+	_, _, err = listModelPage(list, &models.ListModelsParams{Cursor: str("not cursor")})
+	assert.Equal(t, errModelCursor, err)
+}
+
+func TestListModelDb(t *testing.T) {
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		DbSqlite: filepath.Join(t.TempDir(), "sqlite3"),
+	}}
+	store := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer store.Close()
+	put := func(name, modelType, owner, visibility string) {
+		assert.Nil(t, store.Put(name, map[string]interface{}{
+			datastore.KModelName:       name,
+			datastore.KModelType:       modelType,
+			datastore.KModelOssPath:    "",
+			datastore.KModelEtag:       "",
+			datastore.KModelStatus:     config.MODEL_LOADED,
+			datastore.KModelCreateTime: "1700000000",
+			datastore.KModelModifyTime: "1700000000",
+			datastore.KModelOwner:      owner,
+			datastore.KModelVisibility: visibility,
+		}))
+	}
+	// more rows than one batch
+	var all []string
+	for i := 0; i < modelListBatch+50; i++ {
+		name := fmt.Sprintf("m%04d.safetensors", i)
+		if i%3 == 0 {
+			put(name, "lora", "", config.MODEL_PUBLIC)
+			all = append(all, "lora/"+name)
+		} else {
+			put(name, "sdModel", "", config.MODEL_PUBLIC)
+			all = append(all, "sdModel/"+name)
+		}
+	}
+	put("x.safetensors", "sdModel", "alice", config.MODEL_PRIVATE)
+	list := func(user string) func(params *models.ListModelsParams) ([]*models.ModelAttributes, string, error) {
+		return func(params *models.ListModelsParams) ([]*models.ModelAttributes, string, error) {
+			return listModelDb(store, user, params)
+		}
+	}
+	str := func(s string) *string { return &s }
+	limit := 7
+
+	assert.Equal(t, all, listAllPages(t, models.ListModelsParams{Limit: &limit}, list("bob")))
+	assert.Equal(t, append(all, "sdModel/x.safetensors"),
+		listAllPages(t, models.ListModelsParams{Limit: &limit}, list("alice")))
+	ret := listAllPages(t, models.ListModelsParams{Limit: &limit, Type: str("lora"), Prefix: str("m01")}, list("bob"))
+	assert.Equal(t, []string{"lora/m0102.safetensors", "lora/m0105.safetensors", "lora/m0108.safetensors"},
+		ret[:3])
+	assert.Equal(t, 33, len(ret))
+	// other sort field fallback to sort all rows
+	page, next, err := listModelDb(store, "alice", &models.ListModelsParams{Limit: &limit, Sort: str("-name")})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", next)
+	assert.Equal(t, "sdModel/x.safetensors", modelKeys(page)[0])
+	_, _, err = listModelDb(store, "alice", &models.ListModelsParams{Cursor: str("not cursor")})
+	assert.Equal(t, errModelCursor, err)
+}
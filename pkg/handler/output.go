@@ -0,0 +1,354 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/models"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var (
+	watermarkImageOnce sync.Once
+	watermarkImage     image.Image
+)
+
+// userConfig user config, json store in user table USER_CONFIG column
+type userConfig struct {
+	OutputOptions *models.OutputOptions `json:"output_options,omitempty"`
+}
+
+func getUserConfig(userStore datastore.Datastore, user string) (*userConfig, error) {
+	data, err := userStore.Get(user, []string{datastore.KUserConfig})
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(userConfig)
+	if val, ok := data[datastore.KUserConfig]; ok && val.(string) != "" {
+		if err := json.Unmarshal([]byte(val.(string)), cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func putUserConfig(userStore datastore.Datastore, user string, cfg *userConfig) error {
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	data, err := userStore.Get(user, []string{datastore.KUserName})
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return userStore.Put(user, map[string]interface{}{
+			datastore.KUserName:       user,
+			datastore.KUserConfig:     string(body),
+			datastore.KUserCreateTime: fmt.Sprintf("%d", utils.TimestampS()),
+			datastore.KUserModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+		})
+	}
+	return userStore.Update(user, map[string]interface{}{
+		datastore.KUserConfig:     string(body),
+		datastore.KUserModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+	})
+}
+
+// checkOutputOptions format: png|jpeg|webp, quality: 1-100
+func checkOutputOptions(format *string, quality *int64) error {
+	if format != nil && *format != "" && utils.NormalizeImageFormat(*format) == "" {
+		return fmt.Errorf("output_format %s not support, support: png|jpeg|webp", *format)
+	}
+	if quality != nil && (*quality < 1 || *quality > 100) {
+		return fmt.Errorf("output_quality %d out of range [1, 100]", *quality)
+	}
+	return nil
+}
+
+// mergeOutputOptions request output options not set use user default
+func mergeOutputOptions(format **string, quality **int64, strip **bool, defaults *models.OutputOptions) {
+	if defaults == nil {
+		return
+	}
+	if *format == nil {
+		*format = defaults.OutputFormat
+	}
+	if *quality == nil {
+		*quality = defaults.OutputQuality
+	}
+	if *strip == nil {
+		*strip = defaults.StripMetadata
+	}
+}
+
+// fillUserOutputOptions fill request output options with user default, read db fail ignore
+func fillUserOutputOptions(userStore datastore.Datastore, user string, format **string, quality **int64,
+	strip **bool) {
+	cfg, err := getUserConfig(userStore, user)
+	if err != nil {
+		logrus.Warnf("get user %s output options err=%s", user, err.Error())
+		return
+	}
+	mergeOutputOptions(format, quality, strip, cfg.OutputOptions)
+}
+
+// newImageOutputOption request output options, not set use config default
+func newImageOutputOption(format *string, quality *int64, strip *bool) *utils.ImageOutputOption {
+	opt := &utils.ImageOutputOption{
+		Format:  config.ConfigGlobal.OutputFormat,
+		Quality: int(config.ConfigGlobal.OutputQuality),
+	}
+	if format != nil && *format != "" {
+		opt.Format = *format
+	}
+	if quality != nil {
+		opt.Quality = int(*quality)
+	}
+	if strip != nil {
+		opt.StripMetadata = *strip
+	}
+	return opt
+}
+
+// decodeOutputImage decode sd output image and apply watermark
+func decodeOutputImage(user, taskId string, imageBody *string) ([]byte, error) {
+	decode, err := base64.StdEncoding.DecodeString(*imageBody)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode err=%s", err.Error())
+	}
+	if !config.ConfigGlobal.EnableVisibleWatermark() && !config.ConfigGlobal.EnableInvisibleWatermark() {
+		return decode, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(decode))
+	if err != nil {
+		return nil, fmt.Errorf("decode image err=%s", err.Error())
+	}
+	if config.ConfigGlobal.EnableVisibleWatermark() {
+		img = utils.DrawVisibleWatermark(img, &utils.VisibleWatermark{
+			Text:     config.ConfigGlobal.WatermarkText,
+			Image:    loadWatermarkImage(),
+			Position: config.ConfigGlobal.WatermarkPosition,
+			Opacity:  config.ConfigGlobal.WatermarkOpacity,
+			Scale:    config.ConfigGlobal.WatermarkScale,
+		})
+	}
+	if config.ConfigGlobal.EnableInvisibleWatermark() {
+		marked, err := utils.EmbedInvisibleWatermark(img, watermarkPayload(user, taskId),
+			config.ConfigGlobal.InvisibleWatermarkStrength)
+		if err != nil {
+			return nil, fmt.Errorf("invisible watermark err=%s", err.Error())
+		}
+		img = marked
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadWatermarkImage watermark image from local file or oss, load once
+func loadWatermarkImage() image.Image {
+	watermarkImageOnce.Do(func() {
+		path := config.ConfigGlobal.WatermarkImage
+		if path == "" {
+			return
+		}
+		var body []byte
+		var err error
+		if utils.FileExists(path) {
+			body, err = ioutil.ReadFile(path)
+		} else {
+			var imageBase64 *string
+			if imageBase64, err = module.OssGlobal.DownloadFileToBase64(path); err == nil {
+				body, err = base64.StdEncoding.DecodeString(*imageBase64)
+			}
+		}
+		if err != nil {
+			logrus.Errorf("load watermark image %s err=%s", path, err.Error())
+			return
+		}
+		if watermarkImage, _, err = image.Decode(bytes.NewReader(body)); err != nil {
+			logrus.Errorf("decode watermark image %s err=%s", path, err.Error())
+		}
+	})
+	return watermarkImage
+}
+
+// watermarkPayload invisible watermark payload: {user}|{taskId}
+func watermarkPayload(user, taskId string) []byte {
+	maxUserLen := utils.MaxWatermarkPayload - len(taskId) - 1
+	if maxUserLen < 0 {
+		maxUserLen = 0
+	}
+	if len(user) > maxUserLen {
+		user = user[:maxUserLen]
+	}
+	payload := fmt.Sprintf("%s|%s", user, taskId)
+	if len(payload) > utils.MaxWatermarkPayload {
+		payload = payload[:utils.MaxWatermarkPayload]
+	}
+	return []byte(payload)
+}
+
+func parseWatermarkPayload(payload string) (string, string) {
+	idx := strings.LastIndex(payload, "|")
+	if idx < 0 {
+		return "", payload
+	}
+	return payload[:idx], payload[idx+1:]
+}
+
+// uploadOutputImage convert image to output format, embed infotext and upload, ossKey = {ossKeyPrefix}.{ext}
+func uploadOutputImage(ossKeyPrefix string, decode []byte, infotext string,
+	opt *utils.ImageOutputOption) (string, error) {
+	// not fallback to other format, client expect the requested ext
+	body, ext, err := utils.ConvertImage(decode, opt)
+	if err != nil {
+		return "", fmt.Errorf("convert image to %s err=%s", opt.Format, err.Error())
+	}
+	// write generation params to image metadata
+	if !opt.StripMetadata && infotext != "" {
+		if embedded, err := utils.EmbedInfotext(body, infotext); err == nil {
+			body = embedded
+		} else {
+			logrus.Warnf("embed infotext err=%s", err.Error())
+		}
+	}
+	ossKey := fmt.Sprintf("%s.%s", ossKeyPrefix, ext)
+	return ossKey, module.UploadWithRetryQueue(ossKey, body)
+}
+
+// uploadThumbnails upload thumbnails of output image, ossKey = {ossKeyPrefix}_thumb_{size}.{ext}
+// thumbnail fail not affect task, return size => ossKey, ossKey = "" if fail
+func uploadThumbnails(ossKeyPrefix string, decode []byte, opt *utils.ImageOutputOption) map[string]string {
+	thumbnails := make(map[string]string)
+	for _, size := range config.ConfigGlobal.ThumbnailSizes {
+		thumbnails[fmt.Sprintf("%d", size)] = ""
+		body, ext, err := utils.Thumbnail(decode, size, opt)
+		if err != nil {
+			logrus.Warnf("generate thumbnail %d err=%s", size, err.Error())
+			continue
+		}
+		ossKey := fmt.Sprintf("%s_thumb_%d.%s", ossKeyPrefix, size, ext)
+		if err := module.UploadWithRetryQueue(ossKey, body); err != nil {
+			logrus.Warnf("upload thumbnail %s err=%s", ossKey, err.Error())
+			continue
+		}
+		thumbnails[fmt.Sprintf("%d", size)] = ossKey
+	}
+	return thumbnails
+}
+
+// appendThumbnails append one image thumbnails to task thumbnails, size => ossKey of each image by index
+func appendThumbnails(all map[string][]string, thumbnails map[string]string) {
+	for size, ossKey := range thumbnails {
+		all[size] = append(all[size], ossKey)
+	}
+}
+
+func thumbnailsToString(thumbnails map[string][]string) string {
+	body, err := json.Marshal(thumbnails)
+	if err != nil {
+		return "{}"
+	}
+	return string(body)
+}
+
+// signThumbnails thumbnails ossKey to url, fail thumbnail keep ""
+func signThumbnails(thumbnails map[string][]string) map[string][]string {
+	thumbnailUrl := make(map[string][]string, len(thumbnails))
+	for size, ossKeys := range thumbnails {
+		urls := make([]string, len(ossKeys))
+		for i, ossKey := range ossKeys {
+			if ossKey == "" {
+				continue
+			}
+			if url, err := module.OssGlobal.GetUrl([]string{ossKey}); err == nil && len(url) > 0 {
+				urls[i] = url[0]
+			} else {
+				logrus.Warn("get thumbnail oss url error")
+			}
+		}
+		thumbnailUrl[size] = urls
+	}
+	return thumbnailUrl
+}
+
+// sdPredictInfo fields of sd predict info used by contact sheet
+type sdPredictInfo struct {
+	AllPrompts        []string `json:"all_prompts"`
+	AllSeeds          []int64  `json:"all_seeds"`
+	IndexOfFirstImage int      `json:"index_of_first_image"`
+}
+
+// contactSheetItem output image with seed/prompt caption, image index from 0
+// webui grid image (index < index_of_first_image) not included
+func contactSheetItem(info *sdPredictInfo, infotexts []string, index int, body []byte) *utils.ContactSheetItem {
+	if index < info.IndexOfFirstImage {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		logrus.Warnf("contact sheet decode image %d err=%s", index, err.Error())
+		return nil
+	}
+	var seed, prompt string
+	if idx := index - info.IndexOfFirstImage; idx < len(info.AllSeeds) {
+		seed = fmt.Sprintf("%d", info.AllSeeds[idx])
+		if idx < len(info.AllPrompts) {
+			prompt = info.AllPrompts[idx]
+		}
+	} else if index < len(infotexts) {
+		var params map[string]string
+		prompt, _, params = utils.ParseInfotext(infotexts[index])
+		seed = params["Seed"]
+	}
+	return &utils.ContactSheetItem{
+		Image:    img,
+		Captions: []string{fmt.Sprintf("#%d seed: %s", index-info.IndexOfFirstImage+1, seed), prompt},
+	}
+}
+
+// uploadContactSheet compose output images grid, ossKey = {ossKeyPrefix}.{ext}
+// contact sheet fail not affect task, return "" if fail
+func uploadContactSheet(ossKeyPrefix string, items []*utils.ContactSheetItem, opt *utils.ImageOutputOption) string {
+	if len(items) == 0 {
+		return ""
+	}
+	sheet := utils.ContactSheet(items)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, sheet); err != nil {
+		logrus.Warnf("encode contact sheet err=%s", err.Error())
+		return ""
+	}
+	ossKey, err := uploadOutputImage(ossKeyPrefix, buf.Bytes(), "", opt)
+	if err != nil {
+		logrus.Warnf("upload contact sheet err=%s", err.Error())
+		return ""
+	}
+	return ossKey
+}
+
+// parseInfotexts get infotext of each image from sd predict info
+func parseInfotexts(info string) []string {
+	var m struct {
+		Infotexts []string `json:"infotexts"`
+	}
+	if err := json.Unmarshal([]byte(info), &m); err != nil {
+		return nil
+	}
+	return m.Infotexts
+}
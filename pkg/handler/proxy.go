@@ -3,6 +3,7 @@ package handler
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,16 +16,27 @@ import (
 	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
 const DEFAULT_USER = "default"
 
+// modelColumns model info columns of response
+var modelColumns = []string{datastore.KModelType, datastore.KModelName, datastore.KModelOssPath,
+	datastore.KModelUrl, datastore.KModelEtag, datastore.KModelStatus, datastore.KModelCreateTime, datastore.KModelModifyTime,
+	datastore.KModelProgress, datastore.KModelMessage, datastore.KModelSha256, datastore.KModelShortHash,
+	datastore.KModelInfo, datastore.KModelVersions, datastore.KModelAliases, datastore.KModelLastUsed,
+	datastore.KModelUseCount, datastore.KModelOwner, datastore.KModelVisibility, datastore.KModelSharedWith}
+
 type ProxyHandler struct {
 	userStore     datastore.Datastore
 	taskStore     datastore.Datastore
@@ -180,37 +192,71 @@ func (p *ProxyHandler) GetTaskResult(c *gin.Context, taskId string) {
 	c.JSON(http.StatusOK, result)
 }
 
-// ListModels list model
+// GetTaskArchive download zip of task outputs
+// (GET /tasks/{taskId}/archive)
+func (p *ProxyHandler) GetTaskArchive(c *gin.Context, taskId string) {
+	p.taskArchive(c, taskId, []string{taskId})
+}
+
+// ArchiveTasks download zip of multi tasks outputs
+// (POST /tasks/archive)
+func (p *ProxyHandler) ArchiveTasks(c *gin.Context) {
+	request := new(models.ArchiveTasksJSONRequestBody)
+	if err := getBindResult(c, request); err != nil {
+		handleError(c, http.StatusBadRequest, config.BADREQUEST)
+		return
+	}
+	taskIds, err := parseArchiveTaskIds(request.TaskIds)
+	if err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.taskArchive(c, fmt.Sprintf("tasks_%d", utils.TimestampS()), taskIds)
+}
+
+// ListModels list model, filter/sort/paginate by query params
 // (GET /models)
-func (p *ProxyHandler) ListModels(c *gin.Context) {
+func (p *ProxyHandler) ListModels(c *gin.Context, params models.ListModelsParams) {
+	var list []*models.ModelAttributes
 	if config.ConfigGlobal.UseLocalModel() {
-		// get from local disk
-		ret := make([]*models.ModelAttributes, 0)
-		// sdModel
-		path := fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "Stable-diffusion")
-		ret = append(ret, listModelFile(path, config.SD_MODEL)...)
-		// sdVae
-		path = fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "VAE")
-		ret = append(ret, listModelFile(path, config.SD_VAE)...)
-		// lora
-		path = fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "Lora")
-		ret = append(ret, listModelFile(path, config.LORA_MODEL)...)
-		// controlNet
-		path = fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "ControlNet")
-		ret = append(ret, listModelFile(path, config.CONTORLNET_MODEL)...)
-		c.JSON(http.StatusOK, ret)
+		// get from local disk, types share dir listed once, only scan dir of type if filtered
+		var modelTypes []string
+		if params.Type != nil && *params.Type != "" {
+			modelTypes = []string{*params.Type}
+		}
+		for _, file := range module.ListModelFiles(modelTypes...) {
+			list = append(list, &models.ModelAttributes{
+				Type:   file.Type,
+				Name:   file.Name,
+				Status: config.MODEL_LOADED,
+			})
+		}
 	} else {
-		// get from db
-		val, err := p.modelStore.ListAll([]string{datastore.KModelType, datastore.KModelName,
-			datastore.KModelOssPath, datastore.KModelEtag, datastore.KModelStatus, datastore.KModelCreateTime,
-			datastore.KModelModifyTime})
-		if err != nil {
-			handleError(c, http.StatusInternalServerError, "read model from db error")
+		// get from db, only models visible to user
+		ret, next, err := listModelDb(p.modelStore, requestUser(c), &params)
+		if err == errModelRead {
+			handleError(c, http.StatusInternalServerError, err.Error())
+			return
+		} else if err != nil {
+			handleError(c, http.StatusBadRequest, err.Error())
 			return
 		}
-		c.JSON(http.StatusOK, convertToModelResponse(val))
+		writeModelPage(c, ret, next)
+		return
 	}
+	ret, next, err := listModelPage(list, &params)
+	if err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeModelPage(c, ret, next)
+}
 
+func writeModelPage(c *gin.Context, ret []*models.ModelAttributes, next string) {
+	if next != "" {
+		c.Header(nextCursorHeader, next)
+	}
+	c.JSON(http.StatusOK, ret)
 }
 
 // RegisterModel upload model
@@ -225,52 +271,124 @@ func (p *ProxyHandler) RegisterModel(c *gin.Context) {
 		handleError(c, http.StatusBadRequest, config.BADREQUEST)
 		return
 	}
+	register, err := newModelRegister((*models.ModelAttributes)(request))
+	if err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	user := requestUser(c)
+	if register.Acl, err = newModelAcl(user, request.Visibility, request.SharedWith); err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
 	// check models exist or not
 	data, err := p.modelStore.Get(request.Name, []string{datastore.KModelName,
-		datastore.KModelEtag, datastore.KModelOssPath, datastore.KModelStatus})
+		datastore.KModelEtag, datastore.KModelOssPath, datastore.KModelUrl, datastore.KModelStatus,
+		datastore.KModelOwner, datastore.KModelVisibility})
 	if err != nil {
 		handleError(c, http.StatusInternalServerError, "read models db error")
 		return
 	}
-
-	// models existed
-	if data != nil && len(data) != 0 && data[datastore.KModelStatus].(string) != config.MODEL_DELETE && data[datastore.KModelEtag].(string) == request.Etag &&
-		data[datastore.KModelOssPath].(string) == request.OssPath {
-		c.JSON(http.StatusOK, gin.H{"message": "models existed"})
+	// name of other user model not overwrite
+	if len(data) != 0 && data[datastore.KModelStatus] != config.MODEL_DELETE &&
+		!module.ParseModelAcl(data).CanManage(user) {
+		handleError(c, http.StatusConflict, "model name registered by other user")
 		return
 	}
-	// from oss download model to local
-	localFile, err := downloadModelsFromOss(request.Type, request.OssPath, request.Name)
-	if err != nil {
-		handleError(c, http.StatusInternalServerError, fmt.Sprintf("please check oss model valid, "+
-			"err=%s", err.Error()))
+	// file on disk not registered or of other user not overwrite
+	if localFile, _ := module.ModelLocalPath(request.Type, request.Name); utils.FileExists(localFile) &&
+		!isAdmin(user) && (len(data) == 0 || module.ParseModelAcl(data).Owner != user) {
+		handleError(c, http.StatusConflict, "model file existed, only owner can register again")
 		return
 	}
 
-	// update db
-	data = map[string]interface{}{
-		datastore.KModelType:       request.Type,
-		datastore.KModelName:       request.Name,
-		datastore.KModelOssPath:    request.OssPath,
-		datastore.KModelEtag:       request.Etag,
-		datastore.KModelLocalPath:  localFile,
-		datastore.KModelStatus:     getModelsStatus(request.Type),
-		datastore.KModelCreateTime: fmt.Sprintf("%d", utils.TimestampS()),
-		datastore.KModelModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+	if data != nil && len(data) != 0 && isSameModelSource(data, register) {
+		switch data[datastore.KModelStatus].(string) {
+		case config.MODEL_REGISTERING, config.MODEL_LOADING, config.MODEL_DELETE, config.MODEL_FAILED:
+			// register again, running job of any instance coalesced by Register
+		default:
+			c.JSON(http.StatusOK, gin.H{"message": "models existed"})
+			return
+		}
+	}
+	// download in background, query progress by GET /models/{model_name}
+	if _, err := module.ModelManagerGlobal.Register(register); err != nil {
+		if errors.Is(err, module.ErrModelRegistering) {
+			handleError(c, http.StatusConflict, err.Error())
+		} else {
+			handleError(c, http.StatusInternalServerError, config.OTSPUTERROR)
+		}
+		return
+	}
+	p.modelRegistering(c, request.Name)
+}
+
+// newModelRegister model source: ossPath, url or huggingFace reference
+func newModelRegister(request *models.ModelAttributes) (*module.ModelRegister, error) {
+	if config.ConfigGlobal.GetModelType(request.Type) == nil {
+		return nil, fmt.Errorf("model type %s not support, support: %s", request.Type,
+			strings.Join(config.ConfigGlobal.ModelTypeNames(), ","))
+	}
+	if _, err := module.ModelLocalPath(request.Type, request.Name); err != nil {
+		return nil, err
+	}
+	register := &module.ModelRegister{
+		Type: request.Type,
+		Name: request.Name,
+		Etag: request.Etag,
+	}
+	if request.Sha256 != nil {
+		register.Sha256 = *request.Sha256
+	}
+	if request.AuthToken != nil {
+		register.Token = *request.AuthToken
+	}
+	rawUrl, hubRef := "", ""
+	if request.Url != nil {
+		rawUrl = *request.Url
+	}
+	if request.HuggingFace != nil {
+		hubRef = *request.HuggingFace
+	}
+	if err := register.SetSource(request.OssPath, rawUrl, hubRef); err != nil {
+		return nil, err
 	}
-	p.modelStore.Put(request.Name, data)
-	c.JSON(http.StatusOK, gin.H{"message": "register success"})
+	return register, nil
+}
+
+// isSameModelSource db model source and etag same as register
+func isSameModelSource(data map[string]interface{}, register *module.ModelRegister) bool {
+	etag, _ := data[datastore.KModelEtag].(string)
+	ossPath, _ := data[datastore.KModelOssPath].(string)
+	modelUrl, _ := data[datastore.KModelUrl].(string)
+	return etag == register.Etag && ossPath == register.OssPath && modelUrl == register.Url
+}
+
+// modelRegistering response 202 with current model status
+func (p *ProxyHandler) modelRegistering(c *gin.Context, modelName string) {
+	data, err := p.modelStore.Get(modelName, modelColumns)
+	if err != nil || len(data) == 0 {
+		handleError(c, http.StatusInternalServerError, "get model info from db error")
+		return
+	}
+	c.JSON(http.StatusAccepted, convertToModelResponse(map[string]map[string]interface{}{
+		modelName: data,
+	})[0])
 }
 
 // DeleteModel delete model
 // (DELETE /models/{model_name})
-func (p *ProxyHandler) DeleteModel(c *gin.Context, modelName string) {
+func (p *ProxyHandler) DeleteModel(c *gin.Context, modelName string, params models.DeleteModelParams) {
 	if config.ConfigGlobal.UseLocalModel() {
 		c.String(http.StatusNotFound, "useLocalModel=yes not support")
 		return
 	}
+	if !p.checkModelAcl(c, modelName, true) {
+		return
+	}
 	// get local file path
-	data, err := p.modelStore.Get(modelName, []string{datastore.KModelLocalPath, datastore.KModelStatus})
+	data, err := p.modelStore.Get(modelName, []string{datastore.KModelLocalPath, datastore.KModelStatus,
+		datastore.KModelType})
 	if err != nil {
 		handleError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -279,12 +397,53 @@ func (p *ProxyHandler) DeleteModel(c *gin.Context, modelName string) {
 		handleError(c, http.StatusInternalServerError, "model not exist")
 		return
 	}
+	versions, err := module.ModelManagerGlobal.Versions(modelName)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result := models.ModelDeleteResult{Files: make([]string, 0), Functions: make([]string, 0)}
+	// functions first, model kept for retry if fail
+	if params.DeleteFunction != nil && *params.DeleteFunction && versions != nil {
+		modelType, _ := data[datastore.KModelType].(string)
+		if keys := module.ModelFunctionKeys(modelName, modelType, versions); len(keys) != 0 {
+			deleted, fails, errs := module.FuncManagerGlobal.DeleteModelFunction(keys)
+			result.Functions = append(result.Functions, deleted...)
+			if len(fails) != 0 {
+				failFuncs := make([]map[string]interface{}, 0, len(fails))
+				for i := range fails {
+					failFuncs = append(failFuncs, map[string]interface{}{
+						"functionName": fails[i],
+						"err":          errs[i],
+					})
+				}
+				result.Message = "delete function fail, model not deleted"
+				result.Fails = &failFuncs
+				c.JSON(http.StatusInternalServerError, result)
+				return
+			}
+		}
+	}
 	localFile := data[datastore.KModelLocalPath].(string)
 	// delete nas models
 	if ok, err := utils.DeleteLocalFile(localFile); !ok {
 		handleError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	result.Files = append(result.Files, localFile)
+	// other versions
+	if versions != nil {
+		for _, ver := range versions.Versions {
+			if ver.LocalPath == "" || ver.LocalPath == localFile {
+				continue
+			}
+			if ok, err := utils.DeleteLocalFile(ver.LocalPath); !ok {
+				logrus.Warnf("delete model %s version %d err=%s", modelName, ver.Version, err.Error())
+			} else {
+				result.Files = append(result.Files, ver.LocalPath)
+			}
+		}
+	}
 	// model status set deleted
 	if err := p.modelStore.Update(modelName, map[string]interface{}{
 		datastore.KModelStatus:     config.MODEL_DELETE,
@@ -292,7 +451,8 @@ func (p *ProxyHandler) DeleteModel(c *gin.Context, modelName string) {
 	}); err != nil {
 		handleError(c, http.StatusInternalServerError, "update model status error")
 	} else {
-		c.JSON(http.StatusOK, gin.H{"message": "delete success"})
+		result.Message = "delete success"
+		c.JSON(http.StatusOK, result)
 	}
 }
 
@@ -303,14 +463,12 @@ func (p *ProxyHandler) GetModel(c *gin.Context, modelName string) {
 		c.String(http.StatusNotFound, "useLocalModel=yes not support")
 		return
 	}
-	data, err := p.modelStore.Get(modelName, []string{datastore.KModelType, datastore.KModelName,
-		datastore.KModelOssPath, datastore.KModelEtag, datastore.KModelStatus, datastore.KModelCreateTime,
-		datastore.KModelModifyTime})
+	data, err := p.modelStore.Get(modelName, modelColumns)
 	if err != nil {
 		handleError(c, http.StatusInternalServerError, "get model info from db error")
 		return
 	}
-	if data == nil || len(data) == 0 {
+	if data == nil || len(data) == 0 || !module.ParseModelAcl(data).CanUse(requestUser(c)) {
 		handleError(c, http.StatusNotFound, config.NOTFOUND)
 		return
 	}
@@ -332,9 +490,18 @@ func (p *ProxyHandler) UpdateModel(c *gin.Context, modelName string) {
 		handleError(c, http.StatusBadRequest, config.BADREQUEST)
 		return
 	}
+	register, err := newModelRegister((*models.ModelAttributes)(request))
+	if err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	register.Name = modelName
+	if !p.checkModelAcl(c, modelName, true) {
+		return
+	}
 	// check models exist or not
 	data, err := p.modelStore.Get(modelName, []string{datastore.KModelName,
-		datastore.KModelEtag, datastore.KModelOssPath, datastore.KModelStatus})
+		datastore.KModelEtag, datastore.KModelOssPath, datastore.KModelUrl, datastore.KModelStatus})
 	if err != nil {
 		handleError(c, http.StatusInternalServerError, "read models db error")
 		return
@@ -344,8 +511,7 @@ func (p *ProxyHandler) UpdateModel(c *gin.Context, modelName string) {
 		if data[datastore.KModelStatus].(string) == config.MODEL_DELETE {
 			handleError(c, http.StatusNotFound, "model not register, please register first")
 			return
-		} else if data[datastore.KModelEtag].(string) == request.Etag &&
-			data[datastore.KModelOssPath].(string) == request.OssPath {
+		} else if isSameModelSource(data, register) {
 			c.JSON(http.StatusOK, gin.H{"message": "models existed and not change"})
 			return
 		}
@@ -353,34 +519,388 @@ func (p *ProxyHandler) UpdateModel(c *gin.Context, modelName string) {
 		handleError(c, http.StatusNotFound, "model not register, please register first")
 		return
 	}
-	// from oss download nas
-	if _, err := downloadModelsFromOss(request.Type, request.OssPath, request.Name); err != nil {
-		handleError(c, http.StatusInternalServerError, fmt.Sprintf("please check oss model valid, "+
-			"err=%s", err.Error()))
+	// download as new version in background, old versions kept for rollback by moving alias,
+	// query progress by GET /models/{model_name}
+	version, started, err := module.ModelManagerGlobal.Update(register)
+	if err != nil {
+		switch {
+		case errors.Is(err, module.ErrModelRegistering):
+			handleError(c, http.StatusConflict, err.Error())
+		case errors.Is(err, module.ErrModelVersionNotFound):
+			handleError(c, http.StatusNotFound, "model not register, please register first")
+		default:
+			handleError(c, http.StatusInternalServerError, fmt.Sprintf("please check model source valid, "+
+				"err=%s", err.Error()))
+		}
+		return
+	}
+	if started {
+		c.JSON(http.StatusAccepted, gin.H{"message": fmt.Sprintf("model updating to version %d", version),
+			"version": version})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("model switch to version %d", version), "version": version})
+}
+
+// GetModelDrift drift between model files and db
+// (GET /models/drift)
+func (p *ProxyHandler) GetModelDrift(c *gin.Context) {
+	if !config.ConfigGlobal.HybridModel() || module.ModelReconcilerGlobal == nil {
+		c.String(http.StatusNotFound, "useLocalModel=hybrid only")
+		return
+	}
+	drift, err := module.ModelReconcilerGlobal.Drift()
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "read model from db error")
+		return
+	}
+	c.JSON(http.StatusOK, models.ModelDrift{
+		ScanTime:  drift.ScanTime,
+		Untracked: convertToDriftItems(drift.Untracked),
+		Missing:   convertToDriftItems(drift.Missing),
+		Restored:  convertToDriftItems(drift.Restored),
+	})
+}
+
+func convertToDriftItems(items []*module.ModelDriftItem) []models.ModelDriftItem {
+	ret := make([]models.ModelDriftItem, 0, len(items))
+	for _, item := range items {
+		one := models.ModelDriftItem{Name: item.Name, Type: item.Type, LocalPath: item.LocalPath}
+		if item.Status != "" {
+			one.Status = utils.String(item.Status)
+		}
+		if item.Message != "" {
+			one.Message = utils.String(item.Message)
+		}
+		ret = append(ret, one)
+	}
+	return ret
+}
+
+// GcModels delete models unused for days with their multiFunc functions, dry run by default
+// (POST /models/gc)
+func (p *ProxyHandler) GcModels(c *gin.Context) {
+	if config.ConfigGlobal.UseLocalModel() || module.ModelUsageGlobal == nil {
+		c.String(http.StatusNotFound, "useLocalModel=yes not support")
+		return
+	}
+	request := new(models.GcModelsJSONRequestBody)
+	if c.Request.ContentLength != 0 {
+		if err := getBindResult(c, request); err != nil {
+			handleError(c, http.StatusBadRequest, config.BADREQUEST)
+			return
+		}
+	}
+	policy := module.DefaultModelGcPolicy(request.DryRun == nil || *request.DryRun)
+	// tenant only collect own models
+	if user := requestUser(c); !isAdmin(user) {
+		policy.Owner = user
+	}
+	if request.Days != nil {
+		policy.Days = *request.Days
+	}
+	if request.Types != nil {
+		policy.Types = *request.Types
+	}
+	if request.Exclude != nil {
+		policy.Exclude = *request.Exclude
+	}
+	if policy.Days <= 0 {
+		handleError(c, http.StatusBadRequest, "days must be greater than 0")
 		return
 	}
-	// sdModel and sdVae enable env update
-	if request.Type == config.SD_MODEL || request.Type == config.SD_VAE {
-		if err := module.FuncManagerGlobal.UpdateFunctionEnv(request.Name); err != nil {
-			handleError(c, http.StatusInternalServerError, config.MODELUPDATEFCERROR)
+	for _, modelType := range policy.Types {
+		if config.ConfigGlobal.GetModelType(modelType) == nil {
+			handleError(c, http.StatusBadRequest, fmt.Sprintf("modeltype: %s not support", modelType))
 			return
 		}
 	}
+	report, err := module.ModelUsageGlobal.Collect(policy)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := models.ModelGcReport{
+		DryRun:     report.DryRun,
+		Before:     report.Before,
+		FreedBytes: report.FreedBytes,
+		Items:      make([]models.ModelGcItem, 0, len(report.Items)),
+	}
+	for _, item := range report.Items {
+		one := models.ModelGcItem{Name: item.Name, Type: item.Type, LastUsed: item.LastUsed,
+			UseCount: item.UseCount, Size: item.Size, Functions: item.Functions, Deleted: item.Deleted}
+		if item.Message != "" {
+			one.Message = utils.String(item.Message)
+		}
+		resp.Items = append(resp.Items, one)
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	// update db
-	data = map[string]interface{}{
-		datastore.KModelType:       request.Type,
-		datastore.KModelOssPath:    request.OssPath,
-		datastore.KModelEtag:       request.Etag,
-		datastore.KModelStatus:     getModelsStatus(request.Type),
-		datastore.KModelModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+// ListModelVersions list model versions and aliases
+// (GET /models/{model_name}/versions)
+func (p *ProxyHandler) ListModelVersions(c *gin.Context, modelName string) {
+	if config.ConfigGlobal.UseLocalModel() {
+		c.String(http.StatusNotFound, "useLocalModel=yes not support")
+		return
+	}
+	if !p.checkModelAcl(c, modelName, false) {
+		return
 	}
-	if err := p.modelStore.Update(modelName, data); err != nil {
-		handleError(c, http.StatusInternalServerError, config.NOTFOUND)
+	versions, err := module.ModelManagerGlobal.Versions(modelName)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "get model info from db error")
+		return
+	}
+	if versions == nil {
+		handleError(c, http.StatusNotFound, config.NOTFOUND)
+		return
+	}
+	ret := models.ModelVersionList{
+		Versions: make([]models.ModelVersion, 0, len(versions.Versions)),
+		Aliases:  versions.Aliases,
+	}
+	for _, ver := range versions.Versions {
+		item := models.ModelVersion{Version: ver.Version, CreateTime: ver.CreateTime}
+		if ver.OssPath != "" {
+			item.OssPath = utils.String(ver.OssPath)
+		}
+		if ver.Url != "" {
+			item.Url = utils.String(ver.Url)
+		}
+		if ver.Etag != "" {
+			item.Etag = utils.String(ver.Etag)
+		}
+		if ver.Sha256 != "" {
+			item.Sha256 = utils.String(ver.Sha256)
+		}
+		if ver.ShortHash != "" {
+			item.ShortHash = utils.String(ver.ShortHash)
+		}
+		ret.Versions = append(ret.Versions, item)
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+// SetModelAlias point alias to version
+// (PUT /models/{model_name}/aliases/{alias})
+func (p *ProxyHandler) SetModelAlias(c *gin.Context, modelName string, alias string) {
+	if config.ConfigGlobal.UseLocalModel() {
+		c.String(http.StatusNotFound, "useLocalModel=yes not support")
+		return
+	}
+	if !p.checkModelAcl(c, modelName, true) {
+		return
+	}
+	request := new(models.SetModelAliasJSONRequestBody)
+	if err := getBindResult(c, request); err != nil || !isValidAlias(alias) {
+		handleError(c, http.StatusBadRequest, config.BADREQUEST)
+		return
+	}
+	if err := module.ModelManagerGlobal.SetAlias(modelName, alias, request.Version); err != nil {
+		handleModelVersionError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+// DeleteModelAlias delete alias
+// (DELETE /models/{model_name}/aliases/{alias})
+func (p *ProxyHandler) DeleteModelAlias(c *gin.Context, modelName string, alias string) {
+	if config.ConfigGlobal.UseLocalModel() {
+		c.String(http.StatusNotFound, "useLocalModel=yes not support")
+		return
+	}
+	if alias == module.ModelAliasLatest {
+		handleError(c, http.StatusBadRequest, "alias latest can not delete")
+		return
+	}
+	if !p.checkModelAcl(c, modelName, true) {
+		return
+	}
+	if err := module.ModelManagerGlobal.DeleteAlias(modelName, alias); err != nil {
+		handleModelVersionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "delete success"})
+}
+
+// isValidAlias alias not number, not contain reference separator
+func isValidAlias(alias string) bool {
+	if alias == "" || strings.ContainsAny(alias, "@:/\\") {
+		return false
+	}
+	_, err := strconv.Atoi(alias)
+	return err != nil
+}
+
+func handleModelVersionError(c *gin.Context, err error) {
+	if errors.Is(err, module.ErrModelVersionNotFound) {
+		handleError(c, http.StatusNotFound, err.Error())
+	} else {
+		handleError(c, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// resolveModelRefs sd model and vae name@{version} or name:{alias} to versioned model name,
+// lora/lycoris/hypernetwork tags of prompts name@{version} to versioned file stem
+func resolveModelRefs(c *gin.Context, sdModel, sdVae *string, prompts ...*string) bool {
+	if config.ConfigGlobal.UseLocalModel() || module.ModelManagerGlobal == nil {
+		return true
+	}
+	refs := []*string{sdModel}
+	if sdVae != nil && *sdVae != "" && *sdVae != "None" && *sdVae != "Automatic" {
+		refs = append(refs, sdVae)
+	}
+	for _, ref := range refs {
+		resolved, err := module.ModelManagerGlobal.Resolve(*ref)
+		if err != nil {
+			handleModelVersionError(c, err)
+			return false
+		}
+		*ref = resolved
+	}
+	for _, prompt := range prompts {
+		if prompt == nil {
+			continue
+		}
+		resolved, err := module.ModelManagerGlobal.ResolvePrompt(*prompt)
+		if err != nil {
+			handleModelVersionError(c, err)
+			return false
+		}
+		*prompt = resolved
+	}
+	return true
+}
+
+// UpdateModelAcl change model visibility and shared users, owner only
+// (PUT /models/{model_name}/acl)
+func (p *ProxyHandler) UpdateModelAcl(c *gin.Context, modelName string) {
+	if config.ConfigGlobal.UseLocalModel() {
+		c.String(http.StatusNotFound, "useLocalModel=yes not support")
+		return
+	}
+	request := new(models.UpdateModelAclJSONRequestBody)
+	if err := getBindResult(c, request); err != nil {
+		handleError(c, http.StatusBadRequest, config.BADREQUEST)
+		return
+	}
+	acl, err := module.ModelManagerGlobal.Acl(modelName)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "read models db error")
+		return
+	}
+	user := requestUser(c)
+	if acl == nil || !acl.CanUse(user) {
+		handleError(c, http.StatusNotFound, config.NOTFOUND)
+		return
+	}
+	if !acl.CanManage(user) {
+		handleError(c, http.StatusForbidden, "only owner can change model acl")
+		return
+	}
+	visibility := models.ModelAttributesVisibility(request.Visibility)
+	newAcl, err := newModelAcl(acl.Owner, &visibility, request.SharedWith)
+	if err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := module.ModelManagerGlobal.SetAcl(modelName, newAcl); err != nil {
+		handleError(c, http.StatusInternalServerError, "update model acl error")
+		return
+	}
+	resp := models.ModelAcl{Visibility: models.ModelAclVisibility(newAcl.Visibility), SharedWith: &newAcl.SharedWith}
+	if newAcl.Owner != "" {
+		resp.Owner = &newAcl.Owner
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// newModelAcl visibility default config modelVisibility
+func newModelAcl(owner string, visibility *models.ModelAttributesVisibility, sharedWith *[]string) (*module.ModelAcl,
+	error) {
+	acl := &module.ModelAcl{Owner: owner, Visibility: config.ConfigGlobal.ModelVisibility,
+		SharedWith: make([]string, 0)}
+	if visibility != nil && *visibility != "" {
+		acl.Visibility = string(*visibility)
+	}
+	if !module.IsValidVisibility(acl.Visibility) {
+		return nil, fmt.Errorf("visibility %s not valid, value: private|shared|public", acl.Visibility)
+	}
+	if sharedWith != nil {
+		for _, user := range *sharedWith {
+			if user = strings.TrimSpace(user); user != "" && user != owner {
+				acl.SharedWith = append(acl.SharedWith, user)
+			}
+		}
+	}
+	return acl, nil
+}
+
+// isAdmin builtin admin of login, or default user of single tenant when login off
+func isAdmin(user string) bool {
+	return user == module.DefaultUser || (!config.ConfigGlobal.EnableLogin() && user == DEFAULT_USER)
+}
+
+// requestUser user of request, default user if login off
+func requestUser(c *gin.Context) string {
+	if username := c.GetHeader(userKey); username != "" || config.ConfigGlobal.EnableLogin() {
+		return username
+	}
+	return DEFAULT_USER
+}
+
+// checkModelAcl model not visible to user 404, manage by other user 403, not registered pass
+func (p *ProxyHandler) checkModelAcl(c *gin.Context, modelName string, manage bool) bool {
+	acl, err := module.ModelManagerGlobal.Acl(modelName)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "read models db error")
+		return false
+	}
+	user := requestUser(c)
+	switch {
+	case acl == nil:
+		return true
+	case !acl.CanUse(user):
+		handleError(c, http.StatusNotFound, config.NOTFOUND)
+		return false
+	case manage && !acl.CanManage(user):
+		handleError(c, http.StatusForbidden, "only owner can change the model")
+		return false
+	}
+	return true
+}
 
+// canUseModel sd model registered by other user not usable, useLocalModel=yes all usable
+func (p *ProxyHandler) canUseModel(user, sdModel string) bool {
+	if config.ConfigGlobal.UseLocalModel() || module.ModelManagerGlobal == nil {
+		return true
+	}
+	ok, err := module.ModelManagerGlobal.CanUse(user, sdModel)
+	if err != nil {
+		logrus.Warnf("check model %s acl err=%s", sdModel, err.Error())
+	}
+	return ok
+}
+
+// checkModelRefsAccess vae, controlnet models, networks and embeddings of prompts registered by other user
+// not usable
+func (p *ProxyHandler) checkModelRefsAccess(c *gin.Context, user string, refs *module.ModelRefs) bool {
+	if config.ConfigGlobal.UseLocalModel() || module.ModelManagerGlobal == nil {
+		return true
+	}
+	forbidden, err := module.ModelManagerGlobal.ForbiddenModels(user, refs)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "read models db error")
+		return false
+	}
+	if len(forbidden) != 0 {
+		handleError(c, http.StatusNotFound, fmt.Sprintf("model %s not found, please check request",
+			strings.Join(forbidden, ",")))
+		return false
+	}
+	return true
 }
 
 // GetTaskProgress get predict progress
@@ -422,11 +942,44 @@ func (p *ProxyHandler) ExtraImages(c *gin.Context) {
 			username = DEFAULT_USER
 		}
 	}
+	if !checkImageQuota(c, username) {
+		return
+	}
 	request := new(models.ExtraImagesJSONRequestBody)
-	if err := getBindResult(c, request); err != nil {
+	var images *multipartImages
+	if isMultipart(c) {
+		// binary image checked here, stage to oss after request validated and forward oss key
+		var err error
+		if images, err = bindMultipartRequest(c, username, request, map[string]func([]string) error{
+			"image": func(ossKeys []string) error {
+				request.Image = ossKeys[0]
+				return nil
+			},
+		}); err != nil {
+			handleError(c, uploadErrorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+	} else if err := getBindResult(c, request); err != nil {
 		handleError(c, http.StatusBadRequest, config.BADREQUEST)
 		return
 	}
+	if err := checkOutputOptions(request.OutputFormat, request.OutputQuality); err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if images != nil {
+		if err := images.stage(); err != nil {
+			handleError(c, quotaErrorStatus(err, http.StatusInternalServerError), err.Error())
+			return
+		}
+	}
+	// staged images deleted unless task accepted
+	defer images.rollback()
+	if config.ConfigGlobal.IsServerTypeMatch(config.PROXY) {
+		// user default output options
+		fillUserOutputOptions(p.userStore, username, &request.OutputFormat, &request.OutputQuality,
+			&request.StripMetadata)
+	}
 	// taskId
 	taskId := c.GetHeader(taskKey)
 	if taskId == "" {
@@ -476,6 +1029,7 @@ func (p *ProxyHandler) ExtraImages(c *gin.Context) {
 	if err != nil || (resp.StatusCode != syncSuccessCode && resp.StatusCode != asyncSuccessCode) {
 		handleRespError(c, err, resp, taskId)
 	} else {
+		images.accept()
 		c.JSON(http.StatusOK, models.SubmitTaskResponse{
 			TaskId: taskId,
 			Status: func() string {
@@ -505,6 +1059,9 @@ func (p *ProxyHandler) Txt2Img(c *gin.Context) {
 			username = DEFAULT_USER
 		}
 	}
+	if !checkImageQuota(c, username) {
+		return
+	}
 	request := new(models.Txt2ImgJSONRequestBody)
 	if err := getBindResult(c, request); err != nil {
 		handleError(c, http.StatusBadRequest, config.BADREQUEST)
@@ -514,6 +1071,14 @@ func (p *ProxyHandler) Txt2Img(c *gin.Context) {
 		handleError(c, http.StatusBadRequest, "stable_diffusion_model val not valid, please set valid val")
 		return
 	}
+	if !resolveModelRefs(c, &request.StableDiffusionModel, request.SdVae, request.Prompt, request.NegativePrompt,
+		request.HrPrompt, request.HrNegativePrompt) {
+		return
+	}
+	if err := checkOutputOptions(request.OutputFormat, request.OutputQuality); err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
 	// taskId
 	taskId := c.GetHeader(taskKey)
 	if taskId == "" {
@@ -548,10 +1113,22 @@ func (p *ProxyHandler) Txt2Img(c *gin.Context) {
 	}
 	if config.ConfigGlobal.IsServerTypeMatch(config.PROXY) {
 		// check request valid: sdModel and sdVae exist
-		if existed := p.checkModelExist(request.StableDiffusionModel); !existed {
+		if existed := p.checkModelExist(username, request.StableDiffusionModel); !existed {
 			handleError(c, http.StatusNotFound, "model not found, please check request")
 			return
 		}
+		if !p.checkModelRefsAccess(c, username, &module.ModelRefs{SdVae: request.SdVae,
+			ControlNets: controlNetModels(request.AlwaysonScripts), Prompts: []*string{request.Prompt,
+				request.NegativePrompt, request.HrPrompt, request.HrNegativePrompt}}) {
+			return
+		}
+		if module.ModelUsageGlobal != nil {
+			module.ModelUsageGlobal.Record(request.StableDiffusionModel, request.SdVae,
+				request.Prompt, request.NegativePrompt, request.HrPrompt, request.HrNegativePrompt)
+		}
+		// user default output options
+		fillUserOutputOptions(p.userStore, username, &request.OutputFormat, &request.OutputQuality,
+			&request.StripMetadata)
 		// write db
 		if err := p.taskStore.Put(taskId, map[string]interface{}{
 			datastore.KTaskIdColumnName: taskId,
@@ -640,8 +1217,28 @@ func (p *ProxyHandler) Img2Img(c *gin.Context) {
 			username = DEFAULT_USER
 		}
 	}
+	if !checkImageQuota(c, username) {
+		return
+	}
 	request := new(models.Img2ImgJSONRequestBody)
-	if err := getBindResult(c, request); err != nil {
+	var images *multipartImages
+	if isMultipart(c) {
+		// binary images checked here, stage to oss after request validated and forward oss key
+		var err error
+		if images, err = bindMultipartRequest(c, username, request, map[string]func([]string) error{
+			"init_images": func(ossKeys []string) error {
+				request.InitImages = &ossKeys
+				return nil
+			},
+			"mask": func(ossKeys []string) error {
+				request.Mask = &ossKeys[0]
+				return nil
+			},
+		}); err != nil {
+			handleError(c, uploadErrorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+	} else if err := getBindResult(c, request); err != nil {
 		handleError(c, http.StatusBadRequest, config.BADREQUEST)
 		return
 	}
@@ -649,6 +1246,14 @@ func (p *ProxyHandler) Img2Img(c *gin.Context) {
 		handleError(c, http.StatusBadRequest, "stable_diffusion_model val not valid, please set valid val")
 		return
 	}
+	if !resolveModelRefs(c, &request.StableDiffusionModel, request.SdVae, request.Prompt,
+		request.NegativePrompt) {
+		return
+	}
+	if err := checkOutputOptions(request.OutputFormat, request.OutputQuality); err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
 	// taskId
 	taskId := c.GetHeader(taskKey)
 	if taskId == "" {
@@ -683,10 +1288,30 @@ func (p *ProxyHandler) Img2Img(c *gin.Context) {
 	}
 	if config.ConfigGlobal.IsServerTypeMatch(config.PROXY) {
 		// check request valid: sdModel and sdVae exist
-		if existed := p.checkModelExist(request.StableDiffusionModel); !existed {
+		if existed := p.checkModelExist(username, request.StableDiffusionModel); !existed {
 			handleError(c, http.StatusNotFound, "model not found, please check request")
 			return
 		}
+		if !p.checkModelRefsAccess(c, username, &module.ModelRefs{SdVae: request.SdVae,
+			ControlNets: controlNetModels(request.AlwaysonScripts),
+			Prompts:     []*string{request.Prompt, request.NegativePrompt}}) {
+			return
+		}
+		if images != nil {
+			if err := images.stage(); err != nil {
+				handleError(c, quotaErrorStatus(err, http.StatusInternalServerError), err.Error())
+				return
+			}
+		}
+		// staged images deleted unless task accepted
+		defer images.rollback()
+		if module.ModelUsageGlobal != nil {
+			module.ModelUsageGlobal.Record(request.StableDiffusionModel, request.SdVae,
+				request.Prompt, request.NegativePrompt)
+		}
+		// user default output options
+		fillUserOutputOptions(p.userStore, username, &request.OutputFormat, &request.OutputQuality,
+			&request.StripMetadata)
 		// write db
 		if err := p.taskStore.Put(taskId, map[string]interface{}{
 			datastore.KTaskIdColumnName: taskId,
@@ -746,6 +1371,7 @@ func (p *ProxyHandler) Img2Img(c *gin.Context) {
 		}
 		handleRespError(c, err, resp, taskId)
 	} else {
+		images.accept()
 		c.JSON(http.StatusOK, models.SubmitTaskResponse{
 			TaskId: taskId,
 			Status: func() string {
@@ -762,6 +1388,262 @@ func (p *ProxyHandler) Img2Img(c *gin.Context) {
 	}
 }
 
+// Txt2ImgValidate validate txt to img predict params without predict
+// (POST /txt2img:validate)
+func (p *ProxyHandler) Txt2ImgValidate(c *gin.Context) {
+	if !strings.HasSuffix(c.Request.URL.Path, validateSuffix) {
+		p.NoRouterHandler(c)
+		return
+	}
+	username := c.GetHeader(userKey)
+	if username == "" {
+		if config.ConfigGlobal.EnableLogin() {
+			handleError(c, http.StatusBadRequest, config.BADREQUEST)
+			return
+		} else {
+			username = DEFAULT_USER
+		}
+	}
+	request := new(models.Txt2ImgJSONRequestBody)
+	if err := getBindResult(c, request); err != nil {
+		handleError(c, http.StatusBadRequest, config.BADREQUEST)
+		return
+	}
+	result := newPredictValidator(p, username).validateTxt2Img(request)
+	if !result.Valid {
+		c.JSON(requestFail, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Img2ImgValidate validate img to img predict params without predict
+// (POST /img2img:validate)
+func (p *ProxyHandler) Img2ImgValidate(c *gin.Context) {
+	if !strings.HasSuffix(c.Request.URL.Path, validateSuffix) {
+		p.NoRouterHandler(c)
+		return
+	}
+	username := c.GetHeader(userKey)
+	if username == "" {
+		if config.ConfigGlobal.EnableLogin() {
+			handleError(c, http.StatusBadRequest, config.BADREQUEST)
+			return
+		} else {
+			username = DEFAULT_USER
+		}
+	}
+	request := new(models.Img2ImgJSONRequestBody)
+	if err := getBindResult(c, request); err != nil {
+		handleError(c, http.StatusBadRequest, config.BADREQUEST)
+		return
+	}
+	result := newPredictValidator(p, username).validateImg2Img(request)
+	if !result.Valid {
+		c.JSON(requestFail, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetUserOutputOptions get user default output image options
+// (GET /users/{user_name}/output_options)
+func (p *ProxyHandler) GetUserOutputOptions(c *gin.Context, userName string) {
+	if !p.checkUserAccess(c, userName) {
+		return
+	}
+	cfg, err := getUserConfig(p.userStore, userName)
+	if err != nil {
+		logrus.Errorf("get user %s config err=%s", userName, err.Error())
+		handleError(c, http.StatusInternalServerError, config.OTSGETERROR)
+		return
+	}
+	if cfg.OutputOptions == nil {
+		cfg.OutputOptions = new(models.OutputOptions)
+	}
+	c.JSON(http.StatusOK, cfg.OutputOptions)
+}
+
+// UpdateUserOutputOptions update user default output image options
+// (PUT /users/{user_name}/output_options)
+func (p *ProxyHandler) UpdateUserOutputOptions(c *gin.Context, userName string) {
+	if !p.checkUserAccess(c, userName) {
+		return
+	}
+	request := new(models.UpdateUserOutputOptionsJSONRequestBody)
+	if err := getBindResult(c, request); err != nil {
+		handleError(c, http.StatusBadRequest, config.BADREQUEST)
+		return
+	}
+	if err := checkOutputOptions(request.OutputFormat, request.OutputQuality); err != nil {
+		handleError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	cfg, err := getUserConfig(p.userStore, userName)
+	if err != nil {
+		logrus.Errorf("get user %s config err=%s", userName, err.Error())
+		handleError(c, http.StatusInternalServerError, config.OTSGETERROR)
+		return
+	}
+	cfg.OutputOptions = (*models.OutputOptions)(request)
+	if err := putUserConfig(p.userStore, userName, cfg); err != nil {
+		logrus.Errorf("put user %s config err=%s", userName, err.Error())
+		handleError(c, http.StatusInternalServerError, config.OTSPUTERROR)
+		return
+	}
+	c.JSON(http.StatusOK, models.ResponseMessage{Message: "success"})
+}
+
+// GetUserUsage get user storage usage and quota
+// (GET /users/{user_name}/usage)
+func (p *ProxyHandler) GetUserUsage(c *gin.Context, userName string) {
+	if !p.checkUserAccess(c, userName) {
+		return
+	}
+	usage, err := module.QuotaManagerGlobal.Usage(userName)
+	if err != nil {
+		logrus.Errorf("get user %s usage err=%s", userName, err.Error())
+		handleError(c, http.StatusInternalServerError, config.OTSGETERROR)
+		return
+	}
+	c.JSON(http.StatusOK, models.StorageUsage{
+		Images:      usage.Images,
+		Inputs:      usage.Inputs,
+		ImagesQuota: usage.ImagesQuota,
+		InputsQuota: usage.InputsQuota,
+	})
+}
+
+// UploadImage upload input image to oss
+// (POST /images)
+func (p *ProxyHandler) UploadImage(c *gin.Context) {
+	username := c.GetHeader(userKey)
+	if username == "" {
+		if config.ConfigGlobal.EnableLogin() {
+			handleError(c, http.StatusBadRequest, config.BADREQUEST)
+			return
+		} else {
+			username = DEFAULT_USER
+		}
+	}
+	body, err := readUploadBody(c)
+	if err != nil {
+		handleError(c, uploadErrorStatus(err, http.StatusBadRequest), err.Error())
+		return
+	}
+	img, err := saveInputImage(username, body)
+	if err != nil {
+		handleError(c, quotaErrorStatus(err, http.StatusBadRequest), err.Error())
+		return
+	}
+	resp := models.UploadedImage{
+		OssKey: img.ossKey,
+		Width:  img.width,
+		Height: img.height,
+		Format: utils.String(img.format),
+	}
+	if ossUrl, err := module.OssGlobal.GetUrl([]string{img.ossKey}); err == nil && len(ossUrl) > 0 {
+		resp.OssUrl = &ossUrl[0]
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetOssMetrics oss retry/circuit breaker metrics
+// (GET /metrics/oss)
+func (p *ProxyHandler) GetOssMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, module.GetOssMetrics())
+}
+
+// PngInfo read generation params from image metadata
+// (POST /png-info)
+func (p *ProxyHandler) PngInfo(c *gin.Context) {
+	username := c.GetHeader(userKey)
+	if username == "" {
+		if config.ConfigGlobal.EnableLogin() {
+			handleError(c, http.StatusBadRequest, config.BADREQUEST)
+			return
+		} else {
+			username = DEFAULT_USER
+		}
+	}
+	request := new(models.PngInfoJSONRequestBody)
+	limitImageJSONBody(c)
+	if err := getBindResult(c, request); err != nil {
+		if isBodyTooLarge(err) {
+			handleError(c, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		handleError(c, http.StatusBadRequest, config.BADREQUEST)
+		return
+	}
+	body, code, err := p.loadImage(username, request.Image)
+	if err != nil {
+		handleError(c, code, err.Error())
+		return
+	}
+	info, err := utils.ReadInfotext(body)
+	if err != nil {
+		logrus.Infof("read infotext err=%s", err.Error())
+		c.JSON(http.StatusOK, models.ImageInfoResponse{Info: ""})
+		return
+	}
+	prompt, negativePrompt, params := utils.ParseInfotext(info)
+	c.JSON(http.StatusOK, models.ImageInfoResponse{
+		Info:           info,
+		Prompt:         &prompt,
+		NegativePrompt: &negativePrompt,
+		Parameters:     &params,
+	})
+}
+
+// WatermarkVerify decode invisible watermark of image
+// (POST /watermark/verify)
+func (p *ProxyHandler) WatermarkVerify(c *gin.Context) {
+	username := c.GetHeader(userKey)
+	if username == "" {
+		if config.ConfigGlobal.EnableLogin() {
+			handleError(c, http.StatusBadRequest, config.BADREQUEST)
+			return
+		} else {
+			username = DEFAULT_USER
+		}
+	}
+	request := new(models.WatermarkVerifyJSONRequestBody)
+	limitImageJSONBody(c)
+	if err := getBindResult(c, request); err != nil {
+		if isBodyTooLarge(err) {
+			handleError(c, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		handleError(c, http.StatusBadRequest, config.BADREQUEST)
+		return
+	}
+	body, code, err := p.loadImage(username, request.Image)
+	if err != nil {
+		handleError(c, code, err.Error())
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		handleError(c, http.StatusBadRequest, fmt.Sprintf("decode image err=%s", err.Error()))
+		return
+	}
+	payload, err := utils.ExtractInvisibleWatermark(img)
+	if err != nil {
+		c.JSON(http.StatusOK, models.WatermarkResult{
+			Found:   false,
+			Message: utils.String(err.Error()),
+		})
+		return
+	}
+	user, taskId := parseWatermarkPayload(string(payload))
+	c.JSON(http.StatusOK, models.WatermarkResult{
+		Found:  true,
+		User:   &user,
+		TaskId: &taskId,
+	})
+}
+
 // DelSDFunc delete sd function
 // (POST /del/sd/functions)
 func (p *ProxyHandler) DelSDFunc(c *gin.Context) {
@@ -864,7 +1746,7 @@ func (p *ProxyHandler) getTaskResult(taskId string) (*models.TaskResultResponse,
 		OssUrl:     new([]string),
 	}
 	data, err := p.taskStore.Get(taskId, []string{datastore.KTaskStatus, datastore.KTaskImage, datastore.KTaskInfo,
-		datastore.KTaskParams, datastore.KTaskCode})
+		datastore.KTaskParams, datastore.KTaskCode, datastore.KTaskThumbnails, datastore.KTaskContactSheet})
 	if err != nil || data == nil || len(data) == 0 {
 		return nil, errors.New("not found")
 	}
@@ -905,10 +1787,63 @@ func (p *ProxyHandler) getTaskResult(taskId string) (*models.TaskResultResponse,
 	} else {
 		logrus.Warn("get oss url error")
 	}
+	// thumbnails
+	if thumbnailsStr, ok := data[datastore.KTaskThumbnails]; ok && thumbnailsStr.(string) != "" {
+		var thumbnails map[string][]string
+		if err := json.Unmarshal([]byte(thumbnailsStr.(string)), &thumbnails); err != nil {
+			logrus.WithFields(logrus.Fields{"taskId": taskId}).Println("Unmarshal thumbnails error=", err.Error())
+		} else if len(thumbnails) > 0 {
+			thumbnailUrl := signThumbnails(thumbnails)
+			result.Thumbnails = &thumbnailUrl
+		}
+	}
+	// contact sheet
+	if sheet, ok := data[datastore.KTaskContactSheet].(string); ok && sheet != "" {
+		result.ContactSheet = &sheet
+		if url, err := module.OssGlobal.GetUrl([]string{sheet}); err == nil && len(url) > 0 {
+			result.ContactSheetUrl = &url[0]
+		} else {
+			logrus.Warn("get contact sheet oss url error")
+		}
+	}
 	return result, nil
 }
 
-func (p *ProxyHandler) checkModelExist(sdModel string) bool {
+// taskArchive check all tasks before streaming, then write zip to response
+func (p *ProxyHandler) taskArchive(c *gin.Context, name string, taskIds []string) {
+	username := c.GetHeader(userKey)
+	if username == "" {
+		if config.ConfigGlobal.EnableLogin() {
+			handleError(c, http.StatusBadRequest, config.BADREQUEST)
+			return
+		} else {
+			username = DEFAULT_USER
+		}
+	}
+	tasks := make([]*archiveTask, 0, len(taskIds))
+	for _, taskId := range taskIds {
+		task, err := getArchiveTask(p.taskStore, username, taskId)
+		if err != nil {
+			handleError(c, http.StatusNotFound, err.Error())
+			return
+		}
+		tasks = append(tasks, task)
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", name))
+	c.Status(http.StatusOK)
+	if err := writeArchive(c.Writer, tasks); err != nil {
+		// response already started, only log
+		logrus.WithFields(logrus.Fields{"archive": name}).Errorf("write archive err=%s", err.Error())
+		c.Abort()
+	}
+}
+
+func (p *ProxyHandler) checkModelExist(user, sdModel string) bool {
+	// model of other user not visible
+	if !p.canUseModel(user, sdModel) {
+		return false
+	}
 	// mount nas && check
 	if !utils.FileExists(config.ConfigGlobal.SdPath) {
 		return true
@@ -922,10 +1857,10 @@ func (p *ProxyHandler) checkModelExist(sdModel string) bool {
 		// check local existed
 		switch model[0] {
 		case config.SD_MODEL:
-			sdModelPath := fmt.Sprintf("%s/models/%s/%s", config.ConfigGlobal.SdPath, "Stable-diffusion", sdModel)
+			path := config.ConfigGlobal.ModelTypeDir(config.SD_MODEL)
+			sdModelPath := fmt.Sprintf("%s/%s", path, sdModel)
 			if !utils.FileExists(sdModelPath) {
 				// list check image models
-				path := fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "Stable-diffusion")
 				tmp := utils.ListFile(path)
 				for _, one := range tmp {
 					if one == sdModel {
@@ -952,6 +1887,72 @@ func (p *ProxyHandler) checkModelExist(sdModel string) bool {
 	return true
 }
 
+// loadImage get image body of base64, oss image path or task://{taskId}/{index}
+func (p *ProxyHandler) loadImage(username, image string) ([]byte, int, error) {
+	if isTaskRef(image) {
+		ossKey, err := resolveTaskRef(p.taskStore, username, image)
+		if err != nil {
+			return nil, http.StatusNotFound, err
+		}
+		image = ossKey
+	}
+	if isImgPath(image) {
+		// only self images and uploaded inputs
+		if !isUserOssKey(username, image) {
+			return nil, http.StatusForbidden, fmt.Errorf("no permission to access image %s", image)
+		}
+		reader, err := module.OssGlobal.GetObject(image)
+		if err != nil {
+			return nil, http.StatusNotFound, fmt.Errorf("image %s not found", image)
+		}
+		defer reader.Close()
+		body, err := readLimit(reader)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return checkLoadedImage(body)
+	}
+	// data:image/png;base64,xxx
+	if idx := strings.Index(image, ";base64,"); idx >= 0 && strings.HasPrefix(image, "data:") {
+		image = image[idx+len(";base64,"):]
+	}
+	body, err := base64.StdEncoding.DecodeString(image)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New(
+			"image not valid, support base64/oss image path/task://{taskId}/{index}")
+	}
+	return checkLoadedImage(body)
+}
+
+// checkLoadedImage check size and dimensions before caller decode whole image
+func checkLoadedImage(body []byte) ([]byte, int, error) {
+	if int64(len(body)) > config.ConfigGlobal.MaxUploadSize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("image size exceed limit %d",
+			config.ConfigGlobal.MaxUploadSize)
+	}
+	if _, err := checkInputImage(body); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return body, http.StatusOK, nil
+}
+
+// checkUserAccess login enable, user only can access self resource
+func (p *ProxyHandler) checkUserAccess(c *gin.Context, userName string) bool {
+	username := c.GetHeader(userKey)
+	if username == "" {
+		if config.ConfigGlobal.EnableLogin() {
+			handleError(c, http.StatusBadRequest, config.BADREQUEST)
+			return false
+		}
+		username = DEFAULT_USER
+	}
+	if config.ConfigGlobal.EnableLogin() && username != userName {
+		handleError(c, http.StatusForbidden, "no permission to access other user")
+		return false
+	}
+	return true
+}
+
 func convertToModelResponse(datas map[string]map[string]interface{}) []*models.ModelAttributes {
 	ret := make([]*models.ModelAttributes, 0, len(datas))
 	for _, data := range datas {
@@ -966,6 +1967,65 @@ func convertToModelResponse(datas map[string]map[string]interface{}) []*models.M
 			RegisteredTime:       &registeredTime,
 			LastModificationTime: &modifyTime,
 		})
+		model := ret[len(ret)-1]
+		if modelUrl, ok := data[datastore.KModelUrl].(string); ok && modelUrl != "" {
+			model.Url = &modelUrl
+		}
+		if message, ok := data[datastore.KModelMessage].(string); ok && message != "" {
+			model.Message = &message
+		}
+		if progress, ok := data[datastore.KModelProgress].(string); ok && progress != "" && progress != "{}" {
+			model.Progress = new(models.ModelProgress)
+			if err := json.Unmarshal([]byte(progress), model.Progress); err != nil {
+				model.Progress = nil
+			}
+		}
+		if sha256, ok := data[datastore.KModelSha256].(string); ok && sha256 != "" {
+			model.Sha256 = &sha256
+		}
+		if shortHash, ok := data[datastore.KModelShortHash].(string); ok && shortHash != "" {
+			model.ShortHash = &shortHash
+		}
+		acl := module.ParseModelAcl(data)
+		if acl.Owner != "" {
+			model.Owner = &acl.Owner
+		}
+		visibility := models.ModelAttributesVisibility(acl.Visibility)
+		model.Visibility = &visibility
+		if len(acl.SharedWith) != 0 {
+			model.SharedWith = &acl.SharedWith
+		}
+		if lastUsed, ok := data[datastore.KModelLastUsed].(string); ok && lastUsed != "" {
+			model.LastUsedTime = &lastUsed
+		}
+		if useCount, ok := data[datastore.KModelUseCount].(string); ok && useCount != "" {
+			if count, err := strconv.ParseInt(useCount, 10, 64); err == nil {
+				model.UseCount = &count
+			}
+		}
+		if _, ok := data[datastore.KModelVersions]; ok {
+			versions := module.ParseModelVersions(data)
+			version := versions.Aliases[module.ModelAliasLatest]
+			model.Version = &version
+			model.Aliases = &versions.Aliases
+		}
+		if body, ok := data[datastore.KModelInfo].(string); ok && body != "" {
+			info := new(module.ModelInfo)
+			if err := json.Unmarshal([]byte(body), info); err == nil {
+				if info.LegacyHash != "" {
+					model.LegacyHash = &info.LegacyHash
+				}
+				if info.Architecture != "" {
+					model.Architecture = &info.Architecture
+				}
+				if len(info.TriggerWords) != 0 {
+					model.TriggerWords = &info.TriggerWords
+				}
+				if len(info.Metadata) != 0 {
+					model.Metadata = &info.Metadata
+				}
+			}
+		}
 	}
 	return ret
 }
@@ -982,7 +2042,8 @@ func getModelsStatus(modelType string) string {
 func ApiAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		path := c.Request.URL.Path
-		if path != "/login" {
+		// local file url auth by signature
+		if path != "/login" && !strings.HasPrefix(path, module.LocalFileRoute) {
 			tokenString := c.Request.Header.Get("Token")
 			userName, ok := module.UserManagerGlobal.VerifySessionValid(tokenString)
 			if !ok {
@@ -994,6 +2055,22 @@ func ApiAuth() gin.HandlerFunc {
 	}
 }
 
+// GetFile serve local oss file, url from OssManagerLocal.GetUrl
+// (GET /files/*key)
+func GetFile(c *gin.Context) {
+	key := c.Param("key")
+	if err := module.VerifyLocalFileUrl(key, c.Query("expires"), c.Query("signature")); err != nil {
+		handleError(c, http.StatusForbidden, err.Error())
+		return
+	}
+	localFile, err := module.LocalFilePath(key)
+	if err != nil || !utils.FileExists(localFile) {
+		handleError(c, http.StatusNotFound, "file not found")
+		return
+	}
+	c.File(localFile)
+}
+
 func isAsync(invokeType string) bool {
 	// control server default sync
 	if config.ConfigGlobal.GetFlexMode() == config.MultiFunc && config.ConfigGlobal.IsServerTypeMatch(config.CONTROL) {
@@ -1072,7 +2149,7 @@ func (p *ProxyHandler) NoRouterHandler(c *gin.Context) {
 	if config.ConfigGlobal.IsServerTypeMatch(config.PROXY) {
 		// check request valid: sdModel and sdVae exist
 		if sdModel != "" {
-			if existed := p.checkModelExist(sdModel); !existed {
+			if existed := p.checkModelExist(username, sdModel); !existed {
 				handleError(c, http.StatusNotFound, "model not found, please check request")
 				return
 			}
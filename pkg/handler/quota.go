@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"errors"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// checkStorageQuota kind usage + size not exceed user quota, not tracked always pass
+func checkStorageQuota(user, kind string, size int64) error {
+	if module.QuotaManagerGlobal == nil {
+		return nil
+	}
+	return module.QuotaManagerGlobal.Check(user, kind, size)
+}
+
+// checkImageQuota reject new predict task when images quota used up
+func checkImageQuota(c *gin.Context, user string) bool {
+	if err := checkStorageQuota(user, module.StorageImages, 0); err != nil {
+		handleError(c, quotaErrorStatus(err, http.StatusInternalServerError), err.Error())
+		return false
+	}
+	return true
+}
+
+// quotaErrorStatus quota exceeded 403, otherwise defaultCode
+func quotaErrorStatus(err error, defaultCode int) int {
+	var quotaErr *module.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return http.StatusForbidden
+	}
+	if defaultCode == http.StatusInternalServerError {
+		logrus.Errorf("check storage quota err=%s", err.Error())
+	}
+	return defaultCode
+}
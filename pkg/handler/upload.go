@@ -0,0 +1,350 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/models"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// uploadFormField multipart file field of upload image
+	uploadFormField = "file"
+	inputKeyLength  = 16
+	// multipart predict request: json payload part and controlnet_{index} image parts
+	multipartPayload    = "payload"
+	multipartControlNet = "controlnet_"
+	// multipartOverhead boundary and part headers besides file of upload request
+	multipartOverhead = 1 << 20
+)
+
+// upload image content type => file ext
+var uploadContentTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/webp": "webp",
+}
+
+// inputImage uploaded input image
+type inputImage struct {
+	ossKey string
+	width  int
+	height int
+	format string
+}
+
+// readUploadBody read image from multipart file field or raw body, limit config maxUploadSize
+func readUploadBody(c *gin.Context) ([]byte, error) {
+	if isMultipart(c) {
+		limitRequestBody(c, config.ConfigGlobal.MaxUploadSize+multipartOverhead)
+		file, err := c.FormFile(uploadFormField)
+		if err != nil {
+			if isBodyTooLarge(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("multipart field %s not found", uploadFormField)
+		}
+		return readFormFile(file)
+	}
+	limitRequestBody(c, config.ConfigGlobal.MaxUploadSize)
+	return readLimit(c.Request.Body)
+}
+
+// limitRequestBody read body more than limit fail with *http.MaxBytesError
+func limitRequestBody(c *gin.Context, limit int64) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+}
+
+// limitImageJSONBody json request carry one base64 image, limit base64 of config maxUploadSize
+func limitImageJSONBody(c *gin.Context) {
+	limitRequestBody(c, int64(base64.StdEncoding.EncodedLen(int(config.ConfigGlobal.MaxUploadSize)))+
+		multipartOverhead)
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// uploadErrorStatus request body too large 413, quota exceeded 403
+func uploadErrorStatus(err error, defaultCode int) int {
+	if isBodyTooLarge(err) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return quotaErrorStatus(err, defaultCode)
+}
+
+func readFormFile(file *multipart.FileHeader) ([]byte, error) {
+	if file.Size > config.ConfigGlobal.MaxUploadSize {
+		return nil, fmt.Errorf("image %s size %d exceed limit %d", file.Filename, file.Size,
+			config.ConfigGlobal.MaxUploadSize)
+	}
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readLimit(f)
+}
+
+func readLimit(reader io.Reader) ([]byte, error) {
+	maxSize := config.ConfigGlobal.MaxUploadSize
+	body, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, fmt.Errorf("image size exceed limit %d", maxSize)
+	}
+	if len(body) == 0 {
+		return nil, errors.New("image empty")
+	}
+	return body, nil
+}
+
+// checkInputImage check content type (sniff, not trust header) and dimensions
+func checkInputImage(body []byte) (*inputImage, error) {
+	contentType := http.DetectContentType(body)
+	ext, ok := uploadContentTypes[contentType]
+	if !ok {
+		return nil, fmt.Errorf("content type %s not support, support: png|jpeg|webp", contentType)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("decode image err=%s", err.Error())
+	}
+	maxSide := int(config.ConfigGlobal.MaxUploadSide)
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxSide || cfg.Height > maxSide {
+		return nil, fmt.Errorf("image size %dx%d out of range, max side %d", cfg.Width, cfg.Height, maxSide)
+	}
+	return &inputImage{
+		width:  cfg.Width,
+		height: cfg.Height,
+		format: ext,
+	}, nil
+}
+
+// saveInputImage check and upload image to inputs/{user}/{random}.{ext}
+func saveInputImage(user string, body []byte) (*inputImage, error) {
+	img, err := checkInputImage(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStorageQuota(user, module.StorageInputs, int64(len(body))); err != nil {
+		return nil, err
+	}
+	if err := uploadInputImage(user, img, body); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// uploadInputImage upload checked image to inputs/{user}/{random}.{ext}
+func uploadInputImage(user string, img *inputImage, body []byte) error {
+	img.ossKey = fmt.Sprintf("inputs/%s/%s.%s", user, utils.RandStr(inputKeyLength), img.format)
+	if err := module.OssGlobal.UploadFileByByte(img.ossKey, body); err != nil {
+		return fmt.Errorf("upload image err=%s", err.Error())
+	}
+	return nil
+}
+
+// isMultipart request content type multipart/form-data
+func isMultipart(c *gin.Context) bool {
+	return strings.HasPrefix(c.ContentType(), "multipart/form-data")
+}
+
+// multipartImage checked image part not uploaded yet
+type multipartImage struct {
+	img  *inputImage
+	body []byte
+}
+
+// multipartField image parts of one form field and setter of oss keys
+type multipartField struct {
+	name   string
+	setter func(ossKeys []string) error
+	images []*multipartImage
+}
+
+// multipartImages image parts of multipart request, stage to oss after request validated,
+// staged images deleted by rollback until task accepted
+type multipartImages struct {
+	user   string
+	fields []*multipartField
+	staged []string
+}
+
+// bindMultipartRequest bind json payload part to in and check image parts, images not uploaded until stage,
+// setters: form field => set oss keys of field files to request
+func bindMultipartRequest(c *gin.Context, user string, in interface{},
+	setters map[string]func(ossKeys []string) error) (*multipartImages, error) {
+	limitRequestBody(c, config.ConfigGlobal.MaxUploadRequestSize)
+	form, err := c.MultipartForm()
+	if err != nil {
+		if isBodyTooLarge(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("parse multipart form err=%s", err.Error())
+	}
+	payload, ok := form.Value[multipartPayload]
+	if !ok || len(payload) == 0 {
+		// payload may be sent as file part
+		files, ok := form.File[multipartPayload]
+		if !ok || len(files) == 0 {
+			return nil, fmt.Errorf("multipart field %s not found", multipartPayload)
+		}
+		f, err := files[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		payload = []string{string(body)}
+	}
+	if err := json.Unmarshal([]byte(payload[0]), in); err != nil {
+		return nil, fmt.Errorf("multipart field %s not valid json, err=%s", multipartPayload, err.Error())
+	}
+	images := &multipartImages{user: user, fields: make([]*multipartField, 0, len(form.File))}
+	for name, files := range form.File {
+		if name == multipartPayload {
+			continue
+		}
+		setter, ok := setters[name]
+		if !ok {
+			if setter, err = controlNetImageSetter(name, in); err != nil {
+				return nil, err
+			}
+			if setter == nil {
+				return nil, fmt.Errorf("multipart field %s not support", name)
+			}
+		}
+		field := &multipartField{name: name, setter: setter, images: make([]*multipartImage, 0, len(files))}
+		for _, file := range files {
+			body, err := readFormFile(file)
+			if err != nil {
+				return nil, err
+			}
+			img, err := checkInputImage(body)
+			if err != nil {
+				return nil, fmt.Errorf("multipart field %s %w", name, err)
+			}
+			field.images = append(field.images, &multipartImage{img: img, body: body})
+		}
+		images.fields = append(images.fields, field)
+	}
+	return images, nil
+}
+
+// stage check quota of all images, upload and set oss keys to request, uploaded images deleted if fail.
+// caller defer rollback and accept once task accepted
+func (m *multipartImages) stage() error {
+	var size int64
+	for _, field := range m.fields {
+		for _, one := range field.images {
+			size += int64(len(one.body))
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	if err := checkStorageQuota(m.user, module.StorageInputs, size); err != nil {
+		return err
+	}
+	var err error
+	for _, field := range m.fields {
+		ossKeys := make([]string, 0, len(field.images))
+		for _, one := range field.images {
+			if err = uploadInputImage(m.user, one.img, one.body); err != nil {
+				break
+			}
+			m.staged = append(m.staged, one.img.ossKey)
+			ossKeys = append(ossKeys, one.img.ossKey)
+		}
+		if err == nil {
+			err = field.setter(ossKeys)
+		}
+		if err != nil {
+			err = fmt.Errorf("multipart field %s %w", field.name, err)
+			break
+		}
+	}
+	if err != nil {
+		m.rollback()
+	}
+	return err
+}
+
+// accept task accepted, staged images kept
+func (m *multipartImages) accept() {
+	if m != nil {
+		m.staged = nil
+	}
+}
+
+// rollback delete staged images not accepted, no-op after accept
+func (m *multipartImages) rollback() {
+	if m == nil {
+		return
+	}
+	for _, ossKey := range m.staged {
+		if err := module.OssGlobal.DeleteFile(ossKey); err != nil {
+			logrus.Warnf("delete staged image %s err=%s", ossKey, err.Error())
+		}
+	}
+	m.staged = nil
+}
+
+// controlNetImageSetter field controlnet_{index} => alwayson_scripts.controlnet.args[index].image,
+// nil if field not controlnet image, err if controlnet args not in payload
+func controlNetImageSetter(field string, in interface{}) (func(ossKeys []string) error, error) {
+	if !strings.HasPrefix(field, multipartControlNet) {
+		return nil, nil
+	}
+	idx, err := strconv.Atoi(strings.TrimPrefix(field, multipartControlNet))
+	if err != nil || idx < 0 {
+		return nil, nil
+	}
+	request, ok := in.(*models.Img2ImgJSONRequestBody)
+	if !ok {
+		return nil, nil
+	}
+	scripts := request.AlwaysonScripts
+	if scripts == nil {
+		return nil, fmt.Errorf("multipart field %s need alwayson_scripts.controlnet in payload", field)
+	}
+	controlNet, ok := (*scripts)["controlnet"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("multipart field %s need alwayson_scripts.controlnet in payload", field)
+	}
+	args, ok := controlNet["args"].([]interface{})
+	if !ok || idx >= len(args) {
+		return nil, fmt.Errorf("multipart field %s controlnet args[%d] not found", field, idx)
+	}
+	arg, ok := args[idx].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("multipart field %s controlnet args[%d] not valid", field, idx)
+	}
+	return func(ossKeys []string) error {
+		arg["image"] = ossKeys[0]
+		return nil
+	}, nil
+}
@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/models"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func initUploadTest(t *testing.T) string {
+	ossPath := filepath.Join(t.TempDir(), "oss")
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		OssPath:              ossPath,
+		MaxUploadSize:        4096,
+		MaxUploadSide:        64,
+		MaxUploadRequestSize: 16384,
+	}}
+	module.OssGlobal = new(module.OssManagerLocal)
+	module.QuotaManagerGlobal = nil
+	gin.SetMode(gin.TestMode)
+	return ossPath
+}
+
+func testPngBody(t *testing.T, size int) []byte {
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, size, size))))
+	return buf.Bytes()
+}
+
+func newUploadContext(body []byte, contentType string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", contentType)
+	return c
+}
+
+// newMultipartContext parts: field => file bodies, payload as value part
+func newMultipartContext(t *testing.T, payload string, parts map[string][][]byte) *gin.Context {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if payload != "" {
+		assert.Nil(t, w.WriteField(multipartPayload, payload))
+	}
+	for field, bodies := range parts {
+		for _, body := range bodies {
+			fw, err := w.CreateFormFile(field, field+".png")
+			assert.Nil(t, err)
+			fw.Write(body)
+		}
+	}
+	assert.Nil(t, w.Close())
+	return newUploadContext(buf.Bytes(), w.FormDataContentType())
+}
+
+// stagedFiles files uploaded to inputs/{user}/
+func stagedFiles(ossPath, user string) []string {
+	entries, _ := os.ReadDir(filepath.Join(ossPath, module.StorageInputs, user))
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestReadUploadBody(t *testing.T) {
+	initUploadTest(t)
+	image := testPngBody(t, 8)
+
+	// raw body
+	body, err := readUploadBody(newUploadContext(image, "image/png"))
+	assert.Nil(t, err)
+	assert.Equal(t, image, body)
+	_, err = readUploadBody(newUploadContext(nil, "image/png"))
+	assert.NotNil(t, err)
+	// raw body over maxUploadSize cut by MaxBytesReader
+	_, err = readUploadBody(newUploadContext(make([]byte, 4097), "image/png"))
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, uploadErrorStatus(err, http.StatusBadRequest))
+
+	// multipart
+	body, err = readUploadBody(newMultipartContext(t, "", map[string][][]byte{uploadFormField: {image}}))
+	assert.Nil(t, err)
+	assert.Equal(t, image, body)
+	_, err = readUploadBody(newMultipartContext(t, "", map[string][][]byte{"other": {image}}))
+	assert.NotNil(t, err)
+	_, err = readUploadBody(newMultipartContext(t, "", map[string][][]byte{uploadFormField: {make([]byte, 4097)}}))
+	assert.NotNil(t, err)
+	// multipart body over maxUploadSize + overhead
+	_, err = readUploadBody(newMultipartContext(t, "", map[string][][]byte{
+		uploadFormField: {make([]byte, 4096+multipartOverhead)}}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, uploadErrorStatus(err, http.StatusBadRequest))
+
+	// content type sniffed and side limited
+	_, err = checkInputImage([]byte("not image"))
+	assert.NotNil(t, err)
+	_, err = checkInputImage(testPngBody(t, 65))
+	assert.NotNil(t, err)
+	img, err := checkInputImage(image)
+	assert.Nil(t, err)
+	assert.Equal(t, "png", img.format)
+	assert.Equal(t, 8, img.width)
+}
+
+func TestBindMultipartRequest(t *testing.T) {
+	ossPath := initUploadTest(t)
+	image := testPngBody(t, 8)
+	payload := `{"stable_diffusion_model":"sd.safetensors","alwayson_scripts":{"controlnet":{"args":[{"module":"canny"}]}}}`
+	newSetters := func(request *models.Img2ImgJSONRequestBody) map[string]func([]string) error {
+		return map[string]func([]string) error{
+			"init_images": func(ossKeys []string) error {
+				request.InitImages = &ossKeys
+				return nil
+			},
+		}
+	}
+
+	// invalid parts rejected before any image staged
+	for _, parts := range []map[string][][]byte{
+		{"init_images": {image, []byte("not image")}},
+		{"init_images": {image}, "controlnet_1": {image}},
+		{"init_images": {image}, "unknown": {image}},
+		{"init_images": {image, make([]byte, 4097)}},
+	} {
+		request := new(models.Img2ImgJSONRequestBody)
+		_, err := bindMultipartRequest(newMultipartContext(t, payload, parts), "admin", request, newSetters(request))
+		assert.NotNil(t, err)
+	}
+	request := new(models.Img2ImgJSONRequestBody)
+	_, err := bindMultipartRequest(newMultipartContext(t, "", map[string][][]byte{"init_images": {image}}),
+		"admin", request, newSetters(request))
+	assert.NotNil(t, err)
+	_, err = bindMultipartRequest(newMultipartContext(t, "{", map[string][][]byte{"init_images": {image}}),
+		"admin", request, newSetters(request))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(stagedFiles(ossPath, "admin")))
+
+	// request over maxUploadRequestSize
+	big := map[string][][]byte{"init_images": {image, image, image, image, image, image, image, image}}
+	for i := range big["init_images"] {
+		big["init_images"][i] = append(append([]byte{}, image...), make([]byte, 4000-len(image))...)
+	}
+	_, err = bindMultipartRequest(newMultipartContext(t, payload, big), "admin", request, newSetters(request))
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, uploadErrorStatus(err, http.StatusBadRequest))
+
+	// images staged only after stage
+	request = new(models.Img2ImgJSONRequestBody)
+	images, err := bindMultipartRequest(newMultipartContext(t, payload, map[string][][]byte{
+		"init_images":  {image, image},
+		"controlnet_0": {image},
+	}), "admin", request, newSetters(request))
+	assert.Nil(t, err)
+	assert.Equal(t, "sd.safetensors", request.StableDiffusionModel)
+	assert.Nil(t, request.InitImages)
+	assert.Equal(t, 0, len(stagedFiles(ossPath, "admin")))
+
+	assert.Nil(t, images.stage())
+	assert.Equal(t, 3, len(stagedFiles(ossPath, "admin")))
+	assert.Equal(t, 2, len(*request.InitImages))
+	for _, ossKey := range *request.InitImages {
+		assert.True(t, isUserOssKey("admin", ossKey))
+	}
+	arg := (*request.AlwaysonScripts)["controlnet"].(map[string]interface{})["args"].([]interface{})[0]
+	assert.True(t, isUserOssKey("admin", arg.(map[string]interface{})["image"].(string)))
+
+	// task not accepted, staged images deleted
+	images.rollback()
+	assert.Equal(t, 0, len(stagedFiles(ossPath, "admin")))
+	// accepted images kept
+	request = new(models.Img2ImgJSONRequestBody)
+	images, err = bindMultipartRequest(newMultipartContext(t, payload, map[string][][]byte{
+		"init_images": {image},
+	}), "admin", request, newSetters(request))
+	assert.Nil(t, err)
+	assert.Nil(t, images.stage())
+	images.accept()
+	images.rollback()
+	assert.Equal(t, 1, len(stagedFiles(ossPath, "admin")))
+	// no multipart images
+	images = nil
+	images.rollback()
+}
+
+func TestLoadImageLimit(t *testing.T) {
+	initUploadTest(t)
+	p := new(ProxyHandler)
+	image := testPngBody(t, 8)
+	body, code, err := p.loadImage("alice", base64.StdEncoding.EncodeToString(image))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, image, body)
+	// side checked before caller decode
+	_, code, _ = p.loadImage("alice", "data:image/png;base64,"+base64.StdEncoding.EncodeToString(testPngBody(t, 65)))
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code, _ = p.loadImage("alice", base64.StdEncoding.EncodeToString(make([]byte, 4097)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	// oss image read bounded
+	ossKey := module.StorageInputs + "/alice/big.png"
+	assert.Nil(t, module.OssGlobal.UploadFileByByte(ossKey, make([]byte, 8192)))
+	_, code, _ = p.loadImage("alice", ossKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+	ossKey = module.StorageInputs + "/alice/wide.png"
+	assert.Nil(t, module.OssGlobal.UploadFileByByte(ossKey, testPngBody(t, 65)))
+	_, code, _ = p.loadImage("alice", ossKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// json body over limit
+	request, _ := json.Marshal(models.WatermarkVerifyJSONRequestBody{
+		Image: base64.StdEncoding.EncodeToString(make([]byte, 4096+multipartOverhead))})
+	c := newUploadContext(request, "application/json")
+	p.WatermarkVerify(c)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, c.Writer.Status())
+	c = newUploadContext(request, "application/json")
+	p.PngInfo(c)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, c.Writer.Status())
+}
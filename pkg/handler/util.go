@@ -17,6 +17,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -33,6 +34,7 @@ const (
 	asyncSuccessCode = 202
 	syncSuccessCode  = 200
 	base64MinLen     = 2048
+	taskRefPrefix    = "task://"
 )
 
 func getBindResult(c *gin.Context, in interface{}) error {
@@ -53,26 +55,6 @@ func outputImage(fileName, base64Str *string) error {
 	return nil
 }
 
-func downloadModelsFromOss(modelsType, ossPath, modelName string) (string, error) {
-	path := ""
-	switch modelsType {
-	case config.SD_MODEL:
-		path = fmt.Sprintf("%s/models/%s/%s", config.ConfigGlobal.SdPath, "Stable-diffusion", modelName)
-	case config.SD_VAE:
-		path = fmt.Sprintf("%s/models/%s/%s", config.ConfigGlobal.SdPath, "VAE", modelName)
-	case config.LORA_MODEL:
-		path = fmt.Sprintf("%s/models/%s/%s", config.ConfigGlobal.SdPath, "Lora", modelName)
-	case config.CONTORLNET_MODEL:
-		path = fmt.Sprintf("%s/models/%s/%s", config.ConfigGlobal.SdPath, "ControlNet", modelName)
-	default:
-		return "", fmt.Errorf("modeltype: %s not support", modelsType)
-	}
-	if err := module.OssGlobal.DownloadFile(ossPath, path); err != nil {
-		return "", err
-	}
-	return path, nil
-}
-
 func uploadImages(ossPath, imageBody *string) error {
 	decode, err := base64.StdEncoding.DecodeString(*imageBody)
 	if err != nil {
@@ -103,22 +85,113 @@ func handleError(c *gin.Context, code int, err string) {
 
 func isImgPath(str string) bool {
 	return strings.HasSuffix(str, ".png") || strings.HasSuffix(str, ".jpg") ||
-		strings.HasSuffix(str, ".jpeg")
+		strings.HasSuffix(str, ".jpeg") || strings.HasSuffix(str, ".webp")
 }
 
-func listModelFile(path, modelType string) (modelAttrs []*models.ModelAttributes) {
-	files := utils.ListFile(path)
-	for _, name := range files {
-		if strings.HasSuffix(name, ".pt") || strings.HasSuffix(name, ".ckpt") ||
-			strings.HasSuffix(name, ".safetensors") || strings.HasSuffix(name, ".pth") {
-			modelAttrs = append(modelAttrs, &models.ModelAttributes{
-				Type:   modelType,
-				Name:   name,
-				Status: config.MODEL_LOADED,
-			})
+// isUserOssKey ossKey under images/{user}/ or inputs/{user}/
+func isUserOssKey(user, ossKey string) bool {
+	if user == "" || strings.Contains(ossKey, "..") || strings.Contains(ossKey, "\\") {
+		return false
+	}
+	for _, prefix := range []string{module.StorageImages, module.StorageInputs} {
+		if strings.HasPrefix(ossKey, fmt.Sprintf("%s/%s/", prefix, user)) {
+			return true
 		}
 	}
-	return
+	return false
+}
+
+// isTaskRef check str is task output reference, format: task://{taskId}/{index}
+func isTaskRef(str string) bool {
+	return strings.HasPrefix(str, taskRefPrefix)
+}
+
+// resolveTaskRef task://{taskId}/{index} to output image ossKey, index start from 0
+// only the owner of the task can reference its outputs
+func resolveTaskRef(taskStore datastore.Datastore, user, ref string) (string, error) {
+	items := strings.Split(strings.TrimPrefix(ref, taskRefPrefix), "/")
+	if len(items) != 2 || items[0] == "" {
+		return "", fmt.Errorf("task ref %s not valid, format: %s{taskId}/{index}", ref, taskRefPrefix)
+	}
+	taskId := items[0]
+	idx, err := strconv.Atoi(items[1])
+	if err != nil || idx < 0 {
+		return "", fmt.Errorf("task ref %s index not valid", ref)
+	}
+	data, err := taskStore.Get(taskId, []string{datastore.KTaskUser, datastore.KTaskStatus, datastore.KTaskImage})
+	if err != nil {
+		return "", fmt.Errorf("task ref %s read db error", ref)
+	}
+	if data == nil || len(data) == 0 {
+		return "", fmt.Errorf("task ref %s task not found", ref)
+	}
+	if owner, ok := data[datastore.KTaskUser].(string); !ok || owner != user {
+		return "", fmt.Errorf("task ref %s task not found", ref)
+	}
+	if status, ok := data[datastore.KTaskStatus].(string); !ok || status != config.TASK_FINISH {
+		return "", fmt.Errorf("task ref %s task not succeeded", ref)
+	}
+	images := make([]string, 0)
+	if val, ok := data[datastore.KTaskImage].(string); ok {
+		for _, image := range strings.Split(val, ",") {
+			if image != "" {
+				images = append(images, image)
+			}
+		}
+	}
+	if idx >= len(images) {
+		return "", fmt.Errorf("task ref %s index out of range, task has %d images", ref, len(images))
+	}
+	return images[idx], nil
+}
+
+// resolveTaskRefMap replace all task ref in map with output image ossKey
+func resolveTaskRefMap(taskStore datastore.Datastore, user string, aMap map[string]interface{}) error {
+	for key, val := range aMap {
+		switch concreteVal := val.(type) {
+		case map[string]interface{}:
+			if err := resolveTaskRefMap(taskStore, user, concreteVal); err != nil {
+				return err
+			}
+		case []interface{}:
+			if err := resolveTaskRefArray(taskStore, user, concreteVal); err != nil {
+				return err
+			}
+		case string:
+			if isTaskRef(concreteVal) {
+				ossKey, err := resolveTaskRef(taskStore, user, concreteVal)
+				if err != nil {
+					return err
+				}
+				aMap[key] = ossKey
+			}
+		}
+	}
+	return nil
+}
+
+func resolveTaskRefArray(taskStore datastore.Datastore, user string, anArray []interface{}) error {
+	for i, val := range anArray {
+		switch concreteVal := val.(type) {
+		case map[string]interface{}:
+			if err := resolveTaskRefMap(taskStore, user, concreteVal); err != nil {
+				return err
+			}
+		case []interface{}:
+			if err := resolveTaskRefArray(taskStore, user, concreteVal); err != nil {
+				return err
+			}
+		case string:
+			if isTaskRef(concreteVal) {
+				ossKey, err := resolveTaskRef(taskStore, user, concreteVal)
+				if err != nil {
+					return err
+				}
+				anArray[i] = ossKey
+			}
+		}
+	}
+	return nil
 }
 
 // Stat cost code
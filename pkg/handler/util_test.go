@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func newTestTaskStore(t *testing.T) datastore.Datastore {
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		DbSqlite: filepath.Join(t.TempDir(), "sqlite3"),
+	}}
+	taskStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KTaskTableName))
+	t.Cleanup(func() {
+		taskStore.Close()
+	})
+	put := func(taskId, user, status, images string) {
+		assert.Nil(t, taskStore.Put(taskId, map[string]interface{}{
+			datastore.KTaskIdColumnName: taskId,
+			datastore.KTaskUser:         user,
+			datastore.KTaskStatus:       status,
+			datastore.KTaskImage:        images,
+		}))
+	}
+	put("done", "admin", config.TASK_FINISH, "images/admin/done_0.png,images/admin/done_1.png")
+	put("running", "admin", config.TASK_INPROGRESS, "")
+	return taskStore
+}
+
+func TestResolveTaskRef(t *testing.T) {
+	taskStore := newTestTaskStore(t)
+	cases := []struct {
+		ref    string
+		user   string
+		ossKey string
+		ok     bool
+	}{
+		{"task://done/0", "admin", "images/admin/done_0.png", true},
+		{"task://done/1", "admin", "images/admin/done_1.png", true},
+		// out of range, bad format, not owner, not succeeded, not exist
+		{"task://done/2", "admin", "", false},
+		{"task://done/-1", "admin", "", false},
+		{"task://done", "admin", "", false},
+		{"task:///0", "admin", "", false},
+		{"task://done/x", "admin", "", false},
+		{"task://done/0", "other", "", false},
+		{"task://running/0", "admin", "", false},
+		{"task://missing/0", "admin", "", false},
+	}
+	for _, c := range cases {
+		ossKey, err := resolveTaskRef(taskStore, c.user, c.ref)
+		assert.Equal(t, c.ok, err == nil, c.ref)
+		assert.Equal(t, c.ossKey, ossKey, c.ref)
+	}
+}
+
+func TestResolveTaskRefMap(t *testing.T) {
+	taskStore := newTestTaskStore(t)
+	body := map[string]interface{}{
+		"init_images": []interface{}{"task://done/1", "images/admin/input.png"},
+		"alwayson_scripts": map[string]interface{}{
+			"controlnet": map[string]interface{}{
+				"args": []interface{}{map[string]interface{}{"image": "task://done/0"}},
+			},
+		},
+	}
+	assert.Nil(t, resolveTaskRefMap(taskStore, "admin", body))
+	assert.Equal(t, []interface{}{"images/admin/done_1.png", "images/admin/input.png"}, body["init_images"])
+	args := body["alwayson_scripts"].(map[string]interface{})["controlnet"].(map[string]interface{})["args"]
+	assert.Equal(t, "images/admin/done_0.png", args.([]interface{})[0].(map[string]interface{})["image"])
+
+	// other user ref fail
+	assert.NotNil(t, resolveTaskRefMap(taskStore, "other", map[string]interface{}{
+		"init_images": []interface{}{"task://done/0"},
+	}))
+}
+
+func TestIsUserOssKey(t *testing.T) {
+	cases := []struct {
+		ossKey string
+		ok     bool
+	}{
+		{"images/admin/done_0.png", true},
+		{"inputs/admin/abc.webp", true},
+		{"images/other/done_0.png", false},
+		{"images/admin2/done_0.png", false},
+		{"images/admin/../other/done_0.png", false},
+		{"models/admin/a.png", false},
+		{"images/admin", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.ok, isUserOssKey("admin", c.ossKey), c.ossKey)
+	}
+	assert.False(t, isUserOssKey("", "images//a.png"))
+}
@@ -0,0 +1,427 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/models"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// validate api path suffix, eg: /txt2img:validate
+const validateSuffix = ":validate"
+
+// validate error code
+const (
+	validateNotFound   = "notFound"
+	validateOutOfRange = "outOfRange"
+	validateInvalid    = "invalid"
+	validateForbidden  = "forbidden"
+)
+
+var (
+	// controlnet model name with hash suffix, eg: control_v11p_sd15_canny [d14c016b]
+	controlNetHashRegexp = regexp.MustCompile(`\s*\[[0-9a-fA-F]+\]$`)
+	modelExtensions      = []string{".safetensors", ".ckpt", ".pt", ".pth", ".bin"}
+)
+
+// predictValidator check predict params without invoke sd, collect all errors
+type predictValidator struct {
+	p      *ProxyHandler
+	user   string
+	errors []models.ValidateError
+	// model file names cache, key: model type
+	modelFiles map[string]map[string]struct{}
+}
+
+func newPredictValidator(p *ProxyHandler, user string) *predictValidator {
+	return &predictValidator{
+		p:          p,
+		user:       user,
+		errors:     make([]models.ValidateError, 0),
+		modelFiles: make(map[string]map[string]struct{}),
+	}
+}
+
+func (v *predictValidator) addError(field, code, message string) {
+	v.errors = append(v.errors, models.ValidateError{
+		Field:   field,
+		Code:    code,
+		Message: message,
+	})
+}
+
+func (v *predictValidator) result() *models.ValidateResponse {
+	return &models.ValidateResponse{
+		Valid:  len(v.errors) == 0,
+		Errors: v.errors,
+	}
+}
+
+// nasMounted model files only can check when nas mounted
+func (v *predictValidator) nasMounted() bool {
+	return utils.FileExists(config.ConfigGlobal.SdPath)
+}
+
+// listModelFiles list file names and names without extension under dir of model type, include sub dir
+func (v *predictValidator) listModelFiles(modelType string) map[string]struct{} {
+	if files, ok := v.modelFiles[modelType]; ok {
+		return files
+	}
+	files := make(map[string]struct{})
+	root := config.ConfigGlobal.ModelTypeDir(modelType)
+	if root == "" {
+		return files
+	}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		files[name] = struct{}{}
+		for _, ext := range modelExtensions {
+			if strings.HasSuffix(name, ext) {
+				files[strings.TrimSuffix(name, ext)] = struct{}{}
+			}
+		}
+		return nil
+	})
+	v.modelFiles[modelType] = files
+	return files
+}
+
+// modelFileExist file exist in dir of any model type
+func (v *predictValidator) modelFileExist(name string, modelTypes ...string) bool {
+	for _, modelType := range modelTypes {
+		if _, ok := v.listModelFiles(modelType)[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *predictValidator) checkSdModel(sdModel string) {
+	if !checkSdModelValid(sdModel) {
+		v.addError("stable_diffusion_model", validateInvalid, "stable_diffusion_model val not valid")
+		return
+	}
+	if !config.ConfigGlobal.UseLocalModel() && module.ModelManagerGlobal != nil {
+		resolved, err := module.ModelManagerGlobal.Resolve(sdModel)
+		if err != nil {
+			v.addError("stable_diffusion_model", validateNotFound, fmt.Sprintf("model %s not found", sdModel))
+			return
+		}
+		sdModel = resolved
+	}
+	if !v.p.checkModelExist(v.user, sdModel) {
+		v.addError("stable_diffusion_model", validateNotFound, fmt.Sprintf("model %s not found", sdModel))
+	}
+}
+
+func (v *predictValidator) checkSdVae(sdVae *string) {
+	// None || Automatic not need check
+	if sdVae == nil || *sdVae == "" || *sdVae == "None" || *sdVae == "Automatic" {
+		return
+	}
+	vae := *sdVae
+	if !config.ConfigGlobal.UseLocalModel() && module.ModelManagerGlobal != nil {
+		resolved, err := module.ModelManagerGlobal.Resolve(vae)
+		if err != nil {
+			v.addError("sd_vae", validateNotFound, fmt.Sprintf("vae %s not found", *sdVae))
+			return
+		}
+		vae = resolved
+	}
+	if v.forbidden(&module.ModelRefs{SdVae: &vae}) || (v.nasMounted() && !v.modelFileExist(vae, config.SD_VAE)) {
+		v.addError("sd_vae", validateNotFound, fmt.Sprintf("vae %s not found", *sdVae))
+	}
+}
+
+// forbidden models registered by other user, not visible the same as not found
+func (v *predictValidator) forbidden(refs *module.ModelRefs) bool {
+	if config.ConfigGlobal.UseLocalModel() || module.ModelManagerGlobal == nil {
+		return false
+	}
+	names, _ := module.ModelManagerGlobal.ForbiddenModels(v.user, refs)
+	return len(names) != 0
+}
+
+func (v *predictValidator) checkSampler(field string, sampler *string) {
+	if sampler == nil || *sampler == "" || len(config.ConfigGlobal.Samplers) == 0 {
+		return
+	}
+	for _, one := range config.ConfigGlobal.Samplers {
+		if strings.EqualFold(one, *sampler) {
+			return
+		}
+	}
+	v.addError(field, validateNotFound, fmt.Sprintf("sampler %s not found", *sampler))
+}
+
+// checkNetworks check lora, lycoris and hypernetwork referenced in prompt, eg: <lora:name:0.8>,
+// and registered embeddings of other user
+func (v *predictValidator) checkNetworks(field string, prompt *string) {
+	if prompt == nil {
+		return
+	}
+	// registered by other user, versioned name to file stem
+	forbidden := make(map[string]struct{})
+	if !config.ConfigGlobal.UseLocalModel() && module.ModelManagerGlobal != nil {
+		resolved, err := module.ModelManagerGlobal.ResolvePrompt(*prompt)
+		if err != nil {
+			v.addError(field, validateNotFound, err.Error())
+			return
+		}
+		prompt = &resolved
+		names, _ := module.ModelManagerGlobal.ForbiddenModels(v.user, &module.ModelRefs{Prompts: []*string{prompt}})
+		for _, name := range names {
+			forbidden[name] = struct{}{}
+		}
+	}
+	nasMounted := v.nasMounted()
+	tags := make(map[string]struct{})
+	for _, match := range module.NetworkTagRegexp.FindAllStringSubmatch(*prompt, -1) {
+		kind, name := match[1], strings.TrimSpace(match[2])
+		tags[name] = struct{}{}
+		if _, ok := forbidden[name]; ok {
+			v.addError(field, validateNotFound, fmt.Sprintf("%s %s not found", kind, name))
+			continue
+		}
+		if !nasMounted {
+			continue
+		}
+		// webui lora extension load lycoris from both dir
+		modelTypes := []string{config.LORA_MODEL, config.LYCORIS_MODEL}
+		if kind == "hypernet" {
+			modelTypes = []string{config.HYPERNETWORK_MODEL}
+		}
+		if !v.modelFileExist(name, modelTypes...) {
+			v.addError(field, validateNotFound, fmt.Sprintf("%s %s not found", kind, name))
+		}
+	}
+	// embedding words
+	embeddings := make([]string, 0)
+	for name := range forbidden {
+		if _, ok := tags[name]; !ok {
+			embeddings = append(embeddings, name)
+		}
+	}
+	sort.Strings(embeddings)
+	for _, name := range embeddings {
+		v.addError(field, validateNotFound, fmt.Sprintf("embedding %s not found", name))
+	}
+}
+
+func (v *predictValidator) checkRange(field string, val *int64, min, max int64) {
+	if val == nil {
+		return
+	}
+	if *val < min || *val > max {
+		v.addError(field, validateOutOfRange, fmt.Sprintf("%s=%d out of range [%d, %d]", field, *val, min, max))
+	}
+}
+
+func (v *predictValidator) checkSize(width, height *int64) {
+	v.checkRange("width", width, 1, config.ConfigGlobal.MaxWidth)
+	v.checkRange("height", height, 1, config.ConfigGlobal.MaxHeight)
+}
+
+func (v *predictValidator) checkSteps(field string, steps *int64) {
+	v.checkRange(field, steps, 1, config.ConfigGlobal.MaxSteps)
+}
+
+// checkImage check oss image path or task://{taskId}/{index} exist, base64 image skip
+func (v *predictValidator) checkImage(field, image string) {
+	ossKey := image
+	if isTaskRef(image) {
+		key, err := resolveTaskRef(v.p.taskStore, v.user, image)
+		if err != nil {
+			v.addError(field, validateNotFound, err.Error())
+			return
+		}
+		ossKey = key
+	}
+	if !isImgPath(ossKey) {
+		return
+	}
+	// existence of other user image not probed
+	if !isUserOssKey(v.user, ossKey) {
+		v.addError(field, validateForbidden, fmt.Sprintf("no permission to access image %s", ossKey))
+		return
+	}
+	existed, err := module.OssGlobal.IsFileExist(ossKey)
+	if err != nil {
+		logrus.Warnf("check oss image %s exist err=%s", ossKey, err.Error())
+		v.addError(field, validateInvalid, fmt.Sprintf("check image %s err=%s", ossKey, err.Error()))
+		return
+	}
+	if !existed {
+		v.addError(field, validateNotFound, fmt.Sprintf("image %s not found", ossKey))
+	}
+}
+
+// checkScriptImages check all images referenced in alwayson_scripts
+func (v *predictValidator) checkScriptImages(field string, val interface{}) {
+	switch concreteVal := val.(type) {
+	case map[string]interface{}:
+		for key, one := range concreteVal {
+			v.checkScriptImages(fmt.Sprintf("%s.%s", field, key), one)
+		}
+	case []interface{}:
+		for i, one := range concreteVal {
+			v.checkScriptImages(fmt.Sprintf("%s[%d]", field, i), one)
+		}
+	case string:
+		if isImgPath(concreteVal) || isTaskRef(concreteVal) {
+			v.checkImage(field, concreteVal)
+		}
+	}
+}
+
+// controlNetUnits controlnet units of alwayson_scripts args, nil if disabled or not valid
+func controlNetUnits(alwaysonScripts *map[string]interface{}) []map[string]interface{} {
+	if alwaysonScripts == nil {
+		return nil
+	}
+	controlNet, ok := (*alwaysonScripts)["controlnet"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	args, ok := controlNet["args"].([]interface{})
+	if !ok {
+		return nil
+	}
+	ret := make([]map[string]interface{}, len(args))
+	for i, arg := range args {
+		unit, ok := arg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if enabled, ok := unit["enabled"].(bool); ok && !enabled {
+			continue
+		}
+		ret[i] = unit
+	}
+	return ret
+}
+
+// controlNetModel model name of unit without hash suffix, "" if not set
+func controlNetModel(unit map[string]interface{}) string {
+	model, _ := unit["model"].(string)
+	if model == "None" {
+		return ""
+	}
+	return controlNetHashRegexp.ReplaceAllString(model, "")
+}
+
+// controlNetModels controlnet and ip-adapter models of enabled units
+func controlNetModels(alwaysonScripts *map[string]interface{}) []string {
+	ret := make([]string, 0)
+	for _, unit := range controlNetUnits(alwaysonScripts) {
+		if model := controlNetModel(unit); unit != nil && model != "" {
+			ret = append(ret, model)
+		}
+	}
+	return ret
+}
+
+// checkControlNet check controlnet models and modules
+func (v *predictValidator) checkControlNet(alwaysonScripts *map[string]interface{}) {
+	if alwaysonScripts == nil {
+		return
+	}
+	v.checkScriptImages("alwayson_scripts", *alwaysonScripts)
+	for i, unit := range controlNetUnits(alwaysonScripts) {
+		if unit == nil {
+			continue
+		}
+		field := fmt.Sprintf("alwayson_scripts.controlnet.args[%d]", i)
+		if preprocessor, ok := unit["module"].(string); ok && preprocessor != "" && len(config.ConfigGlobal.ControlNetModules) > 0 {
+			found := false
+			for _, one := range config.ConfigGlobal.ControlNetModules {
+				if strings.EqualFold(one, preprocessor) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				v.addError(field+".module", validateNotFound, fmt.Sprintf("controlnet module %s not found", preprocessor))
+			}
+		}
+		name := controlNetModel(unit)
+		if name == "" {
+			continue
+		}
+		if v.forbidden(&module.ModelRefs{ControlNets: []string{name}}) ||
+			(v.nasMounted() && !v.modelFileExist(name, config.CONTORLNET_MODEL, config.IPADAPTER_MODEL)) {
+			v.addError(field+".model", validateNotFound, fmt.Sprintf("controlnet model %s not found", unit["model"]))
+		}
+	}
+}
+
+func (v *predictValidator) checkOutput(format *string, quality *int64) {
+	if format != nil && *format != "" && utils.NormalizeImageFormat(*format) == "" {
+		v.addError("output_format", validateInvalid, fmt.Sprintf("output_format %s not support", *format))
+	}
+	v.checkRange("output_quality", quality, 1, 100)
+}
+
+func (v *predictValidator) validateTxt2Img(request *models.Txt2ImgJSONRequestBody) *models.ValidateResponse {
+	v.checkSdModel(request.StableDiffusionModel)
+	v.checkSdVae(request.SdVae)
+	v.checkSampler("sampler_name", request.SamplerName)
+	v.checkSampler("sampler_index", request.SamplerIndex)
+	v.checkNetworks("prompt", request.Prompt)
+	v.checkNetworks("negative_prompt", request.NegativePrompt)
+	v.checkSize(request.Width, request.Height)
+	v.checkSteps("steps", request.Steps)
+	v.checkOutput(request.OutputFormat, request.OutputQuality)
+	if request.EnableHr != nil && *request.EnableHr {
+		v.checkSampler("hr_sampler_name", request.HrSamplerName)
+		v.checkNetworks("hr_prompt", request.HrPrompt)
+		v.checkNetworks("hr_negative_prompt", request.HrNegativePrompt)
+		v.checkSteps("hr_second_pass_steps", request.HrSecondPassSteps)
+		if request.HrResizeX != nil && *request.HrResizeX > 0 {
+			v.checkRange("hr_resize_x", request.HrResizeX, 1, config.ConfigGlobal.MaxWidth)
+		} else if request.HrScale != nil && request.Width != nil {
+			hrWidth := *request.HrScale * *request.Width
+			v.checkRange("hr_scale", &hrWidth, 1, config.ConfigGlobal.MaxWidth)
+		}
+		if request.HrResizeY != nil && *request.HrResizeY > 0 {
+			v.checkRange("hr_resize_y", request.HrResizeY, 1, config.ConfigGlobal.MaxHeight)
+		} else if request.HrScale != nil && request.Height != nil {
+			hrHeight := *request.HrScale * *request.Height
+			v.checkRange("hr_scale", &hrHeight, 1, config.ConfigGlobal.MaxHeight)
+		}
+	}
+	v.checkControlNet(request.AlwaysonScripts)
+	return v.result()
+}
+
+func (v *predictValidator) validateImg2Img(request *models.Img2ImgJSONRequestBody) *models.ValidateResponse {
+	v.checkSdModel(request.StableDiffusionModel)
+	v.checkSdVae(request.SdVae)
+	v.checkSampler("sampler_name", request.SamplerName)
+	v.checkSampler("sampler_index", request.SamplerIndex)
+	v.checkNetworks("prompt", request.Prompt)
+	v.checkNetworks("negative_prompt", request.NegativePrompt)
+	v.checkSize(request.Width, request.Height)
+	v.checkSteps("steps", request.Steps)
+	v.checkOutput(request.OutputFormat, request.OutputQuality)
+	if request.InitImages != nil {
+		for i, image := range *request.InitImages {
+			v.checkImage(fmt.Sprintf("init_images[%d]", i), image)
+		}
+	}
+	if request.Mask != nil {
+		v.checkImage("mask", *request.Mask)
+	}
+	v.checkControlNet(request.AlwaysonScripts)
+	return v.result()
+}
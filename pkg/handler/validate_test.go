@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/models"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/module"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func newTestValidator(t *testing.T) *predictValidator {
+	p := &ProxyHandler{taskStore: newTestTaskStore(t)}
+	sdPath := filepath.Join(t.TempDir(), "sd")
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		SdPath:            sdPath,
+		OssPath:           filepath.Join(t.TempDir(), "oss"),
+		UseLocalModels:    "yes",
+		MaxWidth:          1024,
+		MaxHeight:         1024,
+		MaxSteps:          50,
+		Samplers:          []string{"Euler a", "DPM++ 2M Karras"},
+		ControlNetModules: []string{"canny"},
+	}}
+	for _, file := range []string{"models/Stable-diffusion/sd.safetensors", "models/VAE/vae.pt",
+		"models/Lora/style.safetensors", "models/LyCORIS/sub/lyco.safetensors",
+		"models/ControlNet/control_canny.pth"} {
+		path := filepath.Join(sdPath, file)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		assert.Nil(t, os.WriteFile(path, []byte(file), 0666))
+	}
+	module.OssGlobal = new(module.OssManagerLocal)
+	assert.Nil(t, module.OssGlobal.UploadFileByByte("images/admin/done_0.png", []byte("png")))
+	return newPredictValidator(p, "admin")
+}
+
+func errorFields(result *models.ValidateResponse) []string {
+	fields := make([]string, 0, len(result.Errors))
+	for _, one := range result.Errors {
+		fields = append(fields, one.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidateTxt2Img(t *testing.T) {
+	v := newTestValidator(t)
+	request := &models.Txt2ImgJSONRequestBody{
+		StableDiffusionModel: "sd.safetensors",
+		SdVae:                utils.String("vae.pt"),
+		SamplerName:          utils.String("euler A"),
+		Prompt:               utils.String("a cat <lora:style:0.8> <lyco:lyco:1>"),
+		Width:                utils.Int64(512),
+		Height:               utils.Int64(768),
+		Steps:                utils.Int64(20),
+		OutputFormat:         utils.String("webp"),
+		OutputQuality:        utils.Int64(90),
+	}
+	result := v.validateTxt2Img(request)
+	assert.True(t, result.Valid, result.Errors)
+
+	v = newTestValidator(t)
+	request = &models.Txt2ImgJSONRequestBody{
+		StableDiffusionModel: "missing.safetensors",
+		SdVae:                utils.String("missing.pt"),
+		SamplerName:          utils.String("unknown"),
+		Prompt:               utils.String("<lora:missing:1> <hypernet:style:1>"),
+		Width:                utils.Int64(2048),
+		Height:               utils.Int64(0),
+		Steps:                utils.Int64(100),
+		OutputFormat:         utils.String("bmp"),
+		OutputQuality:        utils.Int64(101),
+		AlwaysonScripts: &map[string]interface{}{
+			"controlnet": map[string]interface{}{
+				"args": []interface{}{
+					map[string]interface{}{"module": "depth", "model": "missing [a1b2c3d4]",
+						"image": "task://missing/0"},
+					map[string]interface{}{"module": "canny", "model": "control_canny [d14c016b]"},
+					map[string]interface{}{"enabled": false, "module": "depth"},
+				},
+			},
+		},
+	}
+	result = v.validateTxt2Img(request)
+	assert.False(t, result.Valid)
+	assert.Equal(t, []string{
+		"alwayson_scripts.controlnet.args[0].image",
+		"alwayson_scripts.controlnet.args[0].model",
+		"alwayson_scripts.controlnet.args[0].module",
+		"height", "output_format", "output_quality",
+		"prompt", "prompt",
+		"sampler_name", "sd_vae", "stable_diffusion_model", "steps", "width",
+	}, errorFields(result))
+}
+
+func TestValidateTxt2ImgHr(t *testing.T) {
+	v := newTestValidator(t)
+	request := &models.Txt2ImgJSONRequestBody{
+		StableDiffusionModel: "sd.safetensors",
+		Width:                utils.Int64(512),
+		Height:               utils.Int64(512),
+		EnableHr:             utils.Bool(true),
+		HrScale:              utils.Int64(2),
+		HrSamplerName:        utils.String("unknown"),
+		HrPrompt:             utils.String("<lora:missing:1>"),
+		HrSecondPassSteps:    utils.Int64(0),
+	}
+	// hr_scale*width in range, hr params checked only when enable_hr
+	result := v.validateTxt2Img(request)
+	assert.Equal(t, []string{"hr_prompt", "hr_sampler_name", "hr_second_pass_steps"}, errorFields(result))
+
+	v = newTestValidator(t)
+	request.HrScale = utils.Int64(4)
+	request.HrSamplerName = nil
+	request.HrPrompt = nil
+	request.HrSecondPassSteps = nil
+	result = v.validateTxt2Img(request)
+	assert.Equal(t, []string{"hr_scale", "hr_scale"}, errorFields(result))
+
+	v = newTestValidator(t)
+	request.HrResizeX = utils.Int64(1024)
+	request.HrResizeY = utils.Int64(2048)
+	result = v.validateTxt2Img(request)
+	assert.Equal(t, []string{"hr_resize_y"}, errorFields(result))
+
+	v = newTestValidator(t)
+	request.EnableHr = utils.Bool(false)
+	result = v.validateTxt2Img(request)
+	assert.True(t, result.Valid, result.Errors)
+}
+
+func TestValidateImg2Img(t *testing.T) {
+	v := newTestValidator(t)
+	// done_1.png of task not uploaded
+	images := []string{"task://done/0", "task://done/1", "task://done/5", "task://running/0"}
+	request := &models.Img2ImgJSONRequestBody{
+		StableDiffusionModel: "sd.safetensors",
+		InitImages:           &images,
+		Mask:                 utils.String("task://missing/0"),
+	}
+	result := v.validateImg2Img(request)
+	assert.Equal(t, []string{"init_images[1]", "init_images[2]", "init_images[3]", "mask"}, errorFields(result))
+	for _, one := range result.Errors {
+		assert.Equal(t, validateNotFound, one.Code)
+	}
+
+	// other user image existence not probed
+	v = newTestValidator(t)
+	assert.Nil(t, module.OssGlobal.UploadFileByByte("images/other/a.png", []byte("png")))
+	images = []string{"images/admin/done_0.png", "images/other/a.png", "inputs/other/missing.png"}
+	request.Mask = nil
+	result = v.validateImg2Img(request)
+	assert.Equal(t, []string{"init_images[1]", "init_images[2]"}, errorFields(result))
+	for _, one := range result.Errors {
+		assert.Equal(t, validateForbidden, one.Code)
+	}
+}
+
+func TestValidateNasNotMounted(t *testing.T) {
+	v := newTestValidator(t)
+	config.ConfigGlobal.SdPath = filepath.Join(t.TempDir(), "not_mounted")
+	request := &models.Txt2ImgJSONRequestBody{
+		StableDiffusionModel: "missing.safetensors",
+		SdVae:                utils.String("missing.pt"),
+		Prompt:               utils.String("<lora:missing:1>"),
+	}
+	// model files not checked without nas
+	result := v.validateTxt2Img(request)
+	assert.True(t, result.Valid, result.Errors)
+
+	request.StableDiffusionModel = ""
+	result = v.validateTxt2Img(request)
+	assert.Equal(t, []string{"stable_diffusion_model"}, errorFields(result))
+	assert.Equal(t, validateInvalid, result.Errors[0].Code)
+}
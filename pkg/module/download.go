@@ -0,0 +1,243 @@
+package module
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	downloadPartSuffix  = ".part"
+	downloadStateSuffix = ".part.json"
+	downloadRetry       = 3
+	// chunk retry backoff, same as resilient oss
+	downloadBaseBackoff = 200 * time.Millisecond
+	downloadMaxBackoff  = 5 * time.Second
+)
+
+// ObjectMeta object size and etag
+type ObjectMeta struct {
+	Size int64
+	ETag string
+}
+
+// DownloadOption ranged parallel download option
+type DownloadOption struct {
+	// ETag expected oss etag, object changed return error, md5 etag verify content
+	ETag string
+	// Sha256 expected content sha256 hex, verify after download
+	Sha256      string
+	ChunkSize   int64
+	Concurrency int
+	// OnProgress called after each chunk done
+	OnProgress func(done, total int64)
+}
+
+// downloadState resume state, {dest}.part.json
+type downloadState struct {
+	ETag      string `json:"etag"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunkSize"`
+	Done      []bool `json:"done"`
+}
+
+// DownloadObject ranged parallel download to {dest}.part, resume from {dest}.part.json,
+// verify etag/sha256 then rename to dest, return content sha256
+func DownloadObject(op OssOp, ossKey, dest string, opt *DownloadOption) (string, error) {
+	meta, err := op.GetObjectMeta(ossKey)
+	if err != nil {
+		return "", fmt.Errorf("get object %s meta err=%s", ossKey, err.Error())
+	}
+	etag := normalizeETag(meta.ETag)
+	if opt.ETag != "" && etag != "" && normalizeETag(opt.ETag) != etag {
+		return "", fmt.Errorf("object %s etag %s not match %s", ossKey, etag, opt.ETag)
+	}
+	chunkSize, concurrency := opt.ChunkSize, opt.Concurrency
+	if chunkSize <= 0 {
+		chunkSize = 64 << 20
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return "", err
+	}
+	partFile, stateFile := dest+downloadPartSuffix, dest+downloadStateSuffix
+	state := loadDownloadState(stateFile, etag, meta.Size, chunkSize)
+	f, err := os.OpenFile(partFile, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return "", err
+	}
+	if err := f.Truncate(meta.Size); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := downloadChunks(op, ossKey, f, state, stateFile, concurrency, opt.OnProgress); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	sha256Hex, err := verifyDownload(partFile, etag, opt.Sha256)
+	if err != nil {
+		// content broken, not resume
+		os.Remove(partFile)
+		os.Remove(stateFile)
+		return "", err
+	}
+	if err := os.Rename(partFile, dest); err != nil {
+		return "", err
+	}
+	os.Remove(stateFile)
+	return sha256Hex, nil
+}
+
+// loadDownloadState resume when etag/size/chunkSize same, otherwise restart
+func loadDownloadState(stateFile, etag string, size, chunkSize int64) *downloadState {
+	chunks := int((size + chunkSize - 1) / chunkSize)
+	if body, err := ioutil.ReadFile(stateFile); err == nil {
+		state := new(downloadState)
+		if json.Unmarshal(body, state) == nil && state.ETag == etag && state.Size == size &&
+			state.ChunkSize == chunkSize && len(state.Done) == chunks {
+			return state
+		}
+	}
+	return &downloadState{ETag: etag, Size: size, ChunkSize: chunkSize, Done: make([]bool, chunks)}
+}
+
+func downloadChunks(op OssOp, ossKey string, f *os.File, state *downloadState, stateFile string,
+	concurrency int, onProgress func(done, total int64)) error {
+	var lock sync.Mutex
+	var firstErr error
+	var done int64
+	chunks := make(chan int, len(state.Done))
+	for i, ok := range state.Done {
+		if ok {
+			done += chunkLen(state, i)
+		} else {
+			chunks <- i
+		}
+	}
+	close(chunks)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range chunks {
+				lock.Lock()
+				failed := firstErr != nil
+				lock.Unlock()
+				if failed {
+					return
+				}
+				err := downloadChunk(op, ossKey, f, state, i)
+				lock.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					state.Done[i] = true
+					done += chunkLen(state, i)
+					saveDownloadState(stateFile, state)
+					if onProgress != nil {
+						onProgress(done, state.Size)
+					}
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func downloadChunk(op OssOp, ossKey string, f *os.File, state *downloadState, i int) error {
+	start := int64(i) * state.ChunkSize
+	end := start + chunkLen(state, i) - 1
+	var err error
+	for retry := 0; retry < downloadRetry; retry++ {
+		if retry > 0 {
+			time.Sleep(jitterBackoff(downloadBaseBackoff, downloadMaxBackoff, retry))
+		}
+		var reader io.ReadCloser
+		if reader, err = op.GetObjectRange(ossKey, start, end); err != nil {
+			if !isRetryable(err) {
+				break
+			}
+			continue
+		}
+		var n int64
+		n, err = io.Copy(io.NewOffsetWriter(f, start), reader)
+		reader.Close()
+		if err == nil && n != end-start+1 {
+			err = fmt.Errorf("chunk %d size %d not match %d", i, n, end-start+1)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("download %s range %d-%d err=%s", ossKey, start, end, err.Error())
+}
+
+func chunkLen(state *downloadState, i int) int64 {
+	start := int64(i) * state.ChunkSize
+	if start+state.ChunkSize > state.Size {
+		return state.Size - start
+	}
+	return state.ChunkSize
+}
+
+func saveDownloadState(stateFile string, state *downloadState) {
+	if body, err := json.Marshal(state); err == nil {
+		ioutil.WriteFile(stateFile, body, 0666)
+	}
+}
+
+// verifyDownload md5 etag (not multipart upload etag) and sha256, sha256 always computed in the same pass
+// and returned, model info not read the file again
+func verifyDownload(localFile, etag, sha256Hex string) (string, error) {
+	verifyMd5 := len(etag) == md5.Size*2 && !strings.Contains(etag, "-")
+	f, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	writers := []io.Writer{sha256Hash}
+	if verifyMd5 {
+		writers = append(writers, md5Hash)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return "", err
+	}
+	if verifyMd5 && sumHex(md5Hash) != etag {
+		return "", fmt.Errorf("md5 %s not match etag %s", sumHex(md5Hash), etag)
+	}
+	if sha256Hex != "" && sumHex(sha256Hash) != strings.ToLower(sha256Hex) {
+		return "", errors.New("sha256 not match")
+	}
+	return sumHex(sha256Hash), nil
+}
+
+func sumHex(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeETag oss etag "5B3C..." to 5b3c...
+func normalizeETag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, "\""))
+}
@@ -0,0 +1,134 @@
+package module
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// etagOss local oss with md5 etag
+type etagOss struct {
+	OssManagerLocal
+	etag string
+}
+
+func (o *etagOss) GetObjectMeta(ossKey string) (*ObjectMeta, error) {
+	meta, err := o.OssManagerLocal.GetObjectMeta(ossKey)
+	if err != nil {
+		return nil, err
+	}
+	meta.ETag = o.etag
+	return meta, nil
+}
+
+// rangeFailOss ranged read fail first fails calls with failErr
+type rangeFailOss struct {
+	OssManagerLocal
+	lock    sync.Mutex
+	calls   int
+	fails   int
+	failErr error
+}
+
+func (o *rangeFailOss) GetObjectRange(ossKey string, start, end int64) (io.ReadCloser, error) {
+	o.lock.Lock()
+	o.calls++
+	failed := o.calls <= o.fails
+	o.lock.Unlock()
+	if failed {
+		return nil, o.failErr
+	}
+	return o.OssManagerLocal.GetObjectRange(ossKey, start, end)
+}
+
+func TestDownloadObject(t *testing.T) {
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{OssPath: t.TempDir()}}
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	local := new(OssManagerLocal)
+	assert.Nil(t, local.UploadFileByByte("models/model.safetensors", content))
+	md5Sum, sha256Sum := md5.Sum(content), sha256.Sum256(content)
+	op := &etagOss{etag: fmt.Sprintf("\"%X\"", md5Sum)}
+	dest := filepath.Join(t.TempDir(), "Stable-diffusion", "model.safetensors")
+
+	// parallel download, verify md5 etag and sha256
+	var progress int64
+	sum, err := DownloadObject(op, "models/model.safetensors", dest, &DownloadOption{
+		ETag:        hex.EncodeToString(md5Sum[:]),
+		Sha256:      hex.EncodeToString(sha256Sum[:]),
+		ChunkSize:   64,
+		Concurrency: 4,
+		OnProgress:  func(done, total int64) { progress = done },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, hex.EncodeToString(sha256Sum[:]), sum)
+	assert.Equal(t, int64(1000), progress)
+	body, _ := ioutil.ReadFile(dest)
+	assert.Equal(t, content, body)
+	_, err = os.Stat(dest + downloadStateSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// resume: first chunks done, only download rest
+	resumeDest := dest + ".resume"
+	state := loadDownloadState(resumeDest+downloadStateSuffix, "", int64(len(content)), 100)
+	part := make([]byte, len(content))
+	copy(part, content[:500])
+	for i := 0; i < 5; i++ {
+		state.Done[i] = true
+	}
+	assert.Nil(t, ioutil.WriteFile(resumeDest+downloadPartSuffix, part, 0666))
+	saveDownloadState(resumeDest+downloadStateSuffix, state)
+	progress = 0
+	sum, err = DownloadObject(local, "models/model.safetensors", resumeDest, &DownloadOption{
+		ChunkSize:  100,
+		OnProgress: func(done, total int64) { progress++ },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), progress)
+	assert.Equal(t, hex.EncodeToString(sha256Sum[:]), sum)
+	body, _ = ioutil.ReadFile(resumeDest)
+	assert.Equal(t, content, body)
+
+	// etag changed
+	_, err = DownloadObject(op, "models/model.safetensors", dest, &DownloadOption{ETag: "other"})
+	assert.NotNil(t, err)
+	// sha256 not match, part file removed
+	_, err = DownloadObject(local, "models/model.safetensors", dest+".bad", &DownloadOption{Sha256: "00"})
+	assert.NotNil(t, err)
+	_, err = os.Stat(dest + ".bad" + downloadPartSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadChunkRetry(t *testing.T) {
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{OssPath: t.TempDir()}}
+	content := make([]byte, 100)
+	local := new(OssManagerLocal)
+	assert.Nil(t, local.UploadFileByByte("models/model.safetensors", content))
+	dest := filepath.Join(t.TempDir(), "model.safetensors")
+
+	// transient error retried
+	op := &rangeFailOss{fails: downloadRetry - 1, failErr: errors.New("connection reset")}
+	_, err := DownloadObject(op, "models/model.safetensors", dest, &DownloadOption{})
+	assert.Nil(t, err)
+	assert.Equal(t, downloadRetry, op.calls)
+
+	// not found not retried
+	op = &rangeFailOss{fails: downloadRetry, failErr: oss.ServiceError{StatusCode: http.StatusNotFound}}
+	_, err = DownloadObject(op, "models/model.safetensors", dest+".missing", &DownloadOption{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, op.calls)
+}
@@ -12,29 +12,48 @@ var client = &http.Client{}
 // ModelChangeEvent  models change callback func
 func ModelChangeEvent(v any) {
 	modelType := v.(string)
-	path := ""
-	method := "GET"
-	switch modelType {
-	case config.SD_MODEL:
-		path = config.REFRESH_SD_MODEL
-		method = "POST"
-	case config.CONTORLNET_MODEL:
-		path = config.REFRESH_CONTROLNET
-		method = "GET"
-	case config.SD_VAE:
-		path = config.REFRESH_VAE
-		method = "POST"
-	default:
+	mt := config.ConfigGlobal.GetModelType(modelType)
+	if mt == nil || mt.RefreshPath == "" {
 		logrus.Infof("[ModelChangeEvent] modelType=%s no need reload", modelType)
 		return
 	}
-	url := fmt.Sprintf("%s%s", config.ConfigGlobal.SdUrlPrefix, path)
+	if err := refreshModelType(mt); err != nil {
+		logrus.Info("[ModelChangeEvent] listen model refresh do fail")
+	}
+}
+
+// refreshModelType call sd refresh api of model type
+func refreshModelType(mt *config.ModelType) error {
+	method := mt.RefreshMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+	url := fmt.Sprintf("%s%s", config.ConfigGlobal.SdUrlPrefix, mt.RefreshPath)
 	req, _ := http.NewRequest(method, url, nil)
-	_, err := client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		logrus.Info("[ModelChangeEvent] listen model refresh do fail")
-		return
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("refresh %s status %d", mt.RefreshPath, resp.StatusCode)
 	}
+	return nil
+}
+
+// refreshWebuiModels refresh model list of webui in this instance after register,
+// without local webui agents refresh by model file change
+func refreshWebuiModels(modelType string) error {
+	mt := config.ConfigGlobal.GetModelType(modelType)
+	if !hasLocalWebui() || mt == nil || mt.RefreshPath == "" {
+		return nil
+	}
+	return refreshModelType(mt)
+}
+
+// hasLocalWebui sd webui run in this instance
+func hasLocalWebui() bool {
+	return config.ConfigGlobal.IsServerTypeMatch(config.AGENT)
 }
 
 // CancelEvent tasks cancel signal callback
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +14,7 @@ import (
 	fc3 "github.com/alibabacloud-go/fc-20230330/client"
 	fc "github.com/alibabacloud-go/fc-open-20210406/v2/client"
 	fcService "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/alibabacloud-go/tea/tea"
 	gr "github.com/awesome-fc/golang-runtime"
 	"github.com/devsapp/goutils/aigc/project"
 	fcUtils "github.com/devsapp/goutils/fc"
@@ -263,6 +266,59 @@ func (f *FuncManager) DeleteFunction(functions []string) ([]string, []string) {
 	}
 }
 
+// ModelFunctions sdModel key => function name, only keys has function in db
+func (f *FuncManager) ModelFunctions(keys []string) map[string]string {
+	ret := make(map[string]string)
+	for _, key := range keys {
+		data, err := f.funcStore.Get(key, []string{datastore.KModelServiceFunctionName})
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		if functionName, ok := data[datastore.KModelServiceFunctionName].(string); ok && functionName != "" {
+			ret[key] = functionName
+		}
+	}
+	return ret
+}
+
+// DeleteModelFunction delete functions of sdModel keys and evict endpoint cache of the keys,
+// return deleted function names
+func (f *FuncManager) DeleteModelFunction(keys []string) (deleted []string, fails []string, errs []string) {
+	funcs := f.ModelFunctions(keys)
+	functionNames := make([]string, 0, len(funcs))
+	for _, functionName := range funcs {
+		functionNames = append(functionNames, functionName)
+	}
+	sort.Strings(functionNames)
+	if len(functionNames) != 0 {
+		fails, errs = f.DeleteFunction(functionNames)
+	}
+	failed := make(map[string]struct{}, len(fails))
+	for _, functionName := range fails {
+		failed[functionName] = struct{}{}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, key := range keys {
+		if _, ok := failed[funcs[key]]; ok {
+			continue
+		}
+		// cached without db row when create function fail
+		if val, ok := f.endpoints[key]; ok {
+			if val[0] == f.lastInvokeEndpoint {
+				f.lastInvokeEndpoint = ""
+			}
+			delete(f.endpoints, key)
+		}
+	}
+	for _, functionName := range functionNames {
+		if _, ok := failed[functionName]; !ok {
+			deleted = append(deleted, functionName)
+		}
+	}
+	return
+}
+
 // get endpoint from cache
 func (f *FuncManager) getEndpointFromCache(key string) string {
 	f.lock.RLock()
@@ -541,6 +597,20 @@ func getCreateFuncRequest(functionName string, env map[string]*string) *fc.Creat
 }
 
 func (f *FuncManager) delFunction(functionNames []string) (fails []string, errs []string) {
+	return f.delFunctions(functionNames, func(functionName string) error {
+		_, err := f.fcClient.DeleteTrigger(&config.ConfigGlobal.ServiceName, &functionName,
+			utils.String(config.TRIGGER_NAME))
+		return err
+	}, func(functionName string) error {
+		_, err := f.fcClient.DeleteFunction(&config.ConfigGlobal.ServiceName, &functionName)
+		return err
+	})
+}
+
+// delFunctions delete trigger then function, db row deleted only after function deleted so that
+// failed one can be deleted again, trigger or function not found treated as deleted
+func (f *FuncManager) delFunctions(functionNames []string,
+	delTrigger, delFunc func(functionName string) error) (fails []string, errs []string) {
 	func2Model := make(map[string]string)
 	funcs, err := f.funcStore.ListAll([]string{datastore.KModelServiceFunctionName})
 	if err == nil && funcs != nil {
@@ -550,21 +620,16 @@ func (f *FuncManager) delFunction(functionNames []string) (fails []string, errs
 	}
 
 	for _, functionName := range functionNames {
-		if modelName, exist := func2Model[functionName]; exist {
-			if err := f.funcStore.Delete(modelName); err != nil {
-				logrus.Warnf("%s delete fail, err: %s", functionName, err.Error())
-				fails = append(fails, functionName)
-				errs = append(errs, err.Error())
+		err := delTrigger(functionName)
+		if err == nil || isFcNotFound(err) {
+			if err = delFunc(functionName); isFcNotFound(err) {
+				err = nil
 			}
 		}
-
-		if _, err := f.fcClient.DeleteTrigger(&config.ConfigGlobal.ServiceName, &functionName, utils.String(config.TRIGGER_NAME)); err != nil {
-			logrus.Warnf("%s delete fail, err: %s", functionName, err.Error())
-			fails = append(fails, functionName)
-			errs = append(errs, err.Error())
-			continue
+		if modelName, exist := func2Model[functionName]; exist && err == nil {
+			err = f.funcStore.Delete(modelName)
 		}
-		if _, err := f.fcClient.DeleteFunction(&config.ConfigGlobal.ServiceName, &functionName); err != nil {
+		if err != nil {
 			logrus.Warnf("%s delete fail, err: %s", functionName, err.Error())
 			fails = append(fails, functionName)
 			errs = append(errs, err.Error())
@@ -573,6 +638,12 @@ func (f *FuncManager) delFunction(functionNames []string) (fails []string, errs
 	return
 }
 
+// isFcNotFound fc api error of resource not exist
+func isFcNotFound(err error) bool {
+	var sdkErr *tea.SDKError
+	return errors.As(err, &sdkErr) && tea.IntValue(sdkErr.StatusCode) == http.StatusNotFound
+}
+
 // get trigger request
 func getHttpTrigger() *fc.CreateTriggerRequest {
 	triggerConfig := make(map[string]interface{})
@@ -670,36 +741,13 @@ func (f *FuncManager) getCreateFuncRequestFc3(functionName string, env map[strin
 
 // delete function
 func (f *FuncManager) delFunctionFC3(functionNames []string) (fails []string, errs []string) {
-	func2Model := make(map[string]string)
-	funcs, err := f.funcStore.ListAll([]string{datastore.KModelServiceFunctionName})
-	if err == nil && funcs != nil {
-		for model, data := range funcs {
-			func2Model[data[datastore.KModelServiceFunctionName].(string)] = model
-		}
-	}
-
-	for _, functionName := range functionNames {
-		if modelName, exist := func2Model[functionName]; exist {
-			if err := f.funcStore.Delete(modelName); err != nil {
-				logrus.Warnf("%s delete fail, err: %s", functionName, err.Error())
-				fails = append(fails, functionName)
-				errs = append(errs, err.Error())
-			}
-		}
-
-		if _, err := f.fc3Client.DeleteTrigger(&functionName, utils.String(config.TRIGGER_NAME)); err != nil {
-			logrus.Warnf("%s delete fail, err: %s", functionName, err.Error())
-			fails = append(fails, functionName)
-			errs = append(errs, err.Error())
-			continue
-		}
-		if _, err := f.fc3Client.DeleteFunction(&functionName); err != nil {
-			logrus.Warnf("%s delete fail, err: %s", functionName, err.Error())
-			fails = append(fails, functionName)
-			errs = append(errs, err.Error())
-		}
-	}
-	return
+	return f.delFunctions(functionNames, func(functionName string) error {
+		_, err := f.fc3Client.DeleteTrigger(&functionName, utils.String(config.TRIGGER_NAME))
+		return err
+	}, func(functionName string) error {
+		_, err := f.fc3Client.DeleteFunction(&functionName)
+		return err
+	})
 }
 
 // get trigger request
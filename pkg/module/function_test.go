@@ -1,9 +1,17 @@
 package module
 
 import (
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	fc3 "github.com/alibabacloud-go/fc-20230330/client"
 	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
 	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -19,3 +27,87 @@ func TestFunction(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotEqual(t, endpoint, "")
 }
+
+func TestDeleteModelFunction(t *testing.T) {
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		DbSqlite: filepath.Join(t.TempDir(), "sqlite3"),
+	}}
+	funcStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelServiceTableName))
+	defer funcStore.Close()
+	f := &FuncManager{
+		funcStore: funcStore,
+		endpoints: map[string][]string{
+			"sd.safetensors":    {"http://sd", "sd.safetensors"},
+			"sd@v2.safetensors": {"http://sd-v2", "sd@v2.safetensors"},
+			"other.safetensors": {"http://other", "other.safetensors"},
+		},
+		lastInvokeEndpoint: "http://sd-v2",
+	}
+	// function not in db, only endpoint cache evicted
+	deleted, fails, _ := f.DeleteModelFunction([]string{"sd.safetensors", "sd@v2.safetensors"})
+	assert.Equal(t, 0, len(deleted))
+	assert.Equal(t, 0, len(fails))
+	assert.Equal(t, "", f.getEndpointFromCache("sd.safetensors"))
+	assert.Equal(t, "", f.getEndpointFromCache("sd@v2.safetensors"))
+	assert.Equal(t, "http://other", f.getEndpointFromCache("other.safetensors"))
+	assert.Equal(t, "", f.lastInvokeEndpoint)
+}
+
+func TestDeleteModelFunctionFail(t *testing.T) {
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		DbSqlite: filepath.Join(t.TempDir(), "sqlite3"),
+	}}
+	funcStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelServiceTableName))
+	defer funcStore.Close()
+	// function path => status of delete, trigger of all functions not found
+	var lock sync.Mutex
+	status := map[string]int{"/2023-03-30/functions/sd_a": http.StatusInternalServerError,
+		"/2023-03-30/functions/sd_b": http.StatusNotFound}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		code, ok := status[r.URL.Path]
+		if strings.Contains(r.URL.Path, "/triggers/") || !ok {
+			code = http.StatusNotFound
+		}
+		if code == http.StatusNoContent {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(`{"Code":"Error","Message":"delete fail"}`))
+	}))
+	defer server.Close()
+	client, err := fc3.NewClient(new(openapi.Config).SetAccessKeyId("ak").SetAccessKeySecret("sk").
+		SetProtocol("HTTP").SetEndpoint(strings.TrimPrefix(server.URL, "http://")))
+	assert.Nil(t, err)
+	f := &FuncManager{
+		funcStore: funcStore,
+		fc3Client: client,
+		endpoints: map[string][]string{
+			"sd.safetensors":    {"http://sd", "sd.safetensors"},
+			"sd@v2.safetensors": {"http://sd-v2", "sd@v2.safetensors"},
+		},
+	}
+	f.putFunc("sd.safetensors", "sd_a", "sd.safetensors", "http://sd")
+	f.putFunc("sd@v2.safetensors", "sd_b", "sd@v2.safetensors", "http://sd-v2")
+
+	// function delete fail, row and cache kept to delete again, not found treated as deleted
+	deleted, fails, errs := f.DeleteModelFunction([]string{"sd.safetensors", "sd@v2.safetensors"})
+	assert.Equal(t, []string{"sd_b"}, deleted)
+	assert.Equal(t, []string{"sd_a"}, fails)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "http://sd", f.getEndpointFromCache("sd.safetensors"))
+	assert.Equal(t, "", f.getEndpointFromCache("sd@v2.safetensors"))
+	assert.Equal(t, map[string]string{"sd.safetensors": "sd_a"},
+		f.ModelFunctions([]string{"sd.safetensors", "sd@v2.safetensors"}))
+
+	lock.Lock()
+	status["/2023-03-30/functions/sd_a"] = http.StatusNoContent
+	lock.Unlock()
+	deleted, fails, _ = f.DeleteModelFunction([]string{"sd.safetensors"})
+	assert.Equal(t, []string{"sd_a"}, deleted)
+	assert.Equal(t, 0, len(fails))
+	assert.Equal(t, 0, len(f.ModelFunctions([]string{"sd.safetensors"})))
+}
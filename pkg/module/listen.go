@@ -126,21 +126,28 @@ func (l *ListenDbTask) configTask(item *TaskItem) {
 
 // listen model task
 func (l *ListenDbTask) modelTask(item *TaskItem) {
-	// controlNet
-	oldVal := *(item.curVal.(*map[string]struct{}))
-	path := fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "ControlNet")
-	curVal := listModelFile(path)
-	add, del := utils.DiffSet(oldVal, curVal)
-	if len(add) != 0 || len(del) != 0 {
-		logrus.Infof("[modelTask] controlnet model change add: %s, del: %s",
+	// controlNet, lora and other types with refresh api, compare with last file list
+	snapshot := *(item.curVal.(*map[string]map[string]struct{}))
+	refreshed := make(map[string]struct{})
+	for _, modelType := range watchModelTypes() {
+		curVal := listModelFile(modelType)
+		add, del := utils.DiffSet(snapshot[modelType], curVal)
+		if len(add) == 0 && len(del) == 0 {
+			continue
+		}
+		logrus.Infof("[modelTask] %s model change add: %s, del: %s", modelType,
 			strings.Join(add, ","), strings.Join(del, ","))
-		item.curVal = &curVal
-		item.callBack(config.CONTORLNET_MODEL)
+		snapshot[modelType] = curVal
+		// types share refresh api call once
+		refreshPath := config.ConfigGlobal.GetModelType(modelType).RefreshPath
+		if _, ok := refreshed[refreshPath]; !ok {
+			refreshed[refreshPath] = struct{}{}
+			item.callBack(modelType)
+		}
 	}
 	// vae
 	if oldVal, err := getVaeFromSD(); err == nil {
-		path := fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "VAE")
-		curVal := listModelFile(path)
+		curVal := listModelFile(config.SD_VAE)
 		add, del := utils.DiffSet(oldVal, curVal)
 		if len(add) != 0 || len(del) != 0 {
 			logrus.Infof("[modelTask] vae model change add: %s, del: %s",
@@ -150,8 +157,7 @@ func (l *ListenDbTask) modelTask(item *TaskItem) {
 	}
 	// checkpoint
 	if oldVal, err := getCheckPointFromSD(); err == nil {
-		path := fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "Stable-diffusion")
-		curVal := listModelFile(path)
+		curVal := listModelFile(config.SD_MODEL)
 		add, del := utils.DiffSet(oldVal, curVal)
 		if len(add) != 0 || len(del) != 0 {
 			logrus.Infof("[modelTask] Stable-diffusion model change add: %s, del: %s",
@@ -188,13 +194,10 @@ func (l *ListenDbTask) cancelTask(taskId string, item *TaskItem) {
 func (l *ListenDbTask) AddTask(key string, listenType ListenType, callBack CallBack) {
 	var curVal interface{}
 	if listenType == ModelListen {
-		// controlNet load and other type model not need
-		path := fmt.Sprintf("%s/models/%s", config.ConfigGlobal.SdPath, "ControlNet")
-		datas := listModelFile(path)
-		val := make(map[string]struct{})
-		for data := range datas {
-			modelName := data
-			val[modelName] = struct{}{}
+		// file list of types refresh by file change
+		val := make(map[string]map[string]struct{})
+		for _, modelType := range watchModelTypes() {
+			val[modelType] = listModelFile(modelType)
 		}
 		curVal = &val
 	} else if listenType == ConfigListen {
@@ -255,18 +258,115 @@ func (l *ListenDbTask) Close() {
 	l.stop <- struct{}{}
 }
 
-func listModelFile(path string) map[string]struct{} {
-	files := utils.ListFile(path)
+// listModelFile model files in dir of model type
+func listModelFile(modelType string) map[string]struct{} {
 	ret := make(map[string]struct{})
-	for _, name := range files {
-		if strings.HasSuffix(name, ".pt") || strings.HasSuffix(name, ".ckpt") ||
-			strings.HasSuffix(name, ".safetensors") || strings.HasSuffix(name, ".pth") {
+	mt := config.ConfigGlobal.GetModelType(modelType)
+	if mt == nil {
+		return ret
+	}
+	for _, name := range utils.ListFile(config.ConfigGlobal.ModelTypeDir(modelType)) {
+		if mt.IsModelFile(name) {
 			ret[name] = struct{}{}
 		}
 	}
 	return ret
 }
 
+// ModelFile model file on disk and the type it belongs to
+type ModelFile struct {
+	Name      string
+	Type      string
+	LocalPath string
+}
+
+// ListModelFiles model files of types, empty all types. types share dir (eg: controlNet and ipAdapter)
+// scanned once with union of their extensions, file belong to the first type in ModelTypeNames order
+// whose extensions match
+func ListModelFiles(modelTypes ...string) []*ModelFile {
+	want := make(map[string]struct{}, len(modelTypes))
+	for _, modelType := range modelTypes {
+		want[modelType] = struct{}{}
+	}
+	wanted := func(modelType string) bool {
+		_, ok := want[modelType]
+		return len(want) == 0 || ok
+	}
+	dirs := make([]string, 0)
+	dirTypes := make(map[string][]string)
+	for _, modelType := range config.ConfigGlobal.ModelTypeNames() {
+		dir := config.ConfigGlobal.ModelTypeDir(modelType)
+		if _, ok := dirTypes[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		dirTypes[dir] = append(dirTypes[dir], modelType)
+	}
+	ret := make([]*ModelFile, 0)
+	for _, dir := range dirs {
+		types := make([]string, 0, len(dirTypes[dir]))
+		for _, modelType := range dirTypes[dir] {
+			if wanted(modelType) {
+				types = append(types, modelType)
+			}
+		}
+		if len(types) == 0 {
+			continue
+		}
+		for _, name := range utils.ListFile(dir) {
+			modelType := modelFileType(name, dirTypes[dir])
+			if modelType == "" || !wanted(modelType) {
+				continue
+			}
+			ret = append(ret, &ModelFile{Name: name, Type: modelType, LocalPath: fmt.Sprintf("%s/%s", dir, name)})
+		}
+	}
+	return ret
+}
+
+// modelFileType first type whose extensions match file, "" if not model file
+func modelFileType(name string, modelTypes []string) string {
+	for _, modelType := range modelTypes {
+		if config.ConfigGlobal.GetModelType(modelType).IsModelFile(name) {
+			return modelType
+		}
+	}
+	return ""
+}
+
+// webuiHasModel checkpoint and vae listed by webui of this instance,
+// other types (or no local webui) listed in dir of model type
+func webuiHasModel(modelType, fileName string) (bool, error) {
+	var list map[string]struct{}
+	var err error
+	switch {
+	case hasLocalWebui() && modelType == config.SD_MODEL:
+		list, err = getCheckPointFromSD()
+	case hasLocalWebui() && modelType == config.SD_VAE:
+		list, err = getVaeFromSD()
+	default:
+		list = listModelFile(modelType)
+	}
+	if err != nil {
+		return false, err
+	}
+	_, ok := list[fileName]
+	return ok, nil
+}
+
+// watchModelTypes types with refresh api, checkpoint and vae compare with sd api list instead
+func watchModelTypes() []string {
+	ret := make([]string, 0)
+	for _, modelType := range config.ConfigGlobal.ModelTypeNames() {
+		if modelType == config.SD_MODEL || modelType == config.SD_VAE {
+			continue
+		}
+		if config.ConfigGlobal.GetModelType(modelType).RefreshPath != "" {
+			ret = append(ret, modelType)
+		}
+	}
+	return ret
+}
+
 func updateConfig(data []byte, md5 string, configStore datastore.Datastore) error {
 	// check data valid
 	if !json.Valid(data) {
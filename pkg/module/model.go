@@ -0,0 +1,576 @@
+package module
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressPersistStep persist download progress to db every 5%
+const progressPersistStep = 5
+
+var ModelManagerGlobal *modelManager
+
+var ErrModelRegistering = errors.New("model is registering with other source or etag")
+
+var errModelSource = errors.New("one of ossPath, url and huggingFace must be set")
+
+// ModelRegister register request, download from OssPath or http(s) Url
+type ModelRegister struct {
+	Type    string
+	Name    string
+	OssPath string
+	Url     string
+	Etag    string
+	Sha256  string
+	// Version download to versioned file, 0 same as version 1
+	Version int
+	// Token http auth token, not saved, resume use hub token of config
+	Token string
+	// Acl owner and visibility, nil public model without owner
+	Acl *ModelAcl
+	// update job of registered model, nil register
+	update *modelUpdate
+}
+
+// modelUpdate update job saved in MODEL_JOB, resumed with its source and version after crash
+type modelUpdate struct {
+	Type    string `json:"type"`
+	OssPath string `json:"ossPath,omitempty"`
+	Url     string `json:"url,omitempty"`
+	Etag    string `json:"etag,omitempty"`
+	Sha256  string `json:"sha256,omitempty"`
+	Version int    `json:"version"`
+	// PrevStatus restored if update fail, old versions still serving
+	PrevStatus string `json:"prevStatus"`
+}
+
+// SetSource only one of ossPath/url/hub reference allowed, hub reference resolve to url
+func (r *ModelRegister) SetSource(ossPath, rawUrl, hubRef string) error {
+	count := 0
+	for _, item := range []string{ossPath, rawUrl, hubRef} {
+		if item != "" {
+			count++
+		}
+	}
+	if count != 1 {
+		return errModelSource
+	}
+	r.OssPath, r.Url = ossPath, rawUrl
+	if hubRef != "" {
+		hubUrl, err := ResolveHubRef(config.ConfigGlobal.ModelHubEndpoint, hubRef)
+		if err != nil {
+			return err
+		}
+		r.Url = hubUrl
+	}
+	if r.Url != "" {
+		u, err := url.Parse(r.Url)
+		if err != nil {
+			return fmt.Errorf("model url %s not valid", r.Url)
+		}
+		return ModelUrlPolicy().Check(u)
+	}
+	return nil
+}
+
+func (r *ModelRegister) sameSource(other *ModelRegister) bool {
+	return r.Type == other.Type && r.OssPath == other.OssPath && r.Url == other.Url && r.Etag == other.Etag
+}
+
+// ModelProgress download progress, save in MODEL_PROGRESS as json
+type ModelProgress struct {
+	Bytes   int64 `json:"bytes"`
+	Total   int64 `json:"total"`
+	Percent int64 `json:"percent"`
+}
+
+// modelJobLease seconds of register job claimed in db, renewed while running,
+// job of crashed instance taken over after lease expired
+const modelJobLease = 60
+
+// modelLoadCheck times to check webui report the model after refresh, modelLoadInterval between checks
+const (
+	modelLoadCheck    = 3
+	modelLoadInterval = 2 * time.Second
+)
+
+// modelManager register or update model in background: registering(download) -> loading(refresh webui) -> loaded|failed,
+// job claimed in db with owner and lease, only one instance run it
+type modelManager struct {
+	modelStore datastore.Datastore
+	// owner of jobs claimed by this instance
+	owner string
+	lock  sync.Mutex
+	// model name => running register
+	jobs map[string]*ModelRegister
+	// refresh webui model list of type, loaded check webui report model file
+	refresh      func(modelType string) error
+	loaded       func(modelType, fileName string) (bool, error)
+	loadInterval time.Duration
+}
+
+// InitModelManager resume registering models of last run, download continue from .part file
+func InitModelManager(modelStore datastore.Datastore) error {
+	ModelManagerGlobal = newModelManager(modelStore)
+	datas, err := modelStore.ListAll([]string{datastore.KModelName, datastore.KModelStatus})
+	if err != nil {
+		return err
+	}
+	for _, data := range datas {
+		if status, _ := data[datastore.KModelStatus].(string); status != config.MODEL_REGISTERING &&
+			status != config.MODEL_LOADING {
+			continue
+		}
+		name, _ := data[datastore.KModelName].(string)
+		ModelManagerGlobal.resume(name)
+	}
+	return nil
+}
+
+func newModelManager(modelStore datastore.Datastore) *modelManager {
+	return &modelManager{
+		modelStore:   modelStore,
+		owner:        newLeaseOwner(),
+		jobs:         make(map[string]*ModelRegister),
+		refresh:      refreshWebuiModels,
+		loaded:       webuiHasModel,
+		loadInterval: modelLoadInterval,
+	}
+}
+
+// newLeaseOwner unique id of instance holding lease in db
+func newLeaseOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), utils.RandStr(8))
+}
+
+// Register return immediately, same name registering in any instance coalesced,
+// return false if other request of the name running
+func (m *modelManager) Register(req *ModelRegister) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if job, ok := m.jobs[req.Name]; ok {
+		return false, coalesce(job, req)
+	}
+	now := fmt.Sprintf("%d", utils.TimestampS())
+	values := map[string]interface{}{
+		datastore.KModelType:       req.Type,
+		datastore.KModelName:       req.Name,
+		datastore.KModelOssPath:    req.OssPath,
+		datastore.KModelUrl:        req.Url,
+		datastore.KModelEtag:       req.Etag,
+		datastore.KModelSha256:     req.Sha256,
+		datastore.KModelStatus:     config.MODEL_REGISTERING,
+		datastore.KModelProgress:   "{}",
+		datastore.KModelMessage:    "",
+		datastore.KModelCreateTime: now,
+		datastore.KModelModifyTime: now,
+	}
+	// columns of deleted or failed registration cleared
+	for _, key := range []string{datastore.KModelLocalPath, datastore.KModelShortHash, datastore.KModelInfo,
+		datastore.KModelVersions, datastore.KModelAliases, datastore.KModelLastUsed, datastore.KModelUseCount,
+		datastore.KModelJob} {
+		values[key] = ""
+	}
+	acl := req.Acl
+	if acl == nil {
+		acl = new(ModelAcl)
+	}
+	for key, val := range acl.Values() {
+		values[key] = val
+	}
+	running, err := m.claim(req.Name, values)
+	if err != nil {
+		return false, err
+	}
+	if running != nil {
+		return false, coalesce(running, req)
+	}
+	m.jobs[req.Name] = req
+	go m.run(req)
+	return true, nil
+}
+
+// coalesce same source request share the running job
+func coalesce(running, req *ModelRegister) error {
+	if !running.sameSource(req) {
+		return ErrModelRegistering
+	}
+	return nil
+}
+
+// IsRegistering model register running in this instance
+func (m *modelManager) IsRegistering(name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.jobs[name]
+	return ok
+}
+
+// resume claim registering model of crashed instance or last run, source read from db
+func (m *modelManager) resume(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.jobs[name]; ok {
+		return
+	}
+	running, err := m.claim(name, map[string]interface{}{})
+	if err != nil {
+		logrus.Warnf("resume register model %s err=%s", name, err.Error())
+		return
+	}
+	if running != nil {
+		return
+	}
+	data, err := m.modelStore.Get(name, []string{datastore.KModelType, datastore.KModelOssPath,
+		datastore.KModelUrl, datastore.KModelEtag, datastore.KModelSha256, datastore.KModelJob})
+	if err != nil || data == nil {
+		m.release(name)
+		return
+	}
+	req := parseModelRegister(name, data)
+	req.Sha256, _ = data[datastore.KModelSha256].(string)
+	if job, _ := data[datastore.KModelJob].(string); job != "" {
+		// update job, source of new version not in model columns
+		update := new(modelUpdate)
+		if err := json.Unmarshal([]byte(job), update); err != nil {
+			logrus.Warnf("resume update model %s err=%s", name, err.Error())
+			m.release(name)
+			return
+		}
+		req = update.register(name)
+	}
+	logrus.Infof("resume register model %s", name)
+	m.jobs[name] = req
+	go m.run(req)
+}
+
+// claim write values with owner and lease of this instance if no unexpired job of other instance,
+// otherwise return the running register, conditional update so only one instance win
+func (m *modelManager) claim(name string, values map[string]interface{}) (*ModelRegister, error) {
+	data, err := m.modelStore.Get(name, modelJobColumns)
+	if err != nil {
+		return nil, err
+	}
+	// no values only claim existed model
+	if data == nil && len(values) == 0 {
+		return nil, ErrModelVersionNotFound
+	}
+	var expect map[string]interface{}
+	if data != nil {
+		owner, _ := data[datastore.KModelJobOwner].(string)
+		lease, _ := data[datastore.KModelJobLease].(string)
+		if owner != "" && owner != m.owner && !leaseExpired(lease) {
+			return parseModelRegister(name, data), nil
+		}
+		expect = map[string]interface{}{
+			datastore.KModelJobOwner: owner,
+			datastore.KModelJobLease: lease,
+		}
+	}
+	values[datastore.KModelJobOwner] = m.owner
+	values[datastore.KModelJobLease] = newLease()
+	claimed, err := m.modelStore.UpdateIf(name, values, expect)
+	if err != nil || claimed {
+		return nil, err
+	}
+	// claimed by other instance at the same time
+	if data, err = m.modelStore.Get(name, modelJobColumns); err != nil {
+		return nil, err
+	}
+	return parseModelRegister(name, data), nil
+}
+
+var modelJobColumns = []string{datastore.KModelType, datastore.KModelOssPath, datastore.KModelUrl,
+	datastore.KModelEtag, datastore.KModelJobOwner, datastore.KModelJobLease}
+
+func parseModelRegister(name string, data map[string]interface{}) *ModelRegister {
+	req := &ModelRegister{Name: name}
+	req.Type, _ = data[datastore.KModelType].(string)
+	req.OssPath, _ = data[datastore.KModelOssPath].(string)
+	req.Url, _ = data[datastore.KModelUrl].(string)
+	req.Etag, _ = data[datastore.KModelEtag].(string)
+	return req
+}
+
+// newLease expire timestamp of job claimed now
+func newLease() string {
+	return fmt.Sprintf("%d", utils.TimestampS()+modelJobLease)
+}
+
+func leaseExpired(lease string) bool {
+	expire, err := strconv.ParseInt(lease, 10, 64)
+	return err != nil || expire < utils.TimestampS()
+}
+
+// renew lease of job until stop closed
+func (m *modelManager) renew(name string, stop chan struct{}) {
+	ticker := time.NewTicker(modelJobLease * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !m.updateOwned(name, map[string]interface{}{datastore.KModelJobLease: newLease()}) {
+				logrus.Warnf("renew register model %s lease fail", name)
+			}
+		}
+	}
+}
+
+// updateOwned update only when job still owned by this instance
+func (m *modelManager) updateOwned(name string, values map[string]interface{}) bool {
+	ok, err := m.modelStore.UpdateIf(name, values, map[string]interface{}{datastore.KModelJobOwner: m.owner})
+	if err != nil {
+		logrus.Warnf("update model %s err=%s", name, err.Error())
+	}
+	return ok
+}
+
+// release job claimed by this instance
+func (m *modelManager) release(name string) {
+	m.updateOwned(name, map[string]interface{}{
+		datastore.KModelJobOwner: "",
+		datastore.KModelJobLease: "",
+	})
+}
+
+func (m *modelManager) run(req *ModelRegister) {
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		m.lock.Lock()
+		delete(m.jobs, req.Name)
+		m.lock.Unlock()
+	}()
+	go m.renew(req.Name, stop)
+	lastPercent := int64(-progressPersistStep)
+	localFile, sha256Hex, err := DownloadModel(req, func(done, total int64) {
+		percent := done * 100 / total
+		if percent-lastPercent < progressPersistStep && done != total {
+			return
+		}
+		lastPercent = percent
+		m.update(req.Name, config.MODEL_REGISTERING, &ModelProgress{Bytes: done, Total: total,
+			Percent: percent}, "")
+	})
+	if err != nil {
+		logrus.Errorf("register model %s err=%s", req.Name, err.Error())
+		m.fail(req, err)
+		return
+	}
+	ver := newModelVersion(req, localFile, sha256Hex)
+	values := map[string]interface{}{}
+	if req.update == nil {
+		// registered model start from version 1, sd load it when refresh
+		versions := &ModelVersions{Aliases: make(map[string]int)}
+		versions.Add(ver)
+		values = versions.Values()
+		for key, val := range ver.values() {
+			values[key] = val
+		}
+	}
+	values[datastore.KModelStatus] = config.MODEL_LOADING
+	values[datastore.KModelModifyTime] = fmt.Sprintf("%d", utils.TimestampS())
+	if !m.updateOwned(req.Name, values) {
+		logrus.Errorf("update model %s status fail, job taken over", req.Name)
+		return
+	}
+	if err := m.load(req.Type, filepath.Base(localFile)); err != nil {
+		logrus.Errorf("load model %s err=%s", req.Name, err.Error())
+		if req.update != nil {
+			// new version not added, file not referenced
+			os.Remove(localFile)
+		}
+		m.fail(req, err)
+		return
+	}
+	// aliases may changed while downloading, read versions and write under lock
+	m.lock.Lock()
+	values, err = m.loadedValues(req, ver)
+	if err == nil && !m.updateOwned(req.Name, values) {
+		err = errors.New("job taken over")
+	}
+	m.lock.Unlock()
+	if err != nil {
+		logrus.Errorf("update model %s status err=%s", req.Name, err.Error())
+		m.fail(req, err)
+		return
+	}
+	logrus.Infof("register model %s version %d success", req.Name, ver.Version)
+}
+
+// loadedValues status loaded and job released, update also add the version and move latest to it
+func (m *modelManager) loadedValues(req *ModelRegister, ver *ModelVersion) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if req.update != nil {
+		versions, err := m.Versions(req.Name)
+		if err != nil {
+			return nil, err
+		}
+		if versions == nil {
+			return nil, ErrModelVersionNotFound
+		}
+		versions.Add(ver)
+		values = versions.Values()
+		for key, val := range ver.values() {
+			values[key] = val
+		}
+		values[datastore.KModelType] = req.Type
+	}
+	values[datastore.KModelStatus] = config.MODEL_LOADED
+	values[datastore.KModelMessage] = ""
+	values[datastore.KModelModifyTime] = fmt.Sprintf("%d", utils.TimestampS())
+	values[datastore.KModelJob] = ""
+	values[datastore.KModelJobOwner] = ""
+	values[datastore.KModelJobLease] = ""
+	return values, nil
+}
+
+// fail register failed with message, update restore previous status and old versions keep serving
+func (m *modelManager) fail(req *ModelRegister, err error) {
+	status, message := config.MODEL_FAILED, err.Error()
+	if req.update != nil {
+		status = req.update.PrevStatus
+		message = fmt.Sprintf("update to version %d fail, err=%s", req.Version, err.Error())
+	}
+	m.updateOwned(req.Name, map[string]interface{}{
+		datastore.KModelStatus:     status,
+		datastore.KModelMessage:    message,
+		datastore.KModelModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+		datastore.KModelJob:        "",
+		datastore.KModelJobOwner:   "",
+		datastore.KModelJobLease:   "",
+	})
+}
+
+// load refresh webui model list and check webui report the model file
+func (m *modelManager) load(modelType, fileName string) error {
+	if err := m.refresh(modelType); err != nil {
+		return fmt.Errorf("refresh %s models err=%s", modelType, err.Error())
+	}
+	var err error
+	for i := 0; i < modelLoadCheck; i++ {
+		if i > 0 {
+			time.Sleep(m.loadInterval)
+		}
+		var ok bool
+		if ok, err = m.loaded(modelType, fileName); err == nil && ok {
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("check model %s loaded err=%s", fileName, err.Error())
+	}
+	return fmt.Errorf("model %s not found in webui after refresh", fileName)
+}
+
+// update status, progress nil not change
+func (m *modelManager) update(name, status string, progress *ModelProgress, message string) {
+	values := map[string]interface{}{
+		datastore.KModelStatus:     status,
+		datastore.KModelMessage:    message,
+		datastore.KModelModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+	}
+	if progress != nil {
+		if body, err := json.Marshal(progress); err == nil {
+			values[datastore.KModelProgress] = string(body)
+		}
+	}
+	m.updateOwned(name, values)
+}
+
+// ModelLocalPath {sdPath}/{type dir}/{name}, type dir from model type registry,
+// name must be a file name, never escape type dir
+func ModelLocalPath(modelType, modelName string) (string, error) {
+	dir := config.ConfigGlobal.ModelTypeDir(modelType)
+	if dir == "" {
+		return "", fmt.Errorf("modeltype: %s not support", modelType)
+	}
+	if modelName == "" || strings.ContainsAny(modelName, `/\`) || strings.Contains(modelName, "..") ||
+		filepath.IsAbs(modelName) {
+		return "", fmt.Errorf("model name %s not valid, must be a file name", modelName)
+	}
+	path := filepath.Join(dir, modelName)
+	if filepath.Dir(path) != filepath.Clean(dir) {
+		return "", fmt.Errorf("model name %s not valid, must be a file name", modelName)
+	}
+	return path, nil
+}
+
+// DownloadModel download from oss or http(s) url to models/{type}/, verify etag/sha256,
+// return local path and content sha256
+func DownloadModel(req *ModelRegister, onProgress func(done, total int64)) (string, string, error) {
+	path, err := ModelLocalPath(req.Type, ModelVersionName(req.Name, req.Version))
+	if err != nil {
+		return "", "", err
+	}
+	logProgress := downloadProgressLogger(req.Name)
+	progress := func(done, total int64) {
+		logProgress(done, total)
+		if onProgress != nil && total > 0 {
+			onProgress(done, total)
+		}
+	}
+	var sha256Hex string
+	if req.Url != "" {
+		sha256Hex, err = DownloadHttp(req.Url, path, &HttpDownloadOption{
+			Token:        modelToken(req),
+			MaxSize:      config.ConfigGlobal.ModelMaxSize,
+			ContentTypes: config.ConfigGlobal.ModelContentTypes,
+			Sha256:       req.Sha256,
+			OnProgress:   progress,
+		})
+	} else {
+		sha256Hex, err = DownloadObject(OssGlobal, req.OssPath, path, &DownloadOption{
+			ETag:        req.Etag,
+			Sha256:      req.Sha256,
+			ChunkSize:   config.ConfigGlobal.DownloadChunkSize,
+			Concurrency: config.ConfigGlobal.DownloadConcurrency,
+			OnProgress:  progress,
+		})
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return path, sha256Hex, nil
+}
+
+// modelToken request token first, hub token only send to hub endpoint
+func modelToken(req *ModelRegister) string {
+	if req.Token != "" {
+		return req.Token
+	}
+	hub := strings.TrimSuffix(config.ConfigGlobal.ModelHubEndpoint, "/") + "/"
+	if config.ConfigGlobal.ModelHubToken != "" && strings.HasPrefix(req.Url, hub) {
+		return config.ConfigGlobal.ModelHubToken
+	}
+	return ""
+}
+
+// downloadProgressLogger log download progress every 10%
+func downloadProgressLogger(modelName string) func(done, total int64) {
+	lastPercent := int64(-1)
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		if percent := done * 100 / total; percent/10 != lastPercent/10 {
+			lastPercent = percent
+			logrus.Infof("download model %s progress %d%% (%d/%d)", modelName, percent, done, total)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package module
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"regexp"
+	"strings"
+)
+
+var modelAclColumns = []string{datastore.KModelName, datastore.KModelType, datastore.KModelStatus,
+	datastore.KModelOwner, datastore.KModelVisibility, datastore.KModelSharedWith}
+
+// ModelAcl owner and visibility of model, model without owner (registered before or from disk) is public
+type ModelAcl struct {
+	Owner      string
+	Visibility string
+	// SharedWith users can use shared model besides owner
+	SharedWith []string
+}
+
+// IsValidVisibility private, shared or public
+func IsValidVisibility(visibility string) bool {
+	switch visibility {
+	case config.MODEL_PRIVATE, config.MODEL_SHARED, config.MODEL_PUBLIC:
+		return true
+	}
+	return false
+}
+
+// ParseModelAcl acl of model row
+func ParseModelAcl(data map[string]interface{}) *ModelAcl {
+	acl := &ModelAcl{SharedWith: make([]string, 0)}
+	acl.Owner, _ = data[datastore.KModelOwner].(string)
+	acl.Visibility, _ = data[datastore.KModelVisibility].(string)
+	if body, ok := data[datastore.KModelSharedWith].(string); ok && body != "" {
+		json.Unmarshal([]byte(body), &acl.SharedWith)
+	}
+	if acl.Owner == "" || !IsValidVisibility(acl.Visibility) {
+		acl.Visibility = config.MODEL_PUBLIC
+	}
+	return acl
+}
+
+// Values acl columns
+func (a *ModelAcl) Values() map[string]interface{} {
+	sharedWith := a.SharedWith
+	if sharedWith == nil {
+		sharedWith = make([]string, 0)
+	}
+	body, _ := json.Marshal(sharedWith)
+	return map[string]interface{}{
+		datastore.KModelOwner:      a.Owner,
+		datastore.KModelVisibility: a.Visibility,
+		datastore.KModelSharedWith: string(body),
+	}
+}
+
+// CanUse user can list, get and predict with the model
+func (a *ModelAcl) CanUse(user string) bool {
+	switch {
+	case a.Visibility == config.MODEL_PUBLIC || a.Owner == "" || a.Owner == user:
+		return true
+	case a.Visibility == config.MODEL_SHARED:
+		return stringIn(user, a.SharedWith)
+	}
+	return false
+}
+
+// CanManage user can update, delete the model and change acl, model without owner anyone
+func (a *ModelAcl) CanManage(user string) bool {
+	return a.Owner == "" || a.Owner == user
+}
+
+// Acl acl of model, sdModel may be versioned name, nil if not registered
+func (m *modelManager) Acl(sdModel string) (*ModelAcl, error) {
+	names := []string{sdModel}
+	if match := versionFileRegexp.FindStringSubmatch(sdModel); match != nil {
+		names = append(names, match[1]+match[2])
+	}
+	for _, name := range names {
+		data, err := m.modelStore.Get(name, modelAclColumns)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != 0 && data[datastore.KModelStatus] != config.MODEL_DELETE {
+			return ParseModelAcl(data), nil
+		}
+	}
+	return nil, nil
+}
+
+// CanUse model not registered (local file) can be used by anyone
+func (m *modelManager) CanUse(user, sdModel string) (bool, error) {
+	acl, err := m.Acl(sdModel)
+	if err != nil || acl == nil {
+		return err == nil, err
+	}
+	return acl.CanUse(user), nil
+}
+
+// ModelRefs models referenced by predict request besides sd model, names resolved
+type ModelRefs struct {
+	SdVae *string
+	// ControlNets model of controlnet units without hash suffix, controlNet or ipAdapter model
+	ControlNets []string
+	// Prompts lora, lycoris and hypernetwork tags and embedding words
+	Prompts []*string
+}
+
+// promptWordSeparator words of prompt which may be embedding name, eg: (bad-hands-5:1.2)
+var promptWordSeparator = regexp.MustCompile(`[\s,()\[\]{}<>:|]+`)
+
+// ForbiddenModels names referenced registered but user can not use
+func (m *modelManager) ForbiddenModels(user string, refs *ModelRefs) ([]string, error) {
+	type ref struct {
+		kind, name string
+	}
+	candidates := make([]ref, 0)
+	if refs.SdVae != nil && *refs.SdVae != "" && *refs.SdVae != "None" && *refs.SdVae != "Automatic" {
+		candidates = append(candidates, ref{kind: config.SD_VAE, name: *refs.SdVae})
+	}
+	for _, name := range refs.ControlNets {
+		candidates = append(candidates, ref{kind: "controlnet", name: name})
+	}
+	for _, prompt := range refs.Prompts {
+		if prompt == nil || *prompt == "" {
+			continue
+		}
+		for _, match := range NetworkTagRegexp.FindAllStringSubmatch(*prompt, -1) {
+			candidates = append(candidates, ref{kind: match[1], name: strings.TrimSpace(match[2])})
+		}
+		for _, word := range promptWordSeparator.Split(NetworkTagRegexp.ReplaceAllString(*prompt, " "), -1) {
+			if word != "" {
+				candidates = append(candidates, ref{kind: "embedding", name: word})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	// only rows candidates may refer to, not scan the whole table every predict
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, one := range candidates {
+		for _, name := range candidateModelNames(one.kind, one.name) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	datas, err := m.modelStore.BatchGet(names, modelAclColumns)
+	if err != nil {
+		return nil, err
+	}
+	networks := networkModels(datas)
+	ret := make([]string, 0)
+	for _, one := range candidates {
+		var models []string
+		if one.kind == config.SD_VAE {
+			if name := usageModelName(datas, one.name); name != "" {
+				models = []string{name}
+			}
+		} else {
+			models = lookupNetwork(networks, one.kind, one.name)
+		}
+		for _, model := range models {
+			if !ParseModelAcl(datas[model]).CanUse(user) && !stringIn(one.name, ret) {
+				ret = append(ret, one.name)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// candidateModelNames rows may be referenced by vae name or prompt tag of kind, versioned name
+// {stem}@v{n} refer to row of stem, network name without extension match extensions of types of kind
+func candidateModelNames(kind, name string) []string {
+	if kind == config.SD_VAE {
+		names := []string{name}
+		if match := versionFileRegexp.FindStringSubmatch(name); match != nil {
+			names = append(names, match[1]+match[2])
+		}
+		return names
+	}
+	stems := []string{name}
+	if match := versionFileRegexp.FindStringSubmatch(name); match != nil && match[2] == "" {
+		stems = append(stems, match[1])
+	}
+	names := make([]string, 0)
+	for _, modelType := range config.ConfigGlobal.ModelTypeNames() {
+		if !stringIn(kind, networkKinds(modelType)) {
+			continue
+		}
+		for _, ext := range config.ConfigGlobal.GetModelType(modelType).FileExtensions() {
+			for _, stem := range stems {
+				if !stringIn(stem+ext, names) {
+					names = append(names, stem+ext)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// SetAcl change visibility and shared users, owner not changed
+func (m *modelManager) SetAcl(name string, acl *ModelAcl) error {
+	values := acl.Values()
+	delete(values, datastore.KModelOwner)
+	values[datastore.KModelModifyTime] = fmt.Sprintf("%d", utils.TimestampS())
+	return m.modelStore.Update(name, values)
+}
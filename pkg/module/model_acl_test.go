@@ -0,0 +1,80 @@
+package module
+
+import (
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestModelAcl(t *testing.T) {
+	// no owner is public
+	acl := ParseModelAcl(map[string]interface{}{datastore.KModelVisibility: config.MODEL_PRIVATE})
+	assert.Equal(t, config.MODEL_PUBLIC, acl.Visibility)
+	assert.True(t, acl.CanUse("user1"))
+	assert.True(t, acl.CanManage("user1"))
+
+	acl = ParseModelAcl((&ModelAcl{Owner: "owner", Visibility: config.MODEL_SHARED,
+		SharedWith: []string{"user1"}}).Values())
+	assert.True(t, acl.CanUse("owner"))
+	assert.True(t, acl.CanUse("user1"))
+	assert.False(t, acl.CanUse("user2"))
+	assert.False(t, acl.CanManage("user1"))
+	acl.Visibility = config.MODEL_PRIVATE
+	assert.False(t, acl.CanUse("user1"))
+
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		DbSqlite: filepath.Join(dir, "sqlite3"),
+	}}
+	modelStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer modelStore.Close()
+	m := &modelManager{modelStore: modelStore, jobs: make(map[string]*ModelRegister)}
+	put := func(modelType, name string, acl *ModelAcl) {
+		values := acl.Values()
+		values[datastore.KModelName] = name
+		values[datastore.KModelType] = modelType
+		values[datastore.KModelStatus] = config.MODEL_LOADED
+		assert.Nil(t, modelStore.Put(name, values))
+	}
+	put(config.SD_MODEL, "tenant.safetensors", &ModelAcl{Owner: "owner", Visibility: config.MODEL_PRIVATE})
+	put(config.LORA_MODEL, "style.safetensors", &ModelAcl{Owner: "owner", Visibility: config.MODEL_PRIVATE})
+	put(config.LORA_MODEL, "public.safetensors", &ModelAcl{Owner: "owner", Visibility: config.MODEL_PUBLIC})
+
+	// versioned name, not registered model
+	ok, err := m.CanUse("user1", "tenant@v2.safetensors")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, _ = m.CanUse("owner", "tenant@v2.safetensors")
+	assert.True(t, ok)
+	ok, _ = m.CanUse("user1", "local.safetensors")
+	assert.True(t, ok)
+
+	put(config.SD_VAE, "vae.pt", &ModelAcl{Owner: "owner", Visibility: config.MODEL_PRIVATE})
+	put(config.CONTORLNET_MODEL, "control_canny.pth", &ModelAcl{Owner: "owner", Visibility: config.MODEL_PRIVATE})
+	put(config.EMBEDDING_MODEL, "bad-hands.pt", &ModelAcl{Owner: "owner", Visibility: config.MODEL_PRIVATE})
+
+	forbidden, err := m.ForbiddenModels("user1", &ModelRefs{Prompts: []*string{
+		utils.String("<lora:style:0.8> <lyco:style:1> <lora:public:1> <lora:local:1>")}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"style"}, forbidden)
+	forbidden, _ = m.ForbiddenModels("owner", &ModelRefs{Prompts: []*string{utils.String("<lora:style:0.8>")}})
+	assert.Equal(t, 0, len(forbidden))
+
+	// every prompt, vae, controlnet and embedding words checked
+	forbidden, err = m.ForbiddenModels("user1", &ModelRefs{
+		SdVae:       utils.String("vae@v2.pt"),
+		ControlNets: []string{"control_canny", "control_local"},
+		Prompts: []*string{utils.String("a cat"), nil, utils.String("(bad-hands:1.2), <hypernet:x:1>"),
+			utils.String("<lora:style@v2:1>")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"vae@v2.pt", "control_canny", "bad-hands", "style@v2"}, forbidden)
+	forbidden, _ = m.ForbiddenModels("owner", &ModelRefs{SdVae: utils.String("vae.pt"),
+		ControlNets: []string{"control_canny"}, Prompts: []*string{utils.String("bad-hands")}})
+	assert.Equal(t, 0, len(forbidden))
+	forbidden, _ = m.ForbiddenModels("user1", &ModelRefs{SdVae: utils.String("Automatic")})
+	assert.Equal(t, 0, len(forbidden))
+}
@@ -0,0 +1,74 @@
+package module
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// shortHashLen webui AutoV2 hash, sha256[:10]
+	shortHashLen = 10
+	// legacy webui AutoV1 hash, sha256 of 64KB at offset 1MB
+	legacyHashOffset = 0x100000
+	legacyHashSize   = 0x10000
+	legacyHashLen    = 8
+	maxTriggerWords  = 10
+)
+
+// ModelInfo hash and safetensors header info of model file
+type ModelInfo struct {
+	Sha256       string            `json:"-"`
+	ShortHash    string            `json:"-"`
+	LegacyHash   string            `json:"legacyHash,omitempty"`
+	Architecture string            `json:"architecture,omitempty"`
+	TriggerWords []string          `json:"triggerWords,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// ComputeModelInfo full sha256, webui short/legacy hash, parse header of .safetensors,
+// sha256Hex computed by download not read the whole file again, empty compute it
+func ComputeModelInfo(localFile, sha256Hex string) (*ModelInfo, error) {
+	f, err := os.Open(localFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if sha256Hex == "" {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		sha256Hex = hex.EncodeToString(h.Sum(nil))
+	}
+	info := &ModelInfo{Sha256: strings.ToLower(sha256Hex)}
+	info.ShortHash = info.Sha256[:shortHashLen]
+	// file smaller than 1MB hash empty content, same as webui
+	buf := make([]byte, legacyHashSize)
+	n, err := f.ReadAt(buf, legacyHashOffset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	legacy := sha256.Sum256(buf[:n])
+	info.LegacyHash = hex.EncodeToString(legacy[:])[:legacyHashLen]
+	if !strings.HasSuffix(strings.ToLower(localFile), ".safetensors") {
+		return info, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header, err := utils.ReadSafetensorsHeader(f)
+	if err != nil {
+		// hash still valid
+		logrus.Warnf("parse %s header err=%s", localFile, err.Error())
+		return info, nil
+	}
+	info.Architecture = header.Architecture()
+	info.TriggerWords = header.TriggerWords(maxTriggerWords)
+	info.Metadata = header.TrainingMetadata()
+	return info, nil
+}
@@ -0,0 +1,55 @@
+package module
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestComputeModelInfo(t *testing.T) {
+	dir := t.TempDir()
+	// larger than 1MB+64KB, legacy hash of 64KB at offset 1MB
+	large := make([]byte, 0x120000)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	largeFile := filepath.Join(dir, "large.ckpt")
+	assert.Nil(t, ioutil.WriteFile(largeFile, large, 0666))
+	info, err := ComputeModelInfo(largeFile, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "53707f2881b58d19e2c2b18a0a63102e75b30cd965af2cb892a6a79eeafb36f5", info.Sha256)
+	assert.Equal(t, "53707f2881", info.ShortHash)
+	assert.Equal(t, "15ffd73b", info.LegacyHash)
+
+	// sha256 of download not computed again
+	info, err = ComputeModelInfo(largeFile, "ABCDEF0123456789")
+	assert.Nil(t, err)
+	assert.Equal(t, "abcdef0123456789", info.Sha256)
+	assert.Equal(t, "abcdef0123", info.ShortHash)
+	assert.Equal(t, "15ffd73b", info.LegacyHash)
+
+	// smaller than 1MB, legacy hash of empty content
+	small := filepath.Join(dir, "small.pt")
+	assert.Nil(t, ioutil.WriteFile(small, []byte("modelmodelmodel"), 0666))
+	info, err = ComputeModelInfo(small, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "e3b0c442", info.LegacyHash)
+
+	// safetensors header broken, hashes kept
+	broken := make([]byte, 8, 100)
+	binary.LittleEndian.PutUint64(broken, 1<<40)
+	broken = append(broken, []byte("{not json")...)
+	brokenFile := filepath.Join(dir, "broken.safetensors")
+	assert.Nil(t, ioutil.WriteFile(brokenFile, broken, 0666))
+	info, err = ComputeModelInfo(brokenFile, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 64, len(info.Sha256))
+	assert.Equal(t, info.Sha256[:shortHashLen], info.ShortHash)
+	assert.Equal(t, "e3b0c442", info.LegacyHash)
+	assert.Equal(t, "", info.Architecture)
+
+	_, err = ComputeModelInfo(filepath.Join(dir, "missing.ckpt"), "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,315 @@
+package module
+
+import (
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// versionFileRegexp {stem}@v{version}{ext} file of model version
+var versionFileRegexp = regexp.MustCompile(`^(.*)@v[0-9]+(\.[^.]*)?$`)
+
+var ModelReconcilerGlobal *modelReconciler
+
+// ModelDriftItem file or model row not match
+type ModelDriftItem struct {
+	Name      string
+	Type      string
+	LocalPath string
+	Status    string
+	Message   string
+	// status in db before reconcile
+	prevStatus string
+}
+
+// ModelDrift result of last reconcile
+type ModelDrift struct {
+	ScanTime int64
+	// Untracked files on disk not in db, registered unless name conflict
+	Untracked []*ModelDriftItem
+	// Missing db rows whose file not exist
+	Missing []*ModelDriftItem
+	// Restored missing rows whose file come back
+	Restored []*ModelDriftItem
+}
+
+const (
+	// modelReconcileKey config row of reconcile lease, only the instance holding it write db
+	modelReconcileKey = "model_reconcile"
+	// driftNotRegistered message of untracked file to register
+	driftNotRegistered = "not registered"
+)
+
+// modelReconciler hybrid model mode, diff files of model type dirs with models table
+type modelReconciler struct {
+	modelStore  datastore.Datastore
+	configStore datastore.Datastore
+	interval    time.Duration
+	// owner of reconcile lease
+	owner string
+	// scan one reconcile at a time, hash of untracked files done with it held
+	scan sync.Mutex
+	// lock guard drift only, Drift not blocked by running reconcile
+	lock  sync.Mutex
+	drift *ModelDrift
+	stop  chan struct{}
+}
+
+// InitModelReconciler reconcile every reconcileInterval seconds in background
+func InitModelReconciler(modelStore, configStore datastore.Datastore) {
+	ModelReconcilerGlobal = newModelReconciler(modelStore, configStore)
+	go ModelReconcilerGlobal.start()
+}
+
+func newModelReconciler(modelStore, configStore datastore.Datastore) *modelReconciler {
+	return &modelReconciler{
+		modelStore:  modelStore,
+		configStore: configStore,
+		interval:    time.Duration(config.ConfigGlobal.ReconcileInterval) * time.Second,
+		owner:       newLeaseOwner(),
+		stop:        make(chan struct{}),
+	}
+}
+
+func (r *modelReconciler) start() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Reconcile(); err != nil {
+			logrus.Warnf("[modelReconciler] reconcile err=%s", err.Error())
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stop background reconcile
+func (r *modelReconciler) Close() {
+	close(r.stop)
+}
+
+// Drift last reconcile result, diff without writing db if first reconcile not done yet
+func (r *modelReconciler) Drift() (*ModelDrift, error) {
+	r.lock.Lock()
+	drift := r.drift
+	r.lock.Unlock()
+	if drift != nil {
+		return drift, nil
+	}
+	datas, err := r.modelStore.ListAll(modelVersionColumns)
+	if err != nil {
+		return nil, err
+	}
+	return r.diff(datas), nil
+}
+
+// Reconcile register untracked files, flag loaded rows whose file missing, restore missing rows,
+// instance not holding the lease only report drift
+func (r *modelReconciler) Reconcile() (*ModelDrift, error) {
+	r.scan.Lock()
+	defer r.scan.Unlock()
+	datas, err := r.modelStore.ListAll(modelVersionColumns)
+	if err != nil {
+		return nil, err
+	}
+	drift := r.diff(datas)
+	if ok, err := r.claim(); err != nil {
+		logrus.Warnf("[modelReconciler] claim lease err=%s", err.Error())
+	} else if ok {
+		r.apply(drift)
+	}
+	if len(drift.Untracked) != 0 || len(drift.Missing) != 0 || len(drift.Restored) != 0 {
+		logrus.Infof("[modelReconciler] untracked %d, missing %d, restored %d", len(drift.Untracked),
+			len(drift.Missing), len(drift.Restored))
+	}
+	r.lock.Lock()
+	r.drift = drift
+	r.lock.Unlock()
+	return drift, nil
+}
+
+// claim reconcile lease if free, expired or held by this instance, lease renewed every reconcile
+func (r *modelReconciler) claim() (bool, error) {
+	data, err := r.configStore.Get(modelReconcileKey, []string{datastore.KConfigOwner, datastore.KConfigLease})
+	if err != nil {
+		return false, err
+	}
+	var expect map[string]interface{}
+	if data != nil {
+		owner, _ := data[datastore.KConfigOwner].(string)
+		lease, _ := data[datastore.KConfigLease].(string)
+		if owner != "" && owner != r.owner && !leaseExpired(lease) {
+			return false, nil
+		}
+		expect = map[string]interface{}{
+			datastore.KConfigOwner: owner,
+			datastore.KConfigLease: lease,
+		}
+	}
+	// held over two intervals, taken over if owner stop reconciling
+	expire := utils.TimestampS() + int64(2*r.interval/time.Second) + modelJobLease
+	return r.configStore.UpdateIf(modelReconcileKey, map[string]interface{}{
+		datastore.KConfigOwner:      r.owner,
+		datastore.KConfigLease:      fmt.Sprintf("%d", expire),
+		datastore.KConfigModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+	}, expect)
+}
+
+// diff files with rows without writing db
+func (r *modelReconciler) diff(datas map[string]map[string]interface{}) *ModelDrift {
+	drift := &ModelDrift{
+		ScanTime:  utils.TimestampS(),
+		Untracked: make([]*ModelDriftItem, 0),
+		Missing:   make([]*ModelDriftItem, 0),
+		Restored:  make([]*ModelDriftItem, 0),
+	}
+	// local path of all versions of rows
+	tracked := make(map[string]struct{})
+	for name, data := range datas {
+		if data[datastore.KModelStatus] == config.MODEL_DELETE {
+			continue
+		}
+		for _, ver := range ParseModelVersions(data).Versions {
+			if ver.LocalPath != "" {
+				tracked[ver.LocalPath] = struct{}{}
+			}
+		}
+		checkMissing(name, data, drift)
+	}
+	for _, file := range scanModelFiles() {
+		if _, ok := tracked[file.LocalPath]; ok {
+			continue
+		}
+		// version file of model or downloading by register/update
+		if match := versionFileRegexp.FindStringSubmatch(file.Name); match != nil {
+			if data, ok := datas[match[1]+match[2]]; ok && data[datastore.KModelStatus] != config.MODEL_DELETE {
+				continue
+			}
+		}
+		if data, ok := datas[file.Name]; ok && data[datastore.KModelStatus] != config.MODEL_DELETE {
+			status, _ := data[datastore.KModelStatus].(string)
+			if status == config.MODEL_REGISTERING || status == config.MODEL_LOADING {
+				continue
+			}
+			file.Message = "model name registered with other file"
+			drift.Untracked = append(drift.Untracked, file)
+			continue
+		}
+		file.Message = driftNotRegistered
+		drift.Untracked = append(drift.Untracked, file)
+	}
+	return drift
+}
+
+// apply drift to db: update status of missing/restored rows, register untracked files
+func (r *modelReconciler) apply(drift *ModelDrift) {
+	drift.Missing = r.applyStatus(drift.Missing)
+	drift.Restored = r.applyStatus(drift.Restored)
+	for _, file := range drift.Untracked {
+		if file.Message != driftNotRegistered {
+			continue
+		}
+		if ok, err := r.register(file); err != nil {
+			file.Message = fmt.Sprintf("auto register err=%s", err.Error())
+		} else if !ok {
+			file.Message = "model name registered with other file"
+		} else {
+			file.Status = config.MODEL_LOADED
+			file.Message = "auto registered"
+		}
+	}
+}
+
+// applyStatus write status only if not changed since diff (eg: deleted or registered again meanwhile),
+// item dropped if changed
+func (r *modelReconciler) applyStatus(items []*ModelDriftItem) []*ModelDriftItem {
+	ret := make([]*ModelDriftItem, 0, len(items))
+	for _, item := range items {
+		if item.Status == item.prevStatus {
+			ret = append(ret, item)
+			continue
+		}
+		ok, err := r.modelStore.UpdateIf(item.Name, map[string]interface{}{
+			datastore.KModelStatus:     item.Status,
+			datastore.KModelMessage:    item.Message,
+			datastore.KModelModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+		}, map[string]interface{}{datastore.KModelStatus: item.prevStatus})
+		if err != nil {
+			logrus.Warnf("[modelReconciler] update model %s status err=%s", item.Name, err.Error())
+		} else if !ok {
+			continue
+		}
+		ret = append(ret, item)
+	}
+	return ret
+}
+
+// checkMissing loaded row file not exist => missing, missing row file exist => loaded
+func checkMissing(name string, data map[string]interface{}, drift *ModelDrift) {
+	status, _ := data[datastore.KModelStatus].(string)
+	if status != config.MODEL_LOADED && status != config.MODEL_MISSING {
+		return
+	}
+	localPath, _ := data[datastore.KModelLocalPath].(string)
+	modelType, _ := data[datastore.KModelType].(string)
+	if localPath == "" {
+		return
+	}
+	item := &ModelDriftItem{Name: name, Type: modelType, LocalPath: localPath, Status: status, prevStatus: status}
+	exist := utils.FileExists(localPath)
+	switch {
+	case status == config.MODEL_LOADED && !exist:
+		item.Status, item.Message = config.MODEL_MISSING, "model file not exist"
+		drift.Missing = append(drift.Missing, item)
+	case status == config.MODEL_MISSING && !exist:
+		item.Message = "model file not exist"
+		drift.Missing = append(drift.Missing, item)
+	case status == config.MODEL_MISSING && exist:
+		item.Status = config.MODEL_LOADED
+		drift.Restored = append(drift.Restored, item)
+	}
+}
+
+// register untracked file as version 1 of model, hash the whole file,
+// false if the name registered meanwhile
+func (r *modelReconciler) register(file *ModelDriftItem) (bool, error) {
+	req := &ModelRegister{Type: file.Type, Name: file.Name}
+	ver := newModelVersion(req, file.LocalPath, "")
+	versions := &ModelVersions{Aliases: make(map[string]int)}
+	versions.Add(ver)
+	values := versions.Values()
+	for key, val := range ver.values() {
+		values[key] = val
+	}
+	now := fmt.Sprintf("%d", utils.TimestampS())
+	values[datastore.KModelName] = file.Name
+	values[datastore.KModelType] = file.Type
+	values[datastore.KModelStatus] = config.MODEL_LOADED
+	values[datastore.KModelMessage] = "auto registered from disk"
+	values[datastore.KModelProgress] = "{}"
+	values[datastore.KModelCreateTime] = now
+	values[datastore.KModelModifyTime] = now
+	return r.modelStore.UpdateIf(file.Name, values, nil)
+}
+
+// scanModelFiles model files of all model type dirs, types share dir scanned once
+func scanModelFiles() []*ModelDriftItem {
+	files := ListModelFiles()
+	ret := make([]*ModelDriftItem, 0, len(files))
+	for _, file := range files {
+		ret = append(ret, &ModelDriftItem{Name: file.Name, Type: file.Type, LocalPath: file.LocalPath})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].LocalPath < ret[j].LocalPath
+	})
+	return ret
+}
@@ -0,0 +1,112 @@
+package module
+
+import (
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModelReconcile(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		OssPath:           filepath.Join(dir, "oss"),
+		SdPath:            filepath.Join(dir, "sd"),
+		DbSqlite:          filepath.Join(dir, "sqlite3"),
+		DownloadChunkSize: 100,
+	}}
+	modelStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer modelStore.Close()
+	OssGlobal = new(OssManagerLocal)
+	assert.Nil(t, OssGlobal.UploadFileByByte("models/sd.safetensors", make([]byte, 100)))
+	assert.Nil(t, InitModelManager(modelStore))
+	_, err := ModelManagerGlobal.Register(&ModelRegister{Type: config.SD_MODEL, Name: "sd.safetensors",
+		OssPath: "models/sd.safetensors"})
+	assert.Nil(t, err)
+	waitModelStatus(t, modelStore, "sd.safetensors", config.MODEL_LOADED)
+
+	// copied to nas manually, version file of registered model skipped
+	loraDir := filepath.Join(dir, "sd/models/Lora")
+	sdDir := filepath.Join(dir, "sd/models/Stable-diffusion")
+	assert.Nil(t, os.MkdirAll(loraDir, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(loraDir, "manual.safetensors"), []byte("lora"), 0666))
+	assert.Nil(t, os.WriteFile(filepath.Join(sdDir, "sd@v2.safetensors"), []byte("v2"), 0666))
+	configStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KConfigTableName))
+	defer configStore.Close()
+	reconciler := newModelReconciler(modelStore, configStore)
+	// drift before first reconcile only diff
+	drift, err := reconciler.Drift()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(drift.Untracked))
+	data, _ := modelStore.Get("manual.safetensors", []string{datastore.KModelStatus})
+	assert.Nil(t, data)
+	drift, err = reconciler.Reconcile()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(drift.Untracked))
+	assert.Equal(t, "manual.safetensors", drift.Untracked[0].Name)
+	assert.Equal(t, config.LORA_MODEL, drift.Untracked[0].Type)
+	assert.Equal(t, 0, len(drift.Missing))
+	data, _ = modelStore.Get("manual.safetensors", []string{datastore.KModelStatus, datastore.KModelShortHash})
+	assert.Equal(t, config.MODEL_LOADED, data[datastore.KModelStatus])
+	assert.NotEqual(t, "", data[datastore.KModelShortHash])
+
+	// file removed, flagged missing, restored when come back
+	sdFile := filepath.Join(sdDir, "sd.safetensors")
+	assert.Nil(t, os.Rename(sdFile, sdFile+".bak"))
+	// other instance without lease only report drift
+	other := newModelReconciler(modelStore, configStore)
+	drift, _ = other.Reconcile()
+	assert.Equal(t, 1, len(drift.Missing))
+	data, _ = modelStore.Get("sd.safetensors", []string{datastore.KModelStatus})
+	assert.Equal(t, config.MODEL_LOADED, data[datastore.KModelStatus])
+	drift, _ = reconciler.Reconcile()
+	assert.Equal(t, 0, len(drift.Untracked))
+	assert.Equal(t, 1, len(drift.Missing))
+	data, _ = modelStore.Get("sd.safetensors", []string{datastore.KModelStatus})
+	assert.Equal(t, config.MODEL_MISSING, data[datastore.KModelStatus])
+	assert.Nil(t, os.Rename(sdFile+".bak", sdFile))
+	drift, _ = reconciler.Reconcile()
+	assert.Equal(t, 1, len(drift.Restored))
+	data, _ = modelStore.Get("sd.safetensors", []string{datastore.KModelStatus})
+	assert.Equal(t, config.MODEL_LOADED, data[datastore.KModelStatus])
+
+	// deleted between diff and apply not flagged missing again
+	assert.Nil(t, os.Rename(sdFile, sdFile+".bak"))
+	datas, err := modelStore.ListAll(modelVersionColumns)
+	assert.Nil(t, err)
+	drift = reconciler.diff(datas)
+	assert.Equal(t, 1, len(drift.Missing))
+	assert.Nil(t, modelStore.Update("sd.safetensors", map[string]interface{}{
+		datastore.KModelStatus: config.MODEL_DELETE,
+	}))
+	reconciler.apply(drift)
+	assert.Equal(t, 0, len(drift.Missing))
+	data, _ = modelStore.Get("sd.safetensors", []string{datastore.KModelStatus})
+	assert.Equal(t, config.MODEL_DELETE, data[datastore.KModelStatus])
+}
+
+func TestListModelFiles(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{SdPath: dir}}
+	controlNetDir := filepath.Join(dir, "models/ControlNet")
+	assert.Nil(t, os.MkdirAll(controlNetDir, os.ModePerm))
+	for _, name := range []string{"canny.pth", "ip-adapter_sd15.bin", "readme.txt"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(controlNetDir, name), []byte("model"), 0666))
+	}
+
+	// shared dir scanned once with union of extensions, type per file
+	files := scanModelFiles()
+	assert.Equal(t, 2, len(files))
+	assert.Equal(t, "canny.pth", files[0].Name)
+	assert.Equal(t, config.CONTORLNET_MODEL, files[0].Type)
+	assert.Equal(t, "ip-adapter_sd15.bin", files[1].Name)
+	assert.Equal(t, config.IPADAPTER_MODEL, files[1].Type)
+	// filter by type
+	ipAdapters := ListModelFiles(config.IPADAPTER_MODEL)
+	assert.Equal(t, 1, len(ipAdapters))
+	assert.Equal(t, filepath.Join(controlNetDir, "ip-adapter_sd15.bin"), ipAdapters[0].LocalPath)
+	assert.Equal(t, 1, len(ListModelFiles(config.CONTORLNET_MODEL)))
+	assert.Equal(t, 0, len(ListModelFiles(config.LORA_MODEL)))
+}
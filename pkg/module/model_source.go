@@ -0,0 +1,386 @@
+package module
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	hubDefaultRevision = "main"
+	httpHeaderTimeout  = time.Minute
+	httpDialTimeout    = 30 * time.Second
+	httpMaxRedirects   = 10
+	// httpIdleTimeout download canceled when no body bytes received in it
+	httpIdleTimeout = time.Minute
+)
+
+// HttpDownloadOption http(s) model download option
+type HttpDownloadOption struct {
+	// Token send as Authorization: Bearer {token}
+	Token string
+	// MaxSize bytes, 0 unlimited
+	MaxSize int64
+	// ContentTypes allowed content type, empty reject text/* and json (error or login page)
+	ContentTypes []string
+	// Sha256 expected content sha256 hex
+	Sha256     string
+	OnProgress func(done, total int64)
+	// Policy url and redirects check, nil ModelUrlPolicy of config
+	Policy *UrlPolicy
+	// IdleTimeout cancel download when body stalled, 0 httpIdleTimeout
+	IdleTimeout time.Duration
+}
+
+// UrlPolicy scheme/host allowlist of model url and redirects, private address checked after dns resolve
+type UrlPolicy struct {
+	// Schemes empty https only
+	Schemes []string
+	// Hosts exact host or "*.example.com" subdomain, empty any host
+	Hosts []string
+	// AllowPrivate allow private, loopback, link-local and unspecified address
+	AllowPrivate bool
+}
+
+// ModelUrlPolicy url policy of config
+func ModelUrlPolicy() *UrlPolicy {
+	return &UrlPolicy{
+		Schemes:      config.ConfigGlobal.ModelUrlSchemes,
+		Hosts:        config.ConfigGlobal.ModelUrlHosts,
+		AllowPrivate: config.ConfigGlobal.ModelUrlPrivate,
+	}
+}
+
+// Check url scheme and host allowed, address checked when dial
+func (p *UrlPolicy) Check(u *url.URL) error {
+	schemes := p.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"https"}
+	}
+	if u.Host == "" || !stringIn(strings.ToLower(u.Scheme), schemes) {
+		return fmt.Errorf("model url scheme %s not allowed, support: %s", u.Scheme, strings.Join(schemes, ","))
+	}
+	if len(p.Hosts) == 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, item := range p.Hosts {
+		item = strings.ToLower(item)
+		if host == item || (strings.HasPrefix(item, "*.") && strings.HasSuffix(host, item[1:])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("model url host %s not allowed", u.Hostname())
+}
+
+// client no total timeout for large model (idle timeout per download), dial address checked so dns rebinding and redirect
+// to internal address rejected, env proxy not used. follow redirect drop Authorization of other host
+func (p *UrlPolicy) client() *http.Client {
+	dialer := &net.Dialer{Timeout: httpDialTimeout, KeepAlive: httpDialTimeout}
+	if !p.AllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("model url address %s not allowed", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   httpDialTimeout,
+			ResponseHeaderTimeout: httpHeaderTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= httpMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", httpMaxRedirects)
+			}
+			return p.Check(req.URL)
+		},
+	}
+}
+
+// cgnatNet shared address space, cloud metadata service e.g. 100.100.100.200
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnatNet.Contains(ip)
+}
+
+// ResolveHubRef {org}/{repo}/{file}[@revision] => {endpoint}/{org}/{repo}/resolve/{revision}/{file}
+func ResolveHubRef(endpoint, ref string) (string, error) {
+	revision := hubDefaultRevision
+	if idx := strings.LastIndex(ref, "@"); idx >= 0 {
+		ref, revision = ref[:idx], ref[idx+1:]
+	}
+	items := strings.Split(strings.Trim(ref, "/"), "/")
+	if len(items) < 3 || revision == "" {
+		return "", fmt.Errorf("hub reference %s not valid, format {org}/{repo}/{file}@{revision}", ref)
+	}
+	for i, item := range items {
+		if item == "" || item == "." || item == ".." {
+			return "", fmt.Errorf("hub reference %s not valid", ref)
+		}
+		items[i] = url.PathEscape(item)
+	}
+	return fmt.Sprintf("%s/%s/%s/resolve/%s/%s", strings.TrimSuffix(endpoint, "/"), items[0], items[1],
+		url.PathEscape(revision), strings.Join(items[2:], "/")), nil
+}
+
+// httpDownloadState resume validator of part file, {dest}.part.json
+type httpDownloadState struct {
+	Url string `json:"url"`
+	// Validator strong etag or last-modified, sent as If-Range
+	Validator string `json:"validator"`
+}
+
+// DownloadHttp download to {dest}.part, resume by If-Range request if server support,
+// check size/content type, verify sha256 then rename to dest, return content sha256
+func DownloadHttp(rawUrl, dest string, opt *HttpDownloadOption) (string, error) {
+	policy := opt.Policy
+	if policy == nil {
+		policy = ModelUrlPolicy()
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", fmt.Errorf("model url %s not valid", rawUrl)
+	}
+	if err := policy.Check(u); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return "", err
+	}
+	partFile, stateFile := dest+downloadPartSuffix, dest+downloadStateSuffix
+	// resume only part file of the same url with validator, remote changed return whole content
+	var offset int64
+	state := new(httpDownloadState)
+	if body, err := ioutil.ReadFile(stateFile); err == nil && json.Unmarshal(body, state) == nil &&
+		state.Url == rawUrl && state.Validator != "" {
+		if info, err := os.Stat(partFile); err == nil {
+			offset = info.Size()
+		}
+	}
+	client := policy.client()
+	// no total timeout for large model, stalled body canceled by idle timer
+	idle := newIdleCanceler(opt.IdleTimeout)
+	defer idle.stop()
+	resp, err := httpGetRange(idle.ctx, client, rawUrl, opt.Token, offset, state.Validator)
+	if err != nil {
+		return "", idle.wrap(err)
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// part file broken, restart
+		resp.Body.Close()
+		offset = 0
+		idle.reset()
+		if resp, err = httpGetRange(idle.ctx, client, rawUrl, opt.Token, 0, ""); err != nil {
+			return "", idle.wrap(err)
+		}
+	}
+	defer resp.Body.Close()
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(partFile)
+			os.Remove(stateFile)
+			return "", fmt.Errorf("download %s content range %s not match offset %d", rawUrl,
+				resp.Header.Get("Content-Range"), offset)
+		}
+		flag = os.O_WRONLY | os.O_APPEND
+	default:
+		// body may echo request secrets, not saved
+		return "", fmt.Errorf("download %s status=%d", rawUrl, resp.StatusCode)
+	}
+	if err := checkContentType(resp.Header.Get("Content-Type"), opt.ContentTypes); err != nil {
+		return "", err
+	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	if opt.MaxSize > 0 && total > opt.MaxSize {
+		return "", fmt.Errorf("model size %d exceed limit %d", total, opt.MaxSize)
+	}
+	if offset == 0 {
+		saveHttpDownloadState(stateFile, rawUrl, resp.Header)
+	}
+	f, err := os.OpenFile(partFile, flag, 0666)
+	if err != nil {
+		return "", err
+	}
+	var reader io.Reader = &idleReader{r: resp.Body, idle: idle}
+	if opt.MaxSize > 0 {
+		// content length may be absent
+		reader = io.LimitReader(reader, opt.MaxSize-offset+1)
+	}
+	n, err := io.Copy(&progressWriter{w: f, done: offset, total: total, onProgress: opt.OnProgress}, reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// keep part file, resume next time
+		return "", fmt.Errorf("download %s err=%s", rawUrl, idle.wrap(err).Error())
+	}
+	size := offset + n
+	if opt.MaxSize > 0 && size > opt.MaxSize {
+		os.Remove(partFile)
+		os.Remove(stateFile)
+		return "", fmt.Errorf("model size exceed limit %d", opt.MaxSize)
+	}
+	if total >= 0 && size != total {
+		return "", fmt.Errorf("download %s size %d not match %d", rawUrl, size, total)
+	}
+	sha256Hex, err := verifyDownload(partFile, "", opt.Sha256)
+	if err != nil {
+		os.Remove(partFile)
+		os.Remove(stateFile)
+		return "", err
+	}
+	if err := os.Rename(partFile, dest); err != nil {
+		return "", err
+	}
+	os.Remove(stateFile)
+	return sha256Hex, nil
+}
+
+// saveHttpDownloadState weak etag can not used in If-Range, last-modified instead,
+// no validator part file not resumed
+func saveHttpDownloadState(stateFile, rawUrl string, header http.Header) {
+	state := &httpDownloadState{Url: rawUrl, Validator: header.Get("ETag")}
+	if state.Validator == "" || strings.HasPrefix(state.Validator, "W/") {
+		state.Validator = header.Get("Last-Modified")
+	}
+	if state.Validator == "" {
+		os.Remove(stateFile)
+		return
+	}
+	body, _ := json.Marshal(state)
+	ioutil.WriteFile(stateFile, body, 0666)
+}
+
+func httpGetRange(ctx context.Context, client *http.Client, rawUrl, token string, offset int64,
+	validator string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+	return client.Do(req)
+}
+
+func checkContentType(contentType string, allowed []string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if len(allowed) == 0 {
+		if strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" {
+			return fmt.Errorf("content type %s not model file", contentType)
+		}
+		return nil
+	}
+	for _, item := range allowed {
+		if strings.EqualFold(item, mediaType) {
+			return nil
+		}
+	}
+	return fmt.Errorf("content type %s not allowed", contentType)
+}
+
+// idleCanceler cancel ctx when not reset in timeout
+type idleCanceler struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32
+}
+
+func newIdleCanceler(timeout time.Duration) *idleCanceler {
+	if timeout <= 0 {
+		timeout = httpIdleTimeout
+	}
+	i := &idleCanceler{timeout: timeout}
+	i.ctx, i.cancel = context.WithCancel(context.Background())
+	i.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&i.fired, 1)
+		i.cancel()
+	})
+	return i
+}
+
+func (i *idleCanceler) reset() {
+	i.timer.Reset(i.timeout)
+}
+
+func (i *idleCanceler) stop() {
+	i.timer.Stop()
+	i.cancel()
+}
+
+// wrap error caused by idle cancel
+func (i *idleCanceler) wrap(err error) error {
+	if atomic.LoadInt32(&i.fired) == 1 {
+		return fmt.Errorf("no data received in %s, %w", i.timeout, err)
+	}
+	return err
+}
+
+// idleReader reset idle timer on each read
+type idleReader struct {
+	r    io.Reader
+	idle *idleCanceler
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.idle.reset()
+	}
+	return n, err
+}
+
+// progressWriter report written bytes after each write
+type progressWriter struct {
+	w          io.Writer
+	done       int64
+	total      int64
+	onProgress func(done, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if p.onProgress != nil {
+		p.onProgress(p.done, p.total)
+	}
+	return n, err
+}
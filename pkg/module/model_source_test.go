@@ -0,0 +1,192 @@
+package module
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var srvModTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestResolveHubRef(t *testing.T) {
+	hubUrl, err := ResolveHubRef("https://hub.example.com/", "org/repo/vae/model.safetensors@v1.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://hub.example.com/org/repo/resolve/v1.0/vae/model.safetensors", hubUrl)
+	hubUrl, err = ResolveHubRef("https://hub.example.com", "org/repo/model.safetensors")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://hub.example.com/org/repo/resolve/main/model.safetensors", hubUrl)
+	_, err = ResolveHubRef("https://hub.example.com", "repo/model.safetensors")
+	assert.NotNil(t, err)
+	_, err = ResolveHubRef("https://hub.example.com", "org/repo/../model.safetensors")
+	assert.NotNil(t, err)
+}
+
+func TestDownloadHttp(t *testing.T) {
+	content := []byte(strings.Repeat("model", 200))
+	sum := sha256.Sum256(content)
+	// hub stand-in, token required, support range
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("token " + r.Header.Get("Authorization") + " not valid"))
+			return
+		}
+		switch r.URL.Path {
+		case "/org/repo/resolve/main/model.safetensors":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "model.safetensors", srvModTime, strings.NewReader(string(content)))
+		case "/login":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>login</html>"))
+		}
+	}))
+	defer srv.Close()
+	hubUrl, _ := ResolveHubRef(srv.URL, "org/repo/model.safetensors")
+	dest := filepath.Join(t.TempDir(), "Lora", "model.safetensors")
+	local := &UrlPolicy{Schemes: []string{"http"}, AllowPrivate: true}
+
+	// resume from part file with validator
+	assert.Nil(t, os.MkdirAll(filepath.Dir(dest), os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(dest+downloadPartSuffix, content[:300], 0666))
+	saveHttpDownloadState(dest+downloadStateSuffix, hubUrl, http.Header{
+		"Last-Modified": {srvModTime.Format(http.TimeFormat)}})
+	var progress, resumed int64 = 0, -1
+	sha256Hex, err := DownloadHttp(hubUrl, dest, &HttpDownloadOption{
+		Token:  "token",
+		Sha256: hex.EncodeToString(sum[:]),
+		OnProgress: func(done, total int64) {
+			if resumed < 0 {
+				resumed = done
+			}
+			progress = done
+		},
+		Policy: local,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), sha256Hex)
+	assert.Less(t, int64(300), resumed)
+	assert.Equal(t, int64(len(content)), progress)
+	body, _ := ioutil.ReadFile(dest)
+	assert.Equal(t, content, body)
+	assert.False(t, utils.FileExists(dest+downloadStateSuffix))
+
+	// remote changed after part file downloaded, If-Range return whole content
+	assert.Nil(t, ioutil.WriteFile(dest+downloadPartSuffix, []byte("broken"), 0666))
+	saveHttpDownloadState(dest+downloadStateSuffix, hubUrl, http.Header{
+		"Last-Modified": {srvModTime.Add(-time.Hour).Format(http.TimeFormat)}})
+	assert.Nil(t, downloadHttpErr(hubUrl, dest, &HttpDownloadOption{Token: "token",
+		Sha256: hex.EncodeToString(sum[:]), Policy: local}))
+	body, _ = ioutil.ReadFile(dest)
+	assert.Equal(t, content, body)
+
+	// auth error without body, size limit, sha256 pinning, content type
+	_, err = DownloadHttp(hubUrl, dest, &HttpDownloadOption{Policy: local})
+	assert.NotNil(t, err)
+	assert.False(t, strings.Contains(err.Error(), "not valid"))
+	assert.NotNil(t, downloadHttpErr(hubUrl, dest, &HttpDownloadOption{Token: "token", MaxSize: 100, Policy: local}))
+	assert.NotNil(t, downloadHttpErr(hubUrl, dest, &HttpDownloadOption{Token: "token", Sha256: "00", Policy: local}))
+	assert.NotNil(t, downloadHttpErr(hubUrl, dest, &HttpDownloadOption{Token: "token",
+		ContentTypes: []string{"application/x-safetensors"}, Policy: local}))
+	assert.NotNil(t, downloadHttpErr(srv.URL+"/login", dest, &HttpDownloadOption{Token: "token", Policy: local}))
+	assert.NotNil(t, downloadHttpErr("ftp://example.com/model", dest, &HttpDownloadOption{Policy: local}))
+}
+
+func TestDownloadHttpStall(t *testing.T) {
+	release := make(chan struct{})
+	// slow body keep sending, stalled body stop after first bytes
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", "100")
+		for i := 0; i < 10; i++ {
+			w.Write(make([]byte, 10))
+			w.(http.Flusher).Flush()
+			if r.URL.Path == "/stall" && i == 4 {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	dest := filepath.Join(t.TempDir(), "model.safetensors")
+	local := &UrlPolicy{Schemes: []string{"http"}, AllowPrivate: true}
+
+	// total time longer than idle timeout, timer reset by each read
+	assert.Nil(t, downloadHttpErr(srv.URL+"/slow", dest, &HttpDownloadOption{Policy: local,
+		IdleTimeout: 100 * time.Millisecond}))
+	// stalled mid-body canceled, part file kept to resume
+	start := time.Now()
+	err := downloadHttpErr(srv.URL+"/stall", dest+".stall", &HttpDownloadOption{Policy: local,
+		IdleTimeout: 100 * time.Millisecond})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no data received")
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.True(t, utils.FileExists(dest+".stall"+downloadPartSuffix))
+}
+
+func downloadHttpErr(rawUrl, dest string, opt *HttpDownloadOption) error {
+	_, err := DownloadHttp(rawUrl, dest, opt)
+	return err
+}
+
+func TestUrlPolicy(t *testing.T) {
+	content := []byte("model")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(content)
+	}))
+	defer srv.Close()
+	dest := filepath.Join(t.TempDir(), "model.safetensors")
+
+	// loopback address rejected after dns resolve
+	_, err := DownloadHttp(srv.URL+"/model", dest, &HttpDownloadOption{
+		Policy: &UrlPolicy{Schemes: []string{"http"}}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not allowed")
+	local := &UrlPolicy{Schemes: []string{"http"}, Hosts: []string{"127.0.0.1"}, AllowPrivate: true}
+	assert.Nil(t, downloadHttpErr(srv.URL+"/model", dest, &HttpDownloadOption{Policy: local}))
+
+	// redirect checked
+	_, err = DownloadHttp(srv.URL+"/redirect?to=http://localhost/model", dest,
+		&HttpDownloadOption{Policy: local})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "host localhost not allowed")
+
+	for rawUrl, allowed := range map[string]bool{
+		"https://huggingface.co/a":         true,
+		"https://cdn.huggingface.co/a":     true,
+		"https://huggingface.co.evil.io/a": false,
+		"https://evilhuggingface.co/a":     false,
+		"http://huggingface.co/a":          false,
+	} {
+		u, _ := url.Parse(rawUrl)
+		policy := &UrlPolicy{Hosts: []string{"huggingface.co", "*.huggingface.co"}}
+		assert.Equal(t, allowed, policy.Check(u) == nil, rawUrl)
+	}
+	for ip, private := range map[string]bool{
+		"10.0.0.1": true, "172.16.0.1": true, "192.168.1.1": true, "127.0.0.1": true,
+		"169.254.169.254": true, "100.100.100.200": true, "::1": true, "fe80::1": true, "0.0.0.0": true,
+		"::ffff:127.0.0.1": true, "8.8.8.8": false, "2001:4860:4860::8888": false,
+	} {
+		assert.Equal(t, private, isPrivateIP(net.ParseIP(ip)), ip)
+	}
+}
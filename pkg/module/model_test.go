@@ -0,0 +1,361 @@
+package module
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestModelRegister(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		OssPath:           filepath.Join(dir, "oss"),
+		SdPath:            filepath.Join(dir, "sd"),
+		DbSqlite:          filepath.Join(dir, "sqlite3"),
+		DownloadChunkSize: 100,
+	}}
+	modelStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer modelStore.Close()
+	OssGlobal = new(OssManagerLocal)
+	assert.Nil(t, OssGlobal.UploadFileByByte("models/lora.safetensors", make([]byte, 1000)))
+	assert.Nil(t, InitModelManager(modelStore))
+
+	req := &ModelRegister{Type: config.LORA_MODEL, Name: "lora.safetensors", OssPath: "models/lora.safetensors"}
+	started, err := ModelManagerGlobal.Register(req)
+	assert.Nil(t, err)
+	assert.True(t, started)
+	// same name coalesced, other oss path conflict
+	if ModelManagerGlobal.IsRegistering(req.Name) {
+		started, err = ModelManagerGlobal.Register(req)
+		assert.Nil(t, err)
+		assert.False(t, started)
+		_, err = ModelManagerGlobal.Register(&ModelRegister{Type: config.LORA_MODEL, Name: req.Name,
+			OssPath: "models/other.safetensors"})
+		assert.Equal(t, ErrModelRegistering, err)
+	}
+	waitModelStatus(t, modelStore, req.Name, config.MODEL_LOADED)
+	data, _ := modelStore.Get(req.Name, []string{datastore.KModelProgress, datastore.KModelLocalPath})
+	progress := new(ModelProgress)
+	assert.Nil(t, json.Unmarshal([]byte(data[datastore.KModelProgress].(string)), progress))
+	assert.Equal(t, ModelProgress{Bytes: 1000, Total: 1000, Percent: 100}, *progress)
+	assert.Equal(t, filepath.Join(dir, "sd/models/Lora/lora.safetensors"), data[datastore.KModelLocalPath])
+
+	// not exist, failed with message
+	req = &ModelRegister{Type: config.LORA_MODEL, Name: "miss.safetensors", OssPath: "models/miss.safetensors"}
+	_, err = ModelManagerGlobal.Register(req)
+	assert.Nil(t, err)
+	waitModelStatus(t, modelStore, req.Name, config.MODEL_FAILED)
+	data, _ = modelStore.Get(req.Name, []string{datastore.KModelMessage})
+	assert.NotEqual(t, "", data[datastore.KModelMessage])
+}
+
+func TestModelRegisterClaim(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		OssPath:           filepath.Join(dir, "oss"),
+		SdPath:            filepath.Join(dir, "sd"),
+		DbSqlite:          filepath.Join(dir, "sqlite3"),
+		DownloadChunkSize: 100,
+	}}
+	modelStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer modelStore.Close()
+	OssGlobal = new(OssManagerLocal)
+	assert.Nil(t, InitModelManager(modelStore))
+
+	// job of other instance running, coalesced without download
+	name := "lora.safetensors"
+	req := &ModelRegister{Type: config.LORA_MODEL, Name: name, OssPath: "models/lora.safetensors"}
+	other := newModelManager(modelStore)
+	running, err := other.claim(name, map[string]interface{}{
+		datastore.KModelName:    name,
+		datastore.KModelType:    req.Type,
+		datastore.KModelOssPath: req.OssPath,
+		datastore.KModelStatus:  config.MODEL_REGISTERING,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, running)
+	started, err := ModelManagerGlobal.Register(req)
+	assert.Nil(t, err)
+	assert.False(t, started)
+	assert.False(t, ModelManagerGlobal.IsRegistering(name))
+	_, err = ModelManagerGlobal.Register(&ModelRegister{Type: config.LORA_MODEL, Name: name,
+		OssPath: "models/other.safetensors"})
+	assert.Equal(t, ErrModelRegistering, err)
+	_, _, err = ModelManagerGlobal.Update(req)
+	assert.Equal(t, ErrModelRegistering, err)
+	// resume skip model claimed by other instance
+	assert.Nil(t, InitModelManager(modelStore))
+	assert.False(t, ModelManagerGlobal.IsRegistering(name))
+
+	// lease expired, taken over
+	assert.Nil(t, OssGlobal.UploadFileByByte(req.OssPath, make([]byte, 100)))
+	assert.Nil(t, modelStore.Update(name, map[string]interface{}{datastore.KModelJobLease: "1"}))
+	assert.Nil(t, InitModelManager(modelStore))
+	waitModelStatus(t, modelStore, name, config.MODEL_LOADED)
+	data, _ := modelStore.Get(name, []string{datastore.KModelJobOwner, datastore.KModelJobLease})
+	assert.Equal(t, "", data[datastore.KModelJobOwner])
+	assert.Equal(t, "", data[datastore.KModelJobLease])
+	// job released, not update by old owner
+	assert.False(t, other.updateOwned(name, map[string]interface{}{datastore.KModelStatus: config.MODEL_FAILED}))
+}
+
+func TestModelRegisterLoad(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		OssPath:           filepath.Join(dir, "oss"),
+		SdPath:            filepath.Join(dir, "sd"),
+		DbSqlite:          filepath.Join(dir, "sqlite3"),
+		DownloadChunkSize: 100,
+	}}
+	modelStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer modelStore.Close()
+	OssGlobal = new(OssManagerLocal)
+	assert.Nil(t, OssGlobal.UploadFileByByte("models/sd.safetensors", make([]byte, 100)))
+	ModelManagerGlobal = newModelManager(modelStore)
+	ModelManagerGlobal.loadInterval = time.Millisecond
+
+	// status when refresh and check called
+	var lock sync.Mutex
+	var statuses []string
+	record := func(name string) {
+		data, _ := modelStore.Get(name, []string{datastore.KModelStatus, datastore.KModelLocalPath})
+		lock.Lock()
+		statuses = append(statuses, data[datastore.KModelStatus].(string))
+		lock.Unlock()
+		assert.NotEqual(t, "", data[datastore.KModelLocalPath])
+	}
+	reported := map[string]bool{"sd.safetensors": true}
+	var checks int
+	ModelManagerGlobal.refresh = func(modelType string) error {
+		assert.Equal(t, config.SD_MODEL, modelType)
+		record("sd.safetensors")
+		return nil
+	}
+	ModelManagerGlobal.loaded = func(modelType, fileName string) (bool, error) {
+		lock.Lock()
+		checks++
+		lock.Unlock()
+		return reported[fileName], nil
+	}
+
+	// registering -> loading -> loaded
+	req := &ModelRegister{Type: config.SD_MODEL, Name: "sd.safetensors", OssPath: "models/sd.safetensors"}
+	_, err := ModelManagerGlobal.Register(req)
+	assert.Nil(t, err)
+	waitModelStatus(t, modelStore, req.Name, config.MODEL_LOADED)
+	assert.Equal(t, []string{config.MODEL_LOADING}, statuses)
+	assert.Equal(t, 1, checks)
+
+	// webui not report model -> failed
+	statuses, checks = nil, 0
+	req = &ModelRegister{Type: config.SD_MODEL, Name: "other.safetensors", OssPath: "models/sd.safetensors"}
+	ModelManagerGlobal.refresh = func(modelType string) error {
+		record("other.safetensors")
+		return nil
+	}
+	_, err = ModelManagerGlobal.Register(req)
+	assert.Nil(t, err)
+	waitModelStatus(t, modelStore, req.Name, config.MODEL_FAILED)
+	assert.Equal(t, []string{config.MODEL_LOADING}, statuses)
+	assert.Equal(t, modelLoadCheck, checks)
+	data, _ := modelStore.Get(req.Name, []string{datastore.KModelMessage, datastore.KModelJobOwner})
+	assert.NotEqual(t, "", data[datastore.KModelMessage])
+	assert.Equal(t, "", data[datastore.KModelJobOwner])
+
+	// refresh fail -> failed
+	ModelManagerGlobal.refresh = func(modelType string) error {
+		return errors.New("connection refused")
+	}
+	_, err = ModelManagerGlobal.Register(&ModelRegister{Type: config.SD_MODEL, Name: "sd.safetensors",
+		OssPath: "models/sd.safetensors", Etag: "new"})
+	assert.Nil(t, err)
+	waitModelStatus(t, modelStore, "sd.safetensors", config.MODEL_FAILED)
+}
+
+func waitModelStatus(t *testing.T, modelStore datastore.Datastore, name, status string) {
+	for i := 0; i < 100; i++ {
+		data, _ := modelStore.Get(name, []string{datastore.KModelStatus})
+		if data[datastore.KModelStatus] == status && !ModelManagerGlobal.IsRegistering(name) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("model %s status not %s", name, status)
+}
+
+func TestModelVersion(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		OssPath:           filepath.Join(dir, "oss"),
+		SdPath:            filepath.Join(dir, "sd"),
+		DbSqlite:          filepath.Join(dir, "sqlite3"),
+		DownloadChunkSize: 100,
+	}}
+	modelStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer modelStore.Close()
+	OssGlobal = new(OssManagerLocal)
+	assert.Nil(t, OssGlobal.UploadFileByByte("models/v1.safetensors", make([]byte, 100)))
+	assert.Nil(t, OssGlobal.UploadFileByByte("models/v2.safetensors", make([]byte, 200)))
+	assert.Nil(t, InitModelManager(modelStore))
+
+	name := "sd.safetensors"
+	v1 := &ModelRegister{Type: config.SD_MODEL, Name: name, OssPath: "models/v1.safetensors"}
+	_, err := ModelManagerGlobal.Register(v1)
+	assert.Nil(t, err)
+	waitModelStatus(t, modelStore, name, config.MODEL_LOADED)
+
+	// update download new version file in background, latest moved after loaded
+	version, started, err := ModelManagerGlobal.Update(&ModelRegister{Type: config.SD_MODEL, Name: name,
+		OssPath: "models/v2.safetensors"})
+	assert.Nil(t, err)
+	assert.True(t, started)
+	assert.Equal(t, 2, version)
+	waitModelStatus(t, modelStore, name, config.MODEL_LOADED)
+	data, _ := modelStore.Get(name, []string{datastore.KModelLocalPath, datastore.KModelProgress,
+		datastore.KModelJob})
+	assert.Equal(t, filepath.Join(dir, "sd/models/Stable-diffusion/sd@v2.safetensors"),
+		data[datastore.KModelLocalPath])
+	assert.Contains(t, data[datastore.KModelProgress], `"percent":100`)
+	assert.Equal(t, "", data[datastore.KModelJob])
+	resolved, err := ModelManagerGlobal.Resolve(name)
+	assert.Nil(t, err)
+	assert.Equal(t, "sd@v2.safetensors", resolved)
+	resolved, _ = ModelManagerGlobal.Resolve(name + "@1")
+	assert.Equal(t, name, resolved)
+
+	// alias
+	assert.Nil(t, ModelManagerGlobal.SetAlias(name, "prod", 1))
+	resolved, _ = ModelManagerGlobal.Resolve(name + ":prod")
+	assert.Equal(t, name, resolved)
+	_, err = ModelManagerGlobal.Resolve(name + ":canary")
+	assert.Equal(t, ErrModelVersionNotFound, err)
+	assert.Equal(t, ErrModelVersionNotFound, ModelManagerGlobal.SetAlias(name, "canary", 3))
+
+	// update to source of old version only move latest
+	version, started, err = ModelManagerGlobal.Update(v1)
+	assert.Nil(t, err)
+	assert.False(t, started)
+	assert.Equal(t, 1, version)
+	versions, _ := ModelManagerGlobal.Versions(name)
+	assert.Equal(t, 2, len(versions.Versions))
+	assert.Equal(t, map[string]int{ModelAliasLatest: 1, "prod": 1}, versions.Aliases)
+
+	// update fail, previous status restored and latest not moved
+	_, started, err = ModelManagerGlobal.Update(&ModelRegister{Type: config.SD_MODEL, Name: name,
+		OssPath: "models/miss.safetensors"})
+	assert.Nil(t, err)
+	assert.True(t, started)
+	waitModelStatus(t, modelStore, name, config.MODEL_LOADED)
+	data, _ = modelStore.Get(name, []string{datastore.KModelMessage, datastore.KModelJobOwner})
+	assert.Contains(t, data[datastore.KModelMessage], "update to version 3 fail")
+	assert.Equal(t, "", data[datastore.KModelJobOwner])
+	versions, _ = ModelManagerGlobal.Versions(name)
+	assert.Equal(t, 2, len(versions.Versions))
+	assert.Equal(t, 1, versions.Aliases[ModelAliasLatest])
+
+	// update job of crashed instance resumed with its source and version
+	job, _ := json.Marshal(&modelUpdate{Type: config.SD_MODEL, OssPath: "models/v2.safetensors", Version: 3,
+		PrevStatus: config.MODEL_LOADED})
+	assert.Nil(t, modelStore.Update(name, map[string]interface{}{
+		datastore.KModelStatus:   config.MODEL_REGISTERING,
+		datastore.KModelJob:      string(job),
+		datastore.KModelJobOwner: "crashed",
+		datastore.KModelJobLease: "1",
+	}))
+	assert.Nil(t, InitModelManager(modelStore))
+	waitModelStatus(t, modelStore, name, config.MODEL_LOADED)
+	versions, _ = ModelManagerGlobal.Versions(name)
+	assert.Equal(t, 3, len(versions.Versions))
+	assert.Equal(t, 3, versions.Aliases[ModelAliasLatest])
+
+	// unregistered model name as is
+	resolved, _ = ModelManagerGlobal.Resolve("local.ckpt")
+	assert.Equal(t, "local.ckpt", resolved)
+}
+
+func TestResolvePrompt(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		OssPath:           filepath.Join(dir, "oss"),
+		SdPath:            filepath.Join(dir, "sd"),
+		DbSqlite:          filepath.Join(dir, "sqlite3"),
+		DownloadChunkSize: 100,
+	}}
+	modelStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer modelStore.Close()
+	OssGlobal = new(OssManagerLocal)
+	assert.Nil(t, OssGlobal.UploadFileByByte("models/v1.safetensors", make([]byte, 100)))
+	assert.Nil(t, OssGlobal.UploadFileByByte("models/v2.safetensors", make([]byte, 200)))
+	assert.Nil(t, InitModelManager(modelStore))
+	for _, req := range []*ModelRegister{
+		{Type: config.LORA_MODEL, Name: "style.safetensors", OssPath: "models/v1.safetensors"},
+		{Type: config.SD_VAE, Name: "vae.pt", OssPath: "models/v1.safetensors"},
+	} {
+		_, err := ModelManagerGlobal.Register(req)
+		assert.Nil(t, err)
+		waitModelStatus(t, modelStore, req.Name, config.MODEL_LOADED)
+		req.OssPath = "models/v2.safetensors"
+		_, _, err = ModelManagerGlobal.Update(req)
+		assert.Nil(t, err)
+		waitModelStatus(t, modelStore, req.Name, config.MODEL_LOADED)
+	}
+	assert.Nil(t, ModelManagerGlobal.SetAlias("style.safetensors", ModelAliasLatest, 1))
+
+	// plain name to latest, version to versioned stem, not registered kept
+	prompt, err := ModelManagerGlobal.ResolvePrompt(
+		"a cat <lora:style:0.8> <lyco:style@2:1> <lora:style@v2> <lora:other:1> <hypernet:style:1>")
+	assert.Nil(t, err)
+	assert.Equal(t, "a cat <lora:style:0.8> <lyco:style@v2:1> <lora:style@v2> <lora:other:1> <hypernet:style:1>",
+		prompt)
+	_, err = ModelManagerGlobal.ResolvePrompt("<lora:style@3:1>")
+	assert.Equal(t, ErrModelVersionNotFound, err)
+	prompt, _ = ModelManagerGlobal.ResolvePrompt("no tag")
+	assert.Equal(t, "no tag", prompt)
+
+	// vae resolved the same as sd model
+	vae, err := ModelManagerGlobal.Resolve("vae.pt")
+	assert.Nil(t, err)
+	assert.Equal(t, "vae@v2.pt", vae)
+	vae, _ = ModelManagerGlobal.Resolve("vae.pt@1")
+	assert.Equal(t, "vae.pt", vae)
+
+	// versioned stem matched registered model
+	networks := networkModels(map[string]map[string]interface{}{
+		"style.safetensors": {datastore.KModelType: config.LORA_MODEL}})
+	assert.Equal(t, []string{"style.safetensors"}, lookupNetwork(networks, "lora", "style@v2"))
+	assert.Equal(t, 0, len(lookupNetwork(networks, "lora", "style@v2.safetensors")))
+}
+
+func TestParseModelRef(t *testing.T) {
+	for ref, expect := range map[string][]interface{}{
+		"sd.safetensors":         {"sd.safetensors", 0, ""},
+		"sd.safetensors@2":       {"sd.safetensors", 2, ""},
+		"sd.safetensors@v3":      {"sd.safetensors", 3, ""},
+		"sd.safetensors:prod":    {"sd.safetensors", 0, "prod"},
+		"sd@v2.safetensors":      {"sd@v2.safetensors", 0, ""},
+		"sd.safetensors [6ce01]": {"sd.safetensors [6ce01]", 0, ""},
+	} {
+		name, version, alias := ParseModelRef(ref)
+		assert.Equal(t, expect, []interface{}{name, version, alias}, ref)
+	}
+}
+
+func TestModelLocalPath(t *testing.T) {
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{SdPath: "/sd"}}
+	path, err := ModelLocalPath(config.LORA_MODEL, "style@v2.safetensors")
+	assert.Nil(t, err)
+	assert.Equal(t, "/sd/models/Lora/style@v2.safetensors", path)
+	for _, name := range []string{"", ".", "..", "../sd.ckpt", "sub/sd.ckpt", `sub\sd.ckpt`, "/etc/passwd",
+		"a..b.ckpt"} {
+		_, err = ModelLocalPath(config.LORA_MODEL, name)
+		assert.NotNil(t, err, name)
+	}
+	_, err = ModelLocalPath("unknown", "sd.ckpt")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,494 @@
+package module
+
+import (
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageFlushInterval usage counted in memory, write to models table every minute
+const usageFlushInterval = time.Minute
+
+// NetworkTagRegexp lora, lycoris and hypernetwork of prompt, eg: <lora:name:0.8>
+var NetworkTagRegexp = regexp.MustCompile(`<(lora|lyco|hypernet):([^:>]+)[^>]*>`)
+
+var ModelUsageGlobal *modelUsage
+
+// ModelUsageTypes types whose use recorded by predict request, gc only these types unless types given,
+// other types (controlNet, embedding...) never look used
+var ModelUsageTypes = []string{config.SD_MODEL, config.SD_VAE, config.LORA_MODEL, config.LYCORIS_MODEL,
+	config.HYPERNETWORK_MODEL}
+
+// usageFlushRetry conditional update retries of use count updated by other instance
+const usageFlushRetry = 5
+
+var modelUsageColumns = []string{datastore.KModelName, datastore.KModelType, datastore.KModelStatus,
+	datastore.KModelLocalPath, datastore.KModelVersions, datastore.KModelCreateTime, datastore.KModelLastUsed,
+	datastore.KModelUseCount, datastore.KModelOwner}
+
+// usageDelta use count and last used time not flushed
+type usageDelta struct {
+	count    int64
+	lastUsed int64
+}
+
+// ModelGcPolicy models unused Days days of Types (empty ModelUsageTypes) deleted, Exclude name glob kept,
+// only models of Owner if set
+type ModelGcPolicy struct {
+	Days    int
+	Types   []string
+	Exclude []string
+	Owner   string
+	DryRun  bool
+}
+
+// ModelGcItem model deleted or to delete in dry run
+type ModelGcItem struct {
+	Name     string
+	Type     string
+	LastUsed int64
+	UseCount int64
+	// Size bytes of all version files
+	Size int64
+	// Functions multiFunc functions of sd model
+	Functions []string
+	Deleted   bool
+	Message   string
+}
+
+// ModelGcReport result of one gc
+type ModelGcReport struct {
+	DryRun bool
+	// Before models last used before the time collected
+	Before int64
+	Items  []*ModelGcItem
+	// FreedBytes size of deleted models, to free in dry run
+	FreedBytes int64
+}
+
+// modelUsage count model use of predict request, models unused for days garbage collected
+type modelUsage struct {
+	modelStore datastore.Datastore
+	lock       sync.Mutex
+	// sd model or vae name => usage
+	models map[string]*usageDelta
+	// {lora|lyco|hypernet}:{name} of prompt => usage
+	networks map[string]*usageDelta
+	gcLock   sync.Mutex
+	stop     chan struct{}
+}
+
+// InitModelUsage flush usage every minute, gc every modelGcInterval seconds if set
+func InitModelUsage(modelStore datastore.Datastore) {
+	ModelUsageGlobal = newModelUsage(modelStore)
+	go ModelUsageGlobal.start()
+}
+
+func newModelUsage(modelStore datastore.Datastore) *modelUsage {
+	return &modelUsage{
+		modelStore: modelStore,
+		models:     make(map[string]*usageDelta),
+		networks:   make(map[string]*usageDelta),
+		stop:       make(chan struct{}),
+	}
+}
+
+func (u *modelUsage) start() {
+	flushTicker := time.NewTicker(usageFlushInterval)
+	defer flushTicker.Stop()
+	var gcTick <-chan time.Time
+	if config.ConfigGlobal.ModelGcInterval > 0 {
+		gcTicker := time.NewTicker(time.Duration(config.ConfigGlobal.ModelGcInterval) * time.Second)
+		defer gcTicker.Stop()
+		gcTick = gcTicker.C
+	}
+	for {
+		select {
+		case <-u.stop:
+			return
+		case <-flushTicker.C:
+			if err := u.Flush(); err != nil {
+				logrus.Warnf("[modelUsage] flush err=%s", err.Error())
+			}
+		case <-gcTick:
+			report, err := u.Collect(DefaultModelGcPolicy(false))
+			if err != nil {
+				logrus.Warnf("[modelUsage] gc err=%s", err.Error())
+				continue
+			}
+			if len(report.Items) != 0 {
+				logrus.Infof("[modelUsage] gc %d models, freed %d bytes", len(report.Items), report.FreedBytes)
+			}
+		}
+	}
+}
+
+// Close stop background flush and gc, flush remaining usage
+func (u *modelUsage) Close() {
+	close(u.stop)
+	if err := u.Flush(); err != nil {
+		logrus.Warnf("[modelUsage] flush err=%s", err.Error())
+	}
+}
+
+// DefaultModelGcPolicy policy of config
+func DefaultModelGcPolicy(dryRun bool) *ModelGcPolicy {
+	return &ModelGcPolicy{
+		Days:    config.ConfigGlobal.ModelGcDays,
+		Types:   config.ConfigGlobal.ModelGcTypes,
+		Exclude: config.ConfigGlobal.ModelGcExclude,
+		DryRun:  dryRun,
+	}
+}
+
+// Record sd model and vae of predict request and networks referenced in prompts, may be versioned name,
+// network used by several prompts of one request counted once
+func (u *modelUsage) Record(sdModel string, sdVae *string, prompts ...*string) {
+	now := utils.TimestampS()
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if sdModel != "" {
+		addUsage(u.models, sdModel, now)
+	}
+	if sdVae != nil && *sdVae != "" && *sdVae != "None" && *sdVae != "Automatic" {
+		addUsage(u.models, *sdVae, now)
+	}
+	networks := make(map[string]struct{})
+	for _, prompt := range prompts {
+		if prompt == nil {
+			continue
+		}
+		for _, match := range NetworkTagRegexp.FindAllStringSubmatch(*prompt, -1) {
+			if name := strings.TrimSpace(match[2]); name != "" {
+				networks[fmt.Sprintf("%s:%s", match[1], name)] = struct{}{}
+			}
+		}
+	}
+	for key := range networks {
+		addUsage(u.networks, key, now)
+	}
+}
+
+func addUsage(usage map[string]*usageDelta, key string, now int64) {
+	delta, ok := usage[key]
+	if !ok {
+		delta = new(usageDelta)
+		usage[key] = delta
+	}
+	delta.count++
+	delta.lastUsed = now
+}
+
+// Flush add counted usage to models table, usage of not registered model dropped
+func (u *modelUsage) Flush() error {
+	u.lock.Lock()
+	models, networks := u.models, u.networks
+	u.models, u.networks = make(map[string]*usageDelta), make(map[string]*usageDelta)
+	u.lock.Unlock()
+	if len(models) == 0 && len(networks) == 0 {
+		return nil
+	}
+	datas, err := u.modelStore.ListAll(modelUsageColumns)
+	if err != nil {
+		// keep usage, retry next flush
+		u.lock.Lock()
+		for key, delta := range models {
+			mergeUsage(u.models, key, delta)
+		}
+		for key, delta := range networks {
+			mergeUsage(u.networks, key, delta)
+		}
+		u.lock.Unlock()
+		return err
+	}
+	pending := make(map[string]*usageDelta)
+	for sdModel, delta := range models {
+		if name := usageModelName(datas, sdModel); name != "" {
+			mergeUsage(pending, name, delta)
+		}
+	}
+	stems := networkModels(datas)
+	for key, delta := range networks {
+		kind, stem, _ := strings.Cut(key, ":")
+		for _, name := range lookupNetwork(stems, kind, stem) {
+			mergeUsage(pending, name, delta)
+		}
+	}
+	for name, delta := range pending {
+		if err := u.addUsage(name, datas[name], delta); err != nil {
+			logrus.Warnf("[modelUsage] update model %s usage err=%s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// addUsage conditional update on use count and last used read, other instance flush the same model meanwhile
+// re-read and retry, so no count lost
+func (u *modelUsage) addUsage(name string, data map[string]interface{}, delta *usageDelta) error {
+	for i := 0; i < usageFlushRetry; i++ {
+		if data == nil {
+			return nil
+		}
+		count, _ := data[datastore.KModelUseCount].(string)
+		lastUsed, _ := data[datastore.KModelLastUsed].(string)
+		newLastUsed := parseInt(data, datastore.KModelLastUsed)
+		if delta.lastUsed > newLastUsed {
+			newLastUsed = delta.lastUsed
+		}
+		ok, err := u.modelStore.UpdateIf(name, map[string]interface{}{
+			datastore.KModelLastUsed: strconv.FormatInt(newLastUsed, 10),
+			datastore.KModelUseCount: strconv.FormatInt(parseInt(data, datastore.KModelUseCount)+delta.count, 10),
+		}, map[string]interface{}{
+			datastore.KModelUseCount: count,
+			datastore.KModelLastUsed: lastUsed,
+		})
+		if err != nil || ok {
+			return err
+		}
+		if data, err = u.modelStore.Get(name, modelUsageColumns); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("use count updated by others, retry %d times", usageFlushRetry)
+}
+
+func mergeUsage(usage map[string]*usageDelta, key string, delta *usageDelta) {
+	old, ok := usage[key]
+	if !ok {
+		usage[key] = &usageDelta{count: delta.count, lastUsed: delta.lastUsed}
+		return
+	}
+	old.count += delta.count
+	if delta.lastUsed > old.lastUsed {
+		old.lastUsed = delta.lastUsed
+	}
+}
+
+// usageModelName registered model of sd model, {stem}@v{n}{ext} => {stem}{ext}
+func usageModelName(datas map[string]map[string]interface{}, sdModel string) string {
+	name := sdModel
+	if _, ok := datas[name]; !ok {
+		match := versionFileRegexp.FindStringSubmatch(sdModel)
+		if match == nil {
+			return ""
+		}
+		name = match[1] + match[2]
+	}
+	if data, ok := datas[name]; !ok || data[datastore.KModelStatus] == config.MODEL_DELETE {
+		return ""
+	}
+	return name
+}
+
+// networkModels {lora|lyco|hypernet|controlnet|embedding}:{name} => registered models,
+// network name is file name without extension, may with sub dir
+func networkModels(datas map[string]map[string]interface{}) map[string][]string {
+	ret := make(map[string][]string)
+	for name, data := range datas {
+		if data[datastore.KModelStatus] == config.MODEL_DELETE {
+			continue
+		}
+		modelType, _ := data[datastore.KModelType].(string)
+		for _, kind := range networkKinds(modelType) {
+			key := fmt.Sprintf("%s:%s", kind, strings.TrimSuffix(name, filepath.Ext(name)))
+			ret[key] = append(ret[key], name)
+		}
+	}
+	return ret
+}
+
+// lookupNetwork registered models of prompt tag, versioned stem {stem}@v{n} of the model included
+func lookupNetwork(networks map[string][]string, kind, name string) []string {
+	if models, ok := networks[fmt.Sprintf("%s:%s", kind, name)]; ok {
+		return models
+	}
+	if match := versionFileRegexp.FindStringSubmatch(name); match != nil && match[2] == "" {
+		return networks[fmt.Sprintf("%s:%s", kind, match[1])]
+	}
+	return nil
+}
+
+// networkKinds prompt tag kinds load the model type, webui lora extension load lycoris by both tags,
+// controlnet units and embedding words of prompt also referenced by file stem
+func networkKinds(modelType string) []string {
+	switch modelType {
+	case config.LORA_MODEL, config.LYCORIS_MODEL:
+		return []string{"lora", "lyco"}
+	case config.HYPERNETWORK_MODEL:
+		return []string{"hypernet"}
+	case config.CONTORLNET_MODEL, config.IPADAPTER_MODEL:
+		return []string{"controlnet"}
+	case config.EMBEDDING_MODEL:
+		return []string{"embedding"}
+	}
+	return nil
+}
+
+// Collect delete models last used (registered time if never used) before policy days,
+// registering, loading or deleted models skipped, dry run only report
+func (u *modelUsage) Collect(policy *ModelGcPolicy) (*ModelGcReport, error) {
+	if policy.Days <= 0 {
+		return nil, fmt.Errorf("gc days %d not valid", policy.Days)
+	}
+	u.gcLock.Lock()
+	defer u.gcLock.Unlock()
+	// usage of recent requests first
+	if err := u.Flush(); err != nil {
+		return nil, err
+	}
+	datas, err := u.modelStore.ListAll(modelUsageColumns)
+	if err != nil {
+		return nil, err
+	}
+	report := &ModelGcReport{
+		DryRun: policy.DryRun,
+		Before: utils.TimestampS() - int64(policy.Days)*24*3600,
+		Items:  make([]*ModelGcItem, 0),
+	}
+	for name, data := range datas {
+		item := gcCandidate(name, data, policy, report.Before)
+		if item == nil {
+			continue
+		}
+		versions := ParseModelVersions(data)
+		files := versionFiles(data, versions)
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				item.Size += info.Size()
+			}
+		}
+		keys := ModelFunctionKeys(name, item.Type, versions)
+		if len(keys) != 0 {
+			for _, functionName := range FuncManagerGlobal.ModelFunctions(keys) {
+				item.Functions = append(item.Functions, functionName)
+			}
+			sort.Strings(item.Functions)
+		}
+		if !policy.DryRun {
+			u.delete(item, files, keys)
+		}
+		if policy.DryRun || item.Deleted {
+			report.FreedBytes += item.Size
+		}
+		report.Items = append(report.Items, item)
+	}
+	sort.Slice(report.Items, func(i, j int) bool {
+		return report.Items[i].Name < report.Items[j].Name
+	})
+	return report, nil
+}
+
+// gcCandidate nil if model kept
+func gcCandidate(name string, data map[string]interface{}, policy *ModelGcPolicy, before int64) *ModelGcItem {
+	status, _ := data[datastore.KModelStatus].(string)
+	if status == config.MODEL_REGISTERING || status == config.MODEL_LOADING || status == config.MODEL_DELETE ||
+		(ModelManagerGlobal != nil && ModelManagerGlobal.IsRegistering(name)) {
+		return nil
+	}
+	if owner, _ := data[datastore.KModelOwner].(string); policy.Owner != "" && owner != policy.Owner {
+		return nil
+	}
+	modelType, _ := data[datastore.KModelType].(string)
+	types := policy.Types
+	if len(types) == 0 {
+		types = ModelUsageTypes
+	}
+	if !stringIn(modelType, types) {
+		return nil
+	}
+	for _, pattern := range policy.Exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return nil
+		}
+	}
+	lastUsed := parseInt(data, datastore.KModelLastUsed)
+	if lastUsed == 0 {
+		lastUsed = parseInt(data, datastore.KModelCreateTime)
+	}
+	if lastUsed >= before {
+		return nil
+	}
+	return &ModelGcItem{
+		Name:      name,
+		Type:      modelType,
+		LastUsed:  lastUsed,
+		UseCount:  parseInt(data, datastore.KModelUseCount),
+		Functions: make([]string, 0),
+	}
+}
+
+// versionFiles local file of all versions
+func versionFiles(data map[string]interface{}, versions *ModelVersions) []string {
+	files := make([]string, 0, len(versions.Versions)+1)
+	if localPath, _ := data[datastore.KModelLocalPath].(string); localPath != "" {
+		files = append(files, localPath)
+	}
+	for _, ver := range versions.Versions {
+		if ver.LocalPath != "" && !stringIn(ver.LocalPath, files) {
+			files = append(files, ver.LocalPath)
+		}
+	}
+	return files
+}
+
+// ModelFunctionKeys multiFunc function keys of sd model, versioned names predict with, nil other mode or type
+func ModelFunctionKeys(name, modelType string, versions *ModelVersions) []string {
+	if modelType != config.SD_MODEL || FuncManagerGlobal == nil ||
+		config.ConfigGlobal.GetFlexMode() != config.MultiFunc {
+		return nil
+	}
+	keys := []string{name}
+	for _, ver := range versions.Versions {
+		if key := ModelVersionName(name, ver.Version); !stringIn(key, keys) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// delete functions first, model file kept if function delete fail
+func (u *modelUsage) delete(item *ModelGcItem, files, keys []string) {
+	if len(keys) != 0 {
+		if _, fails, errs := FuncManagerGlobal.DeleteModelFunction(keys); len(fails) != 0 {
+			item.Message = fmt.Sprintf("delete function %s err=%s", strings.Join(fails, ","),
+				strings.Join(errs, ";"))
+			return
+		}
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			item.Message = fmt.Sprintf("delete file %s err=%s", file, err.Error())
+			return
+		}
+	}
+	if err := u.modelStore.Update(item.Name, map[string]interface{}{
+		datastore.KModelStatus:     config.MODEL_DELETE,
+		datastore.KModelMessage:    fmt.Sprintf("garbage collected, last used %d", item.LastUsed),
+		datastore.KModelModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+	}); err != nil {
+		item.Message = fmt.Sprintf("update model status err=%s", err.Error())
+		return
+	}
+	item.Deleted = true
+	logrus.Infof("[modelUsage] gc model %s, last used %d", item.Name, item.LastUsed)
+}
+
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package module
+
+import (
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestModelUsage(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		SdPath:   filepath.Join(dir, "sd"),
+		DbSqlite: filepath.Join(dir, "sqlite3"),
+	}}
+	modelStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KModelTableName))
+	defer modelStore.Close()
+	put := func(modelType, name string, createTime int64) string {
+		localFile, _ := ModelLocalPath(modelType, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(localFile), os.ModePerm))
+		assert.Nil(t, os.WriteFile(localFile, []byte(name), 0666))
+		assert.Nil(t, modelStore.Put(name, map[string]interface{}{
+			datastore.KModelName:       name,
+			datastore.KModelType:       modelType,
+			datastore.KModelStatus:     config.MODEL_LOADED,
+			datastore.KModelLocalPath:  localFile,
+			datastore.KModelCreateTime: fmt.Sprintf("%d", createTime),
+		}))
+		return localFile
+	}
+	old := utils.TimestampS() - 10*24*3600
+	put(config.SD_MODEL, "sd.safetensors", old)
+	put(config.LORA_MODEL, "style.safetensors", old)
+	oldFile := put(config.SD_MODEL, "old.ckpt", old)
+	put(config.SD_MODEL, "keep.ckpt", old)
+	put(config.SD_VAE, "vae.pt", old)
+	// use not recorded, gc only when type given
+	controlNetFile := put(config.CONTORLNET_MODEL, "control.pth", old)
+
+	// versioned sd model name and lora tag of prompt
+	usage := newModelUsage(modelStore)
+	usage.Record("sd@v2.safetensors", utils.String("vae.pt"), utils.String("a cat <lora:style:0.8>, <lora:unknown:1>"),
+		utils.String("<lora:style:-1>"))
+	usage.Record("sd.safetensors", nil, nil, utils.String("<lora:style:0.5>"))
+	assert.Nil(t, usage.Flush())
+	data, _ := modelStore.Get("sd.safetensors", modelUsageColumns)
+	assert.Equal(t, "2", data[datastore.KModelUseCount])
+	assert.NotEqual(t, "", data[datastore.KModelLastUsed])
+	data, _ = modelStore.Get("style.safetensors", modelUsageColumns)
+	assert.Equal(t, "2", data[datastore.KModelUseCount])
+	data, _ = modelStore.Get("vae.pt", modelUsageColumns)
+	assert.Equal(t, "1", data[datastore.KModelUseCount])
+
+	// instances flush the same model concurrently, no count lost
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			other := newModelUsage(modelStore)
+			for j := 0; j < 5; j++ {
+				other.Record("sd.safetensors", nil)
+				assert.Nil(t, other.Flush())
+			}
+		}()
+	}
+	wg.Wait()
+	data, _ = modelStore.Get("sd.safetensors", modelUsageColumns)
+	assert.Equal(t, "22", data[datastore.KModelUseCount])
+
+	// tenant only collect own models
+	report, err := usage.Collect(&ModelGcPolicy{Days: 7, Owner: "user1", DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(report.Items))
+
+	// dry run, used or excluded models kept
+	policy := &ModelGcPolicy{Days: 7, Exclude: []string{"keep*"}, DryRun: true}
+	report, err = usage.Collect(policy)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Items))
+	assert.Equal(t, "old.ckpt", report.Items[0].Name)
+	assert.Equal(t, int64(len("old.ckpt")), report.FreedBytes)
+	assert.False(t, report.Items[0].Deleted)
+	assert.True(t, utils.FileExists(oldFile))
+
+	policy.DryRun = false
+	report, err = usage.Collect(policy)
+	assert.Nil(t, err)
+	assert.True(t, report.Items[0].Deleted)
+	assert.False(t, utils.FileExists(oldFile))
+	data, _ = modelStore.Get("old.ckpt", modelUsageColumns)
+	assert.Equal(t, config.MODEL_DELETE, data[datastore.KModelStatus])
+
+	// deleted model not collected again
+	report, _ = usage.Collect(policy)
+	assert.Equal(t, 0, len(report.Items))
+	assert.True(t, utils.FileExists(controlNetFile))
+	report, _ = usage.Collect(&ModelGcPolicy{Days: 7, Types: []string{config.CONTORLNET_MODEL}, DryRun: true})
+	assert.Equal(t, 1, len(report.Items))
+	assert.Equal(t, "control.pth", report.Items[0].Name)
+}
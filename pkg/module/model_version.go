@@ -0,0 +1,390 @@
+package module
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ModelAliasLatest model name without version or alias resolve to it, moved by update
+const ModelAliasLatest = "latest"
+
+var ErrModelVersionNotFound = errors.New("model version or alias not found")
+
+// modelVersionColumns columns of version info
+var modelVersionColumns = []string{datastore.KModelName, datastore.KModelType, datastore.KModelStatus,
+	datastore.KModelOssPath, datastore.KModelUrl, datastore.KModelEtag, datastore.KModelSha256,
+	datastore.KModelShortHash, datastore.KModelInfo, datastore.KModelLocalPath, datastore.KModelCreateTime,
+	datastore.KModelVersions, datastore.KModelAliases}
+
+// ModelVersion immutable downloaded version of model
+type ModelVersion struct {
+	Version    int        `json:"version"`
+	OssPath    string     `json:"ossPath,omitempty"`
+	Url        string     `json:"url,omitempty"`
+	Etag       string     `json:"etag,omitempty"`
+	Sha256     string     `json:"sha256,omitempty"`
+	ShortHash  string     `json:"shortHash,omitempty"`
+	LocalPath  string     `json:"localPath"`
+	CreateTime string     `json:"createTime"`
+	Info       *ModelInfo `json:"info,omitempty"`
+}
+
+// ModelVersions versions and aliases of model, save in MODEL_VERSIONS and MODEL_ALIASES as json
+type ModelVersions struct {
+	Versions []*ModelVersion
+	Aliases  map[string]int
+}
+
+// ParseModelVersions from models table row, model registered before versioning is version 1
+func ParseModelVersions(data map[string]interface{}) *ModelVersions {
+	ret := &ModelVersions{Aliases: make(map[string]int)}
+	if body, ok := data[datastore.KModelVersions].(string); ok && body != "" {
+		json.Unmarshal([]byte(body), &ret.Versions)
+	}
+	if body, ok := data[datastore.KModelAliases].(string); ok && body != "" {
+		json.Unmarshal([]byte(body), &ret.Aliases)
+	}
+	if len(ret.Versions) == 0 {
+		ver := &ModelVersion{Version: 1}
+		ver.OssPath, _ = data[datastore.KModelOssPath].(string)
+		ver.Url, _ = data[datastore.KModelUrl].(string)
+		ver.Etag, _ = data[datastore.KModelEtag].(string)
+		ver.Sha256, _ = data[datastore.KModelSha256].(string)
+		ver.ShortHash, _ = data[datastore.KModelShortHash].(string)
+		ver.LocalPath, _ = data[datastore.KModelLocalPath].(string)
+		ver.CreateTime, _ = data[datastore.KModelCreateTime].(string)
+		if body, ok := data[datastore.KModelInfo].(string); ok && body != "" {
+			ver.Info = new(ModelInfo)
+			if err := json.Unmarshal([]byte(body), ver.Info); err != nil {
+				ver.Info = nil
+			}
+		}
+		ret.Versions = []*ModelVersion{ver}
+	}
+	if _, ok := ret.Aliases[ModelAliasLatest]; !ok {
+		ret.Aliases[ModelAliasLatest] = ret.Latest()
+	}
+	return ret
+}
+
+// Values models table columns
+func (v *ModelVersions) Values() map[string]interface{} {
+	versions, _ := json.Marshal(v.Versions)
+	aliases, _ := json.Marshal(v.Aliases)
+	return map[string]interface{}{
+		datastore.KModelVersions: string(versions),
+		datastore.KModelAliases:  string(aliases),
+	}
+}
+
+// Get nil if version not exist
+func (v *ModelVersions) Get(version int) *ModelVersion {
+	for _, ver := range v.Versions {
+		if ver.Version == version {
+			return ver
+		}
+	}
+	return nil
+}
+
+// Latest max version number
+func (v *ModelVersions) Latest() int {
+	latest := 0
+	for _, ver := range v.Versions {
+		if ver.Version > latest {
+			latest = ver.Version
+		}
+	}
+	return latest
+}
+
+// Find version downloaded from same source and etag
+func (v *ModelVersions) Find(req *ModelRegister) *ModelVersion {
+	for _, ver := range v.Versions {
+		if ver.OssPath == req.OssPath && ver.Url == req.Url && ver.Etag == req.Etag {
+			return ver
+		}
+	}
+	return nil
+}
+
+// Add new version and move latest alias to it
+func (v *ModelVersions) Add(ver *ModelVersion) {
+	v.Versions = append(v.Versions, ver)
+	sort.Slice(v.Versions, func(i, j int) bool {
+		return v.Versions[i].Version < v.Versions[j].Version
+	})
+	v.Aliases[ModelAliasLatest] = ver.Version
+}
+
+// Resolve alias or version number, 0 means latest
+func (v *ModelVersions) Resolve(version int, alias string) (*ModelVersion, error) {
+	if version == 0 {
+		if alias == "" {
+			alias = ModelAliasLatest
+		}
+		number, ok := v.Aliases[alias]
+		if !ok {
+			return nil, ErrModelVersionNotFound
+		}
+		version = number
+	}
+	if ver := v.Get(version); ver != nil {
+		return ver, nil
+	}
+	return nil, ErrModelVersionNotFound
+}
+
+// ParseModelRef name@{version} or name:{alias}, name@v{version} also accepted
+func ParseModelRef(ref string) (string, int, string) {
+	if idx := strings.LastIndex(ref, "@"); idx > 0 {
+		if version, err := strconv.Atoi(strings.TrimPrefix(ref[idx+1:], "v")); err == nil && version > 0 {
+			return ref[:idx], version, ""
+		}
+	}
+	if idx := strings.LastIndex(ref, ":"); idx > 0 && idx < len(ref)-1 && !strings.ContainsAny(ref[idx+1:], "/\\") {
+		return ref[:idx], 0, ref[idx+1:]
+	}
+	return ref, 0, ""
+}
+
+// ModelVersionName file name of version, version 1 keep model name, others {stem}@v{version}{ext}
+func ModelVersionName(modelName string, version int) string {
+	if version <= 1 {
+		return modelName
+	}
+	ext := filepath.Ext(modelName)
+	return fmt.Sprintf("%s@v%d%s", strings.TrimSuffix(modelName, ext), version, ext)
+}
+
+// Resolve model reference to versioned model file name, unregistered plain name return as is
+func (m *modelManager) Resolve(ref string) (string, error) {
+	name, version, alias := ParseModelRef(ref)
+	data, err := m.modelStore.Get(name, modelVersionColumns)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 || data[datastore.KModelStatus] == config.MODEL_DELETE {
+		if version != 0 || alias != "" {
+			return "", ErrModelVersionNotFound
+		}
+		return ref, nil
+	}
+	ver, err := ParseModelVersions(data).Resolve(version, alias)
+	if err != nil {
+		return "", err
+	}
+	return ModelVersionName(name, ver.Version), nil
+}
+
+// ResolvePrompt lora, lycoris and hypernetwork tags of registered models to versioned file stem,
+// name@{version} to the version, plain name to latest, eg: <lora:style@2:0.8> => <lora:style@v2:0.8>.
+// alias not supported in tag, ":" is weight separator. not registered tag kept
+func (m *modelManager) ResolvePrompt(prompt string) (string, error) {
+	matches := NetworkTagRegexp.FindAllStringSubmatchIndex(prompt, -1)
+	if len(matches) == 0 {
+		return prompt, nil
+	}
+	datas, err := m.modelStore.ListAll(modelVersionColumns)
+	if err != nil {
+		return "", err
+	}
+	networks := networkModels(datas)
+	var buf strings.Builder
+	last := 0
+	for _, idx := range matches {
+		kind, ref := prompt[idx[2]:idx[3]], strings.TrimSpace(prompt[idx[4]:idx[5]])
+		stem, version, _ := ParseModelRef(ref)
+		names := networks[fmt.Sprintf("%s:%s", kind, stem)]
+		if len(names) == 0 {
+			continue
+		}
+		// same stem with different extension, the first one
+		sort.Strings(names)
+		ver, err := ParseModelVersions(datas[names[0]]).Resolve(version, "")
+		if err != nil {
+			return "", err
+		}
+		file := ModelVersionName(names[0], ver.Version)
+		buf.WriteString(prompt[last:idx[4]])
+		buf.WriteString(strings.TrimSuffix(file, filepath.Ext(file)))
+		last = idx[5]
+	}
+	buf.WriteString(prompt[last:])
+	return buf.String(), nil
+}
+
+// Versions of model, nil if model not exist
+func (m *modelManager) Versions(name string) (*ModelVersions, error) {
+	data, err := m.modelStore.Get(name, modelVersionColumns)
+	if err != nil || len(data) == 0 || data[datastore.KModelStatus] == config.MODEL_DELETE {
+		return nil, err
+	}
+	return ParseModelVersions(data), nil
+}
+
+// SetAlias point alias to version, move latest also switch model source columns to the version
+func (m *modelManager) SetAlias(name, alias string, version int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.setAlias(name, alias, version)
+}
+
+func (m *modelManager) setAlias(name, alias string, version int) error {
+	versions, err := m.Versions(name)
+	if err != nil {
+		return err
+	}
+	if versions == nil {
+		return ErrModelVersionNotFound
+	}
+	ver := versions.Get(version)
+	if ver == nil {
+		return ErrModelVersionNotFound
+	}
+	versions.Aliases[alias] = version
+	values := versions.Values()
+	if alias == ModelAliasLatest {
+		for key, val := range ver.values() {
+			values[key] = val
+		}
+	}
+	values[datastore.KModelModifyTime] = fmt.Sprintf("%d", utils.TimestampS())
+	return m.modelStore.Update(name, values)
+}
+
+// DeleteAlias latest alias can not delete
+func (m *modelManager) DeleteAlias(name, alias string) error {
+	if alias == ModelAliasLatest {
+		return fmt.Errorf("alias %s can not delete", ModelAliasLatest)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	versions, err := m.Versions(name)
+	if err != nil {
+		return err
+	}
+	if versions == nil {
+		return ErrModelVersionNotFound
+	}
+	if _, ok := versions.Aliases[alias]; !ok {
+		return ErrModelVersionNotFound
+	}
+	delete(versions.Aliases, alias)
+	values := versions.Values()
+	values[datastore.KModelModifyTime] = fmt.Sprintf("%d", utils.TimestampS())
+	return m.modelStore.Update(name, values)
+}
+
+// Update download new version of model in background as register job, previous status restored if fail.
+// source same as existed version only move latest alias to it,
+// return version and whether update job started, query progress by model row
+func (m *modelManager) Update(req *ModelRegister) (int, bool, error) {
+	// claim job, reject register or update of the model at the same time in any instance
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.jobs[req.Name]; ok {
+		return 0, false, ErrModelRegistering
+	}
+	running, err := m.claim(req.Name, map[string]interface{}{})
+	if err != nil {
+		return 0, false, err
+	}
+	if running != nil {
+		return 0, false, ErrModelRegistering
+	}
+	data, err := m.modelStore.Get(req.Name, modelVersionColumns)
+	if err == nil && (len(data) == 0 || data[datastore.KModelStatus] == config.MODEL_DELETE) {
+		err = ErrModelVersionNotFound
+	}
+	status, _ := data[datastore.KModelStatus].(string)
+	if err == nil && (status == config.MODEL_REGISTERING || status == config.MODEL_LOADING) {
+		// job of crashed instance, resumed after lease expired
+		err = ErrModelRegistering
+	}
+	if err != nil {
+		m.release(req.Name)
+		return 0, false, err
+	}
+	versions := ParseModelVersions(data)
+	if ver := versions.Find(req); ver != nil {
+		err = m.setAlias(req.Name, ModelAliasLatest, ver.Version)
+		m.release(req.Name)
+		return ver.Version, false, err
+	}
+	req.Version = versions.Latest() + 1
+	req.update = newModelUpdate(req, status)
+	job, _ := json.Marshal(req.update)
+	if !m.updateOwned(req.Name, map[string]interface{}{
+		datastore.KModelStatus:     config.MODEL_REGISTERING,
+		datastore.KModelProgress:   "{}",
+		datastore.KModelMessage:    "",
+		datastore.KModelModifyTime: fmt.Sprintf("%d", utils.TimestampS()),
+		datastore.KModelJob:        string(job),
+	}) {
+		return 0, false, ErrModelRegistering
+	}
+	m.jobs[req.Name] = req
+	go m.run(req)
+	return req.Version, true, nil
+}
+
+func newModelUpdate(req *ModelRegister, prevStatus string) *modelUpdate {
+	return &modelUpdate{Type: req.Type, OssPath: req.OssPath, Url: req.Url, Etag: req.Etag, Sha256: req.Sha256,
+		Version: req.Version, PrevStatus: prevStatus}
+}
+
+// register request of update job resumed
+func (u *modelUpdate) register(name string) *ModelRegister {
+	return &ModelRegister{Type: u.Type, Name: name, OssPath: u.OssPath, Url: u.Url, Etag: u.Etag,
+		Sha256: u.Sha256, Version: u.Version, update: u}
+}
+
+// newModelVersion version of downloaded file, hash and header info computed
+func newModelVersion(req *ModelRegister, localFile, sha256Hex string) *ModelVersion {
+	ver := &ModelVersion{
+		Version:    req.Version,
+		OssPath:    req.OssPath,
+		Url:        req.Url,
+		Etag:       req.Etag,
+		Sha256:     req.Sha256,
+		LocalPath:  localFile,
+		CreateTime: fmt.Sprintf("%d", utils.TimestampS()),
+	}
+	if ver.Version == 0 {
+		ver.Version = 1
+	}
+	if info, err := ComputeModelInfo(localFile, sha256Hex); err != nil {
+		logrus.Warnf("compute model %s info err=%s", req.Name, err.Error())
+	} else {
+		ver.Sha256, ver.ShortHash, ver.Info = info.Sha256, info.ShortHash, info
+	}
+	return ver
+}
+
+// values model source columns of version
+func (v *ModelVersion) values() map[string]interface{} {
+	values := map[string]interface{}{
+		datastore.KModelOssPath:   v.OssPath,
+		datastore.KModelUrl:       v.Url,
+		datastore.KModelEtag:      v.Etag,
+		datastore.KModelSha256:    v.Sha256,
+		datastore.KModelShortHash: v.ShortHash,
+		datastore.KModelLocalPath: v.LocalPath,
+		datastore.KModelInfo:      "",
+	}
+	if v.Info != nil {
+		body, _ := json.Marshal(v.Info)
+		values[datastore.KModelInfo] = string(body)
+	}
+	return values
+}
@@ -2,17 +2,27 @@ package module
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
 	"github.com/devsapp/serverless-stable-diffusion-api/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -26,6 +36,11 @@ type OssOp interface {
 	DeleteFile(ossKey string) error
 	DownloadFileToBase64(ossPath string) (*string, error)
 	GetUrl(ossPath []string) ([]string, error)
+	IsFileExist(ossKey string) (bool, error)
+	GetObject(ossKey string) (io.ReadCloser, error)
+	GetObjectMeta(ossKey string) (*ObjectMeta, error)
+	// GetObjectRange read object bytes [start, end]
+	GetObjectRange(ossKey string, start, end int64) (io.ReadCloser, error)
 }
 
 // OssGlobal oss manager
@@ -49,9 +64,44 @@ func NewOssManager() error {
 		OssGlobal = &OssManagerRemote{
 			bucket: bucket,
 		}
+	case config.S3:
+		accessKey, secretKey := config.ConfigGlobal.S3AccessKey, config.ConfigGlobal.S3SecretKey
+		if accessKey == "" {
+			accessKey, secretKey = config.ConfigGlobal.AccessKeyId, config.ConfigGlobal.AccessKeySecret
+		}
+		s3, err := NewOssManagerS3(config.ConfigGlobal.S3Endpoint, config.ConfigGlobal.S3Bucket,
+			config.ConfigGlobal.S3Region, accessKey, secretKey, config.ConfigGlobal.S3SessionToken,
+			config.ConfigGlobal.S3UsePathStyle())
+		if err != nil {
+			return err
+		}
+		OssGlobal = s3
 	default:
 		log.Fatal("oss mode err")
 	}
+	if config.ConfigGlobal.OssMode != config.LOCAL && config.ConfigGlobal.EnableOssRetry() {
+		return enableOssRetry()
+	}
+	return nil
+}
+
+// enableOssRetry wrap OssGlobal with retry/timeout/circuit breaker, start background upload retry
+func enableOssRetry() error {
+	cfg := config.ConfigGlobal
+	OssGlobal = NewResilientOss(OssGlobal, RetryPolicy{
+		MaxRetries:       cfg.OssMaxRetries,
+		BaseBackoff:      200 * time.Millisecond,
+		MaxBackoff:       5 * time.Second,
+		Timeout:          time.Duration(cfg.OssTimeout) * time.Second,
+		BreakerThreshold: cfg.OssBreakerThreshold,
+		BreakerCooldown:  time.Duration(cfg.OssBreakerCooldown) * time.Second,
+	})
+	queue, err := NewUploadQueue(cfg.OssRetryDir, time.Duration(cfg.OssRetryInterval)*time.Second)
+	if err != nil {
+		return err
+	}
+	queue.Start()
+	UploadQueueGlobal = queue
 	return nil
 }
 
@@ -109,11 +159,111 @@ func (o *OssManagerRemote) DownloadFileToBase64(ossKey string) (*string, error)
 	return &imageBase64, nil
 }
 
+// IsFileExist check object exist in oss
+func (o *OssManagerRemote) IsFileExist(ossKey string) (bool, error) {
+	return o.bucket.IsObjectExist(ossKey)
+}
+
+// GetObject read object stream, caller close it
+func (o *OssManagerRemote) GetObject(ossKey string) (io.ReadCloser, error) {
+	return o.bucket.GetObject(ossKey)
+}
+
+func (o *OssManagerRemote) GetObjectMeta(ossKey string) (*ObjectMeta, error) {
+	header, err := o.bucket.GetObjectDetailedMeta(ossKey)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("object %s size not valid", ossKey)
+	}
+	return &ObjectMeta{Size: size, ETag: header.Get("ETag")}, nil
+}
+
+func (o *OssManagerRemote) GetObjectRange(ossKey string, start, end int64) (io.ReadCloser, error) {
+	return o.bucket.GetObject(ossKey, oss.Range(start, end))
+}
+
 type OssManagerLocal struct {
 }
 
-func (o *OssManagerLocal) GetUrl(ossKey []string) ([]string, error) {
-	return nil, errors.New("not support")
+// local file url route and query params
+const (
+	LocalFileRoute    = "/files/"
+	localUrlExpires   = "expires"
+	localUrlSignature = "signature"
+	localUrlExpire    = 3 * time.Hour
+)
+
+var (
+	localSignSecret     []byte
+	localSignSecretOnce sync.Once
+)
+
+// localFileSecret fileSignSecret first, then accessKeySecret,
+// not set use random secret, only valid in current process
+func localFileSecret() []byte {
+	localSignSecretOnce.Do(func() {
+		secret := config.ConfigGlobal.FileSignSecret
+		if secret == "" {
+			secret = config.ConfigGlobal.AccessKeySecret
+		}
+		if secret == "" {
+			logrus.Warn("fileSignSecret not set, use random secret, local file url only valid in current process")
+			secret = utils.RandStr(32)
+		}
+		localSignSecret = []byte(secret)
+	})
+	return localSignSecret
+}
+
+func signLocalFile(ossKey string, expires int64) string {
+	mac := hmac.New(sha256.New, localFileSecret())
+	mac.Write([]byte(fmt.Sprintf("%s\n%d", ossKey, expires)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyLocalFileUrl check local file url signature and expires
+func VerifyLocalFileUrl(ossKey, expires, signature string) error {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || signature == "" {
+		return errors.New("url signature not valid")
+	}
+	if time.Now().Unix() > expiresAt {
+		return errors.New("url expired")
+	}
+	expected := signLocalFile(strings.TrimPrefix(ossKey, "/"), expiresAt)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("url signature not valid")
+	}
+	return nil
+}
+
+// LocalFilePath local file path of ossKey, ossKey out of ossPath not allowed
+func LocalFilePath(ossKey string) (string, error) {
+	cleaned := path.Clean("/" + ossKey)
+	if cleaned == "/" {
+		return "", errors.New("file not valid")
+	}
+	return fmt.Sprintf("%s%s", config.ConfigGlobal.OssPath, cleaned), nil
+}
+
+// GetUrl local file url served by GET /files/{ossKey}, signed with expiring hmac token
+func (o *OssManagerLocal) GetUrl(ossKeys []string) ([]string, error) {
+	ossUrl := make([]string, 0, len(ossKeys))
+	expires := time.Now().Add(localUrlExpire).Unix()
+	for _, key := range ossKeys {
+		key = strings.TrimPrefix(key, "/")
+		escaped := make([]string, 0)
+		for _, item := range strings.Split(key, "/") {
+			escaped = append(escaped, url.PathEscape(item))
+		}
+		ossUrl = append(ossUrl, fmt.Sprintf("%s%s%s?%s=%d&%s=%s", config.ConfigGlobal.FileUrlPrefix,
+			LocalFileRoute, strings.Join(escaped, "/"), localUrlExpires, expires, localUrlSignature,
+			signLocalFile(key, expires)))
+	}
+	return ossUrl, nil
 }
 
 func (o *OssManagerLocal) UploadFile(ossKey, localFile string) error {
@@ -165,3 +315,40 @@ func (o *OssManagerLocal) DownloadFileToBase64(ossKey string) (*string, error) {
 	imageBase64 := base64.StdEncoding.EncodeToString(data)
 	return &imageBase64, nil
 }
+
+func (o *OssManagerLocal) IsFileExist(ossKey string) (bool, error) {
+	destFile := fmt.Sprintf("%s/%s", config.ConfigGlobal.OssPath, ossKey)
+	return utils.FileExists(destFile), nil
+}
+
+func (o *OssManagerLocal) GetObject(ossKey string) (io.ReadCloser, error) {
+	destFile := fmt.Sprintf("%s/%s", config.ConfigGlobal.OssPath, ossKey)
+	if !utils.FileExists(destFile) {
+		return nil, fmt.Errorf("ossKey:%s not exist", ossKey)
+	}
+	return os.Open(destFile)
+}
+
+// GetObjectMeta local file etag empty, not verify
+func (o *OssManagerLocal) GetObjectMeta(ossKey string) (*ObjectMeta, error) {
+	destFile := fmt.Sprintf("%s/%s", config.ConfigGlobal.OssPath, ossKey)
+	info, err := os.Stat(destFile)
+	if err != nil {
+		return nil, fmt.Errorf("ossKey:%s not exist", ossKey)
+	}
+	return &ObjectMeta{Size: info.Size()}, nil
+}
+
+func (o *OssManagerLocal) GetObjectRange(ossKey string, start, end int64) (io.ReadCloser, error) {
+	destFile := fmt.Sprintf("%s/%s", config.ConfigGlobal.OssPath, ossKey)
+	f, err := os.Open(destFile)
+	if err != nil {
+		return nil, fmt.Errorf("ossKey:%s not exist", ossKey)
+	}
+	return &sectionReadCloser{Reader: io.NewSectionReader(f, start, end-start+1), Closer: f}, nil
+}
+
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,363 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// oss operation name, metrics key
+const (
+	ossOpUpload      = "upload"
+	ossOpDownload    = "download"
+	ossOpDelete      = "delete"
+	ossOpGetUrl      = "getUrl"
+	ossOpExist       = "exist"
+	ossOpGetObject   = "getObject"
+	ossOpObjectMeta  = "objectMeta"
+	ossOpObjectRange = "objectRange"
+)
+
+// circuit breaker state
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "halfOpen"
+)
+
+var ErrBreakerOpen = errors.New("oss circuit breaker open")
+
+// RetryPolicy retry/timeout/breaker config
+type RetryPolicy struct {
+	MaxRetries int
+	// BaseBackoff first retry backoff, double each retry with full jitter, max MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Timeout single attempt timeout, 0 not limit
+	Timeout time.Duration
+	// BreakerThreshold consecutive failures to open breaker, BreakerCooldown open duration before half open
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// OssOpMetrics one operation metrics
+type OssOpMetrics struct {
+	Calls     int64 `json:"calls"`
+	Failures  int64 `json:"failures"`
+	Retries   int64 `json:"retries"`
+	Timeouts  int64 `json:"timeouts"`
+	Rejected  int64 `json:"rejected"`
+	LatencyMs int64 `json:"latencyMs"`
+}
+
+// OssMetrics resilient oss metrics snapshot
+type OssMetrics struct {
+	Breaker    string                   `json:"breaker"`
+	Operations map[string]*OssOpMetrics `json:"operations"`
+	// UploadRetryPending background upload retry queue size
+	UploadRetryPending int `json:"uploadRetryPending"`
+}
+
+// ResilientOss OssOp wrapper with retry, timeout, jittered backoff and circuit breaker
+type ResilientOss struct {
+	op     OssOp
+	policy RetryPolicy
+
+	lock             sync.Mutex
+	state            string
+	consecutiveFails int
+	openedAt         time.Time
+	halfOpenTrial    bool
+	metrics          map[string]*OssOpMetrics
+}
+
+func NewResilientOss(op OssOp, policy RetryPolicy) *ResilientOss {
+	return &ResilientOss{
+		op:      op,
+		policy:  policy,
+		state:   BreakerClosed,
+		metrics: make(map[string]*OssOpMetrics),
+	}
+}
+
+func (r *ResilientOss) UploadFile(ossKey, localFile string) error {
+	return r.do(ossOpUpload, func() error {
+		return r.op.UploadFile(ossKey, localFile)
+	})
+}
+
+func (r *ResilientOss) UploadFileByByte(ossKey string, body []byte) error {
+	return r.do(ossOpUpload, func() error {
+		return r.op.UploadFileByByte(ossKey, body)
+	})
+}
+
+func (r *ResilientOss) DownloadFile(ossKey, localFile string) error {
+	return r.do(ossOpDownload, func() error {
+		return r.op.DownloadFile(ossKey, localFile)
+	})
+}
+
+func (r *ResilientOss) DeleteFile(ossKey string) error {
+	return r.do(ossOpDelete, func() error {
+		return r.op.DeleteFile(ossKey)
+	})
+}
+
+func (r *ResilientOss) DownloadFileToBase64(ossPath string) (*string, error) {
+	ret, err := r.call(ossOpDownload, func() (interface{}, error) {
+		return r.op.DownloadFileToBase64(ossPath)
+	}, nil)
+	val, _ := ret.(*string)
+	return val, err
+}
+
+func (r *ResilientOss) GetUrl(ossPath []string) ([]string, error) {
+	ret, err := r.call(ossOpGetUrl, func() (interface{}, error) {
+		return r.op.GetUrl(ossPath)
+	}, nil)
+	val, _ := ret.([]string)
+	return val, err
+}
+
+func (r *ResilientOss) IsFileExist(ossKey string) (bool, error) {
+	ret, err := r.call(ossOpExist, func() (interface{}, error) {
+		return r.op.IsFileExist(ossKey)
+	}, nil)
+	val, _ := ret.(bool)
+	return val, err
+}
+
+// GetObject timeout only limit open stream
+func (r *ResilientOss) GetObject(ossKey string) (io.ReadCloser, error) {
+	ret, err := r.call(ossOpGetObject, func() (interface{}, error) {
+		return r.op.GetObject(ossKey)
+	}, closeReader)
+	val, _ := ret.(io.ReadCloser)
+	return val, err
+}
+
+func (r *ResilientOss) GetObjectMeta(ossKey string) (*ObjectMeta, error) {
+	ret, err := r.call(ossOpObjectMeta, func() (interface{}, error) {
+		return r.op.GetObjectMeta(ossKey)
+	}, nil)
+	val, _ := ret.(*ObjectMeta)
+	return val, err
+}
+
+func (r *ResilientOss) GetObjectRange(ossKey string, start, end int64) (io.ReadCloser, error) {
+	ret, err := r.call(ossOpObjectRange, func() (interface{}, error) {
+		return r.op.GetObjectRange(ossKey, start, end)
+	}, closeReader)
+	val, _ := ret.(io.ReadCloser)
+	return val, err
+}
+
+// closeReader close stream opened after attempt timeout, nobody read it
+func closeReader(val interface{}) {
+	if reader, ok := val.(io.ReadCloser); ok && reader != nil {
+		reader.Close()
+	}
+}
+
+// Metrics snapshot of metrics, counters updated by atomic without lock
+func (r *ResilientOss) Metrics() *OssMetrics {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := &OssMetrics{
+		Breaker:    r.currentState(time.Now()),
+		Operations: make(map[string]*OssOpMetrics, len(r.metrics)),
+	}
+	for name, m := range r.metrics {
+		ret.Operations[name] = &OssOpMetrics{
+			Calls:     atomic.LoadInt64(&m.Calls),
+			Failures:  atomic.LoadInt64(&m.Failures),
+			Retries:   atomic.LoadInt64(&m.Retries),
+			Timeouts:  atomic.LoadInt64(&m.Timeouts),
+			Rejected:  atomic.LoadInt64(&m.Rejected),
+			LatencyMs: atomic.LoadInt64(&m.LatencyMs),
+		}
+	}
+	return ret
+}
+
+// do call fn without result
+func (r *ResilientOss) do(name string, fn func() error) error {
+	_, err := r.call(name, func() (interface{}, error) {
+		return nil, fn()
+	}, nil)
+	return err
+}
+
+// call retry fn with backoff, non retryable error (eg: not found) return directly,
+// discard release result of attempt which finish after timeout
+func (r *ResilientOss) call(name string, fn func() (interface{}, error), discard func(interface{})) (interface{}, error) {
+	start := time.Now()
+	m := r.opMetrics(name)
+	atomic.AddInt64(&m.Calls, 1)
+	defer func() {
+		atomic.AddInt64(&m.LatencyMs, time.Since(start).Milliseconds())
+	}()
+	var ret interface{}
+	var err error
+	for attempt := 0; attempt <= r.policy.MaxRetries; attempt++ {
+		if attempt > 0 {
+			atomic.AddInt64(&m.Retries, 1)
+			time.Sleep(r.backoff(attempt))
+		}
+		if !r.allow() {
+			atomic.AddInt64(&m.Rejected, 1)
+			return nil, ErrBreakerOpen
+		}
+		ret, err = r.attempt(fn, discard)
+		if errors.Is(err, errOssTimeout) {
+			atomic.AddInt64(&m.Timeouts, 1)
+		}
+		if err == nil || !isRetryable(err) {
+			// not retryable error means oss is available
+			r.record(true)
+			break
+		}
+		r.record(false)
+	}
+	if err != nil {
+		atomic.AddInt64(&m.Failures, 1)
+	}
+	return ret, err
+}
+
+var errOssTimeout = errors.New("oss operation timeout")
+
+type attemptResult struct {
+	val interface{}
+	err error
+}
+
+// attempt run fn with timeout, fn keep running in background after timeout and its result passed to discard
+func (r *ResilientOss) attempt(fn func() (interface{}, error), discard func(interface{})) (interface{}, error) {
+	if r.policy.Timeout <= 0 {
+		return fn()
+	}
+	done := make(chan attemptResult, 1)
+	go func() {
+		val, err := fn()
+		done <- attemptResult{val: val, err: err}
+	}()
+	timer := time.NewTimer(r.policy.Timeout)
+	defer timer.Stop()
+	select {
+	case ret := <-done:
+		return ret.val, ret.err
+	case <-timer.C:
+		if discard != nil {
+			go func() {
+				if ret := <-done; ret.err == nil {
+					discard(ret.val)
+				}
+			}()
+		}
+		return nil, fmt.Errorf("%w after %s", errOssTimeout, r.policy.Timeout)
+	}
+}
+
+func (r *ResilientOss) backoff(attempt int) time.Duration {
+	return jitterBackoff(r.policy.BaseBackoff, r.policy.MaxBackoff, attempt)
+}
+
+// jitterBackoff full jitter: random [0, min(max, base*2^(attempt-1))]
+func jitterBackoff(base, max time.Duration, attempt int) time.Duration {
+	backoff := base << uint(attempt-1)
+	if backoff <= 0 || (max > 0 && backoff > max) {
+		backoff = max
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+func (r *ResilientOss) opMetrics(name string) *OssOpMetrics {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	m, ok := r.metrics[name]
+	if !ok {
+		m = new(OssOpMetrics)
+		r.metrics[name] = m
+	}
+	return m
+}
+
+// allow breaker closed or half open trial
+func (r *ResilientOss) allow() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch r.currentState(time.Now()) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if r.halfOpenTrial {
+			return false
+		}
+		r.halfOpenTrial = true
+	}
+	return true
+}
+
+func (r *ResilientOss) record(success bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state := r.currentState(time.Now())
+	r.halfOpenTrial = false
+	if success {
+		if state != BreakerClosed {
+			logrus.Info("oss circuit breaker closed")
+		}
+		r.state = BreakerClosed
+		r.consecutiveFails = 0
+		return
+	}
+	r.consecutiveFails++
+	if state == BreakerHalfOpen || (r.policy.BreakerThreshold > 0 && r.consecutiveFails >= r.policy.BreakerThreshold) {
+		if state != BreakerOpen {
+			logrus.Warnf("oss circuit breaker open, consecutive failures %d", r.consecutiveFails)
+		}
+		r.state = BreakerOpen
+		r.openedAt = time.Now()
+	}
+}
+
+// currentState open turn to half open after cooldown, need lock
+func (r *ResilientOss) currentState(now time.Time) string {
+	if r.state == BreakerOpen && now.Sub(r.openedAt) >= r.policy.BreakerCooldown {
+		r.state = BreakerHalfOpen
+		r.halfOpenTrial = false
+	}
+	return r.state
+}
+
+// isRetryable network error, timeout, 5xx, 408 and 429 retry; other 4xx not
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrBreakerOpen) {
+		return false
+	}
+	code := 0
+	var ossErr oss.ServiceError
+	var s3Err *s3StatusError
+	if errors.As(err, &ossErr) {
+		code = ossErr.StatusCode
+	} else if errors.As(err, &s3Err) {
+		code = s3Err.code
+	}
+	if code == 0 {
+		return true
+	}
+	return code >= http.StatusInternalServerError || code == http.StatusRequestTimeout ||
+		code == http.StatusTooManyRequests
+}
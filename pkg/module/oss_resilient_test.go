@@ -0,0 +1,149 @@
+package module
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// flakyOss fail first n calls of upload
+type flakyOss struct {
+	OssManagerLocal
+	fails   int
+	calls   int
+	failErr error
+	delay   time.Duration
+	objects map[string][]byte
+	readers chan *trackReader
+}
+
+func (o *flakyOss) UploadFileByByte(ossKey string, body []byte) error {
+	o.calls++
+	time.Sleep(o.delay)
+	if o.calls <= o.fails {
+		return o.failErr
+	}
+	o.objects[ossKey] = body
+	return nil
+}
+
+// trackReader record close of stream
+type trackReader struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (r *trackReader) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func (o *flakyOss) GetObject(ossKey string) (io.ReadCloser, error) {
+	time.Sleep(o.delay)
+	reader := &trackReader{Reader: bytes.NewReader(o.objects[ossKey]), closed: make(chan struct{})}
+	o.readers <- reader
+	return reader, nil
+}
+
+func TestResilientOss(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond,
+		BreakerThreshold: 3, BreakerCooldown: 50 * time.Millisecond}
+
+	// retry success
+	op := &flakyOss{fails: 2, failErr: errors.New("connection reset"), objects: map[string][]byte{}}
+	r := NewResilientOss(op, policy)
+	assert.Nil(t, r.UploadFileByByte("a.png", []byte("a")))
+	assert.Equal(t, 3, op.calls)
+	m := r.Metrics()
+	assert.Equal(t, BreakerClosed, m.Breaker)
+	assert.Equal(t, int64(2), m.Operations[ossOpUpload].Retries)
+	assert.Equal(t, int64(0), m.Operations[ossOpUpload].Failures)
+
+	// 4xx not retry, not open breaker
+	op = &flakyOss{fails: 10, failErr: &s3StatusError{code: http.StatusForbidden}, objects: map[string][]byte{}}
+	r = NewResilientOss(op, policy)
+	assert.NotNil(t, r.UploadFileByByte("a.png", []byte("a")))
+	assert.Equal(t, 1, op.calls)
+	assert.Equal(t, BreakerClosed, r.Metrics().Breaker)
+
+	// breaker open after consecutive failures, reject without call, half open trial close it
+	op = &flakyOss{fails: 3, failErr: &s3StatusError{code: http.StatusServiceUnavailable}, objects: map[string][]byte{}}
+	r = NewResilientOss(op, policy)
+	assert.NotNil(t, r.UploadFileByByte("a.png", []byte("a")))
+	assert.Equal(t, BreakerOpen, r.Metrics().Breaker)
+	assert.Equal(t, ErrBreakerOpen, r.UploadFileByByte("a.png", []byte("a")))
+	assert.Equal(t, 3, op.calls)
+	assert.Equal(t, int64(1), r.Metrics().Operations[ossOpUpload].Rejected)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, r.Metrics().Breaker)
+	assert.Nil(t, r.UploadFileByByte("a.png", []byte("a")))
+	assert.Equal(t, BreakerClosed, r.Metrics().Breaker)
+
+	// timeout
+	op = &flakyOss{delay: 50 * time.Millisecond, objects: map[string][]byte{}}
+	r = NewResilientOss(op, RetryPolicy{Timeout: 10 * time.Millisecond})
+	err := r.UploadFileByByte("a.png", []byte("a"))
+	assert.True(t, errors.Is(err, errOssTimeout))
+	assert.Equal(t, int64(1), r.Metrics().Operations[ossOpUpload].Timeouts)
+}
+
+func TestResilientOssLateObject(t *testing.T) {
+	op := &flakyOss{delay: 30 * time.Millisecond, objects: map[string][]byte{"a.png": []byte("a")},
+		readers: make(chan *trackReader, 2)}
+	r := NewResilientOss(op, RetryPolicy{Timeout: 10 * time.Millisecond})
+	// metrics read concurrently with calls
+	go func() {
+		for i := 0; i < 10; i++ {
+			r.Metrics()
+		}
+	}()
+	_, err := r.GetObject("a.png")
+	assert.True(t, errors.Is(err, errOssTimeout))
+	// stream opened after timeout closed
+	select {
+	case reader := <-op.readers:
+		select {
+		case <-reader.closed:
+		case <-time.After(time.Second):
+			t.Fatal("late object not closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("object not opened")
+	}
+
+	op.delay = 0
+	reader, err := r.GetObject("a.png")
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(reader)
+	assert.Equal(t, []byte("a"), body)
+	reader.Close()
+	assert.Equal(t, int64(2), r.Metrics().Operations[ossOpGetObject].Calls)
+}
+
+func TestUploadQueue(t *testing.T) {
+	dir := t.TempDir()
+	op := &flakyOss{fails: 1, failErr: errors.New("connection reset"), objects: map[string][]byte{}}
+	OssGlobal = op
+	queue, err := NewUploadQueue(dir, time.Hour)
+	assert.Nil(t, err)
+	UploadQueueGlobal = queue
+	defer func() {
+		UploadQueueGlobal = nil
+	}()
+
+	// upload fail, queued
+	assert.Nil(t, UploadWithRetryQueue("images/admin/task_1.png", []byte("img")))
+	assert.Equal(t, 1, GetOssMetrics().UploadRetryPending)
+
+	// reload after restart
+	queue, err = NewUploadQueue(dir, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, queue.Pending())
+	queue.Flush(op)
+	assert.Equal(t, 0, queue.Pending())
+	assert.Equal(t, []byte("img"), op.objects["images/admin/task_1.png"])
+}
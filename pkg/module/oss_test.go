@@ -1,8 +1,11 @@
 package module
 
 import (
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
 	"github.com/stretchr/testify/assert"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +27,23 @@ func TestOss(t *testing.T) {
 	err = os.Remove(downloadFile)
 	assert.Nil(t, err)
 }
+
+func TestLocalFileUrl(t *testing.T) {
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{FileSignSecret: "secret"}}
+	ossUrl, err := new(OssManagerLocal).GetUrl([]string{"images/user a/task_1.png"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ossUrl))
+	u, err := url.Parse(ossUrl[0])
+	assert.Nil(t, err)
+	key := strings.TrimPrefix(u.Path, LocalFileRoute)
+	assert.Equal(t, "images/user a/task_1.png", key)
+	query := u.Query()
+	assert.Nil(t, VerifyLocalFileUrl(key, query.Get("expires"), query.Get("signature")))
+	assert.NotNil(t, VerifyLocalFileUrl("images/other.png", query.Get("expires"), query.Get("signature")))
+	assert.NotNil(t, VerifyLocalFileUrl(key, "1", signLocalFile(key, 1)))
+
+	config.ConfigGlobal.OssPath = "/mnt/oss"
+	localFile, err := LocalFilePath("/../../etc/passwd")
+	assert.Nil(t, err)
+	assert.Equal(t, "/mnt/oss/etc/passwd", localFile)
+}
@@ -0,0 +1,213 @@
+package module
+
+import (
+	"fmt"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// storage kind, ossKey prefix {kind}/{user}/
+const (
+	StorageImages = "images"
+	StorageInputs = "inputs"
+)
+
+var QuotaManagerGlobal *quotaManager
+
+// StorageUsage bytes of user storage and quota, quota 0 means unlimited
+type StorageUsage struct {
+	Images      int64
+	Inputs      int64
+	ImagesQuota int64
+	InputsQuota int64
+}
+
+// QuotaExceededError storage quota exceeded
+type QuotaExceededError struct {
+	Kind  string
+	Used  int64
+	Quota int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s storage quota exceeded, used %d bytes, quota %d bytes", e.Kind, e.Used, e.Quota)
+}
+
+// quotaManager usage bytes save in quota table, shared by proxy and agent
+type quotaManager struct {
+	quotaStore datastore.Datastore
+}
+
+// InitQuotaManager track user storage usage through OssGlobal, call after NewOssManager
+func InitQuotaManager(quotaStore datastore.Datastore) {
+	QuotaManagerGlobal = &quotaManager{quotaStore: quotaStore}
+	OssGlobal = &UsageTrackingOss{OssOp: OssGlobal}
+}
+
+// Usage current usage of user
+func (q *quotaManager) Usage(user string) (*StorageUsage, error) {
+	data, err := q.quotaStore.Get(user, []string{datastore.KQuotaImageBytes, datastore.KQuotaInputBytes})
+	if err != nil {
+		return nil, err
+	}
+	images, inputs := userQuota(user)
+	return &StorageUsage{
+		Images:      parseUsage(data, datastore.KQuotaImageBytes),
+		Inputs:      parseUsage(data, datastore.KQuotaInputBytes),
+		ImagesQuota: images,
+		InputsQuota: inputs,
+	}, nil
+}
+
+// Check kind usage + size not exceed quota
+func (q *quotaManager) Check(user, kind string, size int64) error {
+	usage, err := q.Usage(user)
+	if err != nil {
+		return err
+	}
+	used, quota := usage.Images, usage.ImagesQuota
+	if kind == StorageInputs {
+		used, quota = usage.Inputs, usage.InputsQuota
+	}
+	// images size unknown before predict, reject when quota used up
+	if quota > 0 && (used+size > quota || used >= quota) {
+		return &QuotaExceededError{Kind: kind, Used: used, Quota: quota}
+	}
+	return nil
+}
+
+// Add update usage by delta bytes with atomic increment, safe across instances
+func (q *quotaManager) Add(user, kind string, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	column := datastore.KQuotaImageBytes
+	if kind == StorageInputs {
+		column = datastore.KQuotaInputBytes
+	}
+	ret, err := q.quotaStore.Increment(user, map[string]int64{column: delta})
+	if err != nil {
+		return err
+	}
+	// objects uploaded before tracking deleted, pull usage back to 0
+	if used := ret[column]; used < 0 {
+		_, err = q.quotaStore.Increment(user, map[string]int64{column: -used})
+	}
+	return err
+}
+
+// userQuota user quota first, otherwise global quota
+func userQuota(user string) (int64, int64) {
+	images, inputs := config.ConfigGlobal.ImageQuota, config.ConfigGlobal.InputQuota
+	if quota, ok := config.ConfigGlobal.UserQuotas[user]; ok {
+		if quota.Images != 0 {
+			images = quota.Images
+		}
+		if quota.Inputs != 0 {
+			inputs = quota.Inputs
+		}
+	}
+	return images, inputs
+}
+
+func parseInt(data map[string]interface{}, column string) int64 {
+	val, ok := data[column].(string)
+	if !ok {
+		return 0
+	}
+	ret, _ := strconv.ParseInt(val, 10, 64)
+	return ret
+}
+
+// parseUsage never below 0
+func parseUsage(data map[string]interface{}, column string) int64 {
+	val, ok := data[column].(int64)
+	if !ok || val < 0 {
+		return 0
+	}
+	return val
+}
+
+// parseStorageKey images/{user}/xxx or inputs/{user}/xxx => kind, user
+func parseStorageKey(ossKey string) (string, string, bool) {
+	items := strings.SplitN(strings.TrimPrefix(ossKey, "/"), "/", 3)
+	if len(items) != 3 || items[1] == "" || (items[0] != StorageImages && items[0] != StorageInputs) {
+		return "", "", false
+	}
+	return items[0], items[1], true
+}
+
+// UsageTrackingOss count bytes of images/{user}/ and inputs/{user}/ on upload and delete,
+// overwrite subtract old object size
+type UsageTrackingOss struct {
+	OssOp
+}
+
+func (o *UsageTrackingOss) Unwrap() OssOp {
+	return o.OssOp
+}
+
+func (o *UsageTrackingOss) UploadFile(ossKey, localFile string) error {
+	kind, user, tracked := parseStorageKey(ossKey)
+	if !tracked {
+		return o.OssOp.UploadFile(ossKey, localFile)
+	}
+	stat, err := os.Stat(localFile)
+	if err != nil {
+		return err
+	}
+	oldSize := o.objectSize(ossKey)
+	if err := o.OssOp.UploadFile(ossKey, localFile); err != nil {
+		return err
+	}
+	o.addUsage(user, kind, stat.Size()-oldSize)
+	return nil
+}
+
+func (o *UsageTrackingOss) UploadFileByByte(ossKey string, body []byte) error {
+	kind, user, tracked := parseStorageKey(ossKey)
+	if !tracked {
+		return o.OssOp.UploadFileByByte(ossKey, body)
+	}
+	oldSize := o.objectSize(ossKey)
+	if err := o.OssOp.UploadFileByByte(ossKey, body); err != nil {
+		return err
+	}
+	o.addUsage(user, kind, int64(len(body))-oldSize)
+	return nil
+}
+
+func (o *UsageTrackingOss) DeleteFile(ossKey string) error {
+	kind, user, tracked := parseStorageKey(ossKey)
+	if !tracked {
+		return o.OssOp.DeleteFile(ossKey)
+	}
+	oldSize := o.objectSize(ossKey)
+	if err := o.OssOp.DeleteFile(ossKey); err != nil {
+		return err
+	}
+	o.addUsage(user, kind, -oldSize)
+	return nil
+}
+
+// objectSize 0 if not exist
+func (o *UsageTrackingOss) objectSize(ossKey string) int64 {
+	meta, err := o.OssOp.GetObjectMeta(ossKey)
+	if err != nil {
+		return 0
+	}
+	return meta.Size
+}
+
+func (o *UsageTrackingOss) addUsage(user, kind string, delta int64) {
+	if QuotaManagerGlobal == nil {
+		return
+	}
+	if err := QuotaManagerGlobal.Add(user, kind, delta); err != nil {
+		logrus.Warnf("update user %s %s usage err=%s", user, kind, err.Error())
+	}
+}
@@ -0,0 +1,56 @@
+package module
+
+import (
+	"errors"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/config"
+	"github.com/devsapp/serverless-stable-diffusion-api/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	dir := t.TempDir()
+	config.ConfigGlobal = &config.Config{ConfigYaml: config.ConfigYaml{
+		OssPath:    filepath.Join(dir, "oss"),
+		DbSqlite:   filepath.Join(dir, "sqlite3"),
+		InputQuota: 10,
+		UserQuotas: map[string]config.UserQuota{"vip": {Inputs: 100}},
+	}}
+	quotaStore := datastore.NewSQLiteDatastore(datastore.NewSQLiteConfig(datastore.KQuotaTableName))
+	defer quotaStore.Close()
+	OssGlobal = new(OssManagerLocal)
+	InitQuotaManager(quotaStore)
+	defer func() {
+		QuotaManagerGlobal = nil
+	}()
+
+	// upload, overwrite and delete
+	assert.Nil(t, OssGlobal.UploadFileByByte("images/admin/task_0.png", []byte("12345")))
+	assert.Nil(t, OssGlobal.UploadFileByByte("images/admin/task_1.png", []byte("123")))
+	assert.Nil(t, OssGlobal.UploadFileByByte("images/admin/task_1.png", []byte("1234")))
+	assert.Nil(t, OssGlobal.UploadFileByByte("inputs/admin/a.png", []byte("12345678")))
+	assert.Nil(t, OssGlobal.UploadFileByByte("models/a.safetensors", []byte("123")))
+	usage, err := QuotaManagerGlobal.Usage("admin")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9), usage.Images)
+	assert.Equal(t, int64(8), usage.Inputs)
+	assert.Nil(t, OssGlobal.DeleteFile("images/admin/task_0.png"))
+	usage, _ = QuotaManagerGlobal.Usage("admin")
+	assert.Equal(t, int64(4), usage.Images)
+
+	// inputs quota 10, user quota override
+	assert.Nil(t, QuotaManagerGlobal.Check("admin", StorageImages, 0))
+	err = QuotaManagerGlobal.Check("admin", StorageInputs, 3)
+	var quotaErr *QuotaExceededError
+	assert.True(t, errors.As(err, &quotaErr))
+	assert.Nil(t, QuotaManagerGlobal.Check("vip", StorageInputs, 50))
+
+	// usage never below 0
+	assert.Nil(t, QuotaManagerGlobal.Add("admin", StorageInputs, -100))
+	usage, _ = QuotaManagerGlobal.Usage("admin")
+	assert.Equal(t, int64(0), usage.Inputs)
+	assert.Nil(t, QuotaManagerGlobal.Add("admin", StorageInputs, 2))
+	usage, _ = QuotaManagerGlobal.Usage("admin")
+	assert.Equal(t, int64(2), usage.Inputs)
+}
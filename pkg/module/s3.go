@@ -0,0 +1,352 @@
+package module
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3Service        = "s3"
+	s3UnsignedBody   = "UNSIGNED-PAYLOAD"
+	s3TimeFormat     = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+	s3UrlExpire      = 3 * time.Hour
+	s3RequestTimeout = 5 * time.Minute
+)
+
+// OssManagerS3 s3 compatible object storage, eg: aws s3/minio/ceph rgw, sign with aws signature v4
+type OssManagerS3 struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	// pathStyle: {endpoint}/{bucket}/{key}, otherwise {bucket}.{endpoint}/{key}
+	pathStyle bool
+	client    *http.Client
+	// now for test
+	now func() time.Time
+}
+
+func NewOssManagerS3(endpoint, bucket, region, accessKey, secretKey, sessionToken string,
+	pathStyle bool) (*OssManagerS3, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = fmt.Sprintf("https://%s", endpoint)
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint %s not valid", endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("s3 bucket empty")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &OssManagerS3{
+		endpoint:     u,
+		bucket:       bucket,
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: sessionToken,
+		pathStyle:    pathStyle,
+		client:       &http.Client{Timeout: s3RequestTimeout},
+		now:          time.Now,
+	}, nil
+}
+
+func (o *OssManagerS3) GetUrl(ossKeys []string) ([]string, error) {
+	ossUrl := make([]string, 0, len(ossKeys))
+	for _, key := range ossKeys {
+		ossUrl = append(ossUrl, o.presign(http.MethodGet, key, s3UrlExpire))
+	}
+	return ossUrl, nil
+}
+
+func (o *OssManagerS3) UploadFile(ossKey, localFile string) error {
+	body, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return err
+	}
+	return o.UploadFileByByte(ossKey, body)
+}
+
+func (o *OssManagerS3) UploadFileByByte(ossKey string, body []byte) error {
+	resp, err := o.do(http.MethodPut, ossKey, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (o *OssManagerS3) DownloadFile(ossKey, localFile string) error {
+	reader, err := o.GetObject(ossKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	f, err := os.Create(localFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, reader)
+	return err
+}
+
+func (o *OssManagerS3) DeleteFile(ossKey string) error {
+	resp, err := o.do(http.MethodDelete, ossKey, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (o *OssManagerS3) DownloadFileToBase64(ossKey string) (*string, error) {
+	reader, err := o.GetObject(ossKey)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	imageBase64 := base64.StdEncoding.EncodeToString(data)
+	return &imageBase64, nil
+}
+
+func (o *OssManagerS3) IsFileExist(ossKey string) (bool, error) {
+	resp, err := o.do(http.MethodHead, ossKey, nil)
+	if err != nil {
+		var statusErr *s3StatusError
+		if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// GetObject read object stream, caller close it
+func (o *OssManagerS3) GetObject(ossKey string) (io.ReadCloser, error) {
+	resp, err := o.do(http.MethodGet, ossKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (o *OssManagerS3) GetObjectMeta(ossKey string) (*ObjectMeta, error) {
+	resp, err := o.do(http.MethodHead, ossKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &ObjectMeta{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+}
+
+func (o *OssManagerS3) GetObjectRange(ossKey string, start, end int64) (io.ReadCloser, error) {
+	resp, err := o.doWithHeader(http.MethodGet, ossKey, nil, map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-%d", start, end),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type s3StatusError struct {
+	method string
+	key    string
+	code   int
+	body   string
+}
+
+func (e *s3StatusError) Error() string {
+	return fmt.Sprintf("s3 %s %s status=%d, body=%s", e.method, e.key, e.code, e.body)
+}
+
+// do send signed request, non 2xx return s3StatusError
+func (o *OssManagerS3) do(method, ossKey string, body []byte) (*http.Response, error) {
+	return o.doWithHeader(method, ossKey, body, nil)
+}
+
+func (o *OssManagerS3) doWithHeader(method, ossKey string, body []byte,
+	header map[string]string) (*http.Response, error) {
+	u := o.objectUrl(ossKey)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range header {
+		req.Header.Set(key, val)
+	}
+	if body == nil {
+		req.Body = nil
+	}
+	req.ContentLength = int64(len(body))
+	o.sign(req, hashHex(body))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, &s3StatusError{method: method, key: ossKey, code: resp.StatusCode, body: string(data)}
+	}
+	return resp, nil
+}
+
+func (o *OssManagerS3) objectUrl(ossKey string) *url.URL {
+	u := *o.endpoint
+	key := strings.TrimPrefix(ossKey, "/")
+	if o.pathStyle {
+		u.Path = fmt.Sprintf("%s/%s/%s", o.endpoint.Path, o.bucket, key)
+	} else {
+		u.Host = fmt.Sprintf("%s.%s", o.bucket, o.endpoint.Host)
+		u.Path = fmt.Sprintf("%s/%s", o.endpoint.Path, key)
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+// sign set aws signature v4 authorization header
+func (o *OssManagerS3) sign(req *http.Request, payloadHash string) {
+	t := o.now().UTC()
+	req.Header.Set("x-amz-date", t.Format(s3TimeFormat))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if o.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", o.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for key := range req.Header {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(key))
+		}
+	}
+	signedHeaders, canonicalHeaders := s3CanonicalHeaders(headers)
+	canonicalRequest := strings.Join([]string{req.Method, s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()), canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := o.scope(t)
+	signature := o.signature(t, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, o.accessKey, scope, signedHeaders, signature))
+}
+
+// presign query string signed url, only host header signed
+func (o *OssManagerS3) presign(method, ossKey string, expire time.Duration) string {
+	t := o.now().UTC()
+	u := o.objectUrl(ossKey)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", fmt.Sprintf("%s/%s", o.accessKey, o.scope(t)))
+	query.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(expire.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if o.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", o.sessionToken)
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{method, s3EscapePath(u.Path), canonicalQuery,
+		fmt.Sprintf("host:%s\n", u.Host), "host", s3UnsignedBody}, "\n")
+	u.RawQuery = fmt.Sprintf("%s&X-Amz-Signature=%s", canonicalQuery, o.signature(t, canonicalRequest))
+	return u.String()
+}
+
+func (o *OssManagerS3) scope(t time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", t.Format(s3DateFormat), o.region, s3Service)
+}
+
+func (o *OssManagerS3) signature(t time.Time, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{s3Algorithm, t.Format(s3TimeFormat), o.scope(t),
+		hashHex([]byte(canonicalRequest))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+o.secretKey), t.Format(s3DateFormat))
+	key = hmacSHA256(key, o.region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func s3CanonicalHeaders(headers map[string]string) (string, string) {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var canonical strings.Builder
+	for _, key := range keys {
+		canonical.WriteString(fmt.Sprintf("%s:%s\n", key, headers[key]))
+	}
+	return strings.Join(keys, ";"), canonical.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, val := range query[key] {
+			items = append(items, fmt.Sprintf("%s=%s", s3Escape(key), s3Escape(val)))
+		}
+	}
+	return strings.Join(items, "&")
+}
+
+// s3EscapePath uri encode each path segment, keep "/"
+func s3EscapePath(path string) string {
+	items := strings.Split(path, "/")
+	for i, item := range items {
+		items[i] = s3Escape(item)
+	}
+	return strings.Join(items, "/")
+}
+
+// s3Escape uri encode except unreserved characters A-Z a-z 0-9 - _ . ~
+func s3Escape(s string) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			buf.WriteByte(b)
+		} else {
+			buf.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return buf.String()
+}
+
+func hashHex(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
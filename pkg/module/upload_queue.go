@@ -0,0 +1,175 @@
+package module
+
+import (
+	"encoding/base64"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const uploadQueueSuffix = ".upload"
+
+var UploadQueueGlobal *UploadQueue
+
+// UploadQueue spill failed upload body to local dir, retry in background until success.
+// file name is base64url of ossKey, pending upload survive restart
+type UploadQueue struct {
+	dir      string
+	interval time.Duration
+	lock     sync.Mutex
+	pending  map[string]struct{}
+	stop     chan struct{}
+}
+
+func NewUploadQueue(dir string, interval time.Duration) (*UploadQueue, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	q := &UploadQueue{
+		dir:      dir,
+		interval: interval,
+		pending:  make(map[string]struct{}),
+		stop:     make(chan struct{}),
+	}
+	// reload pending upload of last run
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if ossKey, ok := decodeQueueFile(file.Name()); ok {
+			q.pending[ossKey] = struct{}{}
+		}
+	}
+	if len(q.pending) > 0 {
+		logrus.Infof("upload queue reload %d pending upload", len(q.pending))
+	}
+	return q, nil
+}
+
+// Add save body to local dir, upload later
+func (q *UploadQueue) Add(ossKey string, body []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := ioutil.WriteFile(q.queueFile(ossKey), body, 0666); err != nil {
+		return err
+	}
+	q.pending[ossKey] = struct{}{}
+	return nil
+}
+
+// Pending queue size
+func (q *UploadQueue) Pending() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
+
+// Flush try upload all pending once
+func (q *UploadQueue) Flush(op OssOp) {
+	q.lock.Lock()
+	ossKeys := make([]string, 0, len(q.pending))
+	for ossKey := range q.pending {
+		ossKeys = append(ossKeys, ossKey)
+	}
+	q.lock.Unlock()
+	for _, ossKey := range ossKeys {
+		file := q.queueFile(ossKey)
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			logrus.Warnf("upload queue read %s err=%s, drop it", file, err.Error())
+			q.remove(ossKey)
+			continue
+		}
+		if err := op.UploadFileByByte(ossKey, body); err != nil {
+			logrus.Warnf("upload queue retry %s err=%s", ossKey, err.Error())
+			// oss still unavailable, wait next round
+			return
+		}
+		logrus.Infof("upload queue retry %s success", ossKey)
+		q.remove(ossKey)
+	}
+}
+
+// Start retry in background with OssGlobal
+func (q *UploadQueue) Start() {
+	go func() {
+		ticker := time.NewTicker(q.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if q.Pending() > 0 {
+					q.Flush(OssGlobal)
+				}
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (q *UploadQueue) Close() {
+	close(q.stop)
+}
+
+func (q *UploadQueue) remove(ossKey string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	os.Remove(q.queueFile(ossKey))
+	delete(q.pending, ossKey)
+}
+
+func (q *UploadQueue) queueFile(ossKey string) string {
+	return filepath.Join(q.dir, base64.RawURLEncoding.EncodeToString([]byte(ossKey))+uploadQueueSuffix)
+}
+
+func decodeQueueFile(name string) (string, bool) {
+	if filepath.Ext(name) != uploadQueueSuffix {
+		return "", false
+	}
+	ossKey, err := base64.RawURLEncoding.DecodeString(name[:len(name)-len(uploadQueueSuffix)])
+	if err != nil {
+		return "", false
+	}
+	return string(ossKey), true
+}
+
+// UploadWithRetryQueue upload body, queue it for background retry if fail and queue enabled,
+// ossKey not change so result keep valid after retry success
+func UploadWithRetryQueue(ossKey string, body []byte) error {
+	err := OssGlobal.UploadFileByByte(ossKey, body)
+	if err == nil || UploadQueueGlobal == nil {
+		return err
+	}
+	if qErr := UploadQueueGlobal.Add(ossKey, body); qErr != nil {
+		logrus.Errorf("upload queue add %s err=%s", ossKey, qErr.Error())
+		return err
+	}
+	logrus.Warnf("upload %s err=%s, retry in background", ossKey, err.Error())
+	return nil
+}
+
+// GetOssMetrics resilient oss metrics, oss not wrapped only return queue size
+func GetOssMetrics() *OssMetrics {
+	metrics := &OssMetrics{Operations: map[string]*OssOpMetrics{}}
+	op := OssGlobal
+	for {
+		if resilient, ok := op.(*ResilientOss); ok {
+			metrics = resilient.Metrics()
+			break
+		}
+		wrapper, ok := op.(interface{ Unwrap() OssOp })
+		if !ok {
+			break
+		}
+		op = wrapper.Unwrap()
+	}
+	if UploadQueueGlobal != nil {
+		metrics.UploadRetryPending = UploadQueueGlobal.Pending()
+	}
+	return metrics
+}
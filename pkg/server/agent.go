@@ -21,6 +21,7 @@ type AgentServer struct {
 	taskDataStore   datastore.Datastore
 	modelDataStore  datastore.Datastore
 	configDataStore datastore.Datastore
+	quotaDataStore  datastore.Datastore
 	sdManager       *module.SDManager
 }
 
@@ -66,6 +67,9 @@ func NewAgentServer(port string, dbType datastore.DatastoreType, mode string) (*
 		modelDataStore := tableFactory.NewTable(dbType, datastore.KModelTableName)
 		// init config table
 		configDataStore := tableFactory.NewTable(dbType, datastore.KConfigTableName)
+		// init quota table, track user storage usage of output images
+		quotaDataStore := tableFactory.NewTable(dbType, datastore.KQuotaTableName)
+		module.InitQuotaManager(quotaDataStore)
 		// init listen event
 		listenTask := module.NewListenDbTask(config.ConfigGlobal.ListenInterval, taskDataStore, modelDataStore,
 			configDataStore)
@@ -84,11 +88,15 @@ func NewAgentServer(port string, dbType datastore.DatastoreType, mode string) (*
 
 		handler.RegisterHandlers(router, agentHandler)
 		router.POST("/initialize", handler.InitializeHandler)
+		if config.ConfigGlobal.OssMode == config.LOCAL {
+			router.GET(module.LocalFileRoute+"*key", handler.GetFile)
+		}
 		router.NoRoute(agentHandler.NoRouterAgentHandler)
 		agentServer.listenTask = listenTask
 		agentServer.taskDataStore = taskDataStore
 		agentServer.modelDataStore = modelDataStore
 		agentServer.configDataStore = configDataStore
+		agentServer.quotaDataStore = quotaDataStore
 	}
 
 	agentServer.srv = &http.Server{
@@ -123,6 +131,9 @@ func (p *AgentServer) Close(shutdownTimeout time.Duration) error {
 	if p.configDataStore != nil {
 		p.configDataStore.Close()
 	}
+	if p.quotaDataStore != nil {
+		p.quotaDataStore.Close()
+	}
 	if p.sdManager != nil {
 		p.sdManager.Close()
 	}
@@ -39,8 +39,24 @@ func NewProxyServer(port string, dbType datastore.DatastoreType, mode string) (*
 		logrus.Errorf("user init error %v", err)
 		return nil, err
 	}
+	// track user storage usage
+	quotaDataStore := tableFactory.NewTable(dbType, datastore.KQuotaTableName)
+	module.InitQuotaManager(quotaDataStore)
+	// init model manager, resume registering models
+	if err := module.InitModelManager(modelDataStore); err != nil {
+		logrus.Errorf("model manager init error %v", err)
+		return nil, err
+	}
 	// init config table
 	configDataStore := tableFactory.NewTable(dbType, datastore.KConfigTableName)
+	// hybrid model mode, reconcile model files with db, lease of reconcile in config table
+	if config.ConfigGlobal.HybridModel() {
+		module.InitModelReconciler(modelDataStore, configDataStore)
+	}
+	// model usage of predict, gc unused models
+	if !config.ConfigGlobal.UseLocalModel() {
+		module.InitModelUsage(modelDataStore)
+	}
 	// init function table
 	funcDataStore := tableFactory.NewTable(dbType, datastore.KModelServiceTableName)
 	// init func manager
@@ -75,6 +91,9 @@ func NewProxyServer(port string, dbType datastore.DatastoreType, mode string) (*
 		router.Use(handler.ApiAuth())
 	}
 	handler.RegisterHandlers(router, proxyHandler)
+	if config.ConfigGlobal.OssMode == config.LOCAL {
+		router.GET(module.LocalFileRoute+"*key", handler.GetFile)
+	}
 	router.NoRoute(proxyHandler.NoRouterHandler)
 
 	return &ProxyServer{
@@ -107,6 +126,12 @@ func (p *ProxyServer) Close(shutdownTimeout time.Duration) error {
 	if p.taskDataStore != nil {
 		p.taskDataStore.Close()
 	}
+	if module.ModelReconcilerGlobal != nil {
+		module.ModelReconcilerGlobal.Close()
+	}
+	if module.ModelUsageGlobal != nil {
+		module.ModelUsageGlobal.Close()
+	}
 	if p.modelDataStore != nil {
 		p.modelDataStore.Close()
 	}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	// contact sheet cell max width, large output scale down
+	contactSheetCellWidth = 512
+	contactSheetPadding   = 8
+	// caption lines under each cell
+	contactSheetCaptionLines = 2
+)
+
+// ContactSheetItem one image of contact sheet with caption lines
+type ContactSheetItem struct {
+	Image    image.Image
+	Captions []string
+}
+
+// ContactSheet compose images to grid, caption under each image, columns = ceil(sqrt(n))
+func ContactSheet(items []*ContactSheetItem) *image.RGBA {
+	if len(items) == 0 {
+		return nil
+	}
+	columns := int(math.Ceil(math.Sqrt(float64(len(items)))))
+	rows := (len(items) + columns - 1) / columns
+	// cell size of largest image, scale to max cell width
+	cellWidth, cellHeight := 0, 0
+	for _, item := range items {
+		b := item.Image.Bounds()
+		width, height := b.Dx(), b.Dy()
+		if width > contactSheetCellWidth {
+			height = height * contactSheetCellWidth / width
+			width = contactSheetCellWidth
+		}
+		if width > cellWidth {
+			cellWidth = width
+		}
+		if height > cellHeight {
+			cellHeight = height
+		}
+	}
+	face := basicfont.Face7x13
+	captionHeight := face.Height*contactSheetCaptionLines + contactSheetPadding/2
+	sheet := image.NewRGBA(image.Rect(0, 0,
+		columns*(cellWidth+contactSheetPadding)+contactSheetPadding,
+		rows*(cellHeight+captionHeight+contactSheetPadding)+contactSheetPadding))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+	for i, item := range items {
+		x := contactSheetPadding + (i%columns)*(cellWidth+contactSheetPadding)
+		y := contactSheetPadding + (i/columns)*(cellHeight+captionHeight+contactSheetPadding)
+		b := item.Image.Bounds()
+		width, height := b.Dx(), b.Dy()
+		if width > cellWidth {
+			height = height * cellWidth / width
+			width = cellWidth
+		}
+		// center in cell
+		dst := image.Rect(x+(cellWidth-width)/2, y+(cellHeight-height)/2,
+			x+(cellWidth-width)/2+width, y+(cellHeight-height)/2+height)
+		draw.CatmullRom.Scale(sheet, dst, item.Image, b, draw.Over, nil)
+		for line, caption := range item.Captions {
+			if line >= contactSheetCaptionLines {
+				break
+			}
+			drawer := &font.Drawer{
+				Dst:  sheet,
+				Src:  image.NewUniform(color.RGBA{R: 32, G: 32, B: 32, A: 255}),
+				Face: face,
+				Dot:  fixed.P(x, y+cellHeight+contactSheetPadding/2+face.Ascent+line*face.Height),
+			}
+			drawer.DrawString(truncateText(face, caption, cellWidth))
+		}
+	}
+	return sheet
+}
+
+// truncateText cut text with "..." to fit width
+func truncateText(face font.Face, text string, width int) string {
+	if font.MeasureString(face, text).Ceil() <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		if str := string(runes) + "..."; font.MeasureString(face, str).Ceil() <= width {
+			return str
+		}
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+)
+
+// image output format
+const (
+	FormatPng  = "png"
+	FormatJpeg = "jpeg"
+	FormatWebp = "webp"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// png chunks keep when strip metadata, others like tEXt/zTXt/iTXt/eXIf/tIME removed
+var pngKeepChunks = map[string]struct{}{
+	"IHDR": {}, "PLTE": {}, "IDAT": {}, "IEND": {}, "tRNS": {},
+	"gAMA": {}, "cHRM": {}, "sRGB": {}, "iCCP": {}, "sBIT": {}, "pHYs": {},
+}
+
+// ImageOutputOption output image format/quality/metadata
+type ImageOutputOption struct {
+	Format        string
+	Quality       int
+	StripMetadata bool
+}
+
+// NormalizeImageFormat png|jpeg|jpg|webp to png|jpeg|webp, return "" if not support
+func NormalizeImageFormat(format string) string {
+	switch strings.ToLower(format) {
+	case FormatPng:
+		return FormatPng
+	case FormatJpeg, "jpg":
+		return FormatJpeg
+	case FormatWebp:
+		return FormatWebp
+	}
+	return ""
+}
+
+// ImageExt file ext of format
+func ImageExt(format string) string {
+	switch NormalizeImageFormat(format) {
+	case FormatJpeg:
+		return "jpg"
+	case FormatWebp:
+		return "webp"
+	default:
+		return "png"
+	}
+}
+
+// ConvertImage convert sd output image to target format, return image body and file ext
+func ConvertImage(data []byte, opt *ImageOutputOption) ([]byte, string, error) {
+	format := NormalizeImageFormat(opt.Format)
+	if opt.Format != "" && format == "" {
+		return nil, "", fmt.Errorf("image format %s not support", opt.Format)
+	}
+	isPng := bytes.HasPrefix(data, pngSignature)
+	// png output: keep origin body, only strip metadata chunks
+	if format == "" || format == FormatPng {
+		if !isPng {
+			img, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, "", fmt.Errorf("decode image err=%s", err.Error())
+			}
+			return encodeImage(img, FormatPng, 0)
+		}
+		if opt.StripMetadata {
+			stripped, err := StripPngMetadata(data)
+			if err != nil {
+				return nil, "", err
+			}
+			return stripped, ImageExt(FormatPng), nil
+		}
+		return data, ImageExt(FormatPng), nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decode image err=%s", err.Error())
+	}
+	return encodeImage(img, format, opt.Quality)
+}
+
+// Thumbnail scale image longest side to size and encode to output format, small image not scale up
+func Thumbnail(data []byte, size int, opt *ImageOutputOption) ([]byte, string, error) {
+	format := NormalizeImageFormat(opt.Format)
+	if format == "" {
+		format = FormatPng
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decode image err=%s", err.Error())
+	}
+	return encodeImage(ResizeImage(img, size), format, opt.Quality)
+}
+
+// ResizeImage scale image longest side to size, keep aspect ratio
+func ResizeImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if size <= 0 || (width <= size && height <= size) {
+		return img
+	}
+	if width >= height {
+		height = height * size / width
+		width = size
+	} else {
+		width = width * size / height
+		height = size
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+func encodeImage(img image.Image, format string, quality int) ([]byte, string, error) {
+	if quality <= 0 || quality > 100 {
+		quality = jpeg.DefaultQuality
+	}
+	switch format {
+	case FormatPng:
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), ImageExt(FormatPng), nil
+	case FormatJpeg:
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), ImageExt(FormatJpeg), nil
+	case FormatWebp:
+		body, err := encodeWebp(img)
+		if err != nil {
+			return nil, "", err
+		}
+		return body, ImageExt(FormatWebp), nil
+	}
+	return nil, "", fmt.Errorf("image format %s not support", format)
+}
+
+// StripPngMetadata remove png ancillary text/exif/time chunks, image data not changed
+func StripPngMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not png image")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkType := string(data[pos+4 : pos+8])
+		// length + type + data + crc
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("png chunk out of range")
+		}
+		if _, ok := pngKeepChunks[chunkType]; ok {
+			out.Write(data[pos:end])
+		}
+		pos = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// encodeWebp lossless webp in pure go, quality not used
+func encodeWebp(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, img, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,270 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/webp"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func testPng(t *testing.T) []byte {
+	data := testPngData()
+	assert.NotNil(t, data)
+	return data
+}
+
+func testPngData() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// insert tEXt chunk after IHDR
+func insertTextChunk(data []byte, keyword, text string) []byte {
+	body := append([]byte(keyword+"\x00"), []byte(text)...)
+	chunk := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(chunk[:4], uint32(len(body)))
+	copy(chunk[4:8], "tEXt")
+	chunk = append(chunk, body...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+	// signature(8) + IHDR(25)
+	out := append([]byte{}, data[:33]...)
+	out = append(out, chunk...)
+	return append(out, data[33:]...)
+}
+
+func TestStripPngMetadata(t *testing.T) {
+	origin := testPng(t)
+	withText := insertTextChunk(origin, "parameters", "a cat, Steps: 20")
+	assert.True(t, bytes.Contains(withText, []byte("parameters")))
+
+	stripped, err := StripPngMetadata(withText)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(stripped, []byte("parameters")))
+	assert.Equal(t, origin, stripped)
+	_, err = png.Decode(bytes.NewReader(stripped))
+	assert.Nil(t, err)
+}
+
+func TestConvertImage(t *testing.T) {
+	origin := insertTextChunk(testPng(t), "parameters", "a cat")
+
+	body, ext, err := ConvertImage(origin, &ImageOutputOption{Format: "png"})
+	assert.Nil(t, err)
+	assert.Equal(t, "png", ext)
+	assert.Equal(t, origin, body)
+
+	body, ext, err = ConvertImage(origin, &ImageOutputOption{Format: "jpg", Quality: 80})
+	assert.Nil(t, err)
+	assert.Equal(t, "jpg", ext)
+	_, format, err := image.Decode(bytes.NewReader(body))
+	assert.Nil(t, err)
+	assert.Equal(t, "jpeg", format)
+
+	_, _, err = ConvertImage(origin, &ImageOutputOption{Format: "gif"})
+	assert.NotNil(t, err)
+
+	// webp encoded in go, lossless decode the same pixels
+	body, ext, err = ConvertImage(origin, &ImageOutputOption{Format: "webp", Quality: 80})
+	assert.Nil(t, err)
+	assert.Equal(t, "webp", ext)
+	assert.Equal(t, []byte("RIFF"), body[:4])
+	decoded, err := webp.Decode(bytes.NewReader(body))
+	assert.Nil(t, err)
+	src, _ := png.Decode(bytes.NewReader(origin))
+	assert.Equal(t, src.Bounds(), decoded.Bounds())
+	r0, g0, b0, _ := src.At(3, 5).RGBA()
+	r1, g1, b1, _ := decoded.At(3, 5).RGBA()
+	assert.Equal(t, []uint32{r0, g0, b0}, []uint32{r1, g1, b1})
+}
+
+func TestThumbnail(t *testing.T) {
+	origin := testPng(t)
+	body, ext, err := Thumbnail(origin, 8, &ImageOutputOption{Format: "png"})
+	assert.Nil(t, err)
+	assert.Equal(t, "png", ext)
+	img, err := png.Decode(bytes.NewReader(body))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, img.Bounds().Dx())
+	assert.Equal(t, 8, img.Bounds().Dy())
+
+	// small image not scale up
+	body, _, err = Thumbnail(origin, 256, &ImageOutputOption{Format: "png"})
+	assert.Nil(t, err)
+	img, err = png.Decode(bytes.NewReader(body))
+	assert.Nil(t, err)
+	assert.Equal(t, 16, img.Bounds().Dx())
+}
+
+func TestInfotext(t *testing.T) {
+	infotext := "a cat, <lora:cute:0.8>\nNegative prompt: ugly\nSteps: 20, Sampler: Euler a, CFG scale: 7, " +
+		"Seed: 123, Size: 16x16, Model hash: abcdef1234, Model: \"sd, v1.5\""
+	origin := insertTextChunk(testPng(t), "parameters", "old infotext")
+
+	// png
+	body, err := EmbedInfotext(origin, infotext)
+	assert.Nil(t, err)
+	_, err = png.Decode(bytes.NewReader(body))
+	assert.Nil(t, err)
+	text, err := ReadInfotext(body)
+	assert.Nil(t, err)
+	assert.Equal(t, infotext, text)
+	assert.False(t, bytes.Contains(body, []byte("old infotext")))
+
+	// jpeg
+	jpegBody, _, err := ConvertImage(origin, &ImageOutputOption{Format: "jpeg"})
+	assert.Nil(t, err)
+	body, err = EmbedInfotext(jpegBody, infotext+" 中文")
+	assert.Nil(t, err)
+	_, _, err = image.Decode(bytes.NewReader(body))
+	assert.Nil(t, err)
+	text, err = ReadInfotext(body)
+	assert.Nil(t, err)
+	assert.Equal(t, infotext+" 中文", text)
+
+	prompt, negative, params := ParseInfotext(infotext)
+	assert.Equal(t, "a cat, <lora:cute:0.8>", prompt)
+	assert.Equal(t, "ugly", negative)
+	assert.Equal(t, "20", params["Steps"])
+	assert.Equal(t, "Euler a", params["Sampler"])
+	assert.Equal(t, "123", params["Seed"])
+	assert.Equal(t, "sd, v1.5", params["Model"])
+}
+
+// testWebp lossless webp header only, 16x16
+func testWebp() []byte {
+	vp8l := []byte{0x2f, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(vp8l[1:], 15|15<<14)
+	body := append([]byte("WEBP"), webpChunk("VP8L", vp8l)...)
+	out := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestInfotextWebp(t *testing.T) {
+	body, err := EmbedInfotext(testWebp(), "a cat")
+	assert.Nil(t, err)
+	text, err := ReadInfotext(body)
+	assert.Nil(t, err)
+	assert.Equal(t, "a cat", text)
+	// VP8X kept and exif replaced
+	body, err = EmbedInfotext(body, "a dog")
+	assert.Nil(t, err)
+	text, err = ReadInfotext(body)
+	assert.Nil(t, err)
+	assert.Equal(t, "a dog", text)
+}
+
+func TestInfotextMalformed(t *testing.T) {
+	cases := [][]byte{
+		// zero length jpeg segment
+		{0xff, 0xd8, 0xff, 0xe1, 0x00, 0x00, 0x00, 0x00},
+		{0xff, 0xd8, 0xff, 0xe1, 0x00, 0x01, 0x00, 0x00},
+		// jpeg segment longer than data
+		{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff, 'E', 'x'},
+		// short VP8X chunk
+		append([]byte("RIFF\x10\x00\x00\x00WEBPVP8X\x02\x00\x00\x00"), 0, 0),
+		// webp chunk size out of range
+		[]byte("RIFF\x10\x00\x00\x00WEBPEXIF\xff\xff\xff\xff"),
+		// png chunk length out of range
+		append(append([]byte{}, pngSignature...), 0xff, 0xff, 0xff, 0xff, 'I', 'H', 'D', 'R'),
+	}
+	for i, data := range cases {
+		_, err := ReadInfotext(data)
+		assert.NotNil(t, err, i)
+		_, err = EmbedInfotext(data, "a cat")
+		assert.NotNil(t, err, i)
+	}
+}
+
+// FuzzInfotext read and embed never panic, seeds are truncated valid images
+func FuzzInfotext(f *testing.F) {
+	origin := insertTextChunk(testPngData(), "parameters", "a cat")
+	jpegBody, _, _ := ConvertImage(origin, &ImageOutputOption{Format: "jpeg"})
+	jpegBody, _ = EmbedInfotext(jpegBody, "a cat")
+	webpBody, _ := EmbedInfotext(testWebp(), "a cat")
+	for _, data := range [][]byte{origin, jpegBody, webpBody} {
+		for n := 0; n <= len(data) && n < 512; n++ {
+			f.Add(data[:n])
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadInfotext(data)
+		EmbedInfotext(data, "a cat")
+	})
+}
+
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(64 + (x*y)%128), G: uint8(64 + x%128), B: uint8(64 + y%128), A: 255})
+		}
+	}
+	return img
+}
+
+func TestInvisibleWatermark(t *testing.T) {
+	payload := []byte("user|task123456")
+	marked, err := EmbedInvisibleWatermark(testImage(256, 256), payload, 0)
+	assert.Nil(t, err)
+	ret, err := ExtractInvisibleWatermark(marked)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, ret)
+
+	// survive jpeg compression
+	body, _, err := encodeImage(marked, FormatJpeg, 90)
+	assert.Nil(t, err)
+	decoded, _, err := image.Decode(bytes.NewReader(body))
+	assert.Nil(t, err)
+	ret, err = ExtractInvisibleWatermark(decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, ret)
+
+	_, err = ExtractInvisibleWatermark(testImage(256, 256))
+	assert.NotNil(t, err)
+}
+
+func TestVisibleWatermark(t *testing.T) {
+	origin := testImage(256, 128)
+	marked := DrawVisibleWatermark(origin, &VisibleWatermark{Text: "AI generated", Opacity: 0.8})
+	assert.Equal(t, origin.Bounds(), marked.Bounds())
+	assert.NotEqual(t, origin.Pix, marked.Pix)
+	// top left not changed with default bottom-right position
+	assert.Equal(t, origin.At(0, 0), marked.At(0, 0))
+
+	marked = DrawVisibleWatermark(origin, &VisibleWatermark{Image: testImage(32, 16),
+		Position: PositionTopLeft, Opacity: 0.5, Scale: 0.25})
+	assert.NotEqual(t, origin.At(10, 10), marked.At(10, 10))
+}
+
+func TestContactSheet(t *testing.T) {
+	items := make([]*ContactSheetItem, 0)
+	for i := 0; i < 3; i++ {
+		items = append(items, &ContactSheetItem{Image: testImage(64, 32),
+			Captions: []string{"seed: 123", "a very long prompt that should be truncated to fit the cell width"}})
+	}
+	sheet := ContactSheet(items)
+	// 2 columns, 2 rows
+	assert.Equal(t, 2*(64+contactSheetPadding)+contactSheetPadding, sheet.Bounds().Dx())
+	assert.True(t, sheet.Bounds().Dy() > 2*32)
+	assert.Nil(t, ContactSheet(nil))
+	assert.Equal(t, "abc", truncateText(basicfont.Face7x13, "abc", 100))
+	assert.Equal(t, "a...", truncateText(basicfont.Face7x13, "abcdefg", 28))
+}
@@ -0,0 +1,489 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/image/webp"
+	"hash/crc32"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// InfotextKey png text chunk keyword used by sd webui
+const InfotextKey = "parameters"
+
+const (
+	exifIFDPointerTag = 0x8769
+	userCommentTag    = 0x9286
+)
+
+var (
+	exifHeader     = []byte("Exif\x00\x00")
+	unicodePrefix  = []byte("UNICODE\x00")
+	asciiPrefix    = []byte("ASCII\x00\x00\x00")
+	infotextRegexp = regexp.MustCompile(`\s*([\w ][\w \-/]+):\s*("(?:\\.|[^\\"])+"|[^,]*)(?:,|$)`)
+)
+
+// EmbedInfotext write sd infotext to image metadata, png: tEXt chunk, jpeg/webp: exif UserComment
+func EmbedInfotext(data []byte, infotext string) ([]byte, error) {
+	if infotext == "" {
+		return data, nil
+	}
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return embedPngText(data, InfotextKey, infotext)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return embedJpegExif(data, buildUserCommentExif(infotext))
+	case len(data) > 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return embedWebpExif(data, buildUserCommentExif(infotext))
+	}
+	return nil, errors.New("image format not support embed infotext")
+}
+
+// ReadInfotext read sd infotext from png text chunk or jpeg/webp exif UserComment
+func ReadInfotext(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return readPngText(data, InfotextKey)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return readJpegInfotext(data)
+	case len(data) > 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return readWebpInfotext(data)
+	}
+	return "", errors.New("image format not support")
+}
+
+// ParseInfotext parse sd infotext to prompt, negative prompt and params like Steps/Sampler/Seed
+func ParseInfotext(infotext string) (string, string, map[string]string) {
+	params := make(map[string]string)
+	lines := strings.Split(strings.TrimSpace(infotext), "\n")
+	// last line is params if match more than 3 key: val
+	if len(lines) > 0 {
+		last := lines[len(lines)-1]
+		matches := infotextRegexp.FindAllStringSubmatch(last, -1)
+		if len(matches) >= 3 {
+			for _, match := range matches {
+				val := strings.TrimSpace(match[2])
+				if len(val) >= 2 && strings.HasPrefix(val, "\"") && strings.HasSuffix(val, "\"") {
+					val = strings.ReplaceAll(val[1:len(val)-1], "\\\"", "\"")
+				}
+				params[strings.TrimSpace(match[1])] = val
+			}
+			lines = lines[:len(lines)-1]
+		}
+	}
+	var prompt, negative []string
+	doneWithPrompt := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Negative prompt:") {
+			doneWithPrompt = true
+			line = strings.TrimSpace(strings.TrimPrefix(line, "Negative prompt:"))
+		}
+		if doneWithPrompt {
+			negative = append(negative, line)
+		} else {
+			prompt = append(prompt, line)
+		}
+	}
+	return strings.Join(prompt, "\n"), strings.Join(negative, "\n"), params
+}
+
+func pngChunk(chunkType string, body []byte) []byte {
+	chunk := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(chunk[:4], uint32(len(body)))
+	copy(chunk[4:8], chunkType)
+	chunk = append(chunk, body...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+// walkPngChunks call fn with chunk type, chunk data and whole chunk bytes
+func walkPngChunks(data []byte, fn func(chunkType string, body, chunk []byte)) error {
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return errors.New("png chunk out of range")
+		}
+		fn(chunkType, data[pos+8:pos+8+length], data[pos:end])
+		pos = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return nil
+}
+
+// embedPngText insert tEXt chunk after IHDR, remove text chunks with same keyword
+// non latin1 text write to iTXt chunk
+func embedPngText(data []byte, keyword, text string) ([]byte, error) {
+	var chunk []byte
+	if isLatin1(text) {
+		chunk = pngChunk("tEXt", append([]byte(keyword+"\x00"), latin1(text)...))
+	} else {
+		// keyword, compression flag, compression method, language tag, translated keyword
+		chunk = pngChunk("iTXt", append([]byte(keyword+"\x00\x00\x00\x00\x00"), []byte(text)...))
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+len(chunk)))
+	out.Write(pngSignature)
+	err := walkPngChunks(data, func(chunkType string, body, whole []byte) {
+		if (chunkType == "tEXt" || chunkType == "iTXt" || chunkType == "zTXt") &&
+			bytes.HasPrefix(body, []byte(keyword+"\x00")) {
+			return
+		}
+		out.Write(whole)
+		if chunkType == "IHDR" {
+			out.Write(chunk)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func readPngText(data []byte, keyword string) (string, error) {
+	text := ""
+	found := false
+	err := walkPngChunks(data, func(chunkType string, body, whole []byte) {
+		if found || !bytes.HasPrefix(body, []byte(keyword+"\x00")) {
+			return
+		}
+		val := body[len(keyword)+1:]
+		switch chunkType {
+		case "tEXt":
+			text, found = fromLatin1(val), true
+		case "zTXt":
+			// compression method + zlib data
+			if len(val) > 1 {
+				if decoded, err := zlibDecode(val[1:]); err == nil {
+					text, found = fromLatin1(decoded), true
+				}
+			}
+		case "iTXt":
+			// compression flag, compression method, language tag\0, translated keyword\0, text
+			if len(val) < 2 {
+				return
+			}
+			compressed := val[0] == 1
+			parts := bytes.SplitN(val[2:], []byte{0}, 3)
+			if len(parts) != 3 {
+				return
+			}
+			body := parts[2]
+			if compressed {
+				decoded, err := zlibDecode(body)
+				if err != nil {
+					return
+				}
+				body = decoded
+			}
+			text, found = string(body), true
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", errors.New("infotext not found")
+	}
+	return text, nil
+}
+
+func zlibDecode(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func isLatin1(s string) bool {
+	for _, r := range s {
+		if r > 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func latin1(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		out = append(out, byte(r))
+	}
+	return out
+}
+
+func fromLatin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// buildUserCommentExif exif(big endian tiff) with only ExifIFD UserComment, same as sd webui jpeg/webp
+func buildUserCommentExif(text string) []byte {
+	// UserComment: UNICODE prefix + utf-16 big endian
+	comment := append([]byte{}, unicodePrefix...)
+	for _, u := range utf16.Encode([]rune(text)) {
+		comment = append(comment, byte(u>>8), byte(u))
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("MM")
+	binary.Write(buf, binary.BigEndian, uint16(42))
+	// IFD0 offset
+	binary.Write(buf, binary.BigEndian, uint32(8))
+	// IFD0: 1 entry, ExifIFD pointer
+	exifIFDOffset := uint32(8 + 2 + 12 + 4)
+	binary.Write(buf, binary.BigEndian, uint16(1))
+	binary.Write(buf, binary.BigEndian, uint16(exifIFDPointerTag))
+	binary.Write(buf, binary.BigEndian, uint16(4)) // LONG
+	binary.Write(buf, binary.BigEndian, uint32(1))
+	binary.Write(buf, binary.BigEndian, exifIFDOffset)
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	// ExifIFD: 1 entry, UserComment
+	commentOffset := exifIFDOffset + 2 + 12 + 4
+	binary.Write(buf, binary.BigEndian, uint16(1))
+	binary.Write(buf, binary.BigEndian, uint16(userCommentTag))
+	binary.Write(buf, binary.BigEndian, uint16(7)) // UNDEFINED
+	binary.Write(buf, binary.BigEndian, uint32(len(comment)))
+	binary.Write(buf, binary.BigEndian, commentOffset)
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	buf.Write(comment)
+	return buf.Bytes()
+}
+
+// readUserComment read ExifIFD UserComment from tiff data
+func readUserComment(tiff []byte) (string, error) {
+	if len(tiff) < 8 {
+		return "", errors.New("exif too short")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "MM":
+		order = binary.BigEndian
+	case "II":
+		order = binary.LittleEndian
+	default:
+		return "", errors.New("exif byte order invalid")
+	}
+	findTag := func(ifdOffset uint32, tag uint16) (uint32, uint32, bool) {
+		if int(ifdOffset)+2 > len(tiff) {
+			return 0, 0, false
+		}
+		count := int(order.Uint16(tiff[ifdOffset:]))
+		for i := 0; i < count; i++ {
+			entry := int(ifdOffset) + 2 + i*12
+			if entry+12 > len(tiff) {
+				return 0, 0, false
+			}
+			if order.Uint16(tiff[entry:]) == tag {
+				return order.Uint32(tiff[entry+4:]), order.Uint32(tiff[entry+8:]), true
+			}
+		}
+		return 0, 0, false
+	}
+	_, exifIFD, ok := findTag(order.Uint32(tiff[4:]), exifIFDPointerTag)
+	if !ok {
+		return "", errors.New("infotext not found")
+	}
+	count, offset, ok := findTag(exifIFD, userCommentTag)
+	if !ok || int(offset)+int(count) > len(tiff) || count < 8 {
+		return "", errors.New("infotext not found")
+	}
+	comment := tiff[offset : offset+count]
+	body := comment[8:]
+	switch {
+	case bytes.HasPrefix(comment, unicodePrefix):
+		units := make([]uint16, 0, len(body)/2)
+		for i := 0; i+1 < len(body); i += 2 {
+			units = append(units, binary.BigEndian.Uint16(body[i:]))
+		}
+		return string(utf16.Decode(units)), nil
+	case bytes.HasPrefix(comment, asciiPrefix):
+		return string(body), nil
+	}
+	return string(bytes.TrimRight(body, "\x00")), nil
+}
+
+// embedJpegExif insert exif APP1 segment after SOI, remove origin exif
+func embedJpegExif(data []byte, tiff []byte) ([]byte, error) {
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+	if len(payload)+2 > 0xffff {
+		return nil, errors.New("exif too large")
+	}
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+len(segment)))
+	out.Write(data[:2])
+	out.Write(segment)
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		marker := data[pos+1]
+		// SOS: image data start
+		if marker == 0xda {
+			break
+		}
+		// length include itself
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("jpeg segment out of range")
+		}
+		if !(marker == 0xe1 && bytes.HasPrefix(data[pos+4:end], exifHeader)) {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+func readJpegInfotext(data []byte) (string, error) {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		marker := data[pos+1]
+		if marker == 0xda {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return "", errors.New("jpeg segment out of range")
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(segment, exifHeader) {
+			return readUserComment(segment[len(exifHeader):])
+		}
+		// COM segment
+		if marker == 0xfe {
+			return string(segment), nil
+		}
+		pos = end
+	}
+	return "", errors.New("infotext not found")
+}
+
+// webpChunks split webp riff to chunks
+func webpChunks(data []byte) ([][]byte, error) {
+	chunks := make([][]byte, 0)
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int64(binary.LittleEndian.Uint32(data[pos+4:]))
+		if int64(pos)+8+size > int64(len(data)) {
+			return nil, errors.New("webp chunk out of range")
+		}
+		// last pad byte may be omitted
+		end := pos + 8 + int(size+size%2)
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, data[pos:end])
+		pos = end
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("webp has no chunk")
+	}
+	return chunks, nil
+}
+
+func webpChunk(chunkType string, body []byte) []byte {
+	chunk := make([]byte, 8, 8+len(body)+1)
+	copy(chunk[:4], chunkType)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// embedWebpExif convert to extended format(VP8X) and add EXIF chunk
+func embedWebpExif(data []byte, tiff []byte) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var vp8x []byte
+	others := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		switch string(chunk[:4]) {
+		case "VP8X":
+			if len(chunk) < 18 {
+				return nil, errors.New("webp VP8X chunk too short")
+			}
+			vp8x = append([]byte{}, chunk[8:18]...)
+		case "EXIF":
+			// replace origin exif
+		default:
+			others = append(others, chunk)
+		}
+	}
+	if vp8x == nil {
+		cfg, err := webp.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("decode webp err=%s", err.Error())
+		}
+		vp8x = make([]byte, 10)
+		w, h := cfg.Width-1, cfg.Height-1
+		vp8x[4], vp8x[5], vp8x[6] = byte(w), byte(w>>8), byte(w>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(h), byte(h>>8), byte(h>>16)
+		for _, chunk := range others {
+			// VP8L alpha in bitstream
+			if string(chunk[:4]) == "VP8L" && len(chunk) > 12 && chunk[12]&0x10 != 0 {
+				vp8x[0] |= 0x10
+			}
+			if string(chunk[:4]) == "ALPH" {
+				vp8x[0] |= 0x10
+			}
+		}
+	}
+	// exif flag
+	vp8x[0] |= 0x08
+	body := new(bytes.Buffer)
+	body.WriteString("WEBP")
+	body.Write(webpChunk("VP8X", vp8x))
+	for _, chunk := range others {
+		body.Write(chunk)
+	}
+	body.Write(webpChunk("EXIF", tiff))
+	out := new(bytes.Buffer)
+	out.WriteString("RIFF")
+	binary.Write(out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
+
+func readWebpInfotext(data []byte) (string, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return "", err
+	}
+	for _, chunk := range chunks {
+		if string(chunk[:4]) == "EXIF" {
+			size := int(binary.LittleEndian.Uint32(chunk[4:]))
+			if 8+size > len(chunk) {
+				return "", errors.New("webp exif out of range")
+			}
+			tiff := chunk[8 : 8+size]
+			// some encoder keep Exif header
+			tiff = bytes.TrimPrefix(tiff, exifHeader)
+			return readUserComment(tiff)
+		}
+	}
+	return "", errors.New("infotext not found")
+}
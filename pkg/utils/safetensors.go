@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// model architecture
+const (
+	ArchSD15 = "SD1.5"
+	ArchSD2  = "SD2"
+	ArchSDXL = "SDXL"
+)
+
+const (
+	// safetensorsMaxHeader header json size limit
+	safetensorsMaxHeader = 100 << 20
+	safetensorsMetadata  = "__metadata__"
+	// metadataMaxValue larger metadata value (eg: ss_tag_frequency) not keep
+	metadataMaxValue = 1024
+)
+
+// SafetensorsHeader tensor names and __metadata__ of safetensors header
+type SafetensorsHeader struct {
+	Metadata map[string]string
+	Tensors  []string
+	// Size header bytes, tensor data start at 8 + Size
+	Size int64
+}
+
+// ReadSafetensorsHeader header: 8 bytes little endian json size + json
+func ReadSafetensorsHeader(r io.Reader) (*SafetensorsHeader, error) {
+	var size uint64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, fmt.Errorf("read safetensors header size err=%s", err.Error())
+	}
+	if size == 0 || size > safetensorsMaxHeader {
+		return nil, fmt.Errorf("safetensors header size %d not valid", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("read safetensors header err=%s", err.Error())
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, errors.New("safetensors header not valid json")
+	}
+	header := &SafetensorsHeader{
+		Metadata: make(map[string]string),
+		Tensors:  make([]string, 0, len(raw)),
+		Size:     int64(size),
+	}
+	for key, val := range raw {
+		if key == safetensorsMetadata {
+			// metadata value must be string
+			if err := json.Unmarshal(val, &header.Metadata); err != nil {
+				return nil, errors.New("safetensors __metadata__ not valid")
+			}
+			continue
+		}
+		header.Tensors = append(header.Tensors, key)
+	}
+	sort.Strings(header.Tensors)
+	return header, nil
+}
+
+// Architecture from modelspec/kohya metadata first, otherwise guess by tensor names, "" unknown
+func (h *SafetensorsHeader) Architecture() string {
+	if arch := h.Metadata["modelspec.architecture"]; arch != "" {
+		switch {
+		case strings.HasPrefix(arch, "stable-diffusion-xl"):
+			return ArchSDXL
+		case strings.HasPrefix(arch, "stable-diffusion-v2"):
+			return ArchSD2
+		case strings.HasPrefix(arch, "stable-diffusion-v1"):
+			return ArchSD15
+		}
+	}
+	if version := strings.ToLower(h.Metadata["ss_base_model_version"]); version != "" {
+		switch {
+		case strings.Contains(version, "sdxl"):
+			return ArchSDXL
+		case strings.Contains(version, "v2"):
+			return ArchSD2
+		case strings.Contains(version, "v1"):
+			return ArchSD15
+		}
+	}
+	if strings.EqualFold(h.Metadata["ss_v2"], "true") {
+		return ArchSD2
+	}
+	for _, name := range h.Tensors {
+		switch {
+		// sdxl second text encoder
+		case strings.HasPrefix(name, "conditioner.embedders.1."), strings.HasPrefix(name, "lora_te2_"):
+			return ArchSDXL
+		// sd2 open clip text encoder
+		case strings.HasPrefix(name, "cond_stage_model.model."):
+			return ArchSD2
+		}
+	}
+	for _, name := range h.Tensors {
+		if strings.HasPrefix(name, "cond_stage_model.transformer.") || strings.HasPrefix(name, "lora_te_") ||
+			strings.HasPrefix(name, "lora_unet_down_blocks_") {
+			return ArchSD15
+		}
+	}
+	return ""
+}
+
+// TriggerWords modelspec trigger phrase, otherwise top n tags of kohya ss_tag_frequency
+func (h *SafetensorsHeader) TriggerWords(n int) []string {
+	if phrase := h.Metadata["modelspec.trigger_phrase"]; phrase != "" {
+		words := make([]string, 0)
+		for _, word := range strings.Split(phrase, ",") {
+			if word = strings.TrimSpace(word); word != "" {
+				words = append(words, word)
+			}
+		}
+		return words
+	}
+	// {dataset: {tag: count}}
+	var frequency map[string]map[string]int
+	if err := json.Unmarshal([]byte(h.Metadata["ss_tag_frequency"]), &frequency); err != nil {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, tags := range frequency {
+		for tag, count := range tags {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				counts[tag] += count
+			}
+		}
+	}
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if counts[tags[i]] != counts[tags[j]] {
+			return counts[tags[i]] > counts[tags[j]]
+		}
+		return tags[i] < tags[j]
+	})
+	if len(tags) > n {
+		tags = tags[:n]
+	}
+	return tags
+}
+
+// TrainingMetadata metadata without large value
+func (h *SafetensorsHeader) TrainingMetadata() map[string]string {
+	ret := make(map[string]string)
+	for key, val := range h.Metadata {
+		if len(val) <= metadataMaxValue {
+			ret[key] = val
+		}
+	}
+	return ret
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func testSafetensors(header map[string]interface{}) []byte {
+	body, _ := json.Marshal(header)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint64(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func TestReadSafetensorsHeader(t *testing.T) {
+	tensor := map[string]interface{}{"dtype": "F16", "shape": []int{1}, "data_offsets": []int{0, 2}}
+	// kohya lora, architecture from metadata, trigger words from tag frequency
+	header, err := ReadSafetensorsHeader(bytes.NewReader(testSafetensors(map[string]interface{}{
+		"__metadata__": map[string]string{
+			"ss_base_model_version": "sdxl_base_v1-0",
+			"ss_tag_frequency":      `{"10_cat": {"cat": 10, " solo": 5, "blue eyes": 5}, "5_dog": {"dog": 3}}`,
+			"ss_network_dim":        "32",
+		},
+		"lora_unet_down_blocks_0.alpha": tensor,
+	})))
+	assert.Nil(t, err)
+	assert.Equal(t, ArchSDXL, header.Architecture())
+	assert.Equal(t, []string{"cat", "blue eyes", "solo"}, header.TriggerWords(3))
+	assert.Equal(t, "32", header.TrainingMetadata()["ss_network_dim"])
+
+	// checkpoint without metadata, guess by tensor names
+	header, err = ReadSafetensorsHeader(bytes.NewReader(testSafetensors(map[string]interface{}{
+		"cond_stage_model.model.ln_final.weight": tensor,
+	})))
+	assert.Nil(t, err)
+	assert.Equal(t, ArchSD2, header.Architecture())
+	assert.Nil(t, header.TriggerWords(10))
+
+	// modelspec, large value omitted
+	header, err = ReadSafetensorsHeader(bytes.NewReader(testSafetensors(map[string]interface{}{
+		"__metadata__": map[string]string{
+			"modelspec.architecture":   "stable-diffusion-v1/lora",
+			"modelspec.trigger_phrase": "pixel art, 8bit",
+			"large":                    strings.Repeat("a", 2048),
+		},
+	})))
+	assert.Nil(t, err)
+	assert.Equal(t, ArchSD15, header.Architecture())
+	assert.Equal(t, []string{"pixel art", "8bit"}, header.TriggerWords(10))
+	_, ok := header.TrainingMetadata()["large"]
+	assert.False(t, ok)
+
+	// not safetensors
+	_, err = ReadSafetensorsHeader(strings.NewReader("not a safetensors file"))
+	assert.NotNil(t, err)
+}
@@ -62,6 +62,10 @@ func Int32(v int32) *int32 {
 	return &v
 }
 
+func Int64(v int64) *int64 {
+	return &v
+}
+
 func Float32(v float32) *float32 {
 	return &v
 }
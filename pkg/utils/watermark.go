@@ -0,0 +1,305 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"math"
+)
+
+// watermark position
+const (
+	PositionTopLeft     = "top-left"
+	PositionTopRight    = "top-right"
+	PositionBottomLeft  = "bottom-left"
+	PositionBottomRight = "bottom-right"
+	PositionCenter      = "center"
+)
+
+const (
+	blockSize = 8
+	// invisible watermark frame: magic(1) + len(1) + payload + crc(2), fixed 64 bytes
+	watermarkMagic      = 0xa5
+	watermarkFrameBytes = 64
+	// MaxWatermarkPayload max invisible watermark payload bytes
+	MaxWatermarkPayload = watermarkFrameBytes - 4
+)
+
+// mid frequency coefficients pair, bit decide by order
+var (
+	coefA = [2]int{4, 3}
+	coefB = [2]int{3, 4}
+)
+
+var dctTable = func() [blockSize][blockSize]float64 {
+	var table [blockSize][blockSize]float64
+	for u := 0; u < blockSize; u++ {
+		c := math.Sqrt(2.0 / blockSize)
+		if u == 0 {
+			c = math.Sqrt(1.0 / blockSize)
+		}
+		for x := 0; x < blockSize; x++ {
+			table[u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*blockSize))
+		}
+	}
+	return table
+}()
+
+// VisibleWatermark text or image overlay
+type VisibleWatermark struct {
+	Text     string
+	Image    image.Image
+	Position string
+	// Opacity 0-1
+	Opacity float64
+	// Scale watermark width / image width, image watermark only
+	Scale float64
+}
+
+// DrawVisibleWatermark overlay text/image watermark to img
+func DrawVisibleWatermark(img image.Image, wm *VisibleWatermark) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	opacity := wm.Opacity
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+	minSide := bounds.Dx()
+	if bounds.Dy() < minSide {
+		minSide = bounds.Dy()
+	}
+	margin := minSide / 50
+	var mark image.Image
+	if wm.Image != nil {
+		scale := wm.Scale
+		if scale <= 0 || scale > 1 {
+			scale = 0.2
+		}
+		mb := wm.Image.Bounds()
+		width := int(float64(bounds.Dx()) * scale)
+		mark = scaleTo(wm.Image, width, mb.Dy()*width/mb.Dx())
+	} else if wm.Text != "" {
+		mark = renderText(wm.Text, minSide/25)
+	} else {
+		return dst
+	}
+	mb := mark.Bounds()
+	var x, y int
+	switch wm.Position {
+	case PositionTopLeft:
+		x, y = margin, margin
+	case PositionTopRight:
+		x, y = bounds.Dx()-mb.Dx()-margin, margin
+	case PositionBottomLeft:
+		x, y = margin, bounds.Dy()-mb.Dy()-margin
+	case PositionCenter:
+		x, y = (bounds.Dx()-mb.Dx())/2, (bounds.Dy()-mb.Dy())/2
+	default:
+		x, y = bounds.Dx()-mb.Dx()-margin, bounds.Dy()-mb.Dy()-margin
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(opacity * 255)})
+	draw.DrawMask(dst, image.Rect(x, y, x+mb.Dx(), y+mb.Dy()), mark, mb.Min, mask, image.Point{}, draw.Over)
+	return dst
+}
+
+func scaleTo(img image.Image, width, height int) image.Image {
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// renderText white text with dark shadow, scale to text height
+func renderText(text string, height int) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil() + 1
+	src := image.NewRGBA(image.Rect(0, 0, width, face.Height+1))
+	drawer := &font.Drawer{
+		Dst:  src,
+		Src:  image.NewUniform(color.RGBA{A: 160}),
+		Face: face,
+		Dot:  fixed.P(1, face.Ascent+1),
+	}
+	drawer.DrawString(text)
+	drawer.Src = image.White
+	drawer.Dot = fixed.P(0, face.Ascent)
+	drawer.DrawString(text)
+	if height <= face.Height {
+		return src
+	}
+	return scaleTo(src, width*height/face.Height, height)
+}
+
+// EmbedInvisibleWatermark embed payload to luminance 8x8 DCT mid frequency coefficients,
+// frame repeat in all blocks for decode voting
+func EmbedInvisibleWatermark(img image.Image, payload []byte, strength float64) (*image.RGBA, error) {
+	if len(payload) > MaxWatermarkPayload {
+		return nil, errors.New("watermark payload too large")
+	}
+	bounds := img.Bounds()
+	blocksX, blocksY := bounds.Dx()/blockSize, bounds.Dy()/blockSize
+	bits := frameBits(payload)
+	if blocksX*blocksY < len(bits) {
+		return nil, errors.New("image too small for invisible watermark")
+	}
+	if strength <= 0 {
+		strength = 16
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	var block, coef, delta [blockSize][blockSize]float64
+	for by := 0; by < blocksY; by++ {
+		for bx := 0; bx < blocksX; bx++ {
+			bit := bits[(by*blocksX+bx)%len(bits)]
+			readLuma(dst, bx, by, &block)
+			dct(&block, &coef)
+			a, b := coef[coefA[0]][coefA[1]], coef[coefB[0]][coefB[1]]
+			mid := (a + b) / 2
+			newA, newB := a, b
+			if bit == 1 && a-b < strength {
+				newA, newB = mid+strength/2, mid-strength/2
+			} else if bit == 0 && b-a < strength {
+				newA, newB = mid-strength/2, mid+strength/2
+			}
+			if newA == a && newB == b {
+				continue
+			}
+			delta = [blockSize][blockSize]float64{}
+			delta[coefA[0]][coefA[1]] = newA - a
+			delta[coefB[0]][coefB[1]] = newB - b
+			idct(&delta, &block)
+			addLuma(dst, bx, by, &block)
+		}
+	}
+	return dst, nil
+}
+
+// ExtractInvisibleWatermark decode payload from invisible watermark
+func ExtractInvisibleWatermark(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	blocksX, blocksY := bounds.Dx()/blockSize, bounds.Dy()/blockSize
+	frameBitLen := watermarkFrameBytes * 8
+	if blocksX*blocksY < frameBitLen {
+		return nil, errors.New("image too small for invisible watermark")
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	votes := make([]float64, frameBitLen)
+	var block, coef [blockSize][blockSize]float64
+	for by := 0; by < blocksY; by++ {
+		for bx := 0; bx < blocksX; bx++ {
+			readLuma(rgba, bx, by, &block)
+			dct(&block, &coef)
+			diff := coef[coefA[0]][coefA[1]] - coef[coefB[0]][coefB[1]]
+			// vote by sign, limit single block weight
+			votes[(by*blocksX+bx)%frameBitLen] += math.Max(-1, math.Min(1, diff))
+		}
+	}
+	frame := make([]byte, watermarkFrameBytes)
+	for i, vote := range votes {
+		if vote > 0 {
+			frame[i/8] |= 1 << (7 - uint(i%8))
+		}
+	}
+	if frame[0] != watermarkMagic {
+		return nil, errors.New("watermark not found")
+	}
+	length := int(frame[1])
+	if length > MaxWatermarkPayload {
+		return nil, errors.New("watermark not found")
+	}
+	payload := frame[2 : 2+length]
+	if binary.BigEndian.Uint16(frame[2+length:]) != uint16(crc32.ChecksumIEEE(payload)) {
+		return nil, errors.New("watermark checksum mismatch")
+	}
+	return payload, nil
+}
+
+func frameBits(payload []byte) []byte {
+	frame := make([]byte, watermarkFrameBytes)
+	frame[0] = watermarkMagic
+	frame[1] = byte(len(payload))
+	copy(frame[2:], payload)
+	binary.BigEndian.PutUint16(frame[2+len(payload):], uint16(crc32.ChecksumIEEE(payload)))
+	bits := make([]byte, 0, len(frame)*8)
+	for _, b := range frame {
+		for i := 7; i >= 0; i-- {
+			bits = append(bits, (b>>uint(i))&1)
+		}
+	}
+	return bits
+}
+
+func readLuma(img *image.RGBA, bx, by int, block *[blockSize][blockSize]float64) {
+	for y := 0; y < blockSize; y++ {
+		for x := 0; x < blockSize; x++ {
+			i := img.PixOffset(bx*blockSize+x, by*blockSize+y)
+			r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+			block[y][x] = 0.299*r + 0.587*g + 0.114*b
+		}
+	}
+}
+
+func addLuma(img *image.RGBA, bx, by int, delta *[blockSize][blockSize]float64) {
+	for y := 0; y < blockSize; y++ {
+		for x := 0; x < blockSize; x++ {
+			i := img.PixOffset(bx*blockSize+x, by*blockSize+y)
+			for c := 0; c < 3; c++ {
+				img.Pix[i+c] = clampUint8(float64(img.Pix[i+c]) + delta[y][x])
+			}
+		}
+	}
+}
+
+func clampUint8(v float64) uint8 {
+	v = math.Round(v)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// dct 2D DCT-II, out[v][u]
+func dct(in, out *[blockSize][blockSize]float64) {
+	for v := 0; v < blockSize; v++ {
+		for u := 0; u < blockSize; u++ {
+			sum := 0.0
+			for y := 0; y < blockSize; y++ {
+				for x := 0; x < blockSize; x++ {
+					sum += in[y][x] * dctTable[u][x] * dctTable[v][y]
+				}
+			}
+			out[v][u] = sum
+		}
+	}
+}
+
+// idct 2D inverse DCT, in[v][u]
+func idct(in, out *[blockSize][blockSize]float64) {
+	for y := 0; y < blockSize; y++ {
+		for x := 0; x < blockSize; x++ {
+			sum := 0.0
+			for v := 0; v < blockSize; v++ {
+				for u := 0; u < blockSize; u++ {
+					sum += in[v][u] * dctTable[u][x] * dctTable[v][y]
+				}
+			}
+			out[y][x] = sum
+		}
+	}
+}